@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/trondhindenes/code-index-mcp/handlers"
+)
+
+// Container mode defaults: serve MCP over HTTP on all interfaces, with the
+// indexes on a volume mounted at /data
+const (
+	containerListenAddr = ":8080"
+	containerIndexDir   = "/data"
+)
+
+// healthPath is where the HTTP transports serve the health endpoint
+const healthPath = "/healthz"
+
+// prepareContainer applies the defaults of container mode to settings not
+// given in the environment, and works around a read-only root filesystem by
+// keeping temporary files on the index volume
+func prepareContainer() {
+	setDefaultEnv("CODE_INDEX_TRANSPORT", "http")
+	setDefaultEnv("CODE_INDEX_LISTEN_ADDR", containerListenAddr)
+	setDefaultEnv("CODE_INDEX_DIR", containerIndexDir)
+	// Containers have no battery to wait for
+	setDefaultEnv("CODE_INDEX_DEFER_ON_BATTERY", "false")
+
+	indexDir := os.Getenv("CODE_INDEX_DIR")
+	if err := os.MkdirAll(indexDir, 0755); err != nil || !handlers.WritableDir(indexDir) {
+		// A read-only volume of prebuilt indexes can still be searched
+		fmt.Fprintf(os.Stderr, "Warning: index directory %s is not writable; existing indexes can be searched, but not built or changed\n", indexDir)
+		setDefaultEnv("CODE_INDEX_AUDIT_LOG", "off")
+		return
+	}
+
+	// Decrypted shards, builds and tree-sitter runs use temporary files
+	if !handlers.WritableDir(os.TempDir()) {
+		tmpDir := filepath.Join(indexDir, "tmp")
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s is not writable and %s cannot be created: %v\n", os.TempDir(), tmpDir, err)
+			return
+		}
+		os.Setenv("TMPDIR", tmpDir)
+	}
+}
+
+// setDefaultEnv sets an environment variable that is not set
+func setDefaultEnv(key string, value string) {
+	if _, ok := os.LookupEnv(key); !ok {
+		os.Setenv(key, value)
+	}
+}
+
+// healthcheck probes the health endpoint of the server listening on
+// CODE_INDEX_LISTEN_ADDR and returns the exit code for a container health
+// check, so images need no curl or wget
+func healthcheck() int {
+	host, port, err := net.SplitHostPort(listenAddr())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid listen address: %v\n", err)
+		return 1
+	}
+	// A server listening on all interfaces is reached on loopback
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + healthPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Health check failed: %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
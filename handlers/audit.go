@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// AuditEntry records a single tool invocation
+type AuditEntry struct {
+	Time       time.Time      `json:"time"`
+	Tool       string         `json:"tool"`
+	Params     map[string]any `json:"params,omitempty"`
+	Session    string         `json:"session,omitempty"`
+	DurationMs int64          `json:"duration_ms"`
+	Outcome    string         `json:"outcome"` // "ok" or "error"
+	Error      string         `json:"error,omitempty"`
+}
+
+// AuditFilter selects entries returned by AuditLog.Query. Zero values match
+// everything.
+type AuditFilter struct {
+	Tool       string
+	Session    string
+	ErrorsOnly bool
+	Limit      int // Return at most this many of the newest entries
+}
+
+// auditMaxSize is the size at which the audit log is rotated. The previous
+// log is kept as <path>.1, so at most twice this much is stored.
+const auditMaxSize = 10 * 1024 * 1024
+
+// AuditLog is an append-only log of tool invocations stored as JSON lines
+type AuditLog struct {
+	path       string
+	omitParams bool
+	mu         sync.Mutex
+}
+
+// NewAuditLog creates an audit log writing to path
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// SetOmitParams leaves the parameters of tool calls out of new entries.
+// The log is plain text, so this keeps search queries and paths off disk
+// when the index is encrypted at rest.
+func (l *AuditLog) SetOmitParams(omit bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.omitParams = omit
+}
+
+// Path returns the location of the log file
+func (l *AuditLog) Path() string {
+	return l.path
+}
+
+// Record appends an entry to the log, rotating it first when it would grow
+// beyond auditMaxSize
+func (l *AuditLog) Record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.omitParams {
+		entry.Params = nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(line))+1 > auditMaxSize {
+		if err := os.Rename(l.path, l.rotatedPath()); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// rotatedPath returns the location of the previous log after rotation
+func (l *AuditLog) rotatedPath() string {
+	return l.path + ".1"
+}
+
+// Query returns the entries matching filter, oldest first, from the current
+// and the previous log
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []AuditEntry
+	for _, path := range []string{l.rotatedPath(), l.path} {
+		matched, err := queryAuditFile(path, filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, matched...)
+	}
+
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// queryAuditFile returns the entries of one log file matching filter
+func queryAuditFile(path string, filter AuditFilter) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Skip lines damaged by an interrupted write
+			continue
+		}
+		if filter.Tool != "" && entry.Tool != filter.Tool {
+			continue
+		}
+		if filter.Session != "" && entry.Session != filter.Session {
+			continue
+		}
+		if filter.ErrorsOnly && entry.Outcome != "error" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// audited wraps a tool handler so every call is recorded in the audit log
+func (h *Handlers) audited(tool string, handler server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if h.audit == nil {
+			return handler(ctx, request)
+		}
+
+		start := time.Now()
+		result, err := handler(ctx, request)
+
+		entry := AuditEntry{
+			Time:       start.UTC(),
+			Tool:       tool,
+			Params:     request.GetArguments(),
+			Session:    sessionID(ctx),
+			DurationMs: time.Since(start).Milliseconds(),
+			Outcome:    "ok",
+		}
+		switch {
+		case err != nil:
+			entry.Outcome = "error"
+			entry.Error = err.Error()
+		case result != nil && result.IsError:
+			entry.Outcome = "error"
+			entry.Error = resultText(result)
+		}
+
+		// Auditing is best effort; a full disk should not break the tools
+		if auditErr := h.audit.Record(entry); auditErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", auditErr)
+		}
+		return result, err
+	}
+}
+
+// sessionID returns the ID of the MCP session that made the call, or ""
+func sessionID(ctx context.Context) string {
+	if session := server.ClientSessionFromContext(ctx); session != nil {
+		return session.SessionID()
+	}
+	return ""
+}
+
+// resultText returns the first text content of a tool result
+func resultText(result *mcp.CallToolResult) string {
+	for _, content := range result.Content {
+		if text, ok := content.(mcp.TextContent); ok {
+			return text.Text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// backgroundPause tracks a pause of background activity and its optional
+// automatic resume
+type backgroundPause struct {
+	mu     sync.Mutex
+	paused bool
+	until  time.Time
+	timer  *time.Timer
+}
+
+// pauseBackground halts scheduled re-indexing, queued index jobs and
+// telemetry reports. If d is positive, activity resumes automatically
+// after d.
+func (h *Handlers) pauseBackground(d time.Duration) {
+	h.pause.mu.Lock()
+	defer h.pause.mu.Unlock()
+
+	h.pause.paused = true
+
+	for _, scheduler := range h.schedulers() {
+		scheduler.Pause()
+	}
+	if h.telemetry != nil {
+		h.telemetry.SetPaused(true)
+	}
+
+	if h.pause.timer != nil {
+		h.pause.timer.Stop()
+		h.pause.timer = nil
+	}
+	h.pause.until = time.Time{}
+	if d > 0 {
+		h.pause.until = time.Now().Add(d)
+		h.pause.timer = time.AfterFunc(d, h.resumeBackground)
+	}
+}
+
+// resumeBackground restarts activity halted by pauseBackground
+func (h *Handlers) resumeBackground() {
+	h.pause.mu.Lock()
+	h.pause.paused = false
+	if h.pause.timer != nil {
+		h.pause.timer.Stop()
+		h.pause.timer = nil
+	}
+	h.pause.until = time.Time{}
+
+	for _, scheduler := range h.schedulers() {
+		scheduler.Resume()
+	}
+	if h.telemetry != nil {
+		h.telemetry.SetPaused(false)
+	}
+	// Start the jobs held back without h.pause.mu, which startIndexJobs
+	// takes under h.jobs.mu
+	h.pause.mu.Unlock()
+
+	h.jobs.mu.Lock()
+	defer h.jobs.mu.Unlock()
+	h.startIndexJobs()
+}
+
+// backgroundPaused reports whether background activity is paused
+func (h *Handlers) backgroundPaused() bool {
+	h.pause.mu.Lock()
+	defer h.pause.mu.Unlock()
+	return h.pause.paused
+}
+
+// schedulers returns the schedulers of all stores
+func (h *Handlers) schedulers() []*indexer.Scheduler {
+	var schedulers []*indexer.Scheduler
+	if h.scheduler != nil {
+		schedulers = append(schedulers, h.scheduler)
+	}
+	for _, store := range h.stores {
+		if store.scheduler != nil {
+			schedulers = append(schedulers, store.scheduler)
+		}
+	}
+	return schedulers
+}
+
+// backgroundStatus describes the background activity for the pause tools
+func (h *Handlers) backgroundStatus() map[string]any {
+	h.pause.mu.Lock()
+	defer h.pause.mu.Unlock()
+
+	status := map[string]any{}
+	if h.scheduler != nil {
+		status["scheduler"] = h.scheduler.Status()
+	}
+	if len(h.stores) > 0 {
+		stores := map[string]any{}
+		for name, store := range h.stores {
+			if store.scheduler != nil {
+				stores[name] = store.scheduler.Status()
+			}
+		}
+		status["store_schedulers"] = stores
+	}
+	if h.telemetry != nil {
+		h.telemetry.mu.Lock()
+		status["telemetry_paused"] = h.telemetry.paused
+		h.telemetry.mu.Unlock()
+	}
+	if !h.pause.until.IsZero() {
+		status["resumes_at"] = h.pause.until.Format(time.RFC3339)
+	}
+	return status
+}
+
+func (h *Handlers) handlePauseBackground(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	minutes := request.GetFloat("minutes", 0)
+	if minutes < 0 {
+		return mcp.NewToolResultError("minutes must not be negative"), nil
+	}
+
+	h.pauseBackground(time.Duration(minutes * float64(time.Minute)))
+	return h.backgroundResult("Background activity paused")
+}
+
+func (h *Handlers) handleResumeBackground(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	h.resumeBackground()
+	return h.backgroundResult("Background activity resumed")
+}
+
+// backgroundResult formats a message followed by the background status
+func (h *Handlers) backgroundResult(message string) (*mcp.CallToolResult, error) {
+	output, err := json.MarshalIndent(h.backgroundStatus(), "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format status: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("%s\n%s", message, output)), nil
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// toolEffect is what calling a tool does to the indexes, the server or the
+// source files, which its annotations tell clients
+type toolEffect int
+
+const (
+	// readOnlyTool only reads indexes and files
+	readOnlyTool toolEffect = iota
+	// idempotentTool changes state, but calling it again with the same
+	// arguments changes nothing more
+	idempotentTool
+	// additiveTool changes state without removing anything
+	additiveTool
+	// destructiveTool removes indexes or settings, or changes source files
+	destructiveTool
+)
+
+// toolEffects classifies every tool for its annotations
+var toolEffects = map[string]toolEffect{
+	"index_directory":       idempotentTool,
+	"index_directories":     idempotentTool,
+	"ensure_index":          idempotentTool,
+	"index_progress":        readOnlyTool,
+	"index_job_status":      readOnlyTool,
+	"cancel_index_job":      idempotentTool,
+	"search_code":           readOnlyTool,
+	"refine_search":         readOnlyTool,
+	"open_result":           readOnlyTool,
+	"list_indexes":          readOnlyTool,
+	"delete_index":          destructiveTool,
+	"move_index":            idempotentTool,
+	"attach_index_dir":      idempotentTool,
+	"index_info":            readOnlyTool,
+	"warm_index":            idempotentTool,
+	"set_schedule":          idempotentTool,
+	"watch_directory":       idempotentTool,
+	"unwatch_directory":     idempotentTool,
+	"mute_path":             idempotentTool,
+	"set_alias":             idempotentTool,
+	"index_health":          readOnlyTool,
+	"find_target":           readOnlyTool,
+	"who_owns":              readOnlyTool,
+	"usage_stats":           readOnlyTool,
+	"possibly_unreferenced": readOnlyTool,
+	"search_history":        readOnlyTool,
+	"find_endpoint":         readOnlyTool,
+	"find_message":          readOnlyTool,
+	"find_resource":         readOnlyTool,
+	"license_report":        readOnlyTool,
+	"structural_search":     readOnlyTool,
+	"ast_query":             readOnlyTool,
+	"preview_replace":       readOnlyTool,
+	"apply_replace":         destructiveTool,
+	"create_workspace":      idempotentTool,
+	"list_workspaces":       readOnlyTool,
+	"delete_workspace":      destructiveTool,
+	"query_syntax":          readOnlyTool,
+	"run_template":          readOnlyTool,
+	"get_audit_log":         readOnlyTool,
+	"pause_background":      idempotentTool,
+	"resume_background":     idempotentTool,
+	"telemetry_status":      readOnlyTool,
+	"usage_metrics":         readOnlyTool,
+	"selftest":              readOnlyTool,
+	"start_webserver":       additiveTool,
+	"stop_webserver":        idempotentTool,
+	"webserver_status":      readOnlyTool,
+}
+
+// remoteTools reach the remote backends of the config, if there are any
+var remoteTools = []string{"search_code", "refine_search", "run_template"}
+
+// annotate sets the hints clients use to present and gate a tool, such as
+// asking for confirmation before destructive calls
+func (h *Handlers) annotate(tool mcp.Tool) mcp.Tool {
+	effect, ok := toolEffects[tool.Name]
+	if !ok {
+		return tool
+	}
+	tool.Annotations.ReadOnlyHint = mcp.ToBoolPtr(effect == readOnlyTool)
+	tool.Annotations.DestructiveHint = mcp.ToBoolPtr(effect == destructiveTool)
+	tool.Annotations.IdempotentHint = mcp.ToBoolPtr(effect == readOnlyTool || effect == idempotentTool)
+	tool.Annotations.OpenWorldHint = mcp.ToBoolPtr(len(h.remotes) > 0 && slices.Contains(remoteTools, tool.Name))
+	return tool
+}
+
+// toolRequirements are the conditions tools are only listed under, as they
+// can do nothing otherwise. The tools appear once the condition is met, e.g.
+// after indexing a Bazel workspace.
+var toolRequirements = map[string]func(h *Handlers, ctx context.Context) bool{
+	"find_target": func(h *Handlers, ctx context.Context) bool {
+		return h.anyIndex(ctx, func(info indexer.IndexInfo) bool { return info.BazelTargets > 0 })
+	},
+	"who_owns": func(h *Handlers, ctx context.Context) bool {
+		return h.anyIndex(ctx, func(info indexer.IndexInfo) bool { return info.CodeOwners > 0 })
+	},
+	"search_history": func(*Handlers, context.Context) bool { return externalToolAvailable("git") },
+	"ast_query":      func(*Handlers, context.Context) bool { return externalToolAvailable("tree-sitter") },
+}
+
+// conditionalTool is a tool listed only while its requirement is met
+type conditionalTool struct {
+	tool    mcp.Tool
+	handler server.ToolHandlerFunc
+	shown   bool
+}
+
+// toolAvailability tracks the conditional tools of a server
+type toolAvailability struct {
+	mu     sync.Mutex
+	server *server.MCPServer
+	tools  map[string]*conditionalTool
+}
+
+// addConditionalTool registers a tool that is only listed while its
+// requirement is met
+func (h *Handlers) addConditionalTool(s *server.MCPServer, tool mcp.Tool, handler server.ToolHandlerFunc) {
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	h.availability.server = s
+	if h.availability.tools == nil {
+		h.availability.tools = make(map[string]*conditionalTool)
+	}
+	h.availability.tools[tool.Name] = &conditionalTool{tool: tool, handler: handler}
+}
+
+// refreshTools lists the conditional tools whose requirement is met and
+// removes the others. Clients are notified when the list changes.
+func (h *Handlers) refreshTools(ctx context.Context) {
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	if h.availability.server == nil {
+		return
+	}
+	var hidden []string
+	for name, conditional := range h.availability.tools {
+		available := toolRequirements[name](h, ctx)
+		switch {
+		case available && !conditional.shown:
+			h.availability.server.AddTool(conditional.tool, conditional.handler)
+		case !available && conditional.shown:
+			hidden = append(hidden, name)
+		}
+		conditional.shown = available
+	}
+	if len(hidden) > 0 {
+		h.availability.server.DeleteTools(hidden...)
+	}
+}
+
+// refreshingTools refreshes the conditional tools after calls of handler,
+// whose tool may have changed the indexes they depend on. Tools are listed
+// for every session, so the indexes of all owners count.
+func (h *Handlers) refreshingTools(handler server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := handler(ctx, request)
+		h.refreshTools(context.Background())
+		return result, err
+	}
+}
+
+// anyIndex reports whether an index of any store matches
+func (h *Handlers) anyIndex(ctx context.Context, match func(indexer.IndexInfo) bool) bool {
+	managers := []indexer.Backend{h.manager}
+	for _, store := range h.stores {
+		managers = append(managers, store.manager)
+	}
+	for _, manager := range managers {
+		indexes, err := manager.ListIndexes(ctx)
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(indexes, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalToolAvailable reports whether the external tool of the given name
+// was found
+func externalToolAvailable(name string) bool {
+	for _, tool := range indexer.ExternalTools() {
+		if tool.Name == name {
+			return tool.Available()
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// Config holds optional settings read from the config file
+type Config struct {
+	// Templates are named, reusable search queries run via run_template
+	Templates map[string]indexer.QueryTemplate `json:"templates,omitempty"`
+
+	// Indexing tunes the index builder (parallelism, shard size, memory)
+	Indexing indexer.BuildOptions `json:"indexing"`
+
+	// Stores are named index directories besides the default one, selected
+	// with the store parameter of the tools
+	Stores map[string]string `json:"stores,omitempty"`
+
+	// Remotes are search backends searched by search_code along with the
+	// local indexes
+	Remotes []indexer.RemoteConfig `json:"remotes,omitempty"`
+
+	// PathMappings map the directories recorded in indexes built elsewhere,
+	// e.g. in a devcontainer, to this machine
+	PathMappings []indexer.PathMapping `json:"path_mappings,omitempty"`
+
+	// Hooks are shell commands run before and after the builds of indexed
+	// directories
+	Hooks []indexer.HookConfig `json:"hooks,omitempty"`
+
+	// Editor is the editor the web UI opens result files in by default: a
+	// known editor such as vscode or a URL template
+	Editor string `json:"editor,omitempty"`
+
+	// ShowAllTools lists every tool, including those that can do nothing
+	// yet, such as find_target before a Bazel workspace is indexed, for
+	// clients that do not refresh their tool list
+	ShowAllTools bool `json:"show_all_tools,omitempty"`
+
+	// IndexJobs is how many index_directory calls with async build at once;
+	// later ones wait in the queue (default 1)
+	IndexJobs int `json:"index_jobs,omitempty"`
+
+	// SearchConcurrency caps the searches run at once across all stores, as
+	// each loads shards into memory (default no cap); SearchQueue is how
+	// many more wait for a slot before searches fail (default 32)
+	SearchConcurrency int `json:"search_concurrency,omitempty"`
+	SearchQueue       int `json:"search_queue,omitempty"`
+}
+
+// getConfigPath returns the location of the config file. It can be set with
+// CODE_INDEX_CONFIG and defaults to config.json in the index directory.
+func getConfigPath(indexDir string) string {
+	if path := os.Getenv("CODE_INDEX_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(indexDir, "config.json")
+}
+
+// LoadConfig reads the config file. A missing file yields an empty config.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return &Config{}, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// newRemotes creates the remote backends of the config. A backend that is
+// misconfigured is left out with a warning rather than stopping the server.
+func newRemotes(configs []indexer.RemoteConfig) []indexer.Remote {
+	var remotes []indexer.Remote
+	seen := make(map[string]bool)
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring duplicate remote backend %s\n", cfg.Name)
+			continue
+		}
+		remote, err := indexer.NewRemote(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		seen[cfg.Name] = true
+		remotes = append(remotes, remote)
+	}
+	return remotes
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// loadEncryptionKey returns the index encryption key from
+// CODE_INDEX_ENCRYPTION_KEY, or from the output of the command in
+// CODE_INDEX_ENCRYPTION_KEY_COMMAND (e.g. a keychain lookup). The command is
+// run with the shell, so it can quote arguments with spaces. It returns nil
+// if neither is set.
+func loadEncryptionKey() ([]byte, error) {
+	if key := os.Getenv("CODE_INDEX_ENCRYPTION_KEY"); key != "" {
+		return indexer.ParseEncryptionKey(key)
+	}
+
+	command := strings.TrimSpace(os.Getenv("CODE_INDEX_ENCRYPTION_KEY_COMMAND"))
+	if command == "" {
+		return nil, nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run encryption key command: %w", err)
+	}
+	return indexer.ParseEncryptionKey(string(out))
+}
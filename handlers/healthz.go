@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// healthStatus is the response of the health endpoint
+type healthStatus struct {
+	Status   string `json:"status"` // "ok", or "unavailable" if the index directory cannot be read
+	IndexDir string `json:"index_dir"`
+	Indexes  int    `json:"indexes"`
+	// Writable reports whether indexes can be built; a read-only index
+	// directory can still be searched
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthHandler returns the handler of the health endpoint served along
+// with the HTTP transports. It responds 200 while the index directory can be
+// read, and 503 otherwise.
+func (h *Handlers) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{Status: "ok", IndexDir: h.manager.GetIndexDir()}
+		code := http.StatusOK
+
+		// A missing index directory is created by the first index; backends
+		// without one, such as MemoryIndex, report ""
+		if _, err := os.Stat(status.IndexDir); status.IndexDir != "" && err != nil && !os.IsNotExist(err) {
+			status.Status, status.Error, code = "unavailable", err.Error(), http.StatusServiceUnavailable
+		} else if indexes, err := h.manager.ListIndexes(context.Background()); err != nil {
+			status.Status, status.Error, code = "unavailable", err.Error(), http.StatusServiceUnavailable
+		} else {
+			status.Indexes = len(indexes)
+			status.Writable = status.IndexDir == "" || WritableDir(status.IndexDir)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
+
+// WritableDir reports whether files can be created in dir, or in the
+// nearest existing parent it would be created in
+func WritableDir(dir string) bool {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// defaultIndexJobs is how many index jobs run at once unless the config
+// sets index_jobs
+const defaultIndexJobs = 1
+
+// jobRetryInterval is how often queued jobs held back by builds of their
+// directory outside the queue are checked again
+const jobRetryInterval = time.Second
+
+// maxFinishedJobs bounds how many finished jobs are kept for
+// index_job_status; the oldest are dropped first
+const maxFinishedJobs = 100
+
+// Index job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// indexJob is an index_directory call run in the background
+type indexJob struct {
+	ID         string                 `json:"id"`
+	Directory  string                 `json:"directory"`
+	Store      string                 `json:"store,omitempty"`
+	State      string                 `json:"state"`
+	QueuedAt   time.Time              `json:"queued_at"`
+	StartedAt  time.Time              `json:"started_at,omitzero"`
+	FinishedAt time.Time              `json:"finished_at,omitzero"`
+	Progress   *indexer.IndexProgress `json:"progress,omitempty"`
+	Result     string                 `json:"result,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	owner    string          // Session the job is visible to with session scoping
+	manager  indexer.Backend // Manager of the store the job builds in
+	ctx      context.Context
+	cancel   context.CancelFunc
+	canceled bool // Set by cancel_index_job
+	run      func(ctx context.Context) (string, error)
+}
+
+// finished reports whether the job is done, one way or another
+func (j *indexJob) finished() bool {
+	return j.State != jobQueued && j.State != jobRunning
+}
+
+// indexJobs is the queue of background index jobs. Jobs start in the order
+// they were queued, with at most a configured number running at once.
+type indexJobs struct {
+	mu      sync.Mutex
+	jobs    map[string]*indexJob
+	queue   []*indexJob
+	running int
+	next    int
+	retry   *time.Timer // Pending check of held back jobs, if any
+}
+
+// indexJobLimit returns how many index jobs may run at once
+func (h *Handlers) indexJobLimit() int {
+	if h.config.IndexJobs > 0 {
+		return h.config.IndexJobs
+	}
+	return defaultIndexJobs
+}
+
+// submitIndexJob queues run as a job indexing directory. The job keeps the
+// values of ctx, such as the store and owner, but not its cancellation, so it
+// outlives the call that queued it. If a job for the same directory and
+// store is queued or running already, that job is returned instead, with
+// false. The job returned is a copy.
+func (h *Handlers) submitIndexJob(ctx context.Context, directory string, store string, run func(ctx context.Context) (string, error)) (indexJob, bool) {
+	q := &h.jobs
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	absPath, err := filepath.Abs(directory)
+	if err != nil {
+		absPath = directory
+	}
+	for _, job := range q.jobs {
+		if !job.finished() && job.Directory == absPath && job.Store == store {
+			return *job, false
+		}
+	}
+
+	if q.jobs == nil {
+		q.jobs = make(map[string]*indexJob)
+	}
+	q.next++
+	job := &indexJob{
+		ID:        fmt.Sprintf("job-%d", q.next),
+		Directory: absPath,
+		Store:     store,
+		State:     jobQueued,
+		QueuedAt:  time.Now(),
+		manager:   h.managerFor(ctx),
+		run:       run,
+	}
+	if h.sessionScope {
+		job.owner = sessionID(ctx)
+	}
+	job.ctx, job.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	q.jobs[job.ID] = job
+	q.queue = append(q.queue, job)
+	h.startIndexJobs()
+	q.pruneFinished()
+	return *job, true
+}
+
+// startIndexJobs starts queued jobs while fewer than the limit run, unless
+// background activity is paused. A job whose directory is being built
+// outside the queue, e.g. by index_directory or a schedule, is held back
+// until that build finishes rather than waiting for it in a slot. The
+// caller holds h.jobs.mu.
+func (h *Handlers) startIndexJobs() {
+	if h.backgroundPaused() {
+		// resumeBackground starts them
+		return
+	}
+	q := &h.jobs
+	held := false
+	for i := 0; i < len(q.queue) && q.running < h.indexJobLimit(); {
+		job := q.queue[i]
+		if job.manager.Building(job.Directory) {
+			held = true
+			i++
+			continue
+		}
+		q.queue = append(q.queue[:i], q.queue[i+1:]...)
+		q.running++
+		job.State = jobRunning
+		job.StartedAt = time.Now()
+		go h.runIndexJob(job)
+	}
+	if held && q.retry == nil {
+		q.retry = time.AfterFunc(jobRetryInterval, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.retry = nil
+			h.startIndexJobs()
+		})
+	}
+}
+
+// runIndexJob runs a job and records its outcome, then starts the next one
+func (h *Handlers) runIndexJob(job *indexJob) {
+	ctx := indexer.WithIndexProgress(job.ctx, func(progress indexer.IndexProgress) {
+		h.jobs.mu.Lock()
+		job.Progress = &progress
+		h.jobs.mu.Unlock()
+	})
+	result, err := job.run(ctx)
+	job.cancel()
+
+	// The new index may make tools available
+	h.refreshTools(context.Background())
+
+	q := &h.jobs
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.FinishedAt = time.Now()
+	switch {
+	case err == nil:
+		job.State = jobSucceeded
+		job.Result = result
+	case job.canceled:
+		job.State = jobCanceled
+	default:
+		job.State = jobFailed
+		job.Error = err.Error()
+	}
+	q.running--
+	h.startIndexJobs()
+}
+
+// pruneFinished drops the oldest finished jobs past maxFinishedJobs. The
+// caller holds q.mu.
+func (q *indexJobs) pruneFinished() {
+	var finished []*indexJob
+	for _, job := range q.jobs {
+		if job.finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(q.jobs, job.ID)
+	}
+}
+
+// visibleIndexJob returns the job of the given ID if the caller may see it.
+// The caller holds h.jobs.mu.
+func (h *Handlers) visibleIndexJob(ctx context.Context, id string) (*indexJob, error) {
+	job, ok := h.jobs.jobs[id]
+	if !ok || (h.sessionScope && job.owner != sessionID(ctx)) {
+		return nil, fmt.Errorf("no index job %s", id)
+	}
+	return job, nil
+}
+
+// cancelIndexJob cancels a queued or running job. A queued job is dropped
+// from the queue; a running build stops, keeping its last checkpoint.
+func (h *Handlers) cancelIndexJob(ctx context.Context, id string) (*indexJob, error) {
+	q := &h.jobs
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, err := h.visibleIndexJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch job.State {
+	case jobQueued:
+		for i, queued := range q.queue {
+			if queued == job {
+				q.queue = append(q.queue[:i], q.queue[i+1:]...)
+				break
+			}
+		}
+		job.cancel()
+		job.canceled = true
+		job.State = jobCanceled
+		job.FinishedAt = time.Now()
+	case jobRunning:
+		// runIndexJob records the state once the build stops
+		job.canceled = true
+		job.cancel()
+	default:
+		return nil, fmt.Errorf("index job %s already %s", id, job.State)
+	}
+	copied := *job
+	return &copied, nil
+}
+
+func (h *Handlers) handleIndexJobStatus(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	q := &h.jobs
+	q.mu.Lock()
+	var jobs []indexJob
+	if id := request.GetString("job_id", ""); id != "" {
+		job, err := h.visibleIndexJob(ctx, id)
+		if err != nil {
+			q.mu.Unlock()
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		jobs = append(jobs, *job)
+	} else {
+		for _, job := range q.jobs {
+			if !h.sessionScope || job.owner == sessionID(ctx) {
+				jobs = append(jobs, *job)
+			}
+		}
+	}
+	q.mu.Unlock()
+
+	if len(jobs) == 0 {
+		return mcp.NewToolResultText("No index jobs. Use index_directory with async to start one."), nil
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].QueuedAt.Before(jobs[j].QueuedAt) })
+	output, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format index jobs: %v", err)), nil
+	}
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleCancelIndexJob(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	id, err := request.RequireString("job_id")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	job, err := h.cancelIndexJob(ctx, id)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to cancel index job: %v", err)), nil
+	}
+	if job.State == jobCanceled {
+		return mcp.NewToolResultText(fmt.Sprintf("Canceled queued index job %s for %s", job.ID, job.Directory)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Canceling index job %s for %s; the build stops at its next file and keeps its last checkpoint. Use index_job_status to confirm", job.ID, job.Directory)), nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// recentSearches is how many searches usage_metrics lists individually
+const recentSearches = 20
+
+// SearchUsage records the limits of a search and what they left out
+type SearchUsage struct {
+	Time            time.Time `json:"time"`
+	Tool            string    `json:"tool"`
+	Query           string    `json:"query"`
+	MaxFiles        int       `json:"max_files"`
+	MaxLinesPerFile int       `json:"max_lines_per_file"`
+	MaxLineRunes    int       `json:"max_line_runes"`
+	indexer.SearchMetrics
+	// FilesWithMoreMatches counts the files shown with matches left out by
+	// max_lines_per_file
+	FilesWithMoreMatches int `json:"files_with_more_matches"`
+
+	session string // Calling session, for scoped sessions to see only theirs
+}
+
+// UsageMetrics aggregates how much of what searches matched was returned and
+// how much the limits left out, since the server started. It is kept in
+// memory only.
+type UsageMetrics struct {
+	mu     sync.Mutex
+	totals indexer.SearchMetrics
+	// Searches, and how many of them hit each limit
+	searches        int
+	hitMaxFiles     int
+	hitMaxLines     int
+	hitMaxLineRunes int
+	recent          []SearchUsage // Oldest first
+}
+
+// Record adds a search to the metrics
+func (u *UsageMetrics) Record(usage SearchUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.totals.Add(usage.SearchMetrics)
+	u.searches++
+	if usage.OmittedFiles > 0 {
+		u.hitMaxFiles++
+	}
+	if usage.FilesWithMoreMatches > 0 {
+		u.hitMaxLines++
+	}
+	if usage.TruncatedLines > 0 {
+		u.hitMaxLineRunes++
+	}
+	u.recent = append(u.recent, usage)
+	if len(u.recent) > recentSearches {
+		u.recent = u.recent[len(u.recent)-recentSearches:]
+	}
+}
+
+// recordSearch adds a search made by tool to the usage metrics and the log
+// of the calling session
+func (h *Handlers) recordSearch(ctx context.Context, tool string, query string, directory string, opts indexer.SearchOptions, result *indexer.SearchResult) {
+	h.logSearch(ctx, tool, query, directory, result)
+	h.usage.Record(SearchUsage{
+		Time:                 time.Now().UTC(),
+		Tool:                 tool,
+		Query:                query,
+		MaxFiles:             opts.MaxFiles,
+		MaxLinesPerFile:      opts.MaxLinesPerFile,
+		MaxLineRunes:         opts.MaxLineLength,
+		SearchMetrics:        result.Metrics,
+		FilesWithMoreMatches: len(result.MoreMatches),
+		session:              sessionID(ctx),
+	})
+}
+
+func (h *Handlers) handleUsageMetrics(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	u := h.usage
+	u.mu.Lock()
+	report := map[string]any{
+		"searches":                   u.searches,
+		"searches_hitting_max_files": u.hitMaxFiles,
+		"searches_hitting_max_lines": u.hitMaxLines,
+		"searches_truncating_lines":  u.hitMaxLineRunes,
+		"totals":                     u.totals,
+	}
+	if u.searches > 0 {
+		report["average_returned_bytes"] = u.totals.ReturnedBytes / u.searches
+	}
+	// Scoped sessions only see their own queries
+	recent := []SearchUsage{}
+	for i := len(u.recent) - 1; i >= 0; i-- {
+		if !h.sessionScope || u.recent[i].session == sessionID(ctx) {
+			recent = append(recent, u.recent[i])
+		}
+	}
+	report["recent"] = recent
+	u.mu.Unlock()
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format metrics: %v", err)), nil
+	}
+	return mcp.NewToolResultText(string(output)), nil
+}
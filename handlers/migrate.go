@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// storeRedirectFile is the stub left in the old location of a migrated
+// index store, pointing to where it went
+const storeRedirectFile = "moved.json"
+
+// maxStoreRedirects bounds how many redirect stubs are followed, as a store
+// migrated repeatedly leaves a chain of them
+const maxStoreRedirects = 10
+
+// storeRedirect is the content of a redirect stub
+type storeRedirect struct {
+	MovedTo string `json:"moved_to"`
+}
+
+// followStoreRedirect returns the directory the index store at dir was
+// migrated to, following the redirect stubs migrate_store left behind, or
+// dir if it was not migrated
+func followStoreRedirect(dir string) string {
+	for range maxStoreRedirects {
+		content, err := os.ReadFile(filepath.Join(dir, storeRedirectFile))
+		if err != nil {
+			return dir
+		}
+		var redirect storeRedirect
+		if err := json.Unmarshal(content, &redirect); err != nil || redirect.MovedTo == "" {
+			return dir
+		}
+		dir = redirect.MovedTo
+	}
+	return dir
+}
+
+// MigrateStore moves the index store in use, with its named stores inside
+// it, to newDir, e.g. onto a bigger disk: the files are moved, paths into
+// the store recorded in the config and the metadata are updated, and a
+// redirect stub is left in the old location so clients configured with it
+// keep working. No server may be using the store meanwhile. It returns a
+// summary of what was done.
+func MigrateStore(newDir string) (string, error) {
+	oldDir, err := filepath.Abs(getIndexDirectory())
+	if err != nil {
+		return "", err
+	}
+	if newDir, err = filepath.Abs(newDir); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(oldDir); err != nil {
+		return "", fmt.Errorf("no index store at %s: %w", oldDir, err)
+	}
+	if pathWithin(newDir, oldDir) || pathWithin(oldDir, newDir) {
+		return "", fmt.Errorf("cannot migrate the index store at %s to %s: one contains the other", oldDir, newDir)
+	}
+	if entries, err := os.ReadDir(newDir); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("cannot migrate the index store to %s: the directory is not empty", newDir)
+	}
+
+	// Moving within a file system is a rename; otherwise the files are
+	// copied before the old ones are removed
+	if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", filepath.Dir(newDir), err)
+	}
+	_ = os.Remove(newDir)
+	if err := os.Rename(oldDir, newDir); err != nil {
+		if err := copyDir(oldDir, newDir); err != nil {
+			// newDir was empty, so only the partial copy is removed and
+			// the migration can be retried
+			if removeErr := os.RemoveAll(newDir); removeErr != nil {
+				return "", fmt.Errorf("failed to copy the index store: %w; the partial copy in %s could not be removed: %v", err, newDir, removeErr)
+			}
+			return "", fmt.Errorf("failed to copy the index store: %w", err)
+		}
+		if err := os.RemoveAll(oldDir); err != nil {
+			return "", fmt.Errorf("copied the index store to %s, but failed to remove %s: %w", newDir, oldDir, err)
+		}
+	}
+
+	// Leave the redirect before anything else can fail, so the store is
+	// found either way
+	redirect, err := json.MarshalIndent(storeRedirect{MovedTo: newDir}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(oldDir, 0755); err != nil {
+		return "", fmt.Errorf("moved the index store to %s, but failed to leave a redirect: %w", newDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(oldDir, storeRedirectFile), redirect, 0644); err != nil {
+		return "", fmt.Errorf("moved the index store to %s, but failed to leave a redirect: %w", newDir, err)
+	}
+
+	config, updated, err := relocateConfig(oldDir, newDir)
+	if err != nil {
+		return "", err
+	}
+	key, err := loadEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	dirs := []string{newDir}
+	for _, dir := range config.Stores {
+		dirs = append(dirs, storeDirectory(dir, newDir))
+	}
+	for _, dir := range dirs {
+		manager := indexer.NewIndexManager(dir)
+		if key != nil {
+			if err := manager.SetEncryptionKey(key); err != nil {
+				return "", err
+			}
+		}
+		n, err := manager.RelocateStore(oldDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to update the metadata in %s: %w", dir, err)
+		}
+		updated += n
+	}
+
+	return fmt.Sprintf("Moved the index store from %s to %s\nUpdated %d paths pointing into the old location\nLeft a redirect in %s; set CODE_INDEX_DIR=%s to use the new location directly", oldDir, newDir, updated, filepath.Join(oldDir, storeRedirectFile), newDir), nil
+}
+
+// relocateConfig points the named stores of the config file that were
+// inside oldDir by absolute path to newDir. The config file moves along if
+// it is in the store. It returns the config and how many paths were updated.
+func relocateConfig(oldDir string, newDir string) (*Config, int, error) {
+	path := getConfigPath(newDir)
+	if abs, err := filepath.Abs(path); err == nil && pathWithin(abs, oldDir) {
+		rel, _ := filepath.Rel(oldDir, abs)
+		path = filepath.Join(newDir, rel)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		return config, 0, err
+	}
+
+	updated := 0
+	for name, dir := range config.Stores {
+		// Relative paths resolve against the store, so they move along
+		resolved := storeDirectory(dir, oldDir)
+		if resolved == filepath.Join(oldDir, os.ExpandEnv(dir)) || !pathWithin(resolved, oldDir) {
+			continue
+		}
+		rel, _ := filepath.Rel(oldDir, resolved)
+		config.Stores[name] = filepath.Join(newDir, rel)
+		updated++
+	}
+	if updated == 0 {
+		return config, 0, nil
+	}
+
+	// Rewrite only the stores, keeping the other settings as written
+	var raw map[string]json.RawMessage
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, 0, err
+	}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return config, 0, err
+	}
+	if raw["stores"], err = json.Marshal(config.Stores); err != nil {
+		return config, 0, err
+	}
+	content, err = json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return config, 0, err
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return config, 0, fmt.Errorf("failed to update config %s: %w", path, err)
+	}
+	return config, updated, nil
+}
+
+// pathWithin reports whether path is dir or inside it
+func pathWithin(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyDir copies the files under src to dst, keeping their modes
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+// copyFile copies the file src to dst with the given mode
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return errors.Join(out.Sync(), out.Close())
+}
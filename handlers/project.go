@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// rootsTimeout bounds how long ensure_index waits for the client to list
+// its roots, as clients without roots support may never answer
+const rootsTimeout = 5 * time.Second
+
+// clientRoot returns the local path of the first root the client shares,
+// usually the project open in it, or "" if it shares none
+func clientRoot(ctx context.Context) string {
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, rootsTimeout)
+	defer cancel()
+	result, err := srv.RequestRoots(ctx, mcp.ListRootsRequest{})
+	if err != nil {
+		return ""
+	}
+	for _, root := range result.Roots {
+		if path, ok := fileURIPath(root.URI); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// fileURIPath returns the local path of a file:// URI
+func fileURIPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		return "", false
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		if u.Host != "" && u.Host != "localhost" {
+			// file://server/share/dir is the UNC path \\server\share\dir
+			return `\\` + u.Host + filepath.FromSlash(path), true
+		}
+		// file:///C:/dir has the drive after a slash
+		path = strings.TrimPrefix(path, "/")
+	}
+	return filepath.FromSlash(path), true
+}
+
+func (h *Handlers) handleEnsureIndex(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	path := request.GetString("path", "")
+	var output strings.Builder
+	if path == "" {
+		if path = clientRoot(ctx); path == "" {
+			wd, err := os.Getwd()
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Failed to find the project: the client shares no roots, and the working directory is unknown: %v", err)), nil
+			}
+			path = wd
+			fmt.Fprintf(&output, "The client shares no roots, so the working directory of the server was used: %s\n", wd)
+		}
+	}
+
+	status, err := h.managerFor(ctx).ProjectStatus(ctx, path)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to check the index: %v", err)), nil
+	}
+
+	if status.Indexed && status.Stale == "" {
+		fmt.Fprintf(&output, "The index of %s is up to date", status.Directory)
+	} else {
+		reason := "it was not indexed"
+		if status.Indexed {
+			reason = "its index was stale: " + status.Stale
+		}
+		if report := indexProgressReporter(ctx, request); report != nil {
+			ctx = indexer.WithIndexProgress(ctx, report)
+		}
+		timeout := time.Duration(request.GetFloat("timeout_seconds", 0) * float64(time.Second))
+		result, err := h.indexDirectory(ctx, status.Directory, nil, timeout)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to index %s, as %s: %v", status.Directory, reason, err)), nil
+		}
+		fmt.Fprintf(&output, "Indexed %s, as %s\n%s", status.Directory, reason, result)
+	}
+
+	if info := h.indexInfo(ctx, status.Directory); info != nil {
+		fmt.Fprintf(&output, "\nReady to search: %d files indexed at %s", info.Files, info.IndexedAt.Format(time.RFC3339))
+		if info.Commit != "" {
+			checkout := indexer.ShortHash(info.Commit)
+			if info.Branch != "" {
+				checkout = info.Branch + " at " + checkout
+			}
+			fmt.Fprintf(&output, " from %s", checkout)
+		}
+	}
+	fmt.Fprintf(&output, "\nPass directory %s to search_code to search only this project", status.Directory)
+	return mcp.NewToolResultText(output.String()), nil
+}
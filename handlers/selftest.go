@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// SelfTest runs the self-test in the index directory from CODE_INDEX_DIR (or
+// the platform default), for the selftest command. It returns the report
+// and whether every check passed or was skipped.
+func SelfTest(ctx context.Context) (string, bool) {
+	report := indexer.SelfTest(ctx, getIndexDirectory())
+	return formatSelfTest(report), report.Passed
+}
+
+func (h *Handlers) handleSelfTest(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	// Backends without an index directory are checked in the temporary one
+	indexDir := h.managerFor(ctx).GetIndexDir()
+	if indexDir == "" {
+		indexDir = os.TempDir()
+	}
+	return mcp.NewToolResultText(formatSelfTest(indexer.SelfTest(ctx, indexDir))), nil
+}
+
+// formatSelfTest formats a self-test report as a summary followed by a line
+// per check
+func formatSelfTest(report *indexer.SelfTestReport) string {
+	counts := make(map[string]int)
+	for _, check := range report.Checks {
+		counts[check.Status]++
+	}
+	var b strings.Builder
+	if report.Passed {
+		fmt.Fprintf(&b, "Self-test passed in %s: %d passed, %d skipped\n", report.Duration, counts[indexer.SelfTestPass], counts[indexer.SelfTestSkip])
+	} else {
+		fmt.Fprintf(&b, "Self-test FAILED in %s: %d failed, %d passed, %d skipped\n", report.Duration, counts[indexer.SelfTestFail], counts[indexer.SelfTestPass], counts[indexer.SelfTestSkip])
+	}
+	for _, check := range report.Checks {
+		line := fmt.Sprintf("  %-4s  %s", check.Status, check.Name)
+		if check.Detail != "" {
+			line += ": " + check.Detail
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// Session log resources: the log of the calling session, and of a session
+// by ID
+const (
+	sessionLogURI         = "code-index://session-log"
+	sessionLogURIPrefix   = sessionLogURI + "/"
+	sessionLogURITemplate = sessionLogURIPrefix + "{session_id}"
+)
+
+// Limits of the in-memory session logs: searches kept per session, top
+// result lines kept per search and sessions kept, dropping the oldest
+const (
+	maxLoggedSearches = 200
+	maxLoggedLines    = 5
+	maxLoggedSessions = 100
+)
+
+// loggedSearch is a search in a session log
+type loggedSearch struct {
+	time         time.Time
+	tool         string
+	query        string
+	directory    string
+	totalFiles   int
+	totalMatches int
+	estimated    bool
+	top          []string // First result lines
+}
+
+// sessionLog is the research trail of an MCP session
+type sessionLog struct {
+	started  time.Time
+	updated  time.Time
+	searches []loggedSearch
+	dropped  int // Searches dropped beyond maxLoggedSearches
+}
+
+// SessionLogs keeps the searches of each MCP session and their top results,
+// so people can review what an agent looked for. They are kept in memory
+// only.
+type SessionLogs struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionLog
+}
+
+// Record adds a search to the log of session
+func (l *SessionLogs) Record(session string, search loggedSearch) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions == nil {
+		l.sessions = make(map[string]*sessionLog)
+	}
+	log, ok := l.sessions[session]
+	if !ok {
+		if len(l.sessions) >= maxLoggedSessions {
+			l.dropOldest()
+		}
+		log = &sessionLog{started: search.time}
+		l.sessions[session] = log
+	}
+	log.updated = search.time
+	log.searches = append(log.searches, search)
+	if len(log.searches) > maxLoggedSearches {
+		log.dropped += len(log.searches) - maxLoggedSearches
+		log.searches = log.searches[len(log.searches)-maxLoggedSearches:]
+	}
+}
+
+// dropOldest removes the log of the session that searched least recently
+func (l *SessionLogs) dropOldest() {
+	oldest := ""
+	for session, log := range l.sessions {
+		if oldest == "" || log.updated.Before(l.sessions[oldest].updated) {
+			oldest = session
+		}
+	}
+	delete(l.sessions, oldest)
+}
+
+// Markdown renders the log of session as a readable document
+func (l *SessionLogs) Markdown(session string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b strings.Builder
+	name := session
+	if name == "" {
+		name = "(no session ID)"
+	}
+	fmt.Fprintf(&b, "# Research log of session %s\n\n", name)
+	log, ok := l.sessions[session]
+	if !ok || len(log.searches) == 0 {
+		b.WriteString("No searches yet.\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Started %s, %d searches", log.started.Format(time.RFC3339), len(log.searches)+log.dropped)
+	if log.dropped > 0 {
+		fmt.Fprintf(&b, " (the first %d are not kept)", log.dropped)
+	}
+	b.WriteString(".\n")
+
+	for i, search := range log.searches {
+		fmt.Fprintf(&b, "\n## %d. `%s` (%s, %s)\n\n", log.dropped+i+1, search.query, search.tool, search.time.Format("15:04:05"))
+		if search.directory != "" {
+			fmt.Fprintf(&b, "In `%s`. ", search.directory)
+		}
+		switch {
+		case search.totalFiles == 0:
+			b.WriteString("No matches.\n")
+			continue
+		case search.estimated:
+			fmt.Fprintf(&b, "At least %d matches in %d files", search.totalMatches, search.totalFiles)
+		default:
+			fmt.Fprintf(&b, "%d matches in %d files", search.totalMatches, search.totalFiles)
+		}
+		if len(search.top) > 0 {
+			b.WriteString(", top results:\n\n```\n")
+			for _, line := range search.top {
+				b.WriteString(line + "\n")
+			}
+			b.WriteString("```\n")
+		} else {
+			b.WriteString(".\n")
+		}
+	}
+	return b.String()
+}
+
+// logSearch adds a search to the log of the calling session, with the first
+// lines of its result
+func (h *Handlers) logSearch(ctx context.Context, tool string, query string, directory string, result *indexer.SearchResult) {
+	var top []string
+	for _, line := range result.Lines {
+		if len(top) == maxLoggedLines {
+			break
+		}
+		// Leave out notes such as warnings and summaries
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "...") {
+			continue
+		}
+		top = append(top, line)
+	}
+	h.sessionLogs.Record(sessionID(ctx), loggedSearch{
+		time:         time.Now().UTC(),
+		tool:         tool,
+		query:        query,
+		directory:    directory,
+		totalFiles:   result.TotalFiles,
+		totalMatches: result.TotalMatches,
+		estimated:    result.TotalsEstimated,
+		top:          top,
+	})
+}
+
+// registerSessionLog adds the session log resources to s
+func (h *Handlers) registerSessionLog(s *server.MCPServer) {
+	s.AddResource(mcp.NewResource(sessionLogURI, "Session research log",
+		mcp.WithResourceDescription("The searches of this session so far and their top results, as a Markdown log for reviewing the research trail"),
+		mcp.WithMIMEType("text/markdown"),
+	), func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		return h.sessionLogContents(request.Params.URI, sessionID(ctx)), nil
+	})
+
+	s.AddResourceTemplate(mcp.NewResourceTemplate(sessionLogURITemplate, "Session research log by ID",
+		mcp.WithTemplateDescription("The searches of a session and their top results, by session ID as recorded in the audit log, as a Markdown log"),
+		mcp.WithTemplateMIMEType("text/markdown"),
+	), func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		session := strings.TrimPrefix(request.Params.URI, sessionLogURIPrefix)
+		// Scoped sessions may only review their own log
+		if h.sessionScope && session != sessionID(ctx) {
+			return nil, fmt.Errorf("session %s is not the calling session", session)
+		}
+		return h.sessionLogContents(request.Params.URI, session), nil
+	})
+}
+
+// sessionLogContents returns the log of session as resource contents
+func (h *Handlers) sessionLogContents(uri string, session string) []mcp.ResourceContents {
+	return []mcp.ResourceContents{mcp.TextResourceContents{
+		URI:      uri,
+		MIMEType: "text/markdown",
+		Text:     h.sessionLogs.Markdown(session),
+	}}
+}
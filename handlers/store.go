@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// defaultStoreName selects the index directory from CODE_INDEX_DIR when a
+// store is named explicitly
+const defaultStoreName = "default"
+
+// indexStore is an index directory with the managers serving it. Named
+// stores keep the indexes of separate codebases apart, e.g. those of
+// different clients.
+type indexStore struct {
+	name      string
+	manager   indexer.Backend
+	webServer *indexer.WebServerManager
+	scheduler *indexer.Scheduler
+}
+
+// storeKey is the context key of the store selected for a tool call
+type storeKey struct{}
+
+// AddStore makes an index store selectable by name with the store parameter
+// of the tools. It must be called before Register. The config's indexing
+// options, remote backends, path mappings and hooks are applied to manager.
+func (h *Handlers) AddStore(name string, manager indexer.Backend, webServer *indexer.WebServerManager) error {
+	if name == "" || name == defaultStoreName {
+		return fmt.Errorf("invalid store name %q", name)
+	}
+	if _, ok := h.stores[name]; ok {
+		return fmt.Errorf("store %q already exists", name)
+	}
+	manager.SetBuildOptions(h.config.Indexing)
+	manager.SetRemotes(h.remotes)
+	manager.SetPathMappings(h.config.PathMappings)
+	manager.SetHooks(h.config.Hooks)
+	manager.SetSearchLimiter(h.searchLimiter)
+	if h.stores == nil {
+		h.stores = make(map[string]*indexStore)
+	}
+	h.stores[name] = &indexStore{name: name, manager: manager, webServer: webServer}
+	return nil
+}
+
+// storeNames returns the names of the named stores, sorted
+func (h *Handlers) storeNames() []string {
+	names := make([]string, 0, len(h.stores))
+	for name := range h.stores {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// defaultStore returns the store of the handlers' own managers
+func (h *Handlers) defaultStore() *indexStore {
+	return &indexStore{name: defaultStoreName, manager: h.manager, webServer: h.webServer, scheduler: h.scheduler}
+}
+
+// lookupStore returns the store with the given name
+func (h *Handlers) lookupStore(name string) (*indexStore, error) {
+	if name == defaultStoreName {
+		return h.defaultStore(), nil
+	}
+	if store, ok := h.stores[name]; ok {
+		return store, nil
+	}
+	if len(h.stores) == 0 {
+		return nil, fmt.Errorf("unknown store %q: no stores are configured", name)
+	}
+	return nil, fmt.Errorf("unknown store %q, available: %s, %s", name, defaultStoreName, strings.Join(h.storeNames(), ", "))
+}
+
+// store returns the store selected for a tool call by scoped
+func (h *Handlers) store(ctx context.Context) *indexStore {
+	if store, ok := ctx.Value(storeKey{}).(*indexStore); ok {
+		return store
+	}
+	return h.defaultStore()
+}
+
+// managerFor returns the index manager of the store selected for a tool call
+func (h *Handlers) managerFor(ctx context.Context) indexer.Backend {
+	return h.store(ctx).manager
+}
+
+// withStore adds the store parameter to a tool when named stores exist
+func (h *Handlers) withStore(tool mcp.Tool) mcp.Tool {
+	if len(h.stores) == 0 {
+		return tool
+	}
+	mcp.WithString("store",
+		mcp.Description(fmt.Sprintf("Optional: the index store to use, one of %s (default: %s)", strings.Join(append([]string{defaultStoreName}, h.storeNames()...), ", "), defaultStoreName)),
+	)(&tool)
+	return tool
+}
+
+// storeDirectory resolves the index directory of a store in the config.
+// Environment variables such as $CODE_INDEX_DIR and a leading ~ are
+// expanded, and relative paths are relative to the default index directory.
+func storeDirectory(dir string, indexDir string) string {
+	dir = os.ExpandEnv(dir)
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, dir[1:])
+		}
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(indexDir, dir)
+	}
+	return filepath.Clean(dir)
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/trondhindenes/code-index-mcp/indexer"
+)
+
+// telemetryInterval is how often usage reports are sent
+const telemetryInterval = 24 * time.Hour
+
+// telemetrySaveInterval is how often unsent counts are saved, so a crash
+// loses at most this much usage
+const telemetrySaveInterval = time.Hour
+
+// telemetryState is the file in the index directory keeping unsent counts
+// and the time of the last report across restarts
+const telemetryState = "telemetry_counts.json"
+
+// telemetryCounts is the saved form of the unsent counts
+type telemetryCounts struct {
+	ToolCalls  map[string]int `json:"tool_calls"`
+	ToolErrors map[string]int `json:"tool_errors"`
+	LastSent   time.Time      `json:"last_sent,omitempty"`
+}
+
+// TelemetryReport is the anonymous usage summary sent to the telemetry
+// endpoint. It contains counts only: no paths, queries or file contents.
+type TelemetryReport struct {
+	InstallID  string         `json:"install_id"`
+	OS         string         `json:"os"`
+	Arch       string         `json:"arch"`
+	ToolCalls  map[string]int `json:"tool_calls"`
+	ToolErrors map[string]int `json:"tool_errors"`
+	Indexes    int            `json:"indexes"`
+	IndexSizes map[string]int `json:"index_sizes"` // Number of indexes per size bucket
+}
+
+// Telemetry collects aggregate usage counts and periodically reports them.
+// It is only created when the user opts in.
+type Telemetry struct {
+	endpoint  string
+	installID string
+	client    *http.Client
+	statePath string
+
+	mu        sync.Mutex
+	calls     map[string]int
+	errors    map[string]int
+	lastSent  time.Time
+	lastError string
+	paused    bool
+}
+
+// NewTelemetry creates a collector reporting to endpoint. If endpoint is
+// empty, usage is counted but never sent.
+func NewTelemetry(endpoint string, installID string) *Telemetry {
+	return &Telemetry{
+		endpoint:  endpoint,
+		installID: installID,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		calls:     make(map[string]int),
+		errors:    make(map[string]int),
+	}
+}
+
+// Load restores the counts and the time of the last report saved in
+// indexDir, and saves them there from now on. A missing file is not an
+// error.
+func (t *Telemetry) Load(indexDir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.statePath = filepath.Join(indexDir, telemetryState)
+	content, err := os.ReadFile(t.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read telemetry counts: %w", err)
+	}
+	var saved telemetryCounts
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("failed to parse telemetry counts: %w", err)
+	}
+	for tool, n := range saved.ToolCalls {
+		t.calls[tool] += n
+	}
+	for tool, n := range saved.ToolErrors {
+		t.errors[tool] += n
+	}
+	t.lastSent = saved.LastSent
+	return nil
+}
+
+// Save writes the unsent counts to the index directory given to Load, if
+// any
+func (t *Telemetry) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.statePath == "" {
+		return nil
+	}
+	content, err := json.Marshal(telemetryCounts{ToolCalls: t.calls, ToolErrors: t.errors, LastSent: t.lastSent})
+	if err != nil {
+		return fmt.Errorf("failed to encode telemetry counts: %w", err)
+	}
+	tmp := t.statePath + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to save telemetry counts: %w", err)
+	}
+	if err := os.Rename(tmp, t.statePath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save telemetry counts: %w", err)
+	}
+	return nil
+}
+
+// RecordCall counts one invocation of tool
+func (t *Telemetry) RecordCall(tool string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.calls[tool]++
+	if failed {
+		t.errors[tool]++
+	}
+}
+
+// Report returns the usage collected since the last successful send
+func (t *Telemetry) Report(indexes []indexer.IndexInfo) TelemetryReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := TelemetryReport{
+		InstallID:  t.installID,
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		ToolCalls:  make(map[string]int),
+		ToolErrors: make(map[string]int),
+		Indexes:    len(indexes),
+		IndexSizes: make(map[string]int),
+	}
+	for tool, n := range t.calls {
+		report.ToolCalls[tool] = n
+	}
+	for tool, n := range t.errors {
+		report.ToolErrors[tool] = n
+	}
+	for _, info := range indexes {
+		report.IndexSizes[sizeBucket(info.Bytes)]++
+	}
+	return report
+}
+
+// Send posts a report to the endpoint and resets the counters it covered
+func (t *Telemetry) Send(ctx context.Context, report TelemetryReport) error {
+	if t.endpoint == "" {
+		return fmt.Errorf("no telemetry endpoint configured")
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.lastError = err.Error()
+		return fmt.Errorf("failed to send report: %w", err)
+	}
+
+	// Subtract what was sent so calls made during the request are kept
+	for tool, n := range report.ToolCalls {
+		t.calls[tool] -= n
+		if t.calls[tool] <= 0 {
+			delete(t.calls, tool)
+		}
+	}
+	for tool, n := range report.ToolErrors {
+		t.errors[tool] -= n
+		if t.errors[tool] <= 0 {
+			delete(t.errors, tool)
+		}
+	}
+	t.lastSent = time.Now()
+	t.lastError = ""
+	return nil
+}
+
+// Run sends a report every telemetryInterval until ctx is cancelled,
+// counting from the last report, so counts saved by an earlier run that is
+// due a report are sent right away. Unsent counts are saved every
+// telemetrySaveInterval.
+func (t *Telemetry) Run(ctx context.Context, manager indexer.Backend) {
+	t.mu.Lock()
+	next := telemetryInterval
+	if !t.lastSent.IsZero() || len(t.calls) > 0 {
+		next = max(time.Until(t.lastSent.Add(telemetryInterval)), 0)
+	}
+	t.mu.Unlock()
+	report := time.NewTimer(next)
+	defer report.Stop()
+	save := time.NewTicker(telemetrySaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-save.C:
+			if err := t.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		case <-report.C:
+			report.Reset(telemetryInterval)
+			t.mu.Lock()
+			paused := t.paused
+			t.mu.Unlock()
+			if paused {
+				// Counts carry over to the first report after resuming
+				continue
+			}
+			indexes, _ := manager.ListIndexes(ctx)
+			// Failures are kept for telemetry_status; counts carry over
+			if err := t.Send(ctx, t.Report(indexes)); err == nil {
+				if err := t.Save(); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// SetPaused stops or restarts periodic reports
+func (t *Telemetry) SetPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+}
+
+// sizeBucket coarsens an index size so reports cannot identify repositories
+func sizeBucket(size int64) string {
+	const mb = 1024 * 1024
+	switch {
+	case size < mb:
+		return "<1MB"
+	case size < 10*mb:
+		return "1-10MB"
+	case size < 100*mb:
+		return "10-100MB"
+	case size < 1024*mb:
+		return "100MB-1GB"
+	default:
+		return ">1GB"
+	}
+}
+
+// loadInstallID returns the random installation ID stored in indexDir,
+// creating it on first use
+func loadInstallID(indexDir string) (string, error) {
+	path := filepath.Join(indexDir, "telemetry_id")
+	if content, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(content)); id != "" {
+			return id, nil
+		}
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate install ID: %w", err)
+	}
+	id := hex.EncodeToString(raw)
+
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create index directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to save install ID: %w", err)
+	}
+	return id, nil
+}
+
+// counted wraps a tool handler so its calls are counted for telemetry
+func (h *Handlers) counted(tool string, handler server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := handler(ctx, request)
+		if h.telemetry != nil {
+			h.telemetry.RecordCall(tool, err != nil || (result != nil && result.IsError))
+		}
+		return result, err
+	}
+}
+
+func (h *Handlers) handleTelemetryStatus(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	if h.telemetry == nil {
+		return mcp.NewToolResultText("Telemetry is disabled. Set CODE_INDEX_TELEMETRY=true and CODE_INDEX_TELEMETRY_URL to opt in to anonymous usage reports."), nil
+	}
+
+	indexes, err := h.manager.ListIndexes(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to list indexes: %v", err)), nil
+	}
+
+	h.telemetry.mu.Lock()
+	status := map[string]any{
+		"enabled":  true,
+		"endpoint": h.telemetry.endpoint,
+		"interval": telemetryInterval.String(),
+	}
+	if !h.telemetry.lastSent.IsZero() {
+		status["last_sent"] = h.telemetry.lastSent.UTC()
+	}
+	if h.telemetry.lastError != "" {
+		status["last_error"] = h.telemetry.lastError
+	}
+	h.telemetry.mu.Unlock()
+	status["next_report"] = h.telemetry.Report(indexes)
+
+	output, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format status: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
@@ -1,30 +1,283 @@
 package handlers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 	"github.com/trondhindenes/code-index-mcp/indexer"
 )
 
-var manager *indexer.IndexManager
-var webServerManager *indexer.WebServerManager
+// Handlers implements the MCP tools on top of an index manager. Create one
+// with New, or NewDefault for the standard environment-based setup, and
+// attach it to a server with Register.
+type Handlers struct {
+	manager   indexer.Backend
+	webServer *indexer.WebServerManager
+	config    *Config
 
-func init() {
-	// Initialize the index manager with user profile directory
+	// sessionScope limits each MCP session to the indexes it created
+	sessionScope bool
+
+	// audit records every tool call; nil disables auditing
+	audit *AuditLog
+
+	// telemetry counts tool usage when the user opted in; nil disables it
+	telemetry *Telemetry
+
+	// usage measures what the limits of searches left out, for usage_metrics
+	usage *UsageMetrics
+
+	// sessionLogs records the searches of each session for the session log
+	// resources
+	sessionLogs *SessionLogs
+
+	// stores are named index directories besides the default one, selected
+	// with the store parameter of the tools
+	stores map[string]*indexStore
+
+	// remotes are the search backends from the config, searched by
+	// search_code along with the local indexes
+	remotes []indexer.Remote
+
+	// scheduler runs scheduled re-indexes; nil if none is running
+	scheduler *indexer.Scheduler
+	pause     backgroundPause
+
+	// availability lists the tools with requirements while they are met
+	availability toolAvailability
+
+	// jobs are the index_directory calls run in the background
+	jobs indexJobs
+
+	// searchLimiter caps the searches of all stores run at once; nil for
+	// no cap
+	searchLimiter *indexer.SearchLimiter
+}
+
+// New creates handlers that serve the given managers. manager is usually an
+// IndexManager; a MemoryIndex serves the tools without an index directory,
+// e.g. in tests. A nil config is treated as empty. The config's indexing options, remote backends, path
+// mappings and hooks are applied to manager.
+func New(manager indexer.Backend, webServer *indexer.WebServerManager, config *Config) *Handlers {
+	if config == nil {
+		config = &Config{}
+	}
+	remotes := newRemotes(config.Remotes)
+	manager.SetBuildOptions(config.Indexing)
+	manager.SetRemotes(remotes)
+	manager.SetPathMappings(config.PathMappings)
+	manager.SetHooks(config.Hooks)
+	searchLimiter := indexer.NewSearchLimiter(config.SearchConcurrency, config.SearchQueue)
+	manager.SetSearchLimiter(searchLimiter)
+	return &Handlers{
+		manager:   manager,
+		webServer: webServer,
+		config:    config,
+		remotes:   remotes,
+		usage:     &UsageMetrics{},
+
+		sessionLogs:   &SessionLogs{},
+		searchLimiter: searchLimiter,
+	}
+}
+
+// NewDefault creates handlers using the index directory from CODE_INDEX_DIR
+// (or the platform default) and the config file in it. It fails if an
+// encryption key is configured but cannot be loaded, rather than falling
+// back to writing unencrypted indexes.
+func NewDefault() (*Handlers, error) {
 	indexDir := getIndexDirectory()
-	manager = indexer.NewIndexManager(indexDir)
-	webServerManager = indexer.NewWebServerManager(indexDir)
+
+	// Load optional settings; a broken config file should not stop the server
+	config, err := LoadConfig(getConfigPath(indexDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if size := os.Getenv("CODE_INDEX_MAX_FILE_SIZE"); size != "" {
+		if n, err := indexer.ParseSize(size); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring invalid CODE_INDEX_MAX_FILE_SIZE %q\n", size)
+		} else {
+			// Rounded up to whole kilobytes, the unit of the config
+			config.Indexing.MaxFileSizeKB = int((n + 1023) >> 10)
+		}
+	}
+	if limit := os.Getenv("CODE_INDEX_SEARCH_CONCURRENCY"); limit != "" {
+		if n, err := strconv.Atoi(limit); err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring invalid CODE_INDEX_SEARCH_CONCURRENCY %q\n", limit)
+		} else {
+			config.SearchConcurrency = n
+		}
+	}
+
+	// Enable encryption at rest before anything reads or writes the index
+	manager := indexer.NewIndexManager(indexDir)
+	key, err := loadEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := manager.SetEncryptionKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	h := New(manager, indexer.NewWebServerManager(indexDir), config)
+	h.SetSessionScope(os.Getenv("CODE_INDEX_SESSION_SCOPE") == "true")
+
+	// Named stores share the encryption key and indexing options
+	storeManagers := make(map[string]*indexer.IndexManager)
+	for name, dir := range config.Stores {
+		dir = storeDirectory(dir, indexDir)
+		storeManager := indexer.NewIndexManager(dir)
+		if key != nil {
+			if err := storeManager.SetEncryptionKey(key); err != nil {
+				return nil, fmt.Errorf("failed to open store %s: %w", name, err)
+			}
+		}
+		if err := h.AddStore(name, storeManager, indexer.NewWebServerManager(dir)); err != nil {
+			return nil, err
+		}
+		storeManagers[name] = storeManager
+	}
+
+	// Audit to the index directory unless disabled with CODE_INDEX_AUDIT_LOG=off.
+	// Parameters are left out with encryption, as the log is plain text.
+	var audit *AuditLog
+	switch auditPath := os.Getenv("CODE_INDEX_AUDIT_LOG"); auditPath {
+	case "off":
+	case "":
+		audit = NewAuditLog(filepath.Join(indexDir, "audit.log"))
+	default:
+		audit = NewAuditLog(auditPath)
+	}
+	if audit != nil {
+		audit.SetOmitParams(key != nil)
+		h.SetAuditLog(audit)
+	}
+
+	// Re-index directories that have a refresh schedule, in every store
+	var compressAfter time.Duration
+	if days := os.Getenv("CODE_INDEX_COMPRESS_AFTER_DAYS"); days != "" {
+		if n, err := strconv.Atoi(days); err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring invalid CODE_INDEX_COMPRESS_AFTER_DAYS %q\n", days)
+		} else {
+			compressAfter = time.Duration(n) * 24 * time.Hour
+		}
+	}
+	startScheduler := func(manager *indexer.IndexManager) *indexer.Scheduler {
+		scheduler := indexer.NewScheduler(manager)
+		scheduler.SetDeferOnBattery(os.Getenv("CODE_INDEX_DEFER_ON_BATTERY") != "false")
+		scheduler.SetCompressAfter(compressAfter)
+		go scheduler.Run(context.Background())
+		return scheduler
+	}
+	h.SetScheduler(startScheduler(manager))
+	for name, storeManager := range storeManagers {
+		h.stores[name].scheduler = startScheduler(storeManager)
+	}
+
+	// Anonymous usage reporting is strictly opt-in
+	if os.Getenv("CODE_INDEX_TELEMETRY") == "true" {
+		if installID, err := loadInstallID(indexDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: telemetry disabled: %v\n", err)
+		} else {
+			telemetry := NewTelemetry(os.Getenv("CODE_INDEX_TELEMETRY_URL"), installID)
+			if err := telemetry.Load(indexDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			h.SetTelemetry(telemetry)
+			go telemetry.Run(context.Background(), h.manager)
+		}
+	}
+	return h, nil
+}
+
+// Close removes temporary data such as decrypted shard copies and saves
+// unsent telemetry counts
+func (h *Handlers) Close() error {
+	err := h.manager.Close()
+	for _, store := range h.stores {
+		if storeErr := store.manager.Close(); err == nil {
+			err = storeErr
+		}
+	}
+	if h.telemetry != nil {
+		if saveErr := h.telemetry.Save(); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// SetScheduler sets the scheduler controlled by the pause_background and
+// resume_background tools. The caller is responsible for running it.
+func (h *Handlers) SetScheduler(scheduler *indexer.Scheduler) {
+	h.scheduler = scheduler
+}
+
+// SetTelemetry sets the collector for anonymous usage counts. A nil
+// collector disables telemetry.
+func (h *Handlers) SetTelemetry(telemetry *Telemetry) {
+	h.telemetry = telemetry
+}
+
+// SetAuditLog sets the log that records tool calls. A nil log disables
+// auditing.
+func (h *Handlers) SetAuditLog(log *AuditLog) {
+	h.audit = log
+}
+
+// SetSessionScope enables or disables per-session scoping. When enabled,
+// list, search, delete, warm and health tools only see the indexes created
+// by the calling session, so clients sharing an HTTP server cannot touch
+// each other's indexes.
+func (h *Handlers) SetSessionScope(enabled bool) {
+	h.sessionScope = enabled
+}
+
+// scoped wraps a tool handler so the index manager calls it makes are
+// scoped to the calling session when session scoping is enabled, and go to
+// the store named by the store parameter
+func (h *Handlers) scoped(handler server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if h.sessionScope {
+			if session := sessionID(ctx); session != "" {
+				ctx = indexer.WithOwner(ctx, session)
+			}
+		}
+		if name := request.GetString("store", ""); name != "" {
+			store, err := h.lookupStore(name)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			ctx = context.WithValue(ctx, storeKey{}, store)
+		}
+		return handler(ctx, request)
+	}
 }
 
-// getIndexDirectory returns the directory where indexes should be stored
+// getIndexDirectory returns the directory where indexes should be stored,
+// following the redirect left when the store was migrated elsewhere
 func getIndexDirectory() string {
+	return followStoreRedirect(configuredIndexDirectory())
+}
+
+// configuredIndexDirectory returns the index directory from the environment
+// or the platform default
+func configuredIndexDirectory() string {
 	// Check for custom index directory from environment
 	if dir := os.Getenv("CODE_INDEX_DIR"); dir != "" {
 		return dir
@@ -59,28 +312,217 @@ func getIndexDirectory() string {
 	}
 }
 
-// RegisterTools registers all MCP tools with the server
-func RegisterTools(s *server.MCPServer) {
-	// Index directory tool
-	indexTool := mcp.NewTool("index_directory",
+// RegisterTools registers all MCP tools with the server using NewDefault
+func RegisterTools(s *server.MCPServer) error {
+	h, err := NewDefault()
+	if err != nil {
+		return err
+	}
+	h.Register(s)
+	return nil
+}
+
+// addTool registers a tool with auditing, usage counting and its
+// annotations. Tools with a requirement are only listed while it is met,
+// unless show_all_tools is set.
+func (h *Handlers) addTool(s *server.MCPServer, tool mcp.Tool, handler server.ToolHandlerFunc) {
+	tool = h.annotate(tool)
+	handler = h.counted(tool.Name, h.audited(tool.Name, handler))
+	if effect, ok := toolEffects[tool.Name]; !ok || effect != readOnlyTool {
+		handler = h.refreshingTools(handler)
+	}
+	if _, conditional := toolRequirements[tool.Name]; conditional && !h.config.ShowAllTools {
+		h.addConditionalTool(s, tool, handler)
+		return
+	}
+	s.AddTool(tool, handler)
+}
+
+// Register registers all MCP tools with the server
+func (h *Handlers) Register(s *server.MCPServer) {
+	// Index directory tools, which share the build options
+	indexOptions := []mcp.ToolOption{
+		mcp.WithBoolean("tracked_only",
+			mcp.Description("Only index files tracked by git, leaving out untracked scratch files and local dumps. Defaults to the setting the directory was last indexed with"),
+		),
+		mcp.WithArray("ignore_patterns",
+			mcp.Description("Gitignore-style patterns of files to leave out, relative to the directory, e.g. **/generated/** or *.pb.go. They apply to tracked files too and are reused when the directory is re-indexed. Defaults to the patterns the directory was last indexed with; an empty array removes them"),
+			mcp.WithStringItems(),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description("Stop the build if it takes longer than this many seconds, removing the shards it wrote since its last checkpoint. Defaults to timeout_minutes of the indexing config, or no timeout"),
+		),
+		mcp.WithString("max_file_size",
+			mcp.Description("Leave out files larger than this, names included, e.g. 500KB or 2MB (bytes without a unit; 0 for no limit). It is reused when the directory is re-indexed. Defaults to the limit the directory was last indexed with, else CODE_INDEX_MAX_FILE_SIZE or max_file_size_kb of the indexing config"),
+		),
+		mcp.WithBoolean("follow_symlinks",
+			mcp.Description("Index the directories and files symbolic links point to, under the paths of the links. Links into the directory itself and links to targets already indexed are skipped, so cycles end. Defaults to the setting the directory was last indexed with"),
+		),
+		mcp.WithBoolean("default_excludes",
+			mcp.Description("Leave out lockfiles (package-lock.json, yarn.lock, go.sum, Cargo.lock, ...), minified files, source maps and test snapshots, whose generated content clutters results. Set to false to index them. Single files can be brought back with a negated ignore pattern such as !yarn.lock. Defaults to the setting the directory was last indexed with, else true"),
+		),
+		mcp.WithBoolean("async",
+			mcp.Description("Queue the build as a background job and return its job ID right away, instead of waiting for it. Follow it with index_job_status and stop it with cancel_index_job (default: false)"),
+		),
+	}
+	indexTool := mcp.NewTool("index_directory", append([]mcp.ToolOption{
 		mcp.WithDescription("Index a source code directory for fast searching. Creates a Zoekt index that enables fast code search."),
 		mcp.WithString("directory",
 			mcp.Required(),
 			mcp.Description("The absolute or relative path to the directory to index"),
 		),
+	}, indexOptions...)...)
+	h.addTool(s, h.withStore(indexTool), h.scoped(h.handleIndexDirectory))
+
+	batchIndexTool := mcp.NewTool("index_directories", append([]mcp.ToolOption{
+		mcp.WithDescription("Index several directories in one call, e.g. all repositories of a workspace, one after the other. A failing directory does not stop the others; the result reports each directory's outcome. The options apply to every directory, and each keeps the settings it was last indexed with for the options not given."),
+		mcp.WithArray("directories",
+			mcp.Required(),
+			mcp.Description("The absolute or relative paths of the directories to index"),
+			mcp.WithStringItems(),
+		),
+	}, indexOptions...)...)
+	h.addTool(s, h.withStore(batchIndexTool), h.scoped(h.handleIndexDirectories))
+
+	// Ensure index tool
+	ensureTool := mcp.NewTool("ensure_index",
+		mcp.WithDescription("Get the project containing a path ready to search in one call: finds the project root (the indexed directory containing the path, else its git repository root), indexes it if it is not indexed or its index is behind the files, and reports what is indexed. Call it before searching a project instead of checking and indexing it yourself."),
+		mcp.WithString("path",
+			mcp.Description("Optional: a file or directory in the project. Defaults to the first root the client shares, else the working directory of the server"),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description("Stop the build if it takes longer than this many seconds. Defaults to timeout_minutes of the indexing config, or no timeout"),
+		),
+	)
+	h.addTool(s, h.withStore(ensureTool), h.scoped(h.handleEnsureIndex))
+
+	// Index job tools
+	jobStatusTool := mcp.NewTool("index_job_status",
+		mcp.WithDescription("Report the state of background index jobs started with index_directory and async: queued, running (with progress), succeeded (with the build summary), failed (with the error) or canceled."),
+		mcp.WithString("job_id",
+			mcp.Description("Optional: the job to report. Reports all recent jobs if omitted"),
+		),
+	)
+	h.addTool(s, jobStatusTool, h.handleIndexJobStatus)
+
+	cancelJobTool := mcp.NewTool("cancel_index_job",
+		mcp.WithDescription("Cancel a background index job. A queued job is dropped; a running build stops like a timed out one, so the next index_directory of the directory resumes from its last checkpoint."),
+		mcp.WithString("job_id",
+			mcp.Required(),
+			mcp.Description("The job ID index_directory returned"),
+		),
 	)
-	s.AddTool(indexTool, handleIndexDirectory)
+	h.addTool(s, cancelJobTool, h.handleCancelIndexJob)
+
+	// Index progress tool
+	progressTool := mcp.NewTool("index_progress",
+		mcp.WithDescription("Report how far full builds of large directories have come: files walked out of the files counted before the build, percentage and estimated time left. Covers builds running in other calls or processes, and interrupted builds, whose progress stops being updated."),
+		mcp.WithString("directory",
+			mcp.Description("Optional: the directory being indexed. Reports all builds if omitted"),
+		),
+	)
+	h.addTool(s, h.withStore(progressTool), h.scoped(h.handleIndexProgress))
 
 	// Search tool
 	searchTool := mcp.NewTool("search_code",
 		mcp.WithDescription("Search for code across indexed directories using Zoekt query syntax. Returns compact grep-like output."),
 		mcp.WithString("query",
 			mcp.Required(),
-			mcp.Description("The search query. Supports: regex patterns, 'file:pattern' for file filtering, 'lang:go' for language, '-pattern' for exclusion, 'case:yes' for case-sensitive"),
+			mcp.Description("The search query. Supports: regex patterns, 'file:pattern' for file filtering, 'lang:go' for language, '-pattern' for exclusion, 'case:yes' for case-sensitive, 'kind:function|method' for symbol definitions, 'target://pkg:name' for the files of a Bazel target. Use the query_syntax tool for the full reference"),
 		),
 		mcp.WithString("directory",
 			mcp.Description("Optional: limit search to a specific indexed directory path"),
 		),
+		mcp.WithString("workspace",
+			mcp.Description("Optional: limit search to the directories of a workspace created with create_workspace. Cannot be combined with directory"),
+		),
+		mcp.WithNumber("max_files",
+			mcp.Description("Maximum number of files to return (default: 20)"),
+		),
+		mcp.WithNumber("max_lines_per_file",
+			mcp.Description("Maximum matches to show per file (default: 3)"),
+		),
+		mcp.WithBoolean("files_only",
+			mcp.Description("Only return file paths with their match counts, densest files first (default: false)"),
+		),
+		mcp.WithBoolean("one_per_file",
+			mcp.Description("Return only the best matching line of each file, ranking files by the score of all their matches rather than their best one. The densest answer to 'which files are relevant to X' (default: false)"),
+		),
+		mcp.WithBoolean("enclosing",
+			mcp.Description("Label each matched line with the function, method or class it is in, e.g. 'pkg/auth/token.go:87 (func ValidateToken): ...', often saving opening the file. Needs symbol data from universal-ctags (default: false)"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only return matches in files of this language (e.g. 'go', 'python'). Validated against the languages present in the index"),
+		),
+		mcp.WithNumber("max_line_runes",
+			mcp.Description("Truncate matched lines longer than this many characters (default: 200)"),
+		),
+		mcp.WithBoolean("terse",
+			mcp.Description("Only output matched lines, without the '... and N more matches' and summary lines. Counts are returned as structured content instead (default: false)"),
+		),
+		mcp.WithBoolean("ignore_case",
+			mcp.Description("Match letters in either case, even if the query contains uppercase letters. Cannot be combined with case:yes (default: false)"),
+		),
+		mcp.WithBoolean("dotall",
+			mcp.Description("Let '.' in regex patterns match newlines, so matches can span lines (default: false)"),
+		),
+		mcp.WithBoolean("expand_aliases",
+			mcp.Description("Also search for the aliases of the terms in the query set with set_alias for the searched indexes, e.g. k8s finds kubernetes too (default: false)"),
+		),
+		mcp.WithString("scope",
+			mcp.Description("Optional: only match inside 'comments' or 'strings' (string literals), e.g. for documentation or i18n audits. Files in languages without known comment and string syntax are left out, and remote backends are not searched"),
+			mcp.Enum("comments", "strings"),
+		),
+		mcp.WithString("spell_fallback",
+			mcp.Description("Optional: when a query of one identifier (plus filters like lang:) finds nothing, look for words one typo away from it in the index. 'suggest' answers 'Did you mean ...?'; 'include' searches for the closest ones instead"),
+			mcp.Enum("suggest", "include"),
+		),
+		mcp.WithBoolean("smart_identifiers",
+			mcp.Description("Match the plain words of the query as one identifier in any style: 'user id' matches userID, user_id, UserId and user-id, and userId matches user_id too. Field filters, negations and regexes are kept as written. Local indexes only (default: false)"),
+		),
+		mcp.WithBoolean("multiline",
+			mcp.Description("Let '^' and '$' in regex patterns match at every line; false matches only at the start and end of a file (default: true)"),
+		),
+		mcp.WithBoolean("owners",
+			mcp.Description("List the owners of each file from the CODEOWNERS file of its repository after its lines (default: false)"),
+		),
+		mcp.WithBoolean("permalinks",
+			mcp.Description("List a web link to the first match of each file after its lines, pinned to the indexed commit, for sharing with people. Only for repositories with a GitHub or GitLab origin remote (default: false)"),
+		),
+		mcp.WithBoolean("highlight",
+			mcp.Description("Mark the matched text in each line, e.g. 'return «greetUser»(name)', to locate the hit in long lines. Long lines are cut around their first match (default: false)"),
+		),
+		mcp.WithString("highlight_start",
+			mcp.Description("Optional: marker put before matched text instead of '«'. Implies highlight"),
+		),
+		mcp.WithString("highlight_end",
+			mcp.Description("Optional: marker put after matched text instead of '»'. Implies highlight"),
+		),
+		mcp.WithBoolean("relative_paths",
+			mcp.Description("Show paths relative to the indexed directory, stated once before the results, instead of absolute paths. With several indexes, relative to the directory containing them all (default: false)"),
+		),
+		mcp.WithBoolean("color",
+			mcp.Description("Format the output for terminals with ANSI colors: matched text in bold red and file locations dimmed. Ignored if the server runs with NO_COLOR set (default: false)"),
+		),
+	)
+	if len(h.remotes) > 0 {
+		mcp.WithBoolean("local_only",
+			mcp.Description(fmt.Sprintf("Only search the local indexes. Otherwise a search without directory or workspace also searches the remote backends (%s), labeling their results with the backend's name (default: false)", strings.Join(h.remoteNames(), ", "))),
+		)(&searchTool)
+	}
+	h.addTool(s, h.withStore(searchTool), h.scoped(h.handleSearchCode))
+
+	// Refine search tool
+	refineTool := mcp.NewTool("refine_search",
+		mcp.WithDescription("Search only the files matched by a previous search_code, refine_search or run_template result, e.g. to find which of those files also mention something else. Takes the result_id printed with the previous result."),
+		mcp.WithString("result_id",
+			mcp.Required(),
+			mcp.Description("The result_id of the previous result. The last 100 results can be refined"),
+		),
+		mcp.WithString("query",
+			mcp.Required(),
+			mcp.Description("The query to search the files for, with the same syntax as search_code"),
+		),
 		mcp.WithNumber("max_files",
 			mcp.Description("Maximum number of files to return (default: 20)"),
 		),
@@ -88,16 +530,42 @@ func RegisterTools(s *server.MCPServer) {
 			mcp.Description("Maximum matches to show per file (default: 3)"),
 		),
 		mcp.WithBoolean("files_only",
-			mcp.Description("Only return file paths, no line content (default: false)"),
+			mcp.Description("Only return file paths with their match counts, densest files first (default: false)"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only return matches in files of this language"),
+		),
+		mcp.WithBoolean("terse",
+			mcp.Description("Only output matched lines, with the counts as structured content (default: false)"),
+		),
+	)
+	h.addTool(s, h.withStore(refineTool), h.scoped(h.handleRefineSearch))
+
+	// Open result tool
+	openTool := mcp.NewTool("open_result",
+		mcp.WithDescription("Read a file of a previous search_code, refine_search or run_template result by its number, counting from 1 in the order the files are shown, instead of copying its path. The file is read from the index."),
+		mcp.WithString("result_id",
+			mcp.Required(),
+			mcp.Description("The result_id of the previous result"),
+		),
+		mcp.WithNumber("file",
+			mcp.Required(),
+			mcp.Description("Number of the file in the result, e.g. 3 for the third file shown"),
+		),
+		mcp.WithNumber("start_line",
+			mcp.Description("First line to return (default: 1)"),
+		),
+		mcp.WithNumber("max_lines",
+			mcp.Description("Maximum number of lines to return (default: 200)"),
 		),
 	)
-	s.AddTool(searchTool, handleSearchCode)
+	h.addTool(s, h.withStore(openTool), h.scoped(h.handleOpenResult))
 
 	// List indexes tool
 	listTool := mcp.NewTool("list_indexes",
 		mcp.WithDescription("List all indexed directories and their status"),
 	)
-	s.AddTool(listTool, handleListIndexes)
+	h.addTool(s, h.withStore(listTool), h.scoped(h.handleListIndexes))
 
 	// Delete index tool
 	deleteTool := mcp.NewTool("delete_index",
@@ -107,116 +575,1702 @@ func RegisterTools(s *server.MCPServer) {
 			mcp.Description("The path to the directory whose index should be deleted"),
 		),
 	)
-	s.AddTool(deleteTool, handleDeleteIndex)
+	h.addTool(s, h.withStore(deleteTool), h.scoped(h.handleDeleteIndex))
 
-	// Get index info tool
-	infoTool := mcp.NewTool("index_info",
-		mcp.WithDescription("Get information about the indexing configuration, including the index storage location"),
+	// Move index tool
+	moveTool := mcp.NewTool("move_index",
+		mcp.WithDescription("Rebind the index of a directory that was renamed or moved to its new path, without rebuilding it. Submodule indexes, schedules, watching, muted paths, aliases and workspaces follow it"),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The path the directory was indexed under"),
+		),
+		mcp.WithString("new_directory",
+			mcp.Required(),
+			mcp.Description("The path the directory has now"),
+		),
 	)
-	s.AddTool(infoTool, handleIndexInfo)
+	h.addTool(s, h.withStore(moveTool), h.scoped(h.handleMoveIndex))
 
-	// Start webserver tool
-	startWebserverTool := mcp.NewTool("start_webserver",
-		mcp.WithDescription("Start the Zoekt web server for interactive code search in a browser. The server runs in the background and provides a web UI for searching indexed code. Port can be configured via CODE_INDEX_WEBSERVER_PORT environment variable (default: 6070)."),
-		mcp.WithNumber("port",
-			mcp.Description("Port to run the web server on. Overrides CODE_INDEX_WEBSERVER_PORT env var. Use 0 for random available port."),
+	// Attach index directory tool
+	attachTool := mcp.NewTool("attach_index_dir",
+		mcp.WithDescription("Register Zoekt shards built by other tooling (e.g. zoekt-git-index in CI) as the index of a directory, so they can be searched like an index built here. The shards are linked, not copied; attach again after shards are added or removed."),
+		mcp.WithString("shard_dir",
+			mcp.Required(),
+			mcp.Description("The directory containing the .zoekt shard files"),
+		),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The directory results are reported under, usually a local checkout of the repository. Searches and delete_index refer to the index by it"),
+		),
+		mcp.WithString("repository",
+			mcp.Description("Optional: the repository name stored in the shards, e.g. 'github.com/org/repo'. Required if the shard directory holds several repositories"),
+		),
+		mcp.WithBoolean("all_repositories",
+			mcp.Description("Attach every repository of a zoekt-indexserver index directory. directory is then the root their results are reported under, e.g. <directory>/github.com/org/repo (default: false)"),
 		),
 	)
-	s.AddTool(startWebserverTool, handleStartWebserver)
+	h.addTool(s, h.withStore(attachTool), h.scoped(h.handleAttachIndexDir))
 
-	// Stop webserver tool
-	stopWebserverTool := mcp.NewTool("stop_webserver",
-		mcp.WithDescription("Stop the running Zoekt web server"),
+	// Get index info tool
+	infoTool := mcp.NewTool("index_info",
+		mcp.WithDescription("Get information about the indexing configuration, including the index storage location and which optional external tools (universal-ctags, scip-ctags, git, tree-sitter) were found and what they enable"),
 	)
-	s.AddTool(stopWebserverTool, handleStopWebserver)
+	h.addTool(s, h.withStore(infoTool), h.scoped(h.handleIndexInfo))
 
-	// Webserver status tool
-	webserverStatusTool := mcp.NewTool("webserver_status",
-		mcp.WithDescription("Get the current status of the Zoekt web server"),
+	// Warm index tool
+	warmTool := mcp.NewTool("warm_index",
+		mcp.WithDescription("Preload index shards into the OS page cache so the first search after startup is fast. Useful for large indexes on network filesystems or cold caches."),
+		mcp.WithString("directory",
+			mcp.Description("Optional: the indexed directory to warm up. Warms all indexes if omitted"),
+		),
 	)
-	s.AddTool(webserverStatusTool, handleWebserverStatus)
-}
+	h.addTool(s, h.withStore(warmTool), h.scoped(h.handleWarmIndex))
 
-func handleIndexDirectory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	directory, err := request.RequireString("directory")
-	if err != nil {
-		return mcp.NewToolResultError(err.Error()), nil
-	}
+	// Set schedule tool
+	scheduleTool := mcp.NewTool("set_schedule",
+		mcp.WithDescription("Set a cron schedule for automatically re-indexing an indexed directory, e.g. '0 3 * * *' for nightly at 03:00 local time. Supports *, lists, ranges, steps, month/day names and @hourly, @daily, @weekly, @monthly."),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The indexed directory to schedule"),
+		),
+		mcp.WithString("schedule",
+			mcp.Required(),
+			mcp.Description("Five-field cron expression (minute hour day-of-month month day-of-week). Use an empty string to remove the schedule"),
+		),
+	)
+	h.addTool(s, h.withStore(scheduleTool), h.scoped(h.handleSetSchedule))
 
-	if err := manager.IndexDirectory(directory); err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Failed to index directory: %v", err)), nil
-	}
+	// Watch directory tool
+	watchTool := mcp.NewTool("watch_directory",
+		mcp.WithDescription("Keep the index of an indexed directory fresh automatically: watch its files and re-index it in the background a few seconds after they stop changing. Watching is kept across re-indexes and server restarts until unwatch_directory, and pauses with pause_background."),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The indexed directory to watch"),
+		),
+	)
+	h.addTool(s, h.withStore(watchTool), h.scoped(h.handleWatchDirectory))
 
-	absPath, _ := filepath.Abs(directory)
-	return mcp.NewToolResultText(fmt.Sprintf("Successfully indexed directory: %s\nIndex stored in: %s", absPath, manager.GetIndexDir())), nil
-}
+	// Unwatch directory tool
+	unwatchTool := mcp.NewTool("unwatch_directory",
+		mcp.WithDescription("Stop re-indexing a directory automatically when its files change. The index is kept as it is."),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The watched directory"),
+		),
+	)
+	h.addTool(s, h.withStore(unwatchTool), h.scoped(h.handleUnwatchDirectory))
 
-func handleSearchCode(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	query, err := request.RequireString("query")
-	if err != nil {
-		return mcp.NewToolResultError(err.Error()), nil
-	}
+	// Mute path tool
+	muteTool := mcp.NewTool("mute_path",
+		mcp.WithDescription("Leave paths of an index out of all search results, e.g. generated code or old migrations, without re-indexing. Reversible at any time with unmute; muted paths are kept when the directory is re-indexed and listed by list_indexes."),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The indexed directory whose paths to mute"),
+		),
+		mcp.WithString("pattern",
+			mcp.Required(),
+			mcp.Description("A gitignore-style pattern relative to the directory, e.g. 'migrations/**', '*.pb.go' or 'docs/'. Muting a directory mutes the files in it"),
+		),
+		mcp.WithBoolean("unmute",
+			mcp.Description("Remove the pattern from the muted paths instead, so they are searched again (default: false)"),
+		),
+	)
+	h.addTool(s, h.withStore(muteTool), h.scoped(h.handleMutePath))
 
-	directory := request.GetString("directory", "")
+	// Set alias tool
+	aliasTool := mcp.NewTool("set_alias",
+		mcp.WithDescription("Set other names a term is known by in an index, e.g. kubernetes for k8s or the legacy name of a service, so searches with expand_aliases find either. Aliases apply both ways, are kept when the directory is re-indexed and are listed by list_indexes."),
+		mcp.WithString("directory",
+			mcp.Required(),
+			mcp.Description("The indexed directory the aliases apply to"),
+		),
+		mcp.WithString("term",
+			mcp.Required(),
+			mcp.Description("The term, e.g. 'k8s'. Words of letters, digits, '_', '-' and '.', matched in any case"),
+		),
+		mcp.WithArray("aliases",
+			mcp.Description("The other names of the term, replacing those set before. Empty or omitted removes the aliases of the term"),
+			mcp.WithStringItems(),
+		),
+	)
+	h.addTool(s, h.withStore(aliasTool), h.scoped(h.handleSetAlias))
 
-	opts := indexer.SearchOptions{
-		MaxFiles:        int(request.GetFloat("max_files", 20)),
-		MaxLinesPerFile: int(request.GetFloat("max_lines_per_file", 3)),
-		MaxLineLength:   200,
-		FilesOnly:       request.GetBool("files_only", false),
-	}
+	// Index health tool
+	healthTool := mcp.NewTool("index_health",
+		mcp.WithDescription("Get diagnostics for indexes: shard and document counts, content vs index size, memory use, trigram statistics and skipped files. Helps explain why a repository searches slowly."),
+		mcp.WithString("directory",
+			mcp.Description("Optional: the indexed directory to inspect. Reports all indexes if omitted"),
+		),
+		mcp.WithString("workspace",
+			mcp.Description("Optional: inspect the directories of this workspace instead"),
+		),
+	)
+	h.addTool(s, h.withStore(healthTool), h.scoped(h.handleIndexHealth))
 
-	result, err := manager.Search(query, directory, opts)
-	if err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Search failed: %v", err)), nil
-	}
+	// Find Bazel target tool
+	findTargetTool := mcp.NewTool("find_target",
+		mcp.WithDescription("Map source files to the Bazel targets that build them and back, using the BUILD files parsed when a Bazel workspace root was indexed. Give a file to find its targets, or a target label to list its source files."),
+		mcp.WithString("file",
+			mcp.Description("A source file, absolute or relative to the workspace root, to find the targets of"),
+		),
+		mcp.WithString("target",
+			mcp.Description("A target label to list the files of: //pkg:name, //pkg:all or //pkg/... for all targets below a package"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: the indexed workspace root to look in. Looks in all indexes if omitted"),
+		),
+	)
+	h.addTool(s, h.withStore(findTargetTool), h.scoped(h.handleFindTarget))
 
-	if len(result.Lines) == 0 {
-		return mcp.NewToolResultText("No results found"), nil
-	}
+	// Who owns tool
+	whoOwnsTool := mcp.NewTool("who_owns",
+		mcp.WithDescription("Find the owners of a file or directory by the repository's CODEOWNERS file, as recorded when it was indexed, with the rule that decides them. Useful to find reviewers for a change or whom to ask about code."),
+		mcp.WithString("path",
+			mcp.Required(),
+			mcp.Description("The file or directory in an indexed directory, absolute or relative to the working directory of the server"),
+		),
+	)
+	h.addTool(s, h.withStore(whoOwnsTool), h.scoped(h.handleWhoOwns))
 
-	// Return compact grep-like output
-	output := strings.Join(result.Lines, "\n")
-	return mcp.NewToolResultText(output), nil
-}
+	// Usage stats tool
+	usageStatsTool := mcp.NewTool("usage_stats",
+		mcp.WithDescription("Count the uses of a symbol, or the matches of a query, grouped by directory and by test vs non-test code, to see how entrenched an API is before refactoring it. Every match is counted, not only those search_code would show."),
+		mcp.WithString("symbol",
+			mcp.Description("An identifier to count whole-word, case-sensitive uses of, e.g. 'ParseConfig'"),
+		),
+		mcp.WithString("query",
+			mcp.Description("A query in search_code syntax to count the matches of instead of a symbol"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only count files of this language"),
+		),
+		mcp.WithNumber("depth",
+			mcp.Description("Optional: group by this many directory levels below the indexed directory, e.g. 1 for top-level directories. Groups by each file's own directory (package) if omitted"),
+		),
+		mcp.WithNumber("max_directories",
+			mcp.Description("Maximum directories to list, most matches first (default: 30)"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the count to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(usageStatsTool), h.scoped(h.handleUsageStats))
 
-func handleListIndexes(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	indexes, err := manager.ListIndexes()
-	if err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Failed to list indexes: %v", err)), nil
-	}
+	// Possibly unreferenced tool
+	unreferencedTool := mcp.NewTool("possibly_unreferenced",
+		mcp.WithDescription("HEURISTIC: list code files that nothing else in the index seems to import or use, as candidates for cleanup. A file is listed when no other file mentions its name (as in an import path) or any symbol it defines. Files loaded by reflection, by configuration outside the index or by convention can show up too, so verify each before deleting it. Tests and entry points such as main and index files are not checked."),
+		mcp.WithString("language",
+			mcp.Description("Optional: only check files of this language"),
+		),
+		mcp.WithNumber("max_candidates",
+			mcp.Description("Maximum files to check (default: 2000)"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the check to a specific indexed directory path. References from other indexes are not considered then"),
+		),
+	)
+	h.addTool(s, h.withStore(unreferencedTool), h.scoped(h.handlePossiblyUnreferenced))
+
+	// Search history tool
+	searchHistoryTool := mcp.NewTool("search_history",
+		mcp.WithDescription("Search the git history of indexed repositories, rather than their current content, to find when and why something was introduced, changed or removed. Searches commit messages and, with added or changed, the patches of commits (like git log -S and -G). Only commits touching the indexed directories are searched, newest first. The criteria given must all match."),
+		mcp.WithString("message",
+			mcp.Description("Regex the commit message matches, e.g. 'retry|backoff'"),
+		),
+		mcp.WithString("added",
+			mcp.Description("A string the commit added or removed (changed its number of occurrences), e.g. 'func parseConfig'. Finds where a symbol was introduced or deleted"),
+		),
+		mcp.WithString("changed",
+			mcp.Description("Regex matching a line the commit added or removed, including lines merely edited. Cannot be combined with added"),
+		),
+		mcp.WithString("path",
+			mcp.Description("Optional: only commits touching this file or directory, relative to the indexed directory"),
+		),
+		mcp.WithString("author",
+			mcp.Description("Optional: regex the author name or email matches"),
+		),
+		mcp.WithString("since",
+			mcp.Description("Optional: only commits after this date, e.g. '2024-01-01' or '3 months ago'"),
+		),
+		mcp.WithBoolean("ignore_case",
+			mcp.Description("Match message and author in either case (default: false)"),
+		),
+		mcp.WithNumber("max_commits",
+			mcp.Description("Maximum commits per repository (default: 20)"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the search to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(searchHistoryTool), h.scoped(h.handleSearchHistory))
+
+	// Find endpoint tool
+	findEndpointTool := mcp.NewTool("find_endpoint",
+		mcp.WithDescription("Find API endpoints declared in OpenAPI/Swagger documents (YAML or JSON) and .proto files by route path or operation ID, structurally rather than by regex. gRPC methods are listed with method RPC and their google.api.http routes."),
+		mcp.WithString("query",
+			mcp.Description("Text the route path or operation ID contains, ignoring case, e.g. '/users/{id}' or 'getUser'"),
+		),
+		mcp.WithString("method",
+			mcp.Description("Optional: only endpoints of this HTTP method, or RPC for gRPC methods"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the search to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(findEndpointTool), h.scoped(h.handleFindEndpoint))
+
+	// Find message tool
+	findMessageTool := mcp.NewTool("find_message",
+		mcp.WithDescription("Find protobuf messages and enums and OpenAPI schemas by name or by field name, structurally rather than by regex. Lists their fields with types and line numbers."),
+		mcp.WithString("name",
+			mcp.Description("Text the message or schema name contains, ignoring case"),
+		),
+		mcp.WithString("field",
+			mcp.Description("Optional: only messages with a field whose name contains this text, listing just those fields"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the search to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(findMessageTool), h.scoped(h.handleFindMessage))
+
+	// Find resource tool
+	findResourceTool := mcp.NewTool("find_resource",
+		mcp.WithDescription("Find Kubernetes objects in YAML manifests and Terraform resources, data sources and module calls in .tf files by kind and name, structurally rather than by regex. E.g. the Deployment named payments, or the module defining an aws_s3_bucket."),
+		mcp.WithString("kind",
+			mcp.Description("The kind, ignoring case: a Kubernetes kind like Deployment, a Terraform resource type like aws_s3_bucket, data.<type> for data sources, or module for module calls"),
+		),
+		mcp.WithString("name",
+			mcp.Description("Text the resource name contains, ignoring case: metadata.name for Kubernetes, the block label for Terraform"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the search to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(findResourceTool), h.scoped(h.handleFindResource))
+
+	// License report tool
+	licenseReportTool := mcp.NewTool("license_report",
+		mcp.WithDescription("Report the licenses of the indexed code for compliance checks: the license files (LICENSE, COPYING, NOTICE), e.g. of vendored and third-party packages, with the license each holds, and how many files carry a license header per license, with examples. Licenses are named by SPDX identifier."),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the report to a specific indexed directory path"),
+		),
+	)
+	h.addTool(s, h.withStore(licenseReportTool), h.scoped(h.handleLicenseReport))
+
+	// Structural search tool
+	structuralTool := mcp.NewTool("structural_search",
+		mcp.WithDescription("Search code with a comby-style template instead of a regex, e.g. 'if (:[cond]) { return :[x]; }'. :[name] matches any code with balanced parentheses, brackets, braces and quotes, even across lines; :[[name]] matches an identifier; whitespace matches any whitespace. A hole used twice must match the same code. The index narrows the files down to those containing the literal text of the template."),
+		mcp.WithString("template",
+			mcp.Required(),
+			mcp.Description("The template, e.g. 'errors.Wrap(:[err], :[msg])' or 'foo(:[x], :[x])'. Use :[_] for code that should match but not be reported"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only match files of this language (e.g. 'go', 'python')"),
+		),
+		mcp.WithString("file",
+			mcp.Description("Optional: only match files whose path matches this regex, e.g. '_test\\.go$'"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the search to a specific indexed directory path"),
+		),
+		mcp.WithNumber("max_matches",
+			mcp.Description("Maximum number of matches to return (default: 50)"),
+		),
+	)
+	h.addTool(s, h.withStore(structuralTool), h.scoped(h.handleStructuralSearch))
+
+	// AST query tool
+	astTool := mcp.NewTool("ast_query",
+		mcp.WithDescription("Run a tree-sitter query over the syntax trees of indexed files, e.g. '(call_expression function: (selector_expression field: (field_identifier) @fn (#eq? @fn \"Command\"))) @call', returning the captured nodes with their positions. The files are narrowed down with the index first. Needs the tree-sitter CLI with the grammars of the queried languages."),
+		mcp.WithString("query",
+			mcp.Required(),
+			mcp.Description("The tree-sitter query, with @captures for the nodes to return. Node types depend on the grammar of the language"),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Search query, in search_code syntax, that the files must match, e.g. 'Command' or 'file:cmd/ exec'. Text the captured nodes contain makes a good filter"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Only query files of this language (e.g. 'go'). Either filter or language is required"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the query to a specific indexed directory path"),
+		),
+		mcp.WithNumber("max_captures",
+			mcp.Description("Maximum number of captures to return (default: 50)"),
+		),
+	)
+	h.addTool(s, h.withStore(astTool), h.scoped(h.handleASTQuery))
+
+	// Preview replace tool
+	previewReplaceTool := mcp.NewTool("preview_replace",
+		mcp.WithDescription("Preview a regex search-and-replace across indexed files as a unified diff, without writing any file, to assess the blast radius of a refactoring before editing. Files are read from the index, so re-index first if they changed."),
+		mcp.WithString("pattern",
+			mcp.Required(),
+			mcp.Description("Regular expression (RE2 syntax) to replace. '^' and '$' match at line boundaries; use (?i) to ignore case and (?s) to let '.' match newlines"),
+		),
+		mcp.WithString("replacement",
+			mcp.Required(),
+			mcp.Description("Replacement text. $1 or ${name} insert submatches, $$ a literal $. Empty to delete the matches"),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Optional: search query, in search_code syntax, that the files must match as well, e.g. 'file:\\.go$ -file:_test'"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only replace in files of this language (e.g. 'go')"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the replacement to a specific indexed directory path"),
+		),
+		mcp.WithNumber("max_files",
+			mcp.Description("Maximum number of file diffs to return; all changed files are still counted (default: 20)"),
+		),
+	)
+	h.addTool(s, h.withStore(previewReplaceTool), h.scoped(h.handlePreviewReplace))
+
+	// Apply replace tool
+	applyReplaceTool := mcp.NewTool("apply_replace",
+		mcp.WithDescription("Apply a regex search-and-replace to the source files, as previewed with preview_replace. Needs confirm: true. Each changed file is first copied to <file>.orig. Files changed since they were indexed, files with too many replacements and files with an existing backup are skipped, and nothing is changed if too many files would be. Re-index afterwards to search the new content."),
+		mcp.WithString("pattern",
+			mcp.Required(),
+			mcp.Description("Regular expression (RE2 syntax) to replace, as given to preview_replace"),
+		),
+		mcp.WithString("replacement",
+			mcp.Required(),
+			mcp.Description("Replacement text, as given to preview_replace"),
+		),
+		mcp.WithBoolean("confirm",
+			mcp.Required(),
+			mcp.Description("Must be true to change files. Preview the replacement with preview_replace first"),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Optional: search query, in search_code syntax, that the files must match as well"),
+		),
+		mcp.WithString("language",
+			mcp.Description("Optional: only replace in files of this language"),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit the replacement to a specific indexed directory path"),
+		),
+		mcp.WithNumber("max_files",
+			mcp.Description("Change nothing if more files than this would change (default: 20)"),
+		),
+		mcp.WithNumber("max_per_file",
+			mcp.Description("Skip files with more replacements than this (default: 100)"),
+		),
+		mcp.WithBoolean("force",
+			mcp.Description("Ignore the limits, replace in files changed since they were indexed and overwrite existing backups (default: false)"),
+		),
+	)
+	h.addTool(s, h.withStore(applyReplaceTool), h.scoped(h.handleApplyReplace))
+
+	// Create workspace tool
+	createWorkspaceTool := mcp.NewTool("create_workspace",
+		mcp.WithDescription("Group several indexed directories under one name, like a multi-root editor workspace, so search_code, index_health and start_webserver can work on them as a unit. Creating a workspace with an existing name replaces its directories."),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the workspace"),
+		),
+		mcp.WithArray("directories",
+			mcp.Required(),
+			mcp.Description("The indexed directories in the workspace"),
+			mcp.WithStringItems(),
+		),
+	)
+	h.addTool(s, h.withStore(createWorkspaceTool), h.scoped(h.handleCreateWorkspace))
+
+	// List workspaces tool
+	listWorkspacesTool := mcp.NewTool("list_workspaces",
+		mcp.WithDescription("List the workspaces and their directories"),
+	)
+	h.addTool(s, h.withStore(listWorkspacesTool), h.scoped(h.handleListWorkspaces))
+
+	// Delete workspace tool
+	deleteWorkspaceTool := mcp.NewTool("delete_workspace",
+		mcp.WithDescription("Delete a workspace. The indexes of its directories are kept"),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the workspace to delete"),
+		),
+	)
+	h.addTool(s, h.withStore(deleteWorkspaceTool), h.scoped(h.handleDeleteWorkspace))
+
+	// Query syntax reference tool
+	syntaxTool := mcp.NewTool("query_syntax",
+		mcp.WithDescription("Get a machine-readable reference of the search_code query syntax: supported atoms, operators and example queries"),
+	)
+	h.addTool(s, syntaxTool, h.handleQuerySyntax)
+
+	// Run query template tool
+	runTemplateTool := mcp.NewTool("run_template",
+		mcp.WithDescription("Run a named query template from the config file, substituting {placeholder} parameters. "+h.describeTemplates()),
+		mcp.WithString("name",
+			mcp.Required(),
+			mcp.Description("Name of the template to run"),
+		),
+		mcp.WithObject("params",
+			mcp.Description("Values for the template placeholders, e.g. {\"name\": \"CreateUser\"}"),
+			mcp.AdditionalProperties(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("directory",
+			mcp.Description("Optional: limit search to a specific indexed directory path"),
+		),
+		mcp.WithString("workspace",
+			mcp.Description("Optional: limit search to the directories of a workspace. Cannot be combined with directory"),
+		),
+		mcp.WithNumber("max_files",
+			mcp.Description("Maximum number of files to return (default: 20)"),
+		),
+		mcp.WithNumber("max_lines_per_file",
+			mcp.Description("Maximum matches to show per file (default: 3)"),
+		),
+		mcp.WithBoolean("files_only",
+			mcp.Description("Only return file paths with their match counts, densest files first (default: false)"),
+		),
+		mcp.WithBoolean("terse",
+			mcp.Description("Only output matched lines, with the counts as structured content (default: false)"),
+		),
+	)
+	h.addTool(s, h.withStore(runTemplateTool), h.scoped(h.handleRunTemplate))
+
+	// Audit log tool
+	auditTool := mcp.NewTool("get_audit_log",
+		mcp.WithDescription("Get recorded tool invocations (tool, parameters, session, duration and outcome), newest last. With session scoping enabled, only the calling session's calls are returned."),
+		mcp.WithString("tool",
+			mcp.Description("Optional: only return calls of this tool"),
+		),
+		mcp.WithString("session",
+			mcp.Description("Optional: only return calls made by this session ID"),
+		),
+		mcp.WithBoolean("errors_only",
+			mcp.Description("Only return failed calls (default: false)"),
+		),
+		mcp.WithNumber("limit",
+			mcp.Description("Maximum number of entries to return (default: 50)"),
+		),
+	)
+	h.addTool(s, auditTool, h.handleGetAuditLog)
+
+	// Pause background activity tool
+	pauseTool := mcp.NewTool("pause_background",
+		mcp.WithDescription("Temporarily halt background activity: scheduled and queued re-indexes and telemetry reports. Useful while benchmarking or on battery. A re-index that is already running finishes first."),
+		mcp.WithNumber("minutes",
+			mcp.Description("Optional: resume automatically after this many minutes. Pauses until resume_background if omitted"),
+		),
+	)
+	h.addTool(s, pauseTool, h.handlePauseBackground)
+
+	// Resume background activity tool
+	resumeTool := mcp.NewTool("resume_background",
+		mcp.WithDescription("Resume background activity halted by pause_background. Schedules that fired while paused run once"),
+	)
+	h.addTool(s, resumeTool, h.handleResumeBackground)
+
+	// Telemetry status tool
+	telemetryTool := mcp.NewTool("telemetry_status",
+		mcp.WithDescription("Show whether anonymous usage telemetry is enabled, where it is sent and exactly what the next report contains"),
+	)
+	h.addTool(s, telemetryTool, h.handleTelemetryStatus)
+
+	// Usage metrics tool
+	usageTool := mcp.NewTool("usage_metrics",
+		mcp.WithDescription("Show how much of what searches matched was returned and how much max_files, max_lines_per_file and max_line_runes left out, in total since the server started and for the last 20 searches, to tune the limits with data"),
+	)
+	h.addTool(s, usageTool, h.handleUsageMetrics)
+
+	// Self-test tool
+	selfTestTool := mcp.NewTool("selftest",
+		mcp.WithDescription("Check that the installation works end to end: index a small built-in sample repository in a scratch directory inside the index directory, run canonical searches (literal, regex, case-sensitive, language, file name, symbol, history) and compare the results with the expected ones. Reports each check as pass, fail or skip (an optional external tool such as universal-ctags or git is missing). The sample and its index are removed afterwards."),
+	)
+	h.addTool(s, h.withStore(selfTestTool), h.scoped(h.handleSelfTest))
+
+	// Start webserver tool
+	startWebserverTool := mcp.NewTool("start_webserver",
+		mcp.WithDescription("Start the Zoekt web server for interactive code search in a browser. The server runs in the background and provides a web UI for searching indexed code. Port can be configured via CODE_INDEX_WEBSERVER_PORT environment variable (default: 6070)."),
+		mcp.WithNumber("port",
+			mcp.Description("Port to run the web server on. Overrides CODE_INDEX_WEBSERVER_PORT env var. Use 0 for random available port."),
+		),
+		mcp.WithString("workspace",
+			mcp.Description("Optional: only serve the indexes of the directories of this workspace"),
+		),
+		mcp.WithString("editor",
+			mcp.Description("Optional: make result links open files at the matching line in a local editor instead of the browser: vscode, vscode-insiders, cursor, windsurf, idea, sublime, or a URL template with {path} and {line} such as myeditor://open?file={path}&line={line}. browser shows files in the browser. Defaults to the editor setting of the config file"),
+		),
+	)
+	h.addTool(s, h.withStore(startWebserverTool), h.scoped(h.handleStartWebserver))
+
+	// Stop webserver tool
+	stopWebserverTool := mcp.NewTool("stop_webserver",
+		mcp.WithDescription("Stop the running Zoekt web server"),
+	)
+	h.addTool(s, h.withStore(stopWebserverTool), h.scoped(h.handleStopWebserver))
+
+	// Webserver status tool
+	webserverStatusTool := mcp.NewTool("webserver_status",
+		mcp.WithDescription("Get the current status of the Zoekt web server"),
+	)
+	h.addTool(s, h.withStore(webserverStatusTool), h.scoped(h.handleWebserverStatus))
+
+	// Session log resources
+	h.registerSessionLog(s)
+
+	// List the tools whose requirements are met
+	h.refreshTools(context.Background())
+}
+
+func (h *Handlers) handleIndexDirectory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	opts, err := h.requestedIndexOptions(ctx, request, directory)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	timeout := time.Duration(request.GetFloat("timeout_seconds", 0) * float64(time.Second))
+
+	// Queue the build and return right away; index_job_status reports it
+	if request.GetBool("async", false) {
+		job, queued := h.submitIndexJob(ctx, directory, request.GetString("store", ""), func(ctx context.Context) (string, error) {
+			return h.indexDirectory(ctx, directory, opts, timeout)
+		})
+		if !queued {
+			return mcp.NewToolResultText(fmt.Sprintf("An index job for %s is already %s: %s\nUse index_job_status with job_id %s to follow it", job.Directory, job.State, job.ID, job.ID)), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Queued index job %s for %s\nUse index_job_status with job_id %s to follow it, or cancel_index_job to stop it", job.ID, job.Directory, job.ID)), nil
+	}
+
+	if report := indexProgressReporter(ctx, request); report != nil {
+		ctx = indexer.WithIndexProgress(ctx, report)
+	}
+	output, err := h.indexDirectory(ctx, directory, opts, timeout)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to index directory: %v", err)), nil
+	}
+	return mcp.NewToolResultText(output), nil
+}
+
+func (h *Handlers) handleIndexDirectories(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directories, err := request.RequireStringSlice("directories")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if len(directories) == 0 {
+		return mcp.NewToolResultError("directories must not be empty"), nil
+	}
+	timeout := time.Duration(request.GetFloat("timeout_seconds", 0) * float64(time.Second))
+	async := request.GetBool("async", false)
+	if report := indexProgressReporter(ctx, request); report != nil && !async {
+		ctx = indexer.WithIndexProgress(ctx, report)
+	}
+
+	var lines []string
+	succeeded := 0
+	seen := make(map[string]bool)
+	for _, directory := range directories {
+		absPath, err := filepath.Abs(directory)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s: failed: %v", directory, err))
+			continue
+		}
+		if seen[absPath] {
+			continue
+		}
+		seen[absPath] = true
+
+		// The rest are left as they are once the call is cancelled
+		if ctx.Err() != nil {
+			lines = append(lines, fmt.Sprintf("%s: not indexed: %v", absPath, ctx.Err()))
+			continue
+		}
+
+		// Each directory keeps the settings it was last indexed with
+		opts, err := h.requestedIndexOptions(ctx, request, directory)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if async {
+			job, queued := h.submitIndexJob(ctx, directory, request.GetString("store", ""), func(ctx context.Context) (string, error) {
+				return h.indexDirectory(ctx, directory, opts, timeout)
+			})
+			if queued {
+				lines = append(lines, fmt.Sprintf("%s: queued as %s", absPath, job.ID))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s: already %s as %s", absPath, job.State, job.ID))
+			}
+			succeeded++
+			continue
+		}
+		if _, err := h.indexDirectory(ctx, directory, opts, timeout); err != nil {
+			lines = append(lines, fmt.Sprintf("%s: failed: %v", absPath, err))
+			continue
+		}
+		succeeded++
+		line := fmt.Sprintf("%s: indexed", absPath)
+		if info := h.indexInfo(ctx, directory); info != nil {
+			line = fmt.Sprintf("%s: indexed %d files", absPath, info.Files)
+			if skipped := skippedSummary(*info); skipped != "" {
+				line += " (" + strings.TrimSpace(skipped) + ")"
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	var output string
+	if async {
+		output = fmt.Sprintf("Queued %d directories; use index_job_status to follow them\n%s", succeeded, strings.Join(lines, "\n"))
+	} else {
+		output = fmt.Sprintf("Indexed %d of %d directories into %s\n%s", succeeded, len(seen), h.managerFor(ctx).GetIndexDir(), strings.Join(lines, "\n"))
+		if succeeded > 0 && !symbolToolAvailable() {
+			output += "\n[No symbol data was built, so sym:, kind: and definition ranking are unavailable: universal-ctags was not found. See external_tools in index_info]"
+		}
+	}
+	if succeeded == 0 {
+		return mcp.NewToolResultError(output), nil
+	}
+	return mcp.NewToolResultText(output), nil
+}
+
+// indexDirectory builds the index of directory with opts, or the options it
+// was last indexed with if opts is nil, stopping once timeout passes if it
+// is positive. It returns the summary of the build.
+func (h *Handlers) indexDirectory(ctx context.Context, directory string, opts *indexer.IndexOptions, timeout time.Duration) (string, error) {
+	// Stop the build once the timeout passes, as when the client cancels
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var err error
+	if opts != nil {
+		err = h.managerFor(ctx).IndexDirectoryWithOptions(ctx, directory, *opts)
+	} else {
+		err = h.managerFor(ctx).IndexDirectory(ctx, directory)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	output := fmt.Sprintf("Successfully indexed directory: %s\nIndex stored in: %s", absPath, h.managerFor(ctx).GetIndexDir())
+	if info := h.indexInfo(ctx, directory); info != nil {
+		output += skippedSummary(*info)
+	}
+	if !symbolToolAvailable() {
+		output += "\n[No symbol data was built, so sym:, kind: and definition ranking are unavailable: universal-ctags was not found. See external_tools in index_info]"
+	}
+	return output, nil
+}
+
+// requestedIndexOptions returns the index options an index_directory call
+// sets, over the options directory was last indexed with. Without
+// tracked_only, ignore_patterns, max_file_size, follow_symlinks and
+// default_excludes, a re-index keeps the settings of the existing index,
+// and nil is returned.
+func (h *Handlers) requestedIndexOptions(ctx context.Context, request mcp.CallToolRequest, directory string) (*indexer.IndexOptions, error) {
+	args := request.GetArguments()
+	_, trackedOnly := args["tracked_only"]
+	_, ignorePatterns := args["ignore_patterns"]
+	maxFileSize, hasMaxFileSize := args["max_file_size"]
+	_, followSymlinks := args["follow_symlinks"]
+	_, defaultExcludes := args["default_excludes"]
+	if !trackedOnly && !ignorePatterns && !hasMaxFileSize && !followSymlinks && !defaultExcludes {
+		return nil, nil
+	}
+
+	opts := h.recordedIndexOptions(ctx, directory)
+	if trackedOnly {
+		opts.TrackedOnly = request.GetBool("tracked_only", false)
+	}
+	if ignorePatterns {
+		opts.IgnorePatterns = request.GetStringSlice("ignore_patterns", nil)
+	}
+	if hasMaxFileSize {
+		size, err := indexer.ParseSize(fmt.Sprint(maxFileSize))
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_file_size: %w", err)
+		}
+		// 0 turns the limit off, rather than falling back to the default
+		opts.MaxFileSize = size
+		if size == 0 {
+			opts.MaxFileSize = -1
+		}
+	}
+	if followSymlinks {
+		opts.FollowSymlinks = request.GetBool("follow_symlinks", false)
+	}
+	if defaultExcludes {
+		opts.NoDefaultExcludes = !request.GetBool("default_excludes", true)
+	}
+	return &opts, nil
+}
+
+// recordedIndexOptions returns the options directory was last indexed
+// with, or the defaults if it is not indexed
+func (h *Handlers) recordedIndexOptions(ctx context.Context, directory string) indexer.IndexOptions {
+	info := h.indexInfo(ctx, directory)
+	if info == nil {
+		return indexer.IndexOptions{}
+	}
+	return indexer.IndexOptions{
+		TrackedOnly:       info.TrackedOnly,
+		IgnorePatterns:    info.IgnorePatterns,
+		MaxFileSize:       info.MaxFileSize,
+		FollowSymlinks:    info.FollowSymlinks,
+		NoDefaultExcludes: info.NoDefaultExcludes,
+	}
+}
+
+// indexInfo returns the index of directory, or nil if it is not indexed
+func (h *Handlers) indexInfo(ctx context.Context, directory string) *indexer.IndexInfo {
+	absPath, err := filepath.Abs(directory)
+	if err != nil {
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = resolved
+	}
+	indexes, err := h.managerFor(ctx).ListIndexes(ctx)
+	if err != nil {
+		return nil
+	}
+	for i := range indexes {
+		if indexes[i].SourceDir == absPath {
+			return &indexes[i]
+		}
+	}
+	return nil
+}
+
+// skippedSummary describes how many files the last build of an index left
+// out or indexed by name only, and why, or returns "" if none
+func skippedSummary(info indexer.IndexInfo) string {
+	total := 0
+	reasons := make([]string, 0, len(info.Skipped))
+	for reason, n := range info.Skipped {
+		total += n
+		reasons = append(reasons, reason)
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(reasons)
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		part := fmt.Sprintf("%d %s", info.Skipped[reason], strings.ReplaceAll(reason, "_", " "))
+		if reason == "over_max_file_size" && info.MaxFileSize > 0 {
+			part += " (" + indexer.FormatSize(info.MaxFileSize) + ")"
+		}
+		parts = append(parts, part)
+	}
+	return fmt.Sprintf("\nSkipped %d files: %s", total, strings.Join(parts, ", "))
+}
+
+// indexProgressReporter returns a callback that forwards the progress of a
+// full build to the client as progress notifications, or nil if the client
+// did not ask for progress
+func indexProgressReporter(ctx context.Context, request mcp.CallToolRequest) func(indexer.IndexProgress) {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return nil
+	}
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return nil
+	}
+
+	token := request.Params.Meta.ProgressToken
+	return func(progress indexer.IndexProgress) {
+		// Progress is best effort; the final result is returned regardless
+		_ = srv.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+			"progressToken": token,
+			"progress":      progress.FilesDone,
+			"total":         progress.FilesTotal,
+			"message":       formatIndexProgress(progress),
+		})
+	}
+}
+
+// formatIndexProgress describes the progress of a build in a line, e.g.
+// "Indexed 120000 of 480000 files (25.0%), about 6m0s left"
+func formatIndexProgress(progress indexer.IndexProgress) string {
+	message := fmt.Sprintf("Indexed %d of %d files (%.1f%%)", progress.FilesDone, progress.FilesTotal, progress.Percent)
+	if progress.ETASeconds > 0 {
+		message += fmt.Sprintf(", about %s left", time.Duration(progress.ETASeconds)*time.Second)
+	}
+	return message
+}
+
+// symbolToolAvailable reports whether a ctags that builds symbol data was
+// found
+func symbolToolAvailable() bool {
+	for _, tool := range indexer.ExternalTools() {
+		if tool.Available() && (tool.Name == "universal-ctags" || tool.Name == "scip-ctags") {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handlers) handleSearchCode(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	query, err := request.RequireString("query")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	directory := request.GetString("directory", "")
+
+	opts := searchOptionsFromRequest(ctx, request)
+	opts.Remote = !request.GetBool("local_only", false)
+	return h.runSearch(ctx, "search_code", query, directory, opts)
+}
+
+// searchOptionsFromRequest reads the shared search parameters from a tool call
+func searchOptionsFromRequest(ctx context.Context, request mcp.CallToolRequest) indexer.SearchOptions {
+	opts := indexer.SearchOptions{
+		MaxFiles:         int(request.GetFloat("max_files", 20)),
+		MaxLinesPerFile:  int(request.GetFloat("max_lines_per_file", 3)),
+		MaxLineLength:    int(request.GetFloat("max_line_runes", 200)),
+		FilesOnly:        request.GetBool("files_only", false),
+		OnePerFile:       request.GetBool("one_per_file", false),
+		Enclosing:        request.GetBool("enclosing", false),
+		RelativePaths:    request.GetBool("relative_paths", false),
+		SmartIdentifiers: request.GetBool("smart_identifiers", false),
+		ExpandAliases:    request.GetBool("expand_aliases", false),
+		SpellFallback:    request.GetString("spell_fallback", ""),
+		Scope:            request.GetString("scope", ""),
+		Language:         request.GetString("language", ""),
+		Terse:            request.GetBool("terse", false),
+		Workspace:        request.GetString("workspace", ""),
+		IgnoreCase:       request.GetBool("ignore_case", false),
+		DotAll:           request.GetBool("dotall", false),
+		OneLine:          !request.GetBool("multiline", true),
+		Owners:           request.GetBool("owners", false),
+		Permalinks:       request.GetBool("permalinks", false),
+		HighlightStart:   request.GetString("highlight_start", ""),
+		HighlightEnd:     request.GetString("highlight_end", ""),
+		OnProgress:       searchProgressReporter(ctx, request),
+		OnQueued:         searchQueueReporter(ctx, request),
+	}
+
+	// Color output highlights matches in color unless markers are given, and
+	// is turned off by NO_COLOR (https://no-color.org)
+	if request.GetBool("color", false) && os.Getenv("NO_COLOR") == "" {
+		opts.Color = true
+		if opts.HighlightStart == "" && opts.HighlightEnd == "" {
+			opts.HighlightStart, opts.HighlightEnd = indexer.ColorHighlightStart, indexer.ColorHighlightEnd
+		}
+	}
+
+	// Either marker implies highlighting, with the default for the other
+	if request.GetBool("highlight", false) || opts.HighlightStart != "" || opts.HighlightEnd != "" {
+		opts.HighlightStart = cmp.Or(opts.HighlightStart, indexer.DefaultHighlightStart)
+		opts.HighlightEnd = cmp.Or(opts.HighlightEnd, indexer.DefaultHighlightEnd)
+	}
+	return opts
+}
+
+// searchProgressReporter returns a callback that forwards early search hits
+// to the client as progress notifications, or nil if the client did not ask
+// for progress
+func searchProgressReporter(ctx context.Context, request mcp.CallToolRequest) func(indexer.SearchProgress) {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return nil
+	}
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return nil
+	}
+
+	token := request.Params.Meta.ProgressToken
+	return func(progress indexer.SearchProgress) {
+		message := fmt.Sprintf("Found %d files so far: %s", progress.FilesFound, strings.Join(progress.NewFiles, ", "))
+		// Progress is best effort; the final result is returned regardless
+		_ = srv.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+			"progressToken": token,
+			"progress":      progress.FilesFound,
+			"message":       message,
+		})
+	}
+}
+
+// searchQueueReporter returns a callback that tells the client where a
+// search waiting for other searches to finish is in the queue, as progress
+// notifications, or nil if the client did not ask for progress. Progress
+// counts the places moved up since the search was queued, out of its first
+// position.
+func searchQueueReporter(ctx context.Context, request mcp.CallToolRequest) func(position int) {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return nil
+	}
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return nil
+	}
+
+	token := request.Params.Meta.ProgressToken
+	var mu sync.Mutex
+	initial := 0
+	return func(position int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if initial == 0 {
+			initial = position
+		}
+		// Progress is best effort; the final result is returned regardless
+		_ = srv.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+			"progressToken": token,
+			"progress":      initial - position,
+			"total":         initial,
+			"message":       fmt.Sprintf("Waiting for other searches to finish: position %d in the queue", position),
+		})
+	}
+}
+
+// runSearch executes a search for tool and formats the result for the tool
+// response
+func (h *Handlers) runSearch(ctx context.Context, tool string, query string, directory string, opts indexer.SearchOptions) (*mcp.CallToolResult, error) {
+	result, err := h.managerFor(ctx).Search(ctx, query, directory, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Search failed: %v", err)), nil
+	}
+	h.recordSearch(ctx, tool, query, directory, opts, result)
+	return searchToolResult(result, opts), nil
+}
+
+// searchToolResult formats a search result for the tool response
+func searchToolResult(result *indexer.SearchResult, opts indexer.SearchOptions) *mcp.CallToolResult {
+	// Terse output is only the matched lines, with the counts alongside
+	if opts.Terse {
+		counts := searchCounts{
+			TotalFiles:      result.TotalFiles,
+			TotalMatches:    result.TotalMatches,
+			TotalsEstimated: result.TotalsEstimated,
+			ShownFiles:      result.ShownFiles,
+			MoreMatches:     result.MoreMatches,
+			ResultID:        result.ID,
+			Owners:          result.Owners,
+			Permalinks:      result.Permalinks,
+			RemoteFiles:     result.RemoteFiles,
+			RemoteErrors:    result.RemoteErrors,
+			Warnings:        result.Warnings,
+			RelativeTo:      result.RelativeTo,
+			Metrics:         result.Metrics,
+			Suggestions:     result.Suggestions,
+
+			CorruptIndexes: result.CorruptIndexes,
+			QueueWaitMS:    result.QueueWait.Milliseconds(),
+		}
+		return mcp.NewToolResultStructured(counts, strings.Join(result.Lines, "\n"))
+	}
+
+	if len(result.Lines) == 0 {
+		return mcp.NewToolResultText("No results found")
+	}
+
+	// Return compact grep-like output
+	output := strings.Join(result.Lines, "\n")
+	if result.ID != "" {
+		output += fmt.Sprintf("\n[result_id %s: use refine_search to search within these files, or open_result to read file N of them, numbered in the order shown]", result.ID)
+	}
+	if result.QueueWait >= minReportedQueueWait {
+		output += fmt.Sprintf("\n[Waited %s for other searches to finish]", result.QueueWait.Round(minReportedQueueWait))
+	}
+	return mcp.NewToolResultText(output)
+}
+
+func (h *Handlers) handleRefineSearch(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	resultID, err := request.RequireString("result_id")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	query, err := request.RequireString("query")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	opts := searchOptionsFromRequest(ctx, request)
+	result, err := h.managerFor(ctx).RefineSearch(ctx, resultID, query, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Search failed: %v", err)), nil
+	}
+	h.recordSearch(ctx, "refine_search", query, "", opts, result)
+	return searchToolResult(result, opts), nil
+}
+
+func (h *Handlers) handleOpenResult(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	resultID, err := request.RequireString("result_id")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	number, err := request.RequireFloat("file")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	file, err := h.managerFor(ctx).OpenResult(ctx, resultID, int(number),
+		int(request.GetFloat("start_line", 1)), int(request.GetFloat("max_lines", 200)))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to open result: %v", err)), nil
+	}
+
+	// Number the lines like search results, so they can be cited
+	endLine := file.StartLine + len(file.Lines) - 1
+	var output strings.Builder
+	fmt.Fprintf(&output, "%s (lines %d-%d of %d)\n", file.Path, file.StartLine, endLine, file.TotalLines)
+	for i, line := range file.Lines {
+		fmt.Fprintf(&output, "%d: %s\n", file.StartLine+i, line)
+	}
+	if endLine < file.TotalLines {
+		fmt.Fprintf(&output, "[use start_line %d to read more]\n", endLine+1)
+	}
+	return mcp.NewToolResultText(output.String()), nil
+}
+
+// searchCounts is the structured content of a terse search result
+type searchCounts struct {
+	TotalFiles      int                   `json:"total_files"`
+	TotalMatches    int                   `json:"total_matches"`
+	TotalsEstimated bool                  `json:"totals_estimated,omitempty"`
+	ShownFiles      int                   `json:"shown_files"`
+	MoreMatches     map[string]int        `json:"more_matches,omitempty"`
+	ResultID        string                `json:"result_id,omitempty"`
+	Owners          map[string][]string   `json:"owners,omitempty"`
+	Permalinks      map[string]string     `json:"permalinks,omitempty"`
+	RemoteFiles     map[string]int        `json:"remote_files,omitempty"`
+	RemoteErrors    []string              `json:"remote_errors,omitempty"`
+	Warnings        []string              `json:"warnings,omitempty"`
+	RelativeTo      string                `json:"relative_to,omitempty"`
+	Metrics         indexer.SearchMetrics `json:"metrics"`
+	Suggestions     []string              `json:"suggestions,omitempty"`
+
+	CorruptIndexes []indexer.CorruptIndex `json:"corrupt_indexes,omitempty"`
+	QueueWaitMS    int64                  `json:"queue_wait_ms,omitempty"`
+}
+
+// minReportedQueueWait is the shortest wait for a search slot noted in
+// search results
+const minReportedQueueWait = 100 * time.Millisecond
+
+// remoteNames returns the names of the remote backends, in config order
+func (h *Handlers) remoteNames() []string {
+	names := make([]string, 0, len(h.remotes))
+	for _, remote := range h.remotes {
+		names = append(names, remote.Name())
+	}
+	return names
+}
+
+// describeTemplates lists the configured templates for the run_template tool description
+func (h *Handlers) describeTemplates() string {
+	if len(h.config.Templates) == 0 {
+		return "No templates are configured; add them under \"templates\" in " + getConfigPath(h.manager.GetIndexDir()) + "."
+	}
+
+	names := make([]string, 0, len(h.config.Templates))
+	for name := range h.config.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		tmpl := h.config.Templates[name]
+		part := fmt.Sprintf("%s(%s)", name, strings.Join(tmpl.Placeholders(), ", "))
+		if tmpl.Description != "" {
+			part += ": " + tmpl.Description
+		}
+		parts = append(parts, part)
+	}
+	return "Available templates: " + strings.Join(parts, "; ")
+}
+
+func (h *Handlers) handleRunTemplate(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	name, err := request.RequireString("name")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	tmpl, ok := h.config.Templates[name]
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("Unknown template %q. %s", name, h.describeTemplates())), nil
+	}
+
+	params := make(map[string]string)
+	if raw, ok := request.GetArguments()["params"].(map[string]any); ok {
+		for key, value := range raw {
+			params[key] = fmt.Sprint(value)
+		}
+	}
+
+	query, err := tmpl.Expand(params)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to expand template %q: %v", name, err)), nil
+	}
+
+	directory := request.GetString("directory", "")
+	return h.runSearch(ctx, "run_template", query, directory, searchOptionsFromRequest(ctx, request))
+}
+
+func (h *Handlers) handleListIndexes(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	indexes, err := h.managerFor(ctx).ListIndexes(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to list indexes: %v", err)), nil
+	}
 
 	if len(indexes) == 0 {
 		return mcp.NewToolResultText("No indexes found. Use 'index_directory' to create an index."), nil
 	}
 
-	output, err := json.MarshalIndent(indexes, "", "  ")
+	output, err := json.MarshalIndent(indexes, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format indexes: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleDeleteIndex(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	if err := h.managerFor(ctx).DeleteIndex(ctx, directory); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to delete index: %v", err)), nil
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	return mcp.NewToolResultText(fmt.Sprintf("Successfully deleted index for: %s", absPath)), nil
+}
+
+func (h *Handlers) handleMoveIndex(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	newDirectory, err := request.RequireString("new_directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	moved, err := h.managerFor(ctx).MoveIndex(ctx, directory, newDirectory)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to move index: %v", err)), nil
+	}
+	// Watches follow the index to its new path
+	if scheduler := h.store(ctx).scheduler; scheduler != nil {
+		scheduler.SyncWatches()
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	newPath, _ := filepath.Abs(newDirectory)
+	message := fmt.Sprintf("Moved the index of %s to %s", absPath, newPath)
+	if moved > 1 {
+		message += fmt.Sprintf(", with %d submodule indexes", moved-1)
+	}
+	return mcp.NewToolResultText(message + ". The next re-index rebuilds its shards under the new name"), nil
+}
+
+func (h *Handlers) handleAttachIndexDir(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	shardDir, err := request.RequireString("shard_dir")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	repository := request.GetString("repository", "")
+
+	if request.GetBool("all_repositories", false) {
+		if repository != "" {
+			return mcp.NewToolResultError("repository cannot be combined with all_repositories"), nil
+		}
+		attached, skipped, err := h.managerFor(ctx).AttachIndexServer(ctx, shardDir, directory)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to attach indexes: %v", err)), nil
+		}
+
+		var output strings.Builder
+		fmt.Fprintf(&output, "Attached %d repositories:\n", len(attached))
+		for _, repo := range attached {
+			fmt.Fprintf(&output, "%s -> %s (%d files, branches: %s)\n", repo.Repository, repo.SourceDir, repo.Files, strings.Join(repo.Branches, ", "))
+		}
+		if len(skipped) > 0 {
+			fmt.Fprintf(&output, "Skipped %d repositories:\n%s\n", len(skipped), strings.Join(skipped, "\n"))
+		}
+		return mcp.NewToolResultText(strings.TrimSuffix(output.String(), "\n")), nil
+	}
+
+	attached, err := h.managerFor(ctx).AttachIndexDir(ctx, shardDir, directory, repository)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to attach index: %v", err)), nil
+	}
+
+	output, err := json.MarshalIndent(attached, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format result: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("Successfully attached %s as the index of %s\n%s", attached.Repository, attached.SourceDir, output)), nil
+}
+
+func (h *Handlers) handleFindTarget(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	file := request.GetString("file", "")
+	target := request.GetString("target", "")
+	directory := request.GetString("directory", "")
+
+	targets, err := h.managerFor(ctx).FindTargets(ctx, directory, file, target)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find targets: %v", err)), nil
+	}
+
+	if len(targets) == 0 {
+		return mcp.NewToolResultText("No matching Bazel targets found"), nil
+	}
+
+	output, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format targets: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleWhoOwns(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	path, err := request.RequireString("path")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	ownership, err := h.managerFor(ctx).WhoOwns(ctx, path)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find owners: %v", err)), nil
+	}
+
+	if ownership.Owners == nil {
+		if ownership.Rule == "" {
+			return mcp.NewToolResultText(fmt.Sprintf("No rule in %s matches %s", ownership.File, ownership.Path)), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("%s has no owners: %s:%d: %s", ownership.Path, ownership.File, ownership.Line, ownership.Rule)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("%s: %s\n(%s:%d: %s)", ownership.Path, strings.Join(ownership.Owners, " "), ownership.File, ownership.Line, ownership.Rule)), nil
+}
+
+func (h *Handlers) handleUsageStats(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	query := request.GetString("query", "")
+	directory := request.GetString("directory", "")
+	opts := indexer.UsageOptions{
+		Symbol:         request.GetString("symbol", ""),
+		Language:       request.GetString("language", ""),
+		Depth:          int(request.GetFloat("depth", 0)),
+		MaxDirectories: int(request.GetFloat("max_directories", 30)),
+	}
+
+	stats, err := h.managerFor(ctx).UsageStats(ctx, directory, query, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to count usage: %v", err)), nil
+	}
+
+	if stats.Matches == 0 {
+		return mcp.NewToolResultText("No matches found"), nil
+	}
+
+	// Return a compact summary, one line per directory
+	var output strings.Builder
+	fmt.Fprintf(&output, "%d matches in %d files; tests: %d matches in %d files, non-test: %d matches in %d files\n",
+		stats.Matches, stats.Files, stats.TestMatches, stats.TestFiles, stats.Matches-stats.TestMatches, stats.Files-stats.TestFiles)
+	for _, dir := range stats.Directories {
+		fmt.Fprintf(&output, "%s: %d matches in %d files", dir.Directory, dir.Matches, dir.Files)
+		if dir.TestMatches > 0 {
+			fmt.Fprintf(&output, " (%d in tests)", dir.TestMatches)
+		}
+		output.WriteString("\n")
+	}
+	if stats.OtherDirectories > 0 {
+		fmt.Fprintf(&output, "[%d more directories. Use max_directories to see more, or depth to group them]\n", stats.OtherDirectories)
+	}
+	return mcp.NewToolResultText(output.String()), nil
+}
+
+func (h *Handlers) handlePossiblyUnreferenced(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory := request.GetString("directory", "")
+	opts := indexer.UnreferencedOptions{
+		Language:      request.GetString("language", ""),
+		MaxCandidates: int(request.GetFloat("max_candidates", 2000)),
+	}
+
+	result, err := h.managerFor(ctx).PossiblyUnreferenced(ctx, directory, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find unreferenced files: %v", err)), nil
+	}
+
+	// Return compact output, one file per line with the names looked for
+	var output strings.Builder
+	fmt.Fprintf(&output, "Heuristic: %d of %d checked files are not mentioned by name or symbol in any other indexed file. Verify before deleting.\n", len(result.Files), result.Checked)
+	if !result.Symbols {
+		output.WriteString("[No symbol data: only file names, and declarations of Go files, were looked for. Install universal-ctags and re-index for better results]\n")
+	}
+	for _, file := range result.Files {
+		fmt.Fprintf(&output, "%s (looked for: %s)\n", file.Path, strings.Join(file.Names, ", "))
+	}
+	if result.Truncated {
+		fmt.Fprintf(&output, "[Only the first %d files were checked. Use max_candidates, language or directory to check the rest]\n", opts.MaxCandidates)
+	}
+	return mcp.NewToolResultText(output.String()), nil
+}
+
+func (h *Handlers) handleSearchHistory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory := request.GetString("directory", "")
+	opts := indexer.HistoryOptions{
+		Message:    request.GetString("message", ""),
+		Added:      request.GetString("added", ""),
+		Changed:    request.GetString("changed", ""),
+		Path:       request.GetString("path", ""),
+		Author:     request.GetString("author", ""),
+		Since:      request.GetString("since", ""),
+		IgnoreCase: request.GetBool("ignore_case", false),
+		MaxCommits: int(request.GetFloat("max_commits", 20)),
+	}
+
+	commits, err := h.managerFor(ctx).SearchHistory(ctx, directory, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to search history: %v", err)), nil
+	}
+
+	if len(commits) == 0 {
+		return mcp.NewToolResultText("No matching commits found"), nil
+	}
+
+	// Return compact output, one line per commit followed by its files and
+	// matching lines; the repository is named when it changes
+	var output strings.Builder
+	repository := ""
+	for _, commit := range commits {
+		if commit.Repository != repository {
+			repository = commit.Repository
+			fmt.Fprintf(&output, "%s:\n", repository)
+		}
+		fmt.Fprintf(&output, "%s %s %s: %s\n", indexer.ShortHash(commit.Hash), commit.Date, commit.Author, commit.Subject)
+		if len(commit.Files) > 0 {
+			fmt.Fprintf(&output, "  files: %s\n", strings.Join(commit.Files, ", "))
+		}
+		for _, line := range commit.Lines {
+			fmt.Fprintf(&output, "  %s\n", line)
+		}
+	}
+	if len(commits) >= opts.MaxCommits {
+		output.WriteString("[More commits may match. Use max_commits, since or path to see them]\n")
+	}
+	return mcp.NewToolResultText(output.String()), nil
+}
+
+func (h *Handlers) handleFindEndpoint(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	text := request.GetString("query", "")
+	method := request.GetString("method", "")
+	directory := request.GetString("directory", "")
+
+	endpoints, err := h.managerFor(ctx).FindEndpoints(ctx, directory, text, method)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find endpoints: %v", err)), nil
+	}
+
+	if len(endpoints) == 0 {
+		return mcp.NewToolResultText("No matching endpoints found"), nil
+	}
+
+	// Return compact grep-like output
+	var lines []string
+	for _, endpoint := range endpoints {
+		line := fmt.Sprintf("%s:%d: %s %s", endpoint.File, endpoint.Line, endpoint.Method, endpoint.Path)
+		if endpoint.OperationID != "" {
+			line += fmt.Sprintf(" (%s)", endpoint.OperationID)
+		}
+		if endpoint.Summary != "" {
+			line += " - " + endpoint.Summary
+		}
+		lines = append(lines, line)
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handleFindMessage(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	name := request.GetString("name", "")
+	field := request.GetString("field", "")
+	directory := request.GetString("directory", "")
+
+	messages, err := h.managerFor(ctx).FindMessages(ctx, directory, name, field)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find messages: %v", err)), nil
+	}
+
+	if len(messages) == 0 {
+		return mcp.NewToolResultText("No matching messages found"), nil
+	}
+
+	// List each message with its fields, indented under it
+	var lines []string
+	for _, message := range messages {
+		lines = append(lines, fmt.Sprintf("%s:%d: %s %s", message.File, message.Line, message.Kind, message.Name))
+		for _, f := range message.Fields {
+			lines = append(lines, strings.TrimRight(fmt.Sprintf("  %d: %s %s", f.Line, f.Type, f.Name), " "))
+		}
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handleFindResource(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	kind := request.GetString("kind", "")
+	name := request.GetString("name", "")
+	directory := request.GetString("directory", "")
+
+	resources, err := h.managerFor(ctx).FindResources(ctx, directory, kind, name)
 	if err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Failed to format indexes: %v", err)), nil
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to find resources: %v", err)), nil
+	}
+
+	if len(resources) == 0 {
+		return mcp.NewToolResultText("No matching resources found"), nil
+	}
+
+	// Return compact grep-like output
+	var lines []string
+	for _, resource := range resources {
+		line := fmt.Sprintf("%s:%d: %s %s", resource.File, resource.Line, resource.Kind, resource.Name)
+		if resource.Namespace != "" {
+			line += fmt.Sprintf(" (namespace %s)", resource.Namespace)
+		}
+		if resource.Source != "" {
+			line += fmt.Sprintf(" (source %s)", resource.Source)
+		}
+		if resource.Module != "" {
+			line += fmt.Sprintf(" in module %s", resource.Module)
+		}
+		lines = append(lines, line)
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handleLicenseReport(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory := request.GetString("directory", "")
+
+	report, err := h.managerFor(ctx).LicenseReport(ctx, directory)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to build license report: %v", err)), nil
+	}
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format report: %v", err)), nil
 	}
 
 	return mcp.NewToolResultText(string(output)), nil
 }
 
-func handleDeleteIndex(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	directory, err := request.RequireString("directory")
+func (h *Handlers) handleStructuralSearch(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	template, err := request.RequireString("template")
 	if err != nil {
 		return mcp.NewToolResultError(err.Error()), nil
 	}
+	directory := request.GetString("directory", "")
+	opts := indexer.StructuralOptions{
+		Language:   request.GetString("language", ""),
+		File:       request.GetString("file", ""),
+		MaxMatches: int(request.GetFloat("max_matches", 50)),
+	}
 
-	if err := manager.DeleteIndex(directory); err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Failed to delete index: %v", err)), nil
+	result, err := h.managerFor(ctx).StructuralSearch(ctx, directory, template, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Structural search failed: %v", err)), nil
 	}
 
-	absPath, _ := filepath.Abs(directory)
-	return mcp.NewToolResultText(fmt.Sprintf("Successfully deleted index for: %s", absPath)), nil
+	if len(result.Matches) == 0 {
+		return mcp.NewToolResultText("No matches found"), nil
+	}
+
+	output := strings.Join(result.Lines, "\n")
+	if result.More {
+		output += fmt.Sprintf("\n\n(showing the first %d matches, use max_matches to see more)", len(result.Matches))
+	}
+	return mcp.NewToolResultText(output), nil
+}
+
+func (h *Handlers) handleASTQuery(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	treeQuery, err := request.RequireString("query")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	directory := request.GetString("directory", "")
+	opts := indexer.ASTOptions{
+		Filter:      request.GetString("filter", ""),
+		Language:    request.GetString("language", ""),
+		MaxCaptures: int(request.GetFloat("max_captures", 50)),
+	}
+
+	result, err := h.managerFor(ctx).QueryAST(ctx, directory, treeQuery, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("AST query failed: %v", err)), nil
+	}
+
+	lines := result.Lines
+	if len(lines) == 0 {
+		lines = append(lines, "No captures found")
+	}
+	if result.More {
+		lines = append(lines, fmt.Sprintf("\n(showing the first %d captures, use max_captures to see more)", len(result.Captures)))
+	}
+	for _, skipped := range result.Skipped {
+		lines = append(lines, "Skipped "+skipped)
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handlePreviewReplace(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	pattern, err := request.RequireString("pattern")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	replacement, err := request.RequireString("replacement")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	directory := request.GetString("directory", "")
+	opts := indexer.ReplaceOptions{
+		Filter:   request.GetString("filter", ""),
+		Language: request.GetString("language", ""),
+		MaxFiles: int(request.GetFloat("max_files", 20)),
+	}
+
+	preview, err := h.managerFor(ctx).PreviewReplace(ctx, directory, pattern, replacement, opts)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to preview replacement: %v", err)), nil
+	}
+
+	if preview.Files == 0 {
+		return mcp.NewToolResultText("No matches would be replaced"), nil
+	}
+
+	summary := fmt.Sprintf("%d replacements in %d files", preview.Replacements, preview.Files)
+	if preview.ShownFiles < preview.Files {
+		summary += fmt.Sprintf(" (showing %d files, use max_files to see more)", preview.ShownFiles)
+	}
+	return mcp.NewToolResultText(summary + "\n\n" + preview.Diff), nil
+}
+
+func (h *Handlers) handleApplyReplace(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	pattern, err := request.RequireString("pattern")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	replacement, err := request.RequireString("replacement")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if !request.GetBool("confirm", false) {
+		return mcp.NewToolResultError("apply_replace changes files; preview the replacement with preview_replace, then call apply_replace again with confirm: true"), nil
+	}
+	directory := request.GetString("directory", "")
+	opts := indexer.ApplyOptions{
+		Filter:     request.GetString("filter", ""),
+		Language:   request.GetString("language", ""),
+		MaxFiles:   int(request.GetFloat("max_files", 20)),
+		MaxPerFile: int(request.GetFloat("max_per_file", 100)),
+		Force:      request.GetBool("force", false),
+	}
+
+	result, err := h.managerFor(ctx).ApplyReplace(ctx, directory, pattern, replacement, opts)
+	if err != nil && result == nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to apply replacement: %v", err)), nil
+	}
+
+	var lines []string
+	for _, file := range result.Replaced {
+		lines = append(lines, fmt.Sprintf("Replaced %d in %s (backup: %s)", file.Replacements, file.Path, file.Backup))
+	}
+	for _, file := range result.Skipped {
+		lines = append(lines, fmt.Sprintf("Skipped %s: %s", file.Path, file.Reason))
+	}
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("Stopped: %v", err))
+	}
+	if len(lines) == 0 {
+		return mcp.NewToolResultText("No matches were replaced"), nil
+	}
+	if len(result.Replaced) > 0 {
+		lines = append(lines, "\nRe-index with index_directory to search the new content")
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handleCreateWorkspace(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	name, err := request.RequireString("name")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	directories, err := request.RequireStringSlice("directories")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	workspace, err := h.managerFor(ctx).CreateWorkspace(ctx, name, directories)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to create workspace: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("Workspace %s now groups: %s", workspace.Name, strings.Join(workspace.Directories, ", "))), nil
+}
+
+func (h *Handlers) handleListWorkspaces(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	workspaces, err := h.managerFor(ctx).ListWorkspaces(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to list workspaces: %v", err)), nil
+	}
+
+	if len(workspaces) == 0 {
+		return mcp.NewToolResultText("No workspaces found. Use 'create_workspace' to create one."), nil
+	}
+
+	output, err := json.MarshalIndent(workspaces, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format workspaces: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleDeleteWorkspace(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	name, err := request.RequireString("name")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	if err := h.managerFor(ctx).DeleteWorkspace(ctx, name); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to delete workspace: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("Successfully deleted workspace: %s", name)), nil
 }
 
-func handleIndexInfo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	info := map[string]string{
-		"index_directory": manager.GetIndexDir(),
+func (h *Handlers) handleIndexInfo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	store := h.store(ctx)
+	info := map[string]any{
+		"index_directory": store.manager.GetIndexDir(),
 		"description":     "All indexes are stored as .zoekt files in the index directory, with unique prefixes per source directory",
 	}
+	if len(h.stores) > 0 {
+		stores := map[string]string{defaultStoreName: h.manager.GetIndexDir()}
+		for name, named := range h.stores {
+			stores[name] = named.manager.GetIndexDir()
+		}
+		info["store"] = store.name
+		info["stores"] = stores
+	}
+	if len(h.remotes) > 0 {
+		info["remotes"] = h.remoteNames()
+	}
+	info["external_tools"] = indexer.ExternalTools()
 
 	output, err := json.MarshalIndent(info, "", "  ")
 	if err != nil {
@@ -226,6 +2280,234 @@ func handleIndexInfo(ctx context.Context, request mcp.CallToolRequest) (*mcp.Cal
 	return mcp.NewToolResultText(string(output)), nil
 }
 
+func (h *Handlers) handleIndexProgress(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	builds, err := h.managerFor(ctx).IndexProgress(ctx, request.GetString("directory", ""))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to get index progress: %v", err)), nil
+	}
+	if len(builds) == 0 {
+		return mcp.NewToolResultText("No full builds in progress"), nil
+	}
+
+	var lines []string
+	for _, build := range builds {
+		line := fmt.Sprintf("%s: %s", build.SourceDir, formatIndexProgress(build))
+		// A build that stopped updating its progress was interrupted, and
+		// resumes on the next index_directory
+		if since := time.Since(build.UpdatedAt); since > time.Minute {
+			line += fmt.Sprintf(" [last update %s ago]", since.Round(time.Second))
+		}
+		lines = append(lines, line)
+	}
+	return mcp.NewToolResultText(strings.Join(lines, "\n")), nil
+}
+
+func (h *Handlers) handleWarmIndex(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory := request.GetString("directory", "")
+
+	result, err := h.managerFor(ctx).WarmIndex(ctx, directory)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to warm index: %v", err)), nil
+	}
+
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format result: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleSetSchedule(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError("directory parameter is required"), nil
+	}
+	schedule := strings.TrimSpace(request.GetString("schedule", ""))
+
+	if err := h.managerFor(ctx).SetSchedule(ctx, directory, schedule); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to set schedule: %v", err)), nil
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	if schedule == "" {
+		return mcp.NewToolResultText(fmt.Sprintf("Removed schedule for: %s", absPath)), nil
+	}
+
+	nextRun := "never"
+	if cron, err := indexer.ParseCron(schedule); err == nil {
+		if next := cron.Next(time.Now()); !next.IsZero() {
+			nextRun = next.Format(time.RFC1123)
+		}
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Scheduled re-indexing of %s at '%s'. Next run: %s",
+		absPath, schedule, nextRun)), nil
+}
+
+func (h *Handlers) handleWatchDirectory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return h.setWatched(ctx, request, true)
+}
+
+func (h *Handlers) handleUnwatchDirectory(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return h.setWatched(ctx, request, false)
+}
+
+// setWatched turns watching of the directory of a tool call on or off, and
+// has the scheduler of its store pick up the change right away
+func (h *Handlers) setWatched(ctx context.Context, request mcp.CallToolRequest, watched bool) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	if err := h.managerFor(ctx).SetWatched(ctx, directory, watched); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to set watching: %v", err)), nil
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	scheduler := h.store(ctx).scheduler
+	switch {
+	case !watched:
+		if scheduler != nil {
+			scheduler.SyncWatches()
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Stopped watching %s", absPath)), nil
+	case scheduler == nil:
+		return mcp.NewToolResultText(fmt.Sprintf("Marked %s as watched; it is re-indexed on changes while the server runs its scheduler", absPath)), nil
+	}
+	scheduler.SyncWatches()
+	return mcp.NewToolResultText(fmt.Sprintf("Watching %s: it is re-indexed in the background when its files change", absPath)), nil
+}
+
+func (h *Handlers) handleMutePath(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	pattern, err := request.RequireString("pattern")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	muted, err := h.managerFor(ctx).MutePaths(ctx, directory, []string{pattern}, request.GetBool("unmute", false))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to mute path: %v", err)), nil
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	if len(muted) == 0 {
+		return mcp.NewToolResultText(fmt.Sprintf("No paths of %s are muted", absPath)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Muted paths of %s: %s", absPath, strings.Join(muted, ", "))), nil
+}
+
+func (h *Handlers) handleSetAlias(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory, err := request.RequireString("directory")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	term, err := request.RequireString("term")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	aliases, err := h.managerFor(ctx).SetAliases(ctx, directory, term, request.GetStringSlice("aliases", nil))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to set alias: %v", err)), nil
+	}
+
+	absPath, _ := filepath.Abs(directory)
+	if len(aliases) == 0 {
+		return mcp.NewToolResultText(fmt.Sprintf("No aliases are set for %s", absPath)), nil
+	}
+	var output strings.Builder
+	fmt.Fprintf(&output, "Aliases of %s:\n", absPath)
+	for _, term := range slices.Sorted(maps.Keys(aliases)) {
+		fmt.Fprintf(&output, "  %s: %s\n", term, strings.Join(aliases[term], ", "))
+	}
+	return mcp.NewToolResultText(strings.TrimRight(output.String(), "\n")), nil
+}
+
+func (h *Handlers) handleIndexHealth(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	directory := request.GetString("directory", "")
+	workspace := request.GetString("workspace", "")
+
+	// A workspace is inspected directory by directory
+	directories := []string{directory}
+	if workspace != "" {
+		if directory != "" {
+			return mcp.NewToolResultError("directory and workspace cannot be combined"), nil
+		}
+		dirs, err := h.managerFor(ctx).WorkspaceDirectories(ctx, workspace)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to get index health: %v", err)), nil
+		}
+		directories = dirs
+	}
+
+	var health []indexer.IndexHealth
+	for _, dir := range directories {
+		dirHealth, err := h.managerFor(ctx).IndexHealth(ctx, dir)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to get index health: %v", err)), nil
+		}
+		health = append(health, dirHealth...)
+	}
+
+	if len(health) == 0 {
+		return mcp.NewToolResultText("No indexes found. Use 'index_directory' to create an index."), nil
+	}
+
+	output, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format health: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleGetAuditLog(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	if h.audit == nil {
+		return mcp.NewToolResultError("Audit logging is disabled (CODE_INDEX_AUDIT_LOG=off)"), nil
+	}
+
+	filter := AuditFilter{
+		Tool:       request.GetString("tool", ""),
+		Session:    request.GetString("session", ""),
+		ErrorsOnly: request.GetBool("errors_only", false),
+		Limit:      request.GetInt("limit", 50),
+	}
+	// Scoped sessions may only review their own calls
+	if h.sessionScope {
+		filter.Session = sessionID(ctx)
+	}
+
+	entries, err := h.audit.Query(filter)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to read audit log: %v", err)), nil
+	}
+
+	if len(entries) == 0 {
+		return mcp.NewToolResultText("No matching audit entries"), nil
+	}
+
+	output, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format audit log: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+func (h *Handlers) handleQuerySyntax(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	output, err := json.MarshalIndent(indexer.QuerySyntax(), "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to format query syntax: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
 // getDefaultWebserverPort returns the default port from env or 6070
 func getDefaultWebserverPort() int {
 	if portStr := os.Getenv("CODE_INDEX_WEBSERVER_PORT"); portStr != "" {
@@ -237,11 +2519,36 @@ func getDefaultWebserverPort() int {
 	return 6070
 }
 
-func handleStartWebserver(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+func (h *Handlers) handleStartWebserver(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	// Get port from request or use default
 	port := int(request.GetFloat("port", float64(getDefaultWebserverPort())))
 
-	status, err := webServerManager.Start(port)
+	// The web UI would serve decrypted code over HTTP
+	if h.managerFor(ctx).Encrypted() {
+		return mcp.NewToolResultError("The web server is not available for encrypted indexes"), nil
+	}
+
+	// A workspace limits the web UI to the indexes of its directories
+	workspace := request.GetString("workspace", "")
+	var repos []string
+	if workspace != "" {
+		var err error
+		if repos, err = h.managerFor(ctx).WorkspaceRepositories(ctx, workspace); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to start web server: %v", err)), nil
+		}
+	}
+
+	webServer := h.store(ctx).webServer
+	if err := webServer.SetEditor(request.GetString("editor", h.config.Editor)); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to start web server: %v", err)), nil
+	}
+
+	// Keep the served indexes decompressed while the server reads them
+	release, err := h.managerFor(ctx).HoldIndexes(repos)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to start web server: %v", err)), nil
+	}
+	status, err := webServer.StartScoped(port, workspace, repos, release)
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("Failed to start web server: %v", err)), nil
 	}
@@ -254,16 +2561,16 @@ func handleStartWebserver(ctx context.Context, request mcp.CallToolRequest) (*mc
 	return mcp.NewToolResultText(fmt.Sprintf("Web server started successfully!\n%s", string(output))), nil
 }
 
-func handleStopWebserver(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	if err := webServerManager.Stop(); err != nil {
+func (h *Handlers) handleStopWebserver(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	if err := h.store(ctx).webServer.Stop(); err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("Failed to stop web server: %v", err)), nil
 	}
 
 	return mcp.NewToolResultText("Web server stopped successfully"), nil
 }
 
-func handleWebserverStatus(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	status := webServerManager.Status()
+func (h *Handlers) handleWebserverStatus(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	status := h.store(ctx).webServer.Status()
 
 	output, err := json.MarshalIndent(status, "", "  ")
 	if err != nil {
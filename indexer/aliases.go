@@ -0,0 +1,140 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// aliasTerm matches a term or alias: words of letters, digits, _, - and .
+// separated by single spaces
+var aliasTerm = regexp.MustCompile(`^[A-Za-z0-9_.\-]+(?: [A-Za-z0-9_.\-]+)*$`)
+
+// normalizeAlias collapses the spaces of a term or alias and checks that it
+// can be searched for
+func normalizeAlias(term string) (string, error) {
+	normalized := strings.Join(strings.Fields(term), " ")
+	if !aliasTerm.MatchString(normalized) {
+		return "", fmt.Errorf("invalid alias %q: only letters, digits, '_', '-', '.' and spaces are allowed", term)
+	}
+	return normalized, nil
+}
+
+// SetAliases sets the other names term is searched for by in the index of
+// sourceDir when expand_aliases is set, e.g. kubernetes for k8s, or removes
+// the aliases of term if aliases is empty. Aliases apply both ways: a search
+// for an alias also finds term. They take effect with the next search and
+// are kept when the directory is re-indexed. It returns the aliases of the
+// index afterwards.
+func (m *IndexManager) SetAliases(ctx context.Context, sourceDir string, term string, aliases []string) (map[string][]string, error) {
+	if sourceDir == "" {
+		return nil, fmt.Errorf("a directory is required")
+	}
+	key, err := normalizeAlias(term)
+	if err != nil {
+		return nil, err
+	}
+	key = strings.ToLower(key)
+	var names []string
+	for _, alias := range aliases {
+		name, err := normalizeAlias(alias)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(name) != key && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string][]string
+	err = m.updateMetadata(prefixes[0], func(meta *indexMetadata) {
+		if names == nil {
+			delete(meta.Aliases, key)
+		} else {
+			if meta.Aliases == nil {
+				meta.Aliases = make(map[string][]string)
+			}
+			meta.Aliases[key] = names
+		}
+		if len(meta.Aliases) == 0 {
+			meta.Aliases = nil
+		}
+		result = maps.Clone(meta.Aliases)
+	})
+	return result, err
+}
+
+// aliasGroups returns the names each term is searched for by in the
+// indexes named searched, by lower case term. Every name of a group maps to
+// all of them, the term first.
+func aliasGroups(metadata map[string]*indexMetadata, searched []string) map[string][]string {
+	groups := make(map[string][]string)
+	add := func(key string, names []string) {
+		for _, name := range names {
+			if !slices.ContainsFunc(groups[key], func(n string) bool { return strings.EqualFold(n, name) }) {
+				groups[key] = append(groups[key], name)
+			}
+		}
+	}
+	for _, prefix := range searched {
+		meta, ok := metadata[prefix]
+		if !ok {
+			continue
+		}
+		for term, aliases := range meta.Aliases {
+			names := append([]string{term}, aliases...)
+			for _, name := range names {
+				add(strings.ToLower(name), names)
+			}
+		}
+	}
+	return groups
+}
+
+// expandAliases replaces the terms of queryStr that have aliases, as plain
+// words or quoted phrases, with an OR of all their names
+func expandAliases(queryStr string, groups map[string][]string) string {
+	if len(groups) == 0 {
+		return queryStr
+	}
+	tokens := queryTokens(queryStr)
+	expanded := false
+	for i, token := range tokens {
+		term := token
+		if len(term) > 2 && term[0] == '"' && term[len(term)-1] == '"' {
+			term = strings.Join(strings.Fields(term[1:len(term)-1]), " ")
+		}
+		names, ok := groups[strings.ToLower(term)]
+		if !ok {
+			continue
+		}
+		patterns := make([]string, len(names))
+		for j, name := range names {
+			patterns[j] = aliasPattern(name)
+		}
+		tokens[i] = "(" + strings.Join(patterns, " or ") + ")"
+		expanded = true
+	}
+	if !expanded {
+		return queryStr
+	}
+	return strings.Join(tokens, " ")
+}
+
+// aliasPattern returns a query pattern matching name, with its words
+// separated by any whitespace
+func aliasPattern(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return strings.Join(words, `\s+`)
+}
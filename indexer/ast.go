@@ -0,0 +1,250 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultASTCaptures is the number of captures returned by default
+const defaultASTCaptures = 50
+
+// ErrNoTreeSitter is returned when the tree-sitter CLI is not installed
+var ErrNoTreeSitter = errors.New("AST queries need the tree-sitter CLI with the grammars of the queried languages; install it (e.g. npm install -g tree-sitter-cli), run tree-sitter init-config and add the grammars to its parser-directories, or set CODE_INDEX_TREE_SITTER to the binary")
+
+// treeSitterCapture matches a capture printed by tree-sitter query
+// --captures, e.g. "capture: 0 - call, start: (3, 1), end: (3, 14)". Rows
+// and columns count from 0, columns in bytes.
+var treeSitterCapture = regexp.MustCompile(`capture: (?:\d+ - )?([^,\s]+), start: \((\d+), (\d+)\), end: \((\d+), (\d+)\)`)
+
+// ASTOptions narrows down the files a tree-sitter query runs over
+type ASTOptions struct {
+	Filter        string // Search query the files must match, e.g. "exec.Command"
+	Language      string // Only query files of this language (name or alias)
+	MaxCaptures   int    // Maximum number of captures to return (default: 50)
+	MaxLineLength int    // Truncate captured code longer than this many runes (default: 200)
+}
+
+// ASTCapture is a node captured by a tree-sitter query
+type ASTCapture struct {
+	File      string `json:"file"`
+	Name      string `json:"name"` // Capture name without the @
+	Line      int    `json:"line"` // Lines and columns count from 1
+	Column    int    `json:"column"`
+	EndLine   int    `json:"end_line"`
+	EndColumn int    `json:"end_column"`
+	Text      string `json:"text"`
+}
+
+// ASTResult holds the captures of a tree-sitter query
+type ASTResult struct {
+	Captures []ASTCapture
+	More     bool     // Captures were left out beyond MaxCaptures
+	Skipped  []string // Why files of some extensions were not queried
+	// Lines is the compact output: "file:line:column: @name code" per
+	// capture, with the code on one line
+	Lines []string
+}
+
+// astFile is a candidate file of a tree-sitter query
+type astFile struct {
+	path    string // Path in the source directory
+	content []byte
+}
+
+// QueryAST runs a tree-sitter query over the files of the index of
+// sourceDir, or of all indexes, that match opts. The files are read from
+// the index and parsed by the tree-sitter CLI, which picks the grammar by
+// file extension.
+func (m *IndexManager) QueryAST(ctx context.Context, sourceDir string, treeQuery string, opts ASTOptions) (*ASTResult, error) {
+	if opts.MaxCaptures <= 0 {
+		opts.MaxCaptures = defaultASTCaptures
+	}
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = 200
+	}
+	if strings.TrimSpace(treeQuery) == "" {
+		return nil, errors.New("the tree-sitter query is empty")
+	}
+	if opts.Filter == "" && opts.Language == "" {
+		return nil, errors.New("either a filter or a language is needed to pick the files to query")
+	}
+	binary, err := treeSitterBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Narrow the files down with the index, as a search would
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := m.parseSearchQuery(opts.Filter, SearchOptions{Language: opts.Language}, m.visibleMetadata(ctx), prefixes, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the files by extension, so each run of the CLI needs one grammar
+	groups := map[string][]astFile{}
+	var extensions []string
+	err = m.wholeFiles(ctx, sourceDir, parsed.q, func(path string, content []byte) {
+		ext := filepath.Ext(path)
+		if _, ok := groups[ext]; !ok {
+			extensions = append(extensions, ext)
+		}
+		groups[ext] = append(groups[ext], astFile{path: path, content: content})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "code-index-ast-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	queryPath := filepath.Join(tmpDir, "query.scm")
+	if err := os.WriteFile(queryPath, []byte(treeQuery), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write query: %w", err)
+	}
+
+	result := &ASTResult{}
+	var firstErr error
+	for _, ext := range extensions {
+		captures, err := runTreeSitter(ctx, binary, tmpDir, queryPath, groups[ext])
+		if err != nil {
+			// The query may only fit the grammar of some of the files
+			if firstErr == nil {
+				firstErr = err
+			}
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s files: %v", extensionLabel(ext), err))
+			continue
+		}
+		for _, capture := range captures {
+			if len(result.Captures) >= opts.MaxCaptures {
+				result.More = true
+				break
+			}
+			result.Captures = append(result.Captures, capture)
+		}
+	}
+	if len(result.Captures) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+
+	for _, capture := range result.Captures {
+		result.Lines = append(result.Lines, fmt.Sprintf("%s:%d:%d: @%s %s", capture.File, capture.Line, capture.Column, capture.Name, oneLine(capture.Text, opts.MaxLineLength)))
+	}
+	return result, nil
+}
+
+// treeSitterBinary returns the tree-sitter CLI from CODE_INDEX_TREE_SITTER,
+// the PATH or the common install locations
+func treeSitterBinary() (string, error) {
+	path := externalTool(toolTreeSitter)
+	if path == "" {
+		return "", ErrNoTreeSitter
+	}
+	return path, nil
+}
+
+// runTreeSitter runs the query over files of one extension. The files are
+// written to dir under their own names, so the CLI picks their grammar.
+func runTreeSitter(ctx context.Context, binary string, dir string, queryPath string, files []astFile) ([]ASTCapture, error) {
+	byTempPath := map[string]astFile{}
+	args := []string{"query", "--captures", queryPath}
+	for _, file := range files {
+		fileDir, err := os.MkdirTemp(dir, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp dir: %w", err)
+		}
+		tempPath := filepath.Join(fileDir, filepath.Base(file.path))
+		if err := os.WriteFile(tempPath, file.content, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write file: %w", err)
+		}
+		byTempPath[tempPath] = file
+		args = append(args, tempPath)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			// Name the files by their own paths rather than the temp paths
+			for tempPath, file := range byTempPath {
+				msg = strings.ReplaceAll(msg, tempPath, file.path)
+			}
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("tree-sitter failed: %w", err)
+	}
+
+	// Captures are listed under the path of their file
+	var captures []ASTCapture
+	var current *astFile
+	scanner := bufio.NewScanner(&stdout)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if file, ok := byTempPath[strings.TrimSpace(line)]; ok {
+			current = &file
+			continue
+		}
+		match := treeSitterCapture.FindStringSubmatch(line)
+		if match == nil || current == nil {
+			continue
+		}
+		startRow, _ := strconv.Atoi(match[2])
+		startCol, _ := strconv.Atoi(match[3])
+		endRow, _ := strconv.Atoi(match[4])
+		endCol, _ := strconv.Atoi(match[5])
+		captures = append(captures, ASTCapture{
+			File:      current.path,
+			Name:      match[1],
+			Line:      startRow + 1,
+			Column:    startCol + 1,
+			EndLine:   endRow + 1,
+			EndColumn: endCol + 1,
+			Text:      textBetween(current.content, startRow, startCol, endRow, endCol),
+		})
+	}
+	return captures, nil
+}
+
+// textBetween returns the content between two 0-based row and byte column
+// positions
+func textBetween(content []byte, startRow int, startCol int, endRow int, endCol int) string {
+	offset := func(row int, col int) int {
+		pos := 0
+		for ; row > 0; row-- {
+			next := bytes.IndexByte(content[pos:], '\n')
+			if next < 0 {
+				return len(content)
+			}
+			pos += next + 1
+		}
+		return min(pos+col, len(content))
+	}
+	start, end := offset(startRow, startCol), offset(endRow, endCol)
+	if start > end {
+		return ""
+	}
+	return string(content[start:end])
+}
+
+// extensionLabel names the files of an extension in messages
+func extensionLabel(ext string) string {
+	if ext == "" {
+		return "extensionless"
+	}
+	return ext
+}
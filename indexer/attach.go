@@ -0,0 +1,256 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// AttachedIndex describes a repository of externally built shards attached
+// as an index
+type AttachedIndex struct {
+	Repository string   `json:"repository"` // Repository name stored in the shards
+	SourceDir  string   `json:"source_dir"` // Directory results are reported under
+	ShardDir   string   `json:"shard_dir"`
+	Shards     int      `json:"shards"`
+	Files      int      `json:"files"`
+	Bytes      int64    `json:"bytes"`
+	Branches   []string `json:"branches,omitempty"`
+}
+
+// externalRepo is a repository found in the shards of an external directory
+type externalRepo struct {
+	repo      *zoekt.Repository
+	shards    []string
+	indexTime time.Time // When the newest shard was built
+}
+
+// AttachIndexDir registers the shards of repository in shardDir, built by
+// other Zoekt tooling such as zoekt-git-index, as the index of sourceDir,
+// which is usually a checkout of the repository. The shards are linked
+// rather than copied, so rebuilding them in place updates the index;
+// attaching again picks up shards that were added or removed. repository
+// may be empty if shardDir holds a single repository.
+func (m *IndexManager) AttachIndexDir(ctx context.Context, shardDir string, sourceDir string, repository string) (*AttachedIndex, error) {
+	shardDir, repos, err := m.readShardDir(shardDir)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := resolvePath(sourceDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	if repository == "" {
+		if len(repos) > 1 {
+			return nil, fmt.Errorf("%s holds several repositories, pick one: %s", shardDir, strings.Join(slices.Sorted(maps.Keys(repos)), ", "))
+		}
+		for name := range repos {
+			repository = name
+		}
+	}
+	external, ok := repos[repository]
+	if !ok {
+		return nil, fmt.Errorf("repository %q not found in %s, available: %s", repository, shardDir, strings.Join(slices.Sorted(maps.Keys(repos)), ", "))
+	}
+	return m.attachRepo(ctx, shardDir, external, absPath)
+}
+
+// AttachIndexServer attaches every repository in shardDir, laid out the way
+// zoekt-indexserver writes its index directory: the shards of many
+// repositories, named like "github.com/org/repo", each holding one or more
+// branches. The index of each repository is reported under its name below
+// root, e.g. root/github.com/org/repo, matching where zoekt-mirror clones
+// it. Repositories that cannot be attached are listed in skipped.
+func (m *IndexManager) AttachIndexServer(ctx context.Context, shardDir string, root string) (attached []*AttachedIndex, skipped []string, err error) {
+	shardDir, repos, err := m.readShardDir(shardDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err = resolvePath(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(repos)) {
+		if err := ctx.Err(); err != nil {
+			return attached, skipped, err
+		}
+		sourceDir := filepath.Join(root, filepath.FromSlash(name))
+		repo, err := m.attachRepo(ctx, shardDir, repos[name], sourceDir)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		attached = append(attached, repo)
+	}
+	return attached, skipped, nil
+}
+
+// readShardDir returns the resolved path of a directory of external shards
+// and its repositories
+func (m *IndexManager) readShardDir(shardDir string) (string, map[string]*externalRepo, error) {
+	shardDir, err := resolvePath(shardDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	if shardDir == m.indexDir {
+		return "", nil, errors.New("the shard directory is the index directory itself")
+	}
+	repos, err := readExternalShards(shardDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(repos) == 0 {
+		return "", nil, fmt.Errorf("no Zoekt shards found in %s", shardDir)
+	}
+	return shardDir, repos, nil
+}
+
+// attachRepo links the shards of an external repository and records them
+// as the index of sourceDir
+func (m *IndexManager) attachRepo(ctx context.Context, shardDir string, external *externalRepo, sourceDir string) (*AttachedIndex, error) {
+	repository := external.repo.Name
+
+	// The shards keep their repository name, which must not be taken by
+	// another index
+	prefix := m.getIndexPrefix(sourceDir)
+	for other, meta := range m.loadAllMetadata() {
+		switch {
+		case other == repository:
+			return nil, fmt.Errorf("repository name %q is already used by a local index", repository)
+		case other != prefix && meta.SharedWith == repository && meta.Attached != "":
+			return nil, fmt.Errorf("repository %q is already attached as the index of %s; delete that index first", repository, meta.SourceDir)
+		}
+	}
+
+	if err := m.linkExternalShards(repository, external.shards); err != nil {
+		return nil, err
+	}
+	attached := &AttachedIndex{
+		Repository: repository,
+		SourceDir:  sourceDir,
+		ShardDir:   shardDir,
+		Shards:     len(external.shards),
+	}
+	for _, branch := range external.repo.Branches {
+		attached.Branches = append(attached.Branches, branch.Name)
+	}
+	attached.Files, attached.Bytes = externalRepoStats(ctx, repository, external.shards)
+
+	meta := &indexMetadata{
+		Files:      attached.Files,
+		Bytes:      attached.Bytes,
+		IndexedAt:  external.indexTime,
+		SharedWith: repository,
+		Attached:   shardDir,
+	}
+	if owner := ownerFromContext(ctx); owner != "" {
+		meta.Owners = []string{owner}
+	}
+	if err := m.saveIndexMetadata(sourceDir, meta); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return attached, nil
+}
+
+// readExternalShards returns the live repositories of the shards in dir by
+// name, with the shards holding them
+func readExternalShards(dir string) (map[string]*externalRepo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard directory: %w", err)
+	}
+	repos := make(map[string]*externalRepo)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".zoekt") {
+			continue
+		}
+		shard := filepath.Join(dir, entry.Name())
+		shardRepos, shardMeta, err := index.ReadMetadataPathAlive(shard)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard %s: %w", entry.Name(), err)
+		}
+		for _, repo := range shardRepos {
+			if repos[repo.Name] == nil {
+				repos[repo.Name] = &externalRepo{repo: repo}
+			}
+			repos[repo.Name].shards = append(repos[repo.Name].shards, shard)
+			if shardMeta.IndexTime.After(repos[repo.Name].indexTime) {
+				repos[repo.Name].indexTime = shardMeta.IndexTime
+			}
+		}
+	}
+	return repos, nil
+}
+
+// linkExternalShards replaces the links to the shards of repository in the
+// index directory with links to shards
+func (m *IndexManager) linkExternalShards(repository string, shards []string) error {
+	if err := os.MkdirAll(m.indexDir, 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+	existing, err := m.shardFiles(repository)
+	if err != nil {
+		return err
+	}
+	for _, shard := range existing {
+		if info, err := os.Lstat(shard); err == nil && info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("shard %s already exists in the index directory", filepath.Base(shard))
+		}
+		if err := removeShard(shard); err != nil {
+			return fmt.Errorf("failed to remove old link: %w", err)
+		}
+	}
+
+	// Zoekt keeps metadata updated without a rebuild in .meta files
+	for _, shard := range shards {
+		for _, file := range []string{shard, shard + ".meta"} {
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+			if err := os.Symlink(file, filepath.Join(m.indexDir, filepath.Base(file))); err != nil {
+				return fmt.Errorf("failed to link shard: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// externalRepoStats counts the documents and content bytes of repository in
+// its shards. Counts that cannot be read are left out.
+func externalRepoStats(ctx context.Context, repository string, shards []string) (int, int64) {
+	files, bytes := 0, int64(0)
+	for _, shard := range shards {
+		f, err := os.Open(shard)
+		if err != nil {
+			continue
+		}
+		indexFile, err := index.NewIndexFile(f)
+		if err != nil {
+			continue
+		}
+		searcher, err := index.NewSearcher(indexFile)
+		if err != nil {
+			indexFile.Close()
+			continue
+		}
+		list, err := searcher.List(ctx, query.NewRepoSet(repository), nil)
+		if err == nil {
+			for _, entry := range list.Repos {
+				files += entry.Stats.Documents
+				bytes += entry.Stats.ContentBytes
+			}
+		}
+		searcher.Close()
+	}
+	return files, bytes
+}
@@ -0,0 +1,75 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotSupported is returned by backends for operations they do not
+// implement
+var ErrNotSupported = errors.New("not supported by this index backend")
+
+// Backend is what the MCP tools need from an index. IndexManager implements
+// it on shards in an index directory, and MemoryIndex in memory, for tests
+// and for embedders that have no index directory.
+type Backend interface {
+	// Configuration applied by the handlers before serving
+	SetBuildOptions(opts BuildOptions)
+	SetRemotes(remotes []Remote)
+	SetPathMappings(mappings []PathMapping)
+	SetHooks(hooks []HookConfig)
+	SetSearchLimiter(limiter *SearchLimiter)
+	GetIndexDir() string
+	Encrypted() bool
+	Close() error
+
+	// Building and managing indexes
+	IndexDirectory(ctx context.Context, sourceDir string) error
+	IndexDirectoryWithOptions(ctx context.Context, sourceDir string, opts IndexOptions) error
+	Building(sourceDir string) bool
+	ListIndexes(ctx context.Context) ([]IndexInfo, error)
+	DeleteIndex(ctx context.Context, sourceDir string) error
+	MoveIndex(ctx context.Context, oldDir string, newDir string) (int, error)
+	AttachIndexDir(ctx context.Context, shardDir string, sourceDir string, repository string) (*AttachedIndex, error)
+	AttachIndexServer(ctx context.Context, shardDir string, root string) (attached []*AttachedIndex, skipped []string, err error)
+	SetSchedule(ctx context.Context, sourceDir string, schedule string) error
+	SetWatched(ctx context.Context, sourceDir string, watched bool) error
+	MutePaths(ctx context.Context, sourceDir string, patterns []string, unmute bool) ([]string, error)
+	SetAliases(ctx context.Context, sourceDir string, term string, aliases []string) (map[string][]string, error)
+	WarmIndex(ctx context.Context, sourceDir string) (*WarmResult, error)
+	HoldIndexes(repos []string) (func(), error)
+	IndexHealth(ctx context.Context, sourceDir string) ([]IndexHealth, error)
+	IndexProgress(ctx context.Context, sourceDir string) ([]IndexProgress, error)
+	ProjectStatus(ctx context.Context, path string) (*ProjectStatus, error)
+
+	// Searching
+	Search(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions) (*SearchResult, error)
+	RefineSearch(ctx context.Context, resultID string, queryStr string, opts SearchOptions) (*SearchResult, error)
+	OpenResult(ctx context.Context, resultID string, number int, startLine int, maxLines int) (*OpenedFile, error)
+	SearchHistory(ctx context.Context, sourceDir string, opts HistoryOptions) ([]HistoryCommit, error)
+	UsageStats(ctx context.Context, sourceDir string, queryStr string, opts UsageOptions) (*UsageStats, error)
+	PossiblyUnreferenced(ctx context.Context, sourceDir string, opts UnreferencedOptions) (*UnreferencedResult, error)
+	StructuralSearch(ctx context.Context, sourceDir string, template string, opts StructuralOptions) (*StructuralResult, error)
+	QueryAST(ctx context.Context, sourceDir string, treeQuery string, opts ASTOptions) (*ASTResult, error)
+
+	// Data recorded when indexing
+	FindTargets(ctx context.Context, sourceDir string, file string, target string) ([]BazelTarget, error)
+	WhoOwns(ctx context.Context, file string) (*CodeOwnership, error)
+	FindEndpoints(ctx context.Context, sourceDir string, text string, method string) ([]Endpoint, error)
+	FindMessages(ctx context.Context, sourceDir string, name string, field string) ([]SchemaMessage, error)
+	FindResources(ctx context.Context, sourceDir string, kind string, name string) ([]Resource, error)
+	LicenseReport(ctx context.Context, sourceDir string) (*LicenseReport, error)
+
+	// Rewriting code
+	PreviewReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ReplaceOptions) (*ReplacePreview, error)
+	ApplyReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ApplyOptions) (*ReplaceResult, error)
+
+	// Workspaces
+	CreateWorkspace(ctx context.Context, name string, dirs []string) (*Workspace, error)
+	ListWorkspaces(ctx context.Context) ([]Workspace, error)
+	DeleteWorkspace(ctx context.Context, name string) error
+	WorkspaceDirectories(ctx context.Context, name string) ([]string, error)
+	WorkspaceRepositories(ctx context.Context, name string) ([]string, error)
+}
+
+var _ Backend = (*IndexManager)(nil)
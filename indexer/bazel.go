@@ -0,0 +1,545 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// bazelWorkspaceFiles mark the root of a Bazel workspace
+var bazelWorkspaceFiles = []string{"MODULE.bazel", "WORKSPACE.bazel", "WORKSPACE"}
+
+// bazelBuildFiles declare a Bazel package, in order of precedence
+var bazelBuildFiles = []string{"BUILD.bazel", "BUILD"}
+
+// BazelTarget is a rule declared in a Bazel BUILD file, with the source
+// files it lists
+type BazelTarget struct {
+	Label     string   `json:"label"`                // e.g. //server/http:handlers
+	Kind      string   `json:"kind"`                 // Rule, e.g. go_library
+	Files     []string `json:"files,omitempty"`      // srcs and hdrs, relative to the workspace root
+	SourceDir string   `json:"source_dir,omitempty"` // Workspace root, set by FindTargets
+}
+
+// ruleCall matches the start of a top-level rule call in a BUILD file
+var ruleCall = regexp.MustCompile(`(?m)^([A-Za-z_][A-Za-z0-9_.]*)\s*\(`)
+
+// ruleAttr matches the start of an attribute of a rule call
+var ruleAttr = regexp.MustCompile(`(?:^|[,(\s])([A-Za-z_][A-Za-z0-9_]*)\s*=\s*`)
+
+// stringLiteral matches a Starlark string literal
+var stringLiteral = regexp.MustCompile(`"((?:[^"\\\n]|\\.)*)"|'((?:[^'\\\n]|\\.)*)'`)
+
+// globCall matches the start of a glob() call in an attribute
+var globCall = regexp.MustCompile(`\bglob\s*\(`)
+
+// isBazelWorkspace reports whether root is the root of a Bazel workspace
+func isBazelWorkspace(root string) bool {
+	for _, name := range bazelWorkspaceFiles {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bazelTargets parses the BUILD files under walkRoot, a Bazel workspace
+// root, leaving out directories filter excludes
+func bazelTargets(ctx context.Context, walkRoot string, filter *sourceFilter) ([]BazelTarget, error) {
+	// Map each package to its files, which are not in a nested package
+	packages := make(map[string][]string)
+	err := filepath.WalkDir(walkRoot, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(walkRoot, p)
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if rel != "." && (strings.HasPrefix(entry.Name(), ".") || isSkippedDir(entry.Name()) || filter.excludes(rel, true)) {
+				return filepath.SkipDir
+			}
+			if bazelBuildFile(p) != "" {
+				packages[filepath.ToSlash(rel)] = nil
+			}
+			return nil
+		}
+		if filter.excludes(rel, false) {
+			return nil
+		}
+		pkg := path.Dir(filepath.ToSlash(rel))
+		for {
+			if _, ok := packages[pkg]; ok {
+				packages[pkg] = append(packages[pkg], filepath.ToSlash(rel))
+				break
+			}
+			if pkg == "." {
+				break
+			}
+			pkg = path.Dir(pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find BUILD files: %w", err)
+	}
+
+	var targets []BazelTarget
+	for _, pkg := range slices.Sorted(maps.Keys(packages)) {
+		buildFile := bazelBuildFile(filepath.Join(walkRoot, filepath.FromSlash(pkg)))
+		content, err := os.ReadFile(buildFile)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, parseBuildFile(pkg, string(content), packages[pkg])...)
+	}
+	return targets, nil
+}
+
+// bazelBuildFile returns the BUILD file of the package in dir, or "" if
+// dir is not a package
+func bazelBuildFile(dir string) string {
+	for _, name := range bazelBuildFiles {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// parseBuildFile returns the rules with a name declared in the BUILD file
+// of package pkg, whose files are files. Only string literals and glob()
+// calls in srcs and hdrs are understood; files generated by other rules are
+// left out.
+func parseBuildFile(pkg string, content string, files []string) []BazelTarget {
+	content = stripStarlarkComments(content)
+	labelPkg := pkg
+	if pkg == "." {
+		labelPkg = ""
+	}
+
+	var targets []BazelTarget
+	for _, loc := range ruleCall.FindAllStringSubmatchIndex(content, -1) {
+		kind := content[loc[2]:loc[3]]
+		end := closingParen(content, loc[1]-1)
+		if kind == "load" || kind == "package" || end < 0 {
+			continue
+		}
+		attrs := ruleAttributes(content[loc[1]:end])
+		name, ok := starlarkString(attrs["name"])
+		if !ok {
+			continue
+		}
+
+		target := BazelTarget{Label: "//" + labelPkg + ":" + name, Kind: kind}
+		for _, attr := range []string{"srcs", "hdrs"} {
+			for _, file := range attributeFiles(attrs[attr], labelPkg, files) {
+				if !slices.Contains(target.Files, file) {
+					target.Files = append(target.Files, file)
+				}
+			}
+		}
+		slices.Sort(target.Files)
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// stripStarlarkComments removes # comments, keeping string literals intact
+func stripStarlarkComments(content string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(content) {
+				b.WriteByte(c)
+				i++
+				c = content[i]
+			} else if c == quote || c == '\n' {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			if i < len(content) {
+				b.WriteByte('\n')
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// closingParen returns the index of the bracket closing the one at open in
+// s, skipping string literals, or -1
+func closingParen(s string, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ruleAttributes splits the arguments of a rule call into its attributes
+// and their value expressions
+func ruleAttributes(args string) map[string]string {
+	attrs := make(map[string]string)
+	for i := 0; i < len(args); {
+		loc := ruleAttr.FindStringSubmatchIndex(args[i:])
+		if loc == nil {
+			break
+		}
+		name := args[i+loc[2] : i+loc[3]]
+		start := i + loc[1]
+		end := expressionEnd(args, start)
+		attrs[name] = strings.TrimSpace(args[start:end])
+		i = end
+	}
+	return attrs
+}
+
+// expressionEnd returns the end of the expression starting at start in
+// args, at the next comma outside brackets and strings
+func expressionEnd(args string, start int) int {
+	for i := start; i < len(args); i++ {
+		switch args[i] {
+		case '"', '\'':
+			loc := stringLiteral.FindStringIndex(args[i:])
+			if loc == nil || loc[0] != 0 {
+				return len(args)
+			}
+			i += loc[1] - 1
+		case '(', '[', '{':
+			end := closingParen(args, i)
+			if end < 0 {
+				return len(args)
+			}
+			i = end
+		case ',':
+			return i
+		}
+	}
+	return len(args)
+}
+
+// starlarkString returns the value of expr if it is a string literal
+func starlarkString(expr string) (string, bool) {
+	match := stringLiteral.FindStringSubmatch(expr)
+	if match == nil || len(match[0]) != len(expr) {
+		return "", false
+	}
+	return match[1] + match[2], true
+}
+
+// starlarkStrings returns the values of the string literals in expr
+func starlarkStrings(expr string) []string {
+	var values []string
+	for _, match := range stringLiteral.FindAllStringSubmatch(expr, -1) {
+		values = append(values, match[1]+match[2])
+	}
+	return values
+}
+
+// attributeFiles returns the files of the package pkg, with files, that the
+// srcs or hdrs expression expr lists, relative to the workspace root
+func attributeFiles(expr string, pkg string, files []string) []string {
+	var listed []string
+	for {
+		loc := globCall.FindStringIndex(expr)
+		if loc == nil {
+			break
+		}
+		end := closingParen(expr, loc[1]-1)
+		if end < 0 {
+			break
+		}
+		listed = append(listed, globFiles(expr[loc[1]:end], pkg, files)...)
+		expr = expr[:loc[0]] + expr[end+1:]
+	}
+
+	// Other strings are files of the package or labels of other targets,
+	// including the keys of select()
+	for _, value := range starlarkStrings(expr) {
+		if strings.HasPrefix(value, "//") || strings.HasPrefix(value, "@") {
+			continue
+		}
+		file := path.Join(pkg, strings.TrimPrefix(value, ":"))
+		if slices.Contains(files, file) {
+			listed = append(listed, file)
+		}
+	}
+	return listed
+}
+
+// globFiles returns the files of the package matched by the arguments of a
+// glob() call
+func globFiles(args string, pkg string, files []string) []string {
+	attrs := ruleAttributes("(" + args)
+	include := attrs["include"]
+	if include == "" {
+		include = strings.TrimSpace(args[:expressionEnd(args, 0)])
+	}
+	var patterns, excludes []*regexp.Regexp
+	for _, pattern := range starlarkStrings(include) {
+		patterns = append(patterns, globRegexp(pattern))
+	}
+	for _, pattern := range starlarkStrings(attrs["exclude"]) {
+		excludes = append(excludes, globRegexp(pattern))
+	}
+
+	var matched []string
+	for _, file := range files {
+		rel := strings.TrimPrefix(file, pkg+"/")
+		if pkg == "" {
+			rel = file
+		}
+		match := func(re *regexp.Regexp) bool { return re.MatchString(rel) }
+		if slices.ContainsFunc(patterns, match) && !slices.ContainsFunc(excludes, match) {
+			matched = append(matched, file)
+		}
+	}
+	return matched
+}
+
+// globRegexp compiles a Bazel glob pattern, where ** matches any number of
+// directories
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// matchesLabel reports whether the target label matches pattern: the same
+// label, //pkg for //pkg:pkg, //pkg:all or //pkg:* for the targets of a
+// package, or //pkg/... for those of a package and the packages below it
+func matchesLabel(label string, pattern string) bool {
+	pattern = "//" + strings.TrimPrefix(pattern, "//")
+	pkg, name, _ := strings.Cut(strings.TrimPrefix(label, "//"), ":")
+	if rest, ok := strings.CutSuffix(pattern, "..."); ok {
+		base := strings.TrimSuffix(strings.TrimPrefix(rest, "//"), "/")
+		return base == "" || pkg == base || strings.HasPrefix(pkg, base+"/")
+	}
+	patternPkg, patternName, hasName := strings.Cut(strings.TrimPrefix(pattern, "//"), ":")
+	if !hasName {
+		patternName = path.Base(patternPkg)
+	}
+	if pkg != patternPkg {
+		return false
+	}
+	return patternName == name || patternName == "all" || patternName == "*"
+}
+
+func (m *IndexManager) bazelTargetsPath(prefix string) string {
+	return filepath.Join(m.indexDir, prefix+".bazel.json")
+}
+
+// saveBazelTargets records the Bazel targets of absPath if it is the root
+// of a Bazel workspace, for target: filters and FindTargets
+func (m *IndexManager) saveBazelTargets(ctx context.Context, absPath string, walkRoot string, filter *sourceFilter) error {
+	prefix := m.getIndexPrefix(absPath)
+	var targets []BazelTarget
+	if isBazelWorkspace(walkRoot) {
+		var err error
+		if targets, err = bazelTargets(ctx, walkRoot, filter); err != nil {
+			return err
+		}
+	}
+	if len(targets) == 0 {
+		if err := os.Remove(m.bazelTargetsPath(prefix)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove Bazel targets: %w", err)
+		}
+	} else {
+		content, err := json.Marshal(targets)
+		if err != nil {
+			return err
+		}
+		if err := m.writeIndexFile(m.bazelTargetsPath(prefix), content); err != nil {
+			return fmt.Errorf("failed to save Bazel targets: %w", err)
+		}
+	}
+	return m.updateMetadata(prefix, func(meta *indexMetadata) { meta.BazelTargets = len(targets) })
+}
+
+// loadBazelTargets returns the Bazel targets recorded for the index named
+// prefix
+func (m *IndexManager) loadBazelTargets(prefix string) ([]BazelTarget, error) {
+	content, err := m.readIndexFile(m.bazelTargetsPath(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Bazel targets: %w", err)
+	}
+	var targets []BazelTarget
+	if err := json.Unmarshal(content, &targets); err != nil {
+		return nil, fmt.Errorf("failed to read Bazel targets: %w", err)
+	}
+	return targets, nil
+}
+
+// FindTargets returns the Bazel targets of the index of sourceDir, or of all
+// indexes if sourceDir is empty, that list file or match the label pattern
+// target. file is relative to the workspace root or absolute; target
+// accepts //pkg:name, //pkg:all and //pkg/... patterns.
+func (m *IndexManager) FindTargets(ctx context.Context, sourceDir string, file string, target string) ([]BazelTarget, error) {
+	if file == "" && target == "" {
+		return nil, errors.New("either a file or a target is needed")
+	}
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	metadata := m.visibleMetadata(ctx)
+
+	var found []BazelTarget
+	indexed := false
+	for _, prefix := range prefixes {
+		meta := metadata[prefix]
+		if meta == nil || meta.BazelTargets == 0 {
+			continue
+		}
+		indexed = true
+		targets, err := m.loadBazelTargets(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		relFile := file
+		if filepath.IsAbs(file) {
+			rel, err := filepath.Rel(meta.dir(), file)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			relFile = rel
+		}
+		relFile = path.Clean(filepath.ToSlash(relFile))
+
+		for _, t := range targets {
+			if file != "" && !slices.Contains(t.Files, relFile) {
+				continue
+			}
+			if target != "" && !matchesLabel(t.Label, target) {
+				continue
+			}
+			t.SourceDir = meta.dir()
+			found = append(found, t)
+		}
+	}
+	if !indexed {
+		return nil, errors.New("no Bazel targets are indexed; index the root of a Bazel workspace (with a MODULE.bazel or WORKSPACE file)")
+	}
+	return found, nil
+}
+
+// targetAtom matches a target: atom, whose value is a Bazel label pattern
+var targetAtom = regexp.MustCompile(`(^|\s)target:(\S*)`)
+
+// extractTargets removes the target: atoms from queryStr, returning the
+// rest of the query and the label patterns
+func extractTargets(queryStr string) (string, []string, error) {
+	var targets []string
+	var invalid bool
+	rest := targetAtom.ReplaceAllStringFunc(queryStr, func(atom string) string {
+		value := targetAtom.FindStringSubmatch(atom)[2]
+		if value == "" {
+			invalid = true
+		}
+		targets = append(targets, value)
+		return " "
+	})
+	if targets == nil {
+		return queryStr, nil, nil
+	}
+	if invalid {
+		return "", nil, errors.New("target: needs a Bazel label, e.g. target://server/http:handlers or target://server/...")
+	}
+	return strings.TrimSpace(rest), targets, nil
+}
+
+// targetQuery returns a query matching the files of the Bazel targets
+// matching pattern in the indexes named prefixes
+func (m *IndexManager) targetQuery(pattern string, metadata map[string]*indexMetadata, prefixes []string) (query.Q, error) {
+	var sets []query.Q
+	for _, prefix := range prefixes {
+		meta, ok := metadata[prefix]
+		if !ok || meta.BazelTargets == 0 {
+			continue
+		}
+		targets, err := m.loadBazelTargets(prefix)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, t := range targets {
+			if matchesLabel(t.Label, pattern) {
+				for _, file := range t.Files {
+					files = append(files, filepath.FromSlash(file))
+				}
+			}
+		}
+		if files != nil {
+			sets = append(sets, query.NewAnd(
+				query.NewRepoSet(meta.shardPrefix(prefix)),
+				query.NewFileNameSet(files...),
+			))
+		}
+	}
+	if sets == nil {
+		return nil, fmt.Errorf("no Bazel target with source files matches target:%s; use find_target to look up targets", pattern)
+	}
+	return query.NewOr(sets...), nil
+}
@@ -0,0 +1,167 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// defaultBinarySampleKB is how much of the start of a file is checked for
+// binary content unless configured otherwise
+const defaultBinarySampleKB = 8
+
+// defaultBinaryRatio is the share of control characters and invalid UTF-8
+// in a sample above which a file without null bytes is binary. Random
+// binary data scores around 0.5, text in a legacy 8-bit encoding rarely
+// above 0.05.
+const defaultBinaryRatio = 0.3
+
+// UTF-16 byte order marks
+var (
+	utf16LEMark = []byte{0xFF, 0xFE}
+	utf16BEMark = []byte{0xFE, 0xFF}
+)
+
+// sampleBuffers holds the buffers file samples are read into, so walking
+// files that are never indexed does not allocate
+var sampleBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, defaultBinarySampleKB<<10)
+		return &buf
+	},
+}
+
+// binarySampleSize returns how many bytes at the start of a file are
+// checked for binary content
+func (b BuildOptions) binarySampleSize() int {
+	if b.BinarySampleKB <= 0 {
+		return defaultBinarySampleKB << 10
+	}
+	return b.BinarySampleKB << 10
+}
+
+// binaryRatio returns the share of non-text bytes that makes a sample
+// binary, or 0 if only null bytes do
+func (b BuildOptions) binaryRatio() float64 {
+	switch {
+	case b.BinaryRatio < 0:
+		return 0
+	case b.BinaryRatio == 0:
+		return defaultBinaryRatio
+	}
+	return b.BinaryRatio
+}
+
+// binarySample tells from the start of a file whether it is binary,
+// returning the reason it is skipped for, or "" if it is text
+func (b BuildOptions) binarySample(sample []byte) string {
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return skipBinaryContent
+	}
+	if ratio := b.binaryRatio(); ratio > 0 && nonTextRatio(sample) > ratio {
+		return skipBinaryRatio
+	}
+	return ""
+}
+
+// nonTextRatio returns the share of bytes in sample that are control
+// characters other than whitespace, or not part of valid UTF-8. A rune cut
+// off at the end of the sample counts as valid.
+func nonTextRatio(sample []byte) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	nonText := 0
+	for i := 0; i < len(sample); {
+		c := sample[i]
+		if c < utf8.RuneSelf {
+			if (c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != '\v') || c == 0x7F {
+				nonText++
+			}
+			i++
+			continue
+		}
+		if !utf8.FullRune(sample[i:]) {
+			break
+		}
+		r, size := utf8.DecodeRune(sample[i:])
+		if r == utf8.RuneError && size == 1 {
+			nonText++
+		}
+		i += size
+	}
+	return float64(nonText) / float64(len(sample))
+}
+
+// isUTF16 reports whether content starts with a UTF-16 byte order mark
+func isUTF16(content []byte) bool {
+	return bytes.HasPrefix(content, utf16LEMark) || bytes.HasPrefix(content, utf16BEMark)
+}
+
+// decodeUTF16 converts UTF-16 content starting with a byte order mark to
+// UTF-8 without the mark, so the builder can index it as text. Line breaks
+// are kept, so line numbers match the file.
+func decodeUTF16(content []byte) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bytes.HasPrefix(content, utf16BEMark) {
+		order = binary.BigEndian
+	}
+	content = content[2:]
+	units := make([]uint16, len(content)/2)
+	for i := range units {
+		units[i] = order.Uint16(content[2*i:])
+	}
+	decoded := make([]byte, 0, len(units))
+	for _, r := range utf16.Decode(units) {
+		decoded = utf8.AppendRune(decoded, r)
+	}
+	return decoded
+}
+
+// readSample reads the start of a file into buf and returns it
+func readSample(f io.Reader, buf []byte) ([]byte, error) {
+	n, err := io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// readRest returns the content of a file of size bytes whose start, sample,
+// was already read from f. Content is allocated once rather than grown as
+// it is read; a file that shrank since it was opened is returned as far as
+// it could be read, and one that grew is cut at size.
+func readRest(f io.Reader, sample []byte, size int) ([]byte, error) {
+	content := make([]byte, max(size, len(sample)))
+	n := copy(content, sample)
+	read, err := io.ReadFull(f, content[n:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return content[:n+read], err
+}
+
+// catalogBinary passes a binary file to add as a document without content if
+// the build options catalog binaries, so searching for logo.png or
+// model.bin still finds the file. Its size counts towards the indexed bytes.
+func (m *IndexManager) catalogBinary(path string, relPath string, stats *sourceStats, add func(index.Document) error) error {
+	if !m.buildOptions.CatalogBinaries {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	stats.files++
+	stats.bytes += info.Size()
+	return add(index.Document{
+		Name:       relPath,
+		SkipReason: index.SkipReasonBinary,
+	})
+}
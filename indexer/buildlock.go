@@ -0,0 +1,82 @@
+package indexer
+
+import "context"
+
+// buildLock serializes the builds of one index
+type buildLock struct {
+	sem chan struct{}
+	// users counts the builds holding or waiting for the lock, so unused
+	// locks can be dropped
+	users int
+}
+
+// lockBuild waits until no other build of the index named prefix runs, or
+// until ctx is done, and returns the function that releases the lock. Every
+// build goes through indexDirectory, so tool calls, jobs, schedules and
+// watchers building the same directory run one after another.
+func (m *IndexManager) lockBuild(ctx context.Context, prefix string) (func(), error) {
+	lock, leave := m.joinBuildLock(prefix)
+	select {
+	case lock.sem <- struct{}{}:
+		return func() {
+			<-lock.sem
+			leave()
+		}, nil
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
+	}
+}
+
+// tryLockBuild takes the build lock of the index named prefix like
+// lockBuild if no build of it runs, and returns false otherwise
+func (m *IndexManager) tryLockBuild(prefix string) (func(), bool) {
+	lock, leave := m.joinBuildLock(prefix)
+	select {
+	case lock.sem <- struct{}{}:
+		return func() {
+			<-lock.sem
+			leave()
+		}, true
+	default:
+		leave()
+		return nil, false
+	}
+}
+
+// joinBuildLock returns the build lock of the index named prefix, counting
+// the caller as a user until it calls the returned function
+func (m *IndexManager) joinBuildLock(prefix string) (*buildLock, func()) {
+	m.buildLocksMu.Lock()
+	defer m.buildLocksMu.Unlock()
+	if m.buildLocks == nil {
+		m.buildLocks = make(map[string]*buildLock)
+	}
+	lock, ok := m.buildLocks[prefix]
+	if !ok {
+		lock = &buildLock{sem: make(chan struct{}, 1)}
+		m.buildLocks[prefix] = lock
+	}
+	lock.users++
+
+	return lock, func() {
+		m.buildLocksMu.Lock()
+		defer m.buildLocksMu.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(m.buildLocks, prefix)
+		}
+	}
+}
+
+// Building reports whether the index of sourceDir is being built
+func (m *IndexManager) Building(sourceDir string) bool {
+	absPath, err := resolvePath(sourceDir)
+	if err != nil {
+		return false
+	}
+	m.buildLocksMu.Lock()
+	defer m.buildLocksMu.Unlock()
+	lock, ok := m.buildLocks[m.getIndexPrefix(absPath)]
+	return ok && len(lock.sem) > 0
+}
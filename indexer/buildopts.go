@@ -0,0 +1,217 @@
+package indexer
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// BuildOptions tunes the Zoekt index builder. Zero values keep the Zoekt
+// defaults (4 parallel shards of up to 100 MB).
+type BuildOptions struct {
+	// Parallelism is the maximum number of shards built concurrently
+	Parallelism int `json:"parallelism,omitempty"`
+	// ShardMaxMB is the target maximum size of a single shard in megabytes
+	ShardMaxMB int `json:"shard_max_mb,omitempty"`
+	// TrigramMax is the maximum number of distinct trigrams per document
+	TrigramMax int `json:"trigram_max,omitempty"`
+	// MemoryLimitMB is a soft memory ceiling applied while an index is being
+	// built. Parallelism is reduced so that concurrent shards fit under it.
+	MemoryLimitMB int `json:"memory_limit_mb,omitempty"`
+	// ChunkLargeFiles indexes files above Zoekt's 2 MB file size limit as
+	// several documents instead of skipping their content
+	ChunkLargeFiles bool `json:"chunk_large_files,omitempty"`
+	// LargeFileMaxMB is the largest file that is chunked (default 100)
+	LargeFileMaxMB int `json:"large_file_max_mb,omitempty"`
+	// SkipSubmodules leaves git submodules out instead of indexing each as
+	// a separate index linked to the repository
+	SkipSubmodules bool `json:"skip_submodules,omitempty"`
+	// CheckpointMB commits a full build every this many megabytes of
+	// content, so an interrupted build resumes from there (default 1024,
+	// -1 disables checkpoints)
+	CheckpointMB int `json:"checkpoint_mb,omitempty"`
+	// BinarySampleKB is how much of the start of a file is checked for
+	// binary content (default 8)
+	BinarySampleKB int `json:"binary_sample_kb,omitempty"`
+	// BinaryRatio skips a file as binary when this share of its sample is
+	// control characters or invalid UTF-8 (default 0.3, -1 to only skip
+	// files with null bytes)
+	BinaryRatio float64 `json:"binary_ratio,omitempty"`
+	// CatalogBinaries indexes the names of binary files without their
+	// content, so they are found by file name
+	CatalogBinaries bool `json:"catalog_binaries,omitempty"`
+	// ReadWorkers is the number of files read concurrently while walking a
+	// directory (default the number of CPUs, at most 8; 1 reads serially)
+	ReadWorkers int `json:"read_workers,omitempty"`
+	// TimeoutMinutes stops a build of a directory that runs longer, removing
+	// what it wrote since its last checkpoint (default no timeout)
+	TimeoutMinutes int `json:"timeout_minutes,omitempty"`
+	// MaxFileSizeKB leaves files larger than this out of indexes entirely,
+	// names included, unless an index sets its own limit (default no limit)
+	MaxFileSizeKB int `json:"max_file_size_kb,omitempty"`
+}
+
+// maxDefaultReadWorkers caps the default number of read workers, past which
+// reading is bound by the disk and the builder rather than the CPU
+const maxDefaultReadWorkers = 8
+
+// defaultLargeFileMaxMB caps chunked indexing so huge dumps cannot fill a shard
+const defaultLargeFileMaxMB = 100
+
+// shardMemoryFactor approximates builder memory use as a multiple of the
+// shard corpus size (content plus postings and document sections)
+const shardMemoryFactor = 3
+
+// apply copies the tuning into Zoekt builder options, after SetDefaults
+func (b BuildOptions) apply(opts *index.Options) {
+	if b.Parallelism > 0 {
+		opts.Parallelism = b.Parallelism
+	}
+	if b.ShardMaxMB > 0 {
+		opts.ShardMax = b.ShardMaxMB << 20
+	}
+	if b.TrigramMax > 0 {
+		opts.TrigramMax = b.TrigramMax
+	}
+	if b.MemoryLimitMB > 0 {
+		perShard := opts.ShardMax * shardMemoryFactor
+		maxParallel := max(1, (b.MemoryLimitMB<<20)/perShard)
+		opts.Parallelism = min(opts.Parallelism, maxParallel)
+	}
+}
+
+// readWorkers returns the number of files read concurrently
+func (b BuildOptions) readWorkers() int {
+	if b.ReadWorkers > 0 {
+		return b.ReadWorkers
+	}
+	return min(runtime.GOMAXPROCS(0), maxDefaultReadWorkers)
+}
+
+// timeout returns the longest a build of a directory may run, or 0 for no
+// limit
+func (b BuildOptions) timeout() time.Duration {
+	return time.Duration(max(b.TimeoutMinutes, 0)) * time.Minute
+}
+
+// maxFileSize returns the default size in bytes above which files are left
+// out, or 0 for no limit
+func (b BuildOptions) maxFileSize() int64 {
+	return int64(max(b.MaxFileSizeKB, 0)) << 10
+}
+
+// sizeUnits are the units ParseSize accepts, in bytes
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// ParseSize parses a file size such as "512KB", "2MB" or "1.5 GB" into
+// bytes. A number without a unit is in bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	number := strings.TrimRightFunc(s, unicode.IsLetter)
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[len(number):]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: use a number of bytes or a unit of KB, MB or GB", s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q: use a number of bytes or a unit of KB, MB or GB", s)
+	}
+	return int64(math.Ceil(n * unit)), nil
+}
+
+// FormatSize formats a size in bytes for messages, such as "1.5 MB"
+func FormatSize(n int64) string {
+	for _, unit := range []struct {
+		name string
+		size int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= unit.size {
+			return strings.TrimSuffix(strconv.FormatFloat(float64(n)/float64(unit.size), 'f', 1, 64), ".0") + " " + unit.name
+		}
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// chunkFile reports whether a file of the given size should be split into
+// chunks of at most sizeMax bytes
+func (b BuildOptions) chunkFile(size int, sizeMax int) bool {
+	if !b.ChunkLargeFiles || size <= sizeMax {
+		return false
+	}
+	limit := b.LargeFileMaxMB
+	if limit <= 0 {
+		limit = defaultLargeFileMaxMB
+	}
+	return size <= limit<<20
+}
+
+// buildMemoryLimits tracks the memory ceilings of the builds running in the
+// process. The Go runtime has one limit, so the lowest ceiling of the
+// running builds applies, and the limit from before the first build is
+// restored once the last one finishes.
+var buildMemoryLimits struct {
+	mu       sync.Mutex
+	running  map[int64]int // Builds running per ceiling in bytes
+	previous int64         // Limit before the first running build
+}
+
+// setMemoryLimit applies the soft memory ceiling to the Go runtime for the
+// duration of a build and returns a function that lifts it again
+func (b BuildOptions) setMemoryLimit() (restore func()) {
+	if b.MemoryLimitMB <= 0 {
+		return func() {}
+	}
+	limit := int64(b.MemoryLimitMB) << 20
+
+	l := &buildMemoryLimits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.running) == 0 {
+		l.running = make(map[int64]int)
+		l.previous = debug.SetMemoryLimit(-1)
+	}
+	l.running[limit]++
+	debug.SetMemoryLimit(lowestMemoryLimit(l.running))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.running[limit]--; l.running[limit] == 0 {
+				delete(l.running, limit)
+			}
+			if len(l.running) == 0 {
+				debug.SetMemoryLimit(l.previous)
+				return
+			}
+			debug.SetMemoryLimit(lowestMemoryLimit(l.running))
+		})
+	}
+}
+
+// lowestMemoryLimit returns the lowest of the ceilings of running builds
+func lowestMemoryLimit(running map[int64]int) int64 {
+	lowest := int64(math.MaxInt64)
+	for limit := range running {
+		lowest = min(lowest, limit)
+	}
+	return lowest
+}
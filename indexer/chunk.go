@@ -0,0 +1,63 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// chunkSeparator joins a file name and the line offset of a chunk document,
+// e.g. "dump/schema.sql#chunk-L48211"
+const chunkSeparator = "#chunk-L"
+
+// contentChunk is a piece of a large file indexed as its own document
+type contentChunk struct {
+	Content    []byte
+	LineOffset int // Number of lines in the file before this chunk
+}
+
+// chunkName returns the document name for a chunk. The first chunk keeps the
+// file name so file: filters still match it.
+func chunkName(name string, lineOffset int) string {
+	if lineOffset == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s%s%d", name, chunkSeparator, lineOffset)
+}
+
+// splitChunkName reverses chunkName, returning the file name and the line
+// offset to add to line numbers of matches in the chunk
+func splitChunkName(name string) (string, int) {
+	i := strings.LastIndex(name, chunkSeparator)
+	if i < 0 {
+		return name, 0
+	}
+	offset, err := strconv.Atoi(name[i+len(chunkSeparator):])
+	if err != nil {
+		return name, 0
+	}
+	return name[:i], offset
+}
+
+// splitContent splits content into chunks of at most maxSize bytes, breaking
+// after a newline where possible so no line is split across chunks
+func splitContent(content []byte, maxSize int) []contentChunk {
+	var chunks []contentChunk
+	lineOffset := 0
+	for len(content) > 0 {
+		end := len(content)
+		if end > maxSize {
+			end = maxSize
+			if i := bytes.LastIndexByte(content[:maxSize], '\n'); i >= 0 {
+				end = i + 1
+			}
+		}
+
+		chunk := content[:end]
+		chunks = append(chunks, contentChunk{Content: chunk, LineOffset: lineOffset})
+		lineOffset += bytes.Count(chunk, []byte("\n"))
+		content = content[end:]
+	}
+	return chunks
+}
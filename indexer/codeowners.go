@@ -0,0 +1,236 @@
+package indexer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// codeOwnersLocations are where GitHub and GitLab look for a CODEOWNERS
+// file, relative to the repository root, in the order they look
+var codeOwnersLocations = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS", ".gitlab/CODEOWNERS"}
+
+// CodeOwnerRule is a line of a CODEOWNERS file
+type CodeOwnerRule struct {
+	Pattern string   `json:"pattern"`
+	Owners  []string `json:"owners,omitempty"` // No owners leaves the paths unowned
+	Line    int      `json:"line"`
+}
+
+// codeOwners holds the CODEOWNERS rules of the repository an index is in
+type codeOwners struct {
+	File  string          `json:"file"` // Path of the CODEOWNERS file
+	Base  string          `json:"base"` // Path of the indexed directory in the repository
+	Rules []CodeOwnerRule `json:"rules"`
+
+	patterns []gitPattern // Compiled Rules, nil where invalid
+}
+
+// CodeOwnership is the owners of a path by its CODEOWNERS file
+type CodeOwnership struct {
+	Path   string   `json:"path"`
+	Owners []string `json:"owners,omitempty"`
+	Rule   string   `json:"rule,omitempty"` // The last matching pattern, which decides the owners
+	Line   int      `json:"line,omitempty"` // Line of Rule
+	File   string   `json:"file"`           // The CODEOWNERS file
+}
+
+// readCodeOwners parses the CODEOWNERS file of the repository containing
+// dir, or returns nil if there is none. GitLab section headers are skipped,
+// so rules of all sections apply.
+func readCodeOwners(dir string) (*codeOwners, error) {
+	root, _ := findGitDir(dir)
+	if root == "" {
+		root = dir
+	}
+	for _, location := range codeOwnersLocations {
+		file := filepath.Join(root, filepath.FromSlash(location))
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		base, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		owners := &codeOwners{File: file, Base: filepath.ToSlash(base)}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+				continue
+			}
+			rule := CodeOwnerRule{Pattern: fields[0], Line: line}
+			for _, owner := range fields[1:] {
+				if strings.HasPrefix(owner, "#") {
+					break
+				}
+				rule.Owners = append(rule.Owners, owner)
+			}
+			owners.Rules = append(owners.Rules, rule)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		return owners, nil
+	}
+	return nil, nil
+}
+
+// compile parses the patterns of the rules
+func (c *codeOwners) compile() {
+	c.patterns = make([]gitPattern, len(c.Rules))
+	for i, rule := range c.Rules {
+		if parsed := parseGitPatterns([]string{rule.Pattern}, ""); len(parsed) == 1 {
+			c.patterns[i] = parsed[0]
+		}
+	}
+}
+
+// match returns the rule deciding the owners of name, a slash separated
+// path in the indexed directory, or nil if no rule matches. The last
+// matching rule wins. As in gitignore, a pattern matching a directory
+// matches everything in it, except that "dir/*" only matches the files
+// directly in dir.
+func (c *codeOwners) match(name string) *CodeOwnerRule {
+	name = path.Join(c.Base, name)
+	for i := len(c.Rules) - 1; i >= 0; i-- {
+		p := c.patterns[i]
+		if p.re == nil {
+			continue
+		}
+		if !p.dirOnly && p.re.MatchString(name) {
+			return &c.Rules[i]
+		}
+		if strings.HasSuffix(c.Rules[i].Pattern, "/*") {
+			continue
+		}
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if p.re.MatchString(dir) {
+				return &c.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (m *IndexManager) codeOwnersPath(prefix string) string {
+	return filepath.Join(m.indexDir, prefix+".codeowners.json")
+}
+
+// saveCodeOwners records the CODEOWNERS rules of the repository containing
+// absPath, for WhoOwns and annotating search results
+func (m *IndexManager) saveCodeOwners(absPath string) error {
+	prefix := m.getIndexPrefix(absPath)
+	owners, err := readCodeOwners(absPath)
+	if err != nil {
+		return err
+	}
+	rules := 0
+	if owners == nil {
+		if err := os.Remove(m.codeOwnersPath(prefix)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove code owners: %w", err)
+		}
+	} else {
+		content, err := json.Marshal(owners)
+		if err != nil {
+			return err
+		}
+		if err := m.writeIndexFile(m.codeOwnersPath(prefix), content); err != nil {
+			return fmt.Errorf("failed to save code owners: %w", err)
+		}
+		rules = len(owners.Rules)
+	}
+	return m.updateMetadata(prefix, func(meta *indexMetadata) { meta.CodeOwners = rules })
+}
+
+// loadCodeOwners returns the CODEOWNERS rules recorded for the index named
+// prefix
+func (m *IndexManager) loadCodeOwners(prefix string) (*codeOwners, error) {
+	content, err := m.readIndexFile(m.codeOwnersPath(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read code owners: %w", err)
+	}
+	owners := &codeOwners{}
+	if err := json.Unmarshal(content, owners); err != nil {
+		return nil, fmt.Errorf("failed to read code owners: %w", err)
+	}
+	owners.compile()
+	return owners, nil
+}
+
+// WhoOwns returns the owners of a file or directory by the CODEOWNERS file
+// recorded when the index containing it was built
+func (m *IndexManager) WhoOwns(ctx context.Context, file string) (*CodeOwnership, error) {
+	absPath, err := resolvePath(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	// The innermost index containing the path, e.g. that of a submodule
+	var prefix string
+	var meta *indexMetadata
+	for p, candidate := range m.visibleMetadata(ctx) {
+		rel, err := filepath.Rel(candidate.dir(), absPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if meta == nil || len(candidate.dir()) > len(meta.dir()) {
+			prefix, meta = p, candidate
+		}
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("%w: no index contains %s", ErrNotIndexed, absPath)
+	}
+	if meta.CodeOwners == 0 {
+		return nil, fmt.Errorf("no CODEOWNERS file was found when %s was indexed", meta.dir())
+	}
+	owners, err := m.loadCodeOwners(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, _ := filepath.Rel(meta.dir(), absPath)
+	ownership := &CodeOwnership{Path: absPath, File: owners.File}
+	if rule := owners.match(filepath.ToSlash(rel)); rule != nil {
+		ownership.Owners, ownership.Rule, ownership.Line = rule.Owners, rule.Pattern, rule.Line
+	}
+	return ownership, nil
+}
+
+// ownerLookup finds the owners of search result files, loading the rules
+// of each index once
+type ownerLookup struct {
+	m      *IndexManager
+	repos  map[string]*indexMetadata // Metadata by shard prefix
+	owners map[string]*codeOwners    // Rules by shard prefix; nil if there are none
+}
+
+func (m *IndexManager) newOwnerLookup(repos map[string]*indexMetadata) *ownerLookup {
+	return &ownerLookup{m: m, repos: repos, owners: make(map[string]*codeOwners)}
+}
+
+// lookup returns the owners of the file name in the shards named repo
+func (l *ownerLookup) lookup(repo string, name string) []string {
+	owners, ok := l.owners[repo]
+	if !ok {
+		if meta := l.repos[repo]; meta != nil && meta.CodeOwners > 0 {
+			owners, _ = l.m.loadCodeOwners(l.m.getIndexPrefix(meta.SourceDir))
+		}
+		l.owners[repo] = owners
+	}
+	if owners == nil {
+		return nil
+	}
+	if rule := owners.match(name); rule != nil {
+		return rule.Owners
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package indexer
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressedShardSuffix is appended to the names of compressed shard files
+const compressedShardSuffix = ".gz"
+
+// searchedUpdateInterval limits how often searches rewrite the metadata to
+// record when an index was last searched
+const searchedUpdateInterval = time.Hour
+
+// CompressColdIndexes gzips the shards of indexes that have not been
+// searched (or built) within idle and returns their names. Compressed
+// indexes are decompressed automatically the next time they are searched.
+// Encrypted shards are left alone since ciphertext does not compress.
+// Indexes being built are skipped.
+func (m *IndexManager) CompressColdIndexes(ctx context.Context, idle time.Duration) ([]string, error) {
+	usage := shardUsage(m.loadAllMetadata())
+
+	var compressed []string
+	for _, prefix := range slices.Sorted(maps.Keys(usage)) {
+		if err := ctx.Err(); err != nil {
+			return compressed, err
+		}
+		if !usage[prefix].cold(idle) {
+			continue
+		}
+
+		done, err := m.compressIndex(prefix, usage[prefix].users, idle)
+		if err != nil {
+			return compressed, fmt.Errorf("failed to compress %s: %w", prefix, err)
+		}
+		if done {
+			compressed = append(compressed, prefix)
+		}
+	}
+	return compressed, nil
+}
+
+// shardUse is how the shards of one or more indexes are used
+type shardUse struct {
+	users    []string  // Indexes using the shards
+	lastUsed time.Time // Latest search or build of any of them
+	skip     bool      // Compressed already, or not ours to compress
+}
+
+// cold reports whether the shards can be compressed after idle
+func (u *shardUse) cold(idle time.Duration) bool {
+	return !u.skip && !u.lastUsed.IsZero() && time.Since(u.lastUsed) >= idle
+}
+
+// shardUsage returns the use of the shards of metadata, by shard prefix.
+// Shards shared by several checkouts are cold once all of them are.
+func shardUsage(metadata map[string]*indexMetadata) map[string]*shardUse {
+	usage := make(map[string]*shardUse)
+	for prefix, meta := range metadata {
+		shardPrefix := meta.shardPrefix(prefix)
+		use, ok := usage[shardPrefix]
+		if !ok {
+			use = &shardUse{}
+			usage[shardPrefix] = use
+		}
+		use.users = append(use.users, prefix)
+		for _, t := range []time.Time{meta.LastSearched, meta.IndexedAt} {
+			if t.After(use.lastUsed) {
+				use.lastUsed = t
+			}
+		}
+		// Attached shards belong to the tooling that built them
+		if meta.Compressed || meta.Attached != "" {
+			use.skip = true
+		}
+	}
+	return usage
+}
+
+// compressIndex replaces the plain shards named prefix, used by the indexes
+// users, with gzipped copies. It returns false if the index has no plain
+// shards to compress, or if it is no longer cold after idle: one of users
+// is being built, which would replace the shards, or was searched or built
+// since it was found cold.
+func (m *IndexManager) compressIndex(prefix string, users []string, idle time.Duration) (bool, error) {
+	for _, user := range users {
+		unlock, ok := m.tryLockBuild(user)
+		if !ok {
+			return false, nil
+		}
+		defer unlock()
+	}
+
+	m.compressMu.Lock()
+	defer m.compressMu.Unlock()
+
+	if m.heldAll > 0 || m.held[prefix] > 0 {
+		return false, nil
+	}
+	// Searches record their use before they decompress, so any search that
+	// started meanwhile shows here
+	if use, ok := shardUsage(m.loadAllMetadata())[prefix]; !ok || !use.cold(idle) {
+		return false, nil
+	}
+
+	shards, err := m.shardFiles(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	var plain []string
+	for _, shard := range shards {
+		if strings.HasSuffix(shard, ".zoekt") {
+			plain = append(plain, shard)
+		}
+	}
+	if len(plain) == 0 {
+		return false, nil
+	}
+
+	for _, shard := range plain {
+		err := transformFile(shard, shard+compressedShardSuffix, func(w io.Writer, r io.Reader) error {
+			zw := gzip.NewWriter(w)
+			if _, err := io.Copy(zw, r); err != nil {
+				return err
+			}
+			return zw.Close()
+		})
+		if err != nil {
+			return false, err
+		}
+		if err := os.Remove(shard); err != nil {
+			return false, err
+		}
+	}
+
+	return true, m.updateShared(prefix, func(meta *indexMetadata) {
+		meta.Compressed = true
+	})
+}
+
+// HoldIndexes restores the shards of the indexes named repos, as returned by
+// WorkspaceRepositories, or of every index if repos is nil, and keeps them
+// from being compressed until the returned function is called. Readers of
+// the index directory that do not search through the manager, such as the
+// web server, hold the indexes they serve.
+func (m *IndexManager) HoldIndexes(repos []string) (func(), error) {
+	// Shard prefixes name the indexes of the shards
+	metadata := shardView(m.loadAllMetadata())
+	targets := repos
+	if targets == nil {
+		targets = slices.Collect(maps.Keys(metadata))
+	}
+
+	// Hold first, so the shards cannot be compressed once restored
+	m.compressMu.Lock()
+	if m.held == nil {
+		m.held = make(map[string]int)
+	}
+	if repos == nil {
+		m.heldAll++
+	}
+	for _, prefix := range repos {
+		m.held[prefix]++
+	}
+	m.compressMu.Unlock()
+
+	release := func() {
+		m.compressMu.Lock()
+		defer m.compressMu.Unlock()
+		if repos == nil {
+			m.heldAll--
+		}
+		for _, prefix := range repos {
+			if m.held[prefix]--; m.held[prefix] <= 0 {
+				delete(m.held, prefix)
+			}
+		}
+	}
+	if err := m.decompressIndexes(targets, metadata); err != nil {
+		release()
+		return nil, err
+	}
+	return sync.OnceFunc(release), nil
+}
+
+// decompressIndexes restores the plain shards of any compressed index among
+// prefixes so they can be searched
+func (m *IndexManager) decompressIndexes(prefixes []string, metadata map[string]*indexMetadata) error {
+	m.compressMu.Lock()
+	defer m.compressMu.Unlock()
+
+	done := make(map[string]bool)
+	for _, prefix := range prefixes {
+		meta, ok := metadata[prefix]
+		if !ok || !meta.Compressed || done[meta.shardPrefix(prefix)] {
+			continue
+		}
+		prefix = meta.shardPrefix(prefix)
+		done[prefix] = true
+
+		shards, err := m.shardFiles(prefix)
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			if !strings.HasSuffix(shard, ".zoekt"+compressedShardSuffix) {
+				continue
+			}
+			err := transformFile(shard, strings.TrimSuffix(shard, compressedShardSuffix), func(w io.Writer, r io.Reader) error {
+				zr, err := gzip.NewReader(r)
+				if err != nil {
+					return err
+				}
+				defer zr.Close()
+				_, err = io.Copy(w, zr)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", filepath.Base(shard), err)
+			}
+			if err := os.Remove(shard); err != nil {
+				return err
+			}
+		}
+
+		err = m.updateShared(prefix, func(meta *indexMetadata) {
+			meta.Compressed = false
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCompressedShards deletes the compressed shards of an index that has
+// just been rebuilt, so they cannot shadow the new shards later
+func (m *IndexManager) removeCompressedShards(prefix string) error {
+	m.compressMu.Lock()
+	defer m.compressMu.Unlock()
+
+	shards, err := m.shardFiles(prefix)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if strings.HasSuffix(shard, ".zoekt"+compressedShardSuffix) {
+			if err := os.Remove(shard); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markSearched records that the indexes were searched, at most once per
+// searchedUpdateInterval per index
+func (m *IndexManager) markSearched(prefixes []string, metadata map[string]*indexMetadata) {
+	now := time.Now().UTC()
+	stale := make(map[string]bool)
+	for _, prefix := range prefixes {
+		if meta, ok := metadata[prefix]; ok && now.Sub(meta.LastSearched) >= searchedUpdateInterval {
+			stale[prefix] = true
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	// Failing to record usage only makes compression less precise
+	current := m.loadAllMetadata()
+	for prefix := range stale {
+		if meta, ok := current[prefix]; ok {
+			meta.LastSearched = now
+		}
+	}
+	_ = m.saveAllMetadata(current)
+}
+
+// updateMetadata applies update to the stored metadata of one index
+func (m *IndexManager) updateMetadata(prefix string, update func(*indexMetadata)) error {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	meta, ok := metadata[prefix]
+	if !ok {
+		return nil
+	}
+	update(meta)
+	return m.saveAllMetadata(metadata)
+}
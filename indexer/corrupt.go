@@ -0,0 +1,204 @@
+package indexer
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+	"github.com/sourcegraph/zoekt/search"
+)
+
+// CorruptIndex is an index that was left out of a search because one of its
+// shards cannot be loaded, and needs to be rebuilt
+type CorruptIndex struct {
+	Name      string `json:"name"`
+	SourceDir string `json:"source_dir"`
+	Shard     string `json:"shard"`
+	Error     string `json:"error"`
+}
+
+// shardCheck is the outcome of loading a shard file, valid as long as the
+// file keeps its size and modification time
+type shardCheck struct {
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+// checkShard loads a shard the way the searcher does and reports why it
+// fails, if it does
+func checkShard(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	indexFile, err := index.NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	searcher, err := index.NewSearcher(indexFile)
+	if err != nil {
+		indexFile.Close()
+		return err
+	}
+	searcher.Close()
+	return nil
+}
+
+// checkShards sorts the shard files in dir into the ones that load and the
+// ones that do not, with their errors, by file name. Shards are only loaded
+// again once they change.
+func (m *IndexManager) checkShards(dir string) (healthy []string, corrupt map[string]error, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	m.shardChecksMu.Lock()
+	defer m.shardChecksMu.Unlock()
+	checks := make(map[string]shardCheck)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".zoekt") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			// Removed meanwhile, or a link to a missing file
+			continue
+		}
+		check, ok := m.shardChecks[path]
+		if !ok || check.size != info.Size() || !check.modTime.Equal(info.ModTime()) {
+			check = shardCheck{size: info.Size(), modTime: info.ModTime(), err: checkShard(path)}
+		}
+		checks[path] = check
+		if check.err != nil {
+			if corrupt == nil {
+				corrupt = make(map[string]error)
+			}
+			corrupt[name] = check.err
+			continue
+		}
+		healthy = append(healthy, name)
+	}
+	m.shardChecks = checks
+	return healthy, corrupt, nil
+}
+
+// openSearcher loads the shards in dir for searching. Shards that fail to
+// load are left out rather than failing every search, and returned by file
+// name so the indexes they belong to can be reported.
+func (m *IndexManager) openSearcher(dir string) (zoekt.Streamer, map[string]error, error) {
+	healthy, corrupt, err := m.checkShards(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load index: %w", err)
+	}
+	if len(corrupt) == 0 {
+		searcher, err := search.NewDirectorySearcher(dir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load index: %w", err)
+		}
+		return searcher, nil, nil
+	}
+
+	// Search a directory of links to the healthy shards instead
+	linkDir, err := os.MkdirTemp("", "code-index-healthy-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+	for _, name := range healthy {
+		if err := os.Symlink(filepath.Join(dir, name), filepath.Join(linkDir, name)); err != nil {
+			os.RemoveAll(linkDir)
+			return nil, nil, fmt.Errorf("failed to link %s: %w", name, err)
+		}
+	}
+	searcher, err := search.NewDirectorySearcher(linkDir)
+	if err != nil {
+		os.RemoveAll(linkDir)
+		return nil, nil, fmt.Errorf("failed to load index: %w", err)
+	}
+	return &linkedSearcher{Streamer: searcher, dir: linkDir}, corrupt, nil
+}
+
+// linkedSearcher searches a temporary directory of shard links, which it
+// removes when closed
+type linkedSearcher struct {
+	zoekt.Streamer
+	dir string
+}
+
+func (s *linkedSearcher) Close() {
+	s.Streamer.Close()
+	os.RemoveAll(s.dir)
+}
+
+// shardFileMatches reports whether the shard file name belongs to the
+// shards with the given prefix, which Zoekt may have query-escaped
+func shardFileMatches(name string, shardPrefix string) bool {
+	loc := shardVersion.FindStringIndex(name)
+	if loc == nil {
+		return false
+	}
+	prefix := name[:loc[0]]
+	if unescaped, err := url.QueryUnescape(prefix); err == nil && unescaped == shardPrefix {
+		return true
+	}
+	return prefix == shardPrefix
+}
+
+// corruptIndexes returns the searched indexes whose shards are among the
+// corrupt shard files, sorted by name
+func corruptIndexes(corrupt map[string]error, metadata map[string]*indexMetadata, searched []string) []CorruptIndex {
+	if len(corrupt) == 0 {
+		return nil
+	}
+	names := slices.Sorted(maps.Keys(corrupt))
+	var indexes []CorruptIndex
+	for _, prefix := range slices.Sorted(slices.Values(searched)) {
+		meta, ok := metadata[prefix]
+		if !ok {
+			continue
+		}
+		shardPrefix := meta.shardPrefix(prefix)
+		for _, name := range names {
+			if shardFileMatches(name, shardPrefix) {
+				indexes = append(indexes, CorruptIndex{
+					Name:      prefix,
+					SourceDir: meta.dir(),
+					Shard:     name,
+					Error:     corrupt[name].Error(),
+				})
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// addCorruptWarnings records the indexes left out of a search for corrupt
+// shards, with a warning before the lines unless opts.Terse is set
+func (sr *SearchResult) addCorruptWarnings(indexes []CorruptIndex, opts SearchOptions) {
+	if len(indexes) == 0 {
+		return
+	}
+	sr.CorruptIndexes = indexes
+	if opts.Terse {
+		return
+	}
+	lines := make([]string, 0, len(indexes)+len(sr.Lines))
+	for _, corrupt := range indexes {
+		lines = append(lines, fmt.Sprintf("[Warning: index %s (%s) was left out of the search: shard %s cannot be loaded (%s). Re-index the directory to rebuild it]",
+			corrupt.Name, corrupt.SourceDir, corrupt.Shard, corrupt.Error))
+	}
+	sr.Lines = append(lines, sr.Lines...)
+}
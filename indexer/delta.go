@@ -0,0 +1,234 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// maxDeltaBuilds is how many delta builds may be stacked on a full build
+// before the next re-index rebuilds it, since every delta adds a shard
+const maxDeltaBuilds = 10
+
+// maxDirtyFiles is the most uncommitted changes recorded for the next delta
+// build; a checkout with more is fully rebuilt next time
+const maxDirtyFiles = 1000
+
+// deltaBase returns the commit and uncommitted changes of a checkout for
+// the next delta build to start from, or "" if delta builds are not
+// possible. The changes must be listed before the files are read, so a file
+// modified in between is picked up again next time.
+func deltaBase(ctx context.Context, filter *sourceFilter, gitHead string) (string, []string) {
+	if gitHead == "" || filter.root == "" {
+		return "", nil
+	}
+	dirty, err := gitDirtyFiles(ctx, filter.root)
+	if err != nil || len(dirty) > maxDirtyFiles {
+		return "", nil
+	}
+	commit, _, _ := strings.Cut(gitHead, ":")
+	return commit, dirty
+}
+
+// deltaIndex updates the index of absPath with only the files that changed
+// since it was built: the files changed between the indexed commit and HEAD
+// according to git diff, plus uncommitted changes then and now. Changed
+// files are tombstoned in the existing shards and added to a new delta
+// shard. It returns false if a full build is needed instead, for example
+// because there is no previous index or too much has changed.
+func (m *IndexManager) deltaIndex(ctx context.Context, absPath string, walkRoot string, filter *sourceFilter, gitHead string, opts index.Options) (bool, error) {
+	prefix := m.getIndexPrefix(absPath)
+	metadata := m.loadAllMetadata()
+	old, ok := metadata[prefix]
+	if !ok || old.IndexedCommit == "" || gitHead == "" || old.DeltaBuilds >= maxDeltaBuilds {
+		return false, nil
+	}
+	// Encrypted and chunked shards, and shards other checkouts share, are
+	// always rebuilt
+	if m.Encrypted() || m.buildOptions.ChunkLargeFiles || old.SharedWith != "" {
+		return false, nil
+	}
+	// Git does not see changes behind followed links
+	if old.FollowSymlinks || filter.followSymlinks {
+		return false, nil
+	}
+	for other, meta := range metadata {
+		if meta.SharedWith == prefix && other != prefix {
+			return false, nil
+		}
+	}
+	// Changed filters affect files git does not report as changed
+	if old.TrackedOnly != (filter.tracked != nil) || !slices.Equal(old.Sparse, filter.sparsePatterns()) || !slices.Equal(old.IgnorePatterns, filter.ignorePatterns) || old.MaxFileSize != filter.maxFileSize {
+		return false, nil
+	}
+	if old.NoDefaultExcludes != filter.noDefaultExcludes {
+		return false, nil
+	}
+	if !slices.Equal(old.Submodules, filter.submodulePaths()) {
+		return false, nil
+	}
+	// Delta shards must have the branch of the shards they update
+	if old.Branch != gitBranch(absPath) {
+		return false, nil
+	}
+
+	indexedCommit, dirtyFiles := deltaBase(ctx, filter, gitHead)
+	if indexedCommit == "" {
+		return false, nil
+	}
+	committed, err := gitChangedFiles(ctx, filter.root, old.IndexedCommit)
+	if err != nil {
+		// The indexed commit may be gone after a rebase
+		return false, nil
+	}
+
+	// Collect the changes within the source directory, relative to it
+	changed := make(map[string]bool)
+	for _, name := range slices.Concat(committed, old.DirtyFiles, dirtyFiles) {
+		// Ignore rules apply to files git does not report as changed
+		if path.Base(name) == ".gitignore" {
+			return false, nil
+		}
+		if filter.repoPath == "" {
+			changed[name] = true
+		} else if rel, ok := strings.CutPrefix(name, filter.repoPath+"/"); ok {
+			changed[rel] = true
+		}
+	}
+	if len(changed)*2 > old.Files {
+		return false, nil
+	}
+
+	// Existing shards must have been built with the same options
+	if old.Compressed {
+		if err := m.decompressIndexes([]string{prefix}, metadata); err != nil {
+			return false, err
+		}
+	}
+	opts.IndexDir = m.indexDir
+	shards := opts.FindAllShards()
+	if len(shards) == 0 {
+		return false, nil
+	}
+	repos, _, err := index.ReadMetadataPathAlive(shards[0])
+	if err != nil || len(repos) != 1 || repos[0].IndexOptions != opts.GetHash() {
+		return false, nil
+	}
+
+	// Read every file to keep the statistics exact, but only keep the
+	// changed ones
+	var docs []index.Document
+	stats, err := m.walkSource(ctx, walkRoot, filter, opts.SizeMax, func(doc index.Document) error {
+		if changed[filepath.ToSlash(doc.Name)] {
+			docs = append(docs, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to index files: %w", err)
+	}
+
+	deltaBuilds := old.DeltaBuilds
+	if len(changed) > 0 {
+		defer m.buildOptions.setMemoryLimit()()
+
+		opts.IsDelta = true
+		builder, err := index.NewBuilder(opts)
+		if err != nil {
+			return false, nil
+		}
+		for name := range changed {
+			builder.MarkFileAsChangedOrRemoved(filepath.FromSlash(name))
+		}
+		for _, doc := range docs {
+			doc.Branches = branchNames(opts)
+			if err := builder.Add(doc); err != nil {
+				builder.Finish()
+				return false, fmt.Errorf("failed to index files: %w", err)
+			}
+		}
+		if err := builder.Finish(); err != nil {
+			return false, fmt.Errorf("failed to finish delta index: %w", err)
+		}
+		deltaBuilds++
+	}
+
+	meta := &indexMetadata{
+		IndexedAt:   time.Now().UTC(),
+		Files:       stats.files,
+		Bytes:       stats.bytes,
+		Languages:   stats.languages,
+		Skipped:     stats.skipped,
+		GitHead:     gitHead,
+		Fingerprint: stats.fingerprint,
+		Sparse:      filter.sparsePatterns(),
+		TrackedOnly: filter.tracked != nil,
+
+		IndexedCommit: indexedCommit,
+		DirtyFiles:    dirtyFiles,
+		DeltaBuilds:   deltaBuilds,
+		Submodules:    filter.submodulePaths(),
+		Symbols:       hasSymbols(opts),
+
+		IgnorePatterns:    filter.ignorePatterns,
+		MaxFileSize:       filter.maxFileSize,
+		FollowSymlinks:    filter.followSymlinks,
+		Branch:            gitBranch(absPath),
+		Commit:            gitCommit(gitHead),
+		NoDefaultExcludes: filter.noDefaultExcludes,
+	}
+	if owner := ownerFromContext(ctx); owner != "" {
+		meta.Owners = []string{owner}
+	}
+	if err := m.saveIndexMetadata(absPath, meta); err != nil {
+		return false, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return true, nil
+}
+
+// gitChangedFiles lists the files changed between commit and HEAD in the
+// repository at root, slash separated from the root
+func gitChangedFiles(ctx context.Context, root string, commit string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, gitBinary(), "-C", root, "diff", "--name-only", "--no-renames", "-z", commit, "HEAD", "--").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff against %s: %w", commit, err)
+	}
+	return splitNul(out), nil
+}
+
+// gitDirtyFiles lists the modified, staged, deleted and untracked files in
+// the checkout at root, slash separated from the root
+func gitDirtyFiles(ctx context.Context, root string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, gitBinary(), "-C", root, "status", "--porcelain", "-z", "--no-renames", "--untracked-files=all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+
+	// Entries are "XY path"
+	var files []string
+	for _, entry := range splitNul(out) {
+		if len(entry) > 3 {
+			files = append(files, entry[3:])
+		}
+	}
+	return files, nil
+}
+
+// splitNul splits NUL terminated git output
+func splitNul(out []byte) []string {
+	var fields []string
+	for _, field := range bytes.Split(out, []byte{0}) {
+		if len(field) > 0 {
+			fields = append(fields, string(field))
+		}
+	}
+	return fields
+}
@@ -0,0 +1,18 @@
+// Package indexer builds and searches local Zoekt code indexes. It is the
+// engine behind the code-index MCP server and can be embedded directly:
+//
+//	manager := indexer.NewIndexManager(indexDir)
+//	if err := manager.IndexDirectory(ctx, "/path/to/repo"); err != nil {
+//		return err
+//	}
+//	result, err := manager.Search(ctx, "func main", "/path/to/repo", indexer.DefaultSearchOptions())
+//
+// All indexes live side by side in one index directory; metadata.json in that
+// directory maps index names to the source directories they were built from.
+// Methods that take a context stop early when it is cancelled. Operations on
+// a directory without an index return an error wrapping ErrNotIndexed.
+//
+// The MCP tools use an index through the Backend interface. MemoryIndex is a
+// Backend that keeps its indexes in memory, for tests that should not build
+// shards on disk.
+package indexer
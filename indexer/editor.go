@@ -0,0 +1,136 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// editorSchemes are the editor URL templates known by name. {path} is the
+// absolute path of the file, slash separated and starting with a slash, and
+// {line} the line number.
+var editorSchemes = map[string]string{
+	"vscode":          "vscode://file{path}:{line}",
+	"vscode-insiders": "vscode-insiders://file{path}:{line}",
+	"cursor":          "cursor://file{path}:{line}",
+	"windsurf":        "windsurf://file{path}:{line}",
+	"idea":            "idea://open?file={path}&line={line}",
+	"sublime":         "subl://open?url=file://{path}&line={line}",
+}
+
+// editorOpenPath is the web server endpoint result links point to when an
+// editor is set, which redirects to the editor URL of the file
+const editorOpenPath = "/open"
+
+// EditorURL returns the URL template of an editor: the name of a known
+// editor such as vscode, or a template with a {path} placeholder and
+// optionally {line}, such as "myeditor://open?file={path}&line={line}". An
+// empty editor or "browser" returns "", for showing files in the browser.
+func EditorURL(editor string) (string, error) {
+	if editor == "" || strings.EqualFold(editor, "browser") {
+		return "", nil
+	}
+	if template, ok := editorSchemes[strings.ToLower(editor)]; ok {
+		return template, nil
+	}
+	if !strings.Contains(editor, "{path}") {
+		return "", fmt.Errorf("invalid editor %q: use a known editor (vscode, vscode-insiders, cursor, windsurf, idea, sublime) or a URL template with {path} and {line}", editor)
+	}
+	u, err := url.Parse(strings.NewReplacer("{path}", "/", "{line}", "1").Replace(editor))
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("invalid editor URL template %q: it must be an absolute URL", editor)
+	}
+	if u.Scheme == "javascript" || u.Scheme == "data" {
+		return "", fmt.Errorf("invalid editor URL template %q: scheme %s is not allowed", editor, u.Scheme)
+	}
+	return editor, nil
+}
+
+// editorLink fills in an editor URL template for the file at absPath
+func editorLink(template string, absPath string, line int) string {
+	p := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(p, "/") {
+		// Windows drive paths such as C:/src
+		p = "/" + p
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		// Keep drive letters such as C: readable
+		if i != 1 || !strings.HasSuffix(segment, ":") {
+			segments[i] = url.PathEscape(segment)
+		}
+	}
+	return strings.NewReplacer("{path}", strings.Join(segments, "/"), "{line}", strconv.Itoa(line)).Replace(template)
+}
+
+// editorStreamer points the file and line links of web UI results at the
+// open endpoint, in place of the repository URLs of the shards
+type editorStreamer struct {
+	zoekt.Streamer
+}
+
+func (s *editorStreamer) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	result, err := s.Streamer.Search(ctx, q, opts)
+	if err == nil {
+		setEditorLinks(result)
+	}
+	return result, err
+}
+
+func (s *editorStreamer) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) error {
+	return s.Streamer.StreamSearch(ctx, q, opts, zoekt.SenderFunc(func(result *zoekt.SearchResult) {
+		setEditorLinks(result)
+		sender.Send(result)
+	}))
+}
+
+// setEditorLinks sets the link templates of the repositories in result to
+// the open endpoint. The web UI appends the line template to the file link.
+func setEditorLinks(result *zoekt.SearchResult) {
+	if result.RepoURLs == nil {
+		result.RepoURLs = make(map[string]string)
+	}
+	if result.LineFragments == nil {
+		result.LineFragments = make(map[string]string)
+	}
+	for _, fileMatch := range result.Files {
+		repo := fileMatch.Repository
+		result.RepoURLs[repo] = editorOpenPath + "?r=" + url.QueryEscape(repo) + "&f={{urlquery .Path}}"
+		result.LineFragments[repo] = "&l={{.LineNumber}}"
+	}
+}
+
+// editorHandler serves the open endpoint: it redirects to the editor URL of
+// the file f of the index r, at line l
+func editorHandler(searcher zoekt.Streamer, template string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repo, name := r.URL.Query().Get("r"), r.URL.Query().Get("f")
+		line, _ := strconv.Atoi(r.URL.Query().Get("l"))
+		if repo == "" || name == "" {
+			http.Error(w, "missing index or file", http.StatusBadRequest)
+			return
+		}
+
+		// Only files of the served indexes can be opened
+		list, err := searcher.List(r.Context(), query.NewRepoSet(repo), nil)
+		if err != nil || len(list.Repos) == 0 || list.Repos[0].Repository.Source == "" {
+			http.Error(w, "unknown index", http.StatusNotFound)
+			return
+		}
+		sourceDir := list.Repos[0].Repository.Source
+		fileName, lineOffset := splitChunkName(name)
+		absPath := filepath.Join(sourceDir, filepath.FromSlash(fileName))
+		if !containsPath(sourceDir, absPath) {
+			http.Error(w, "file is outside of the index", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, editorLink(template, absPath, max(line, 1)+lineOffset), http.StatusFound)
+	}
+}
@@ -0,0 +1,104 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// enclosingKinds are the ctags kinds of symbols whose body holds the lines
+// after their definition
+var enclosingKinds = []string{"function", "func", "method", "class", "struct", "interface", "trait", "module", "namespace"}
+
+// definition is where a symbol enclosing later lines is defined
+type definition struct {
+	line  int
+	label string // E.g. "func ValidateToken" or "method Server.Start"
+}
+
+// enclosingSymbols holds the definitions of the files of a result that may
+// enclose their matched lines, by repository and file name, in line order
+type enclosingSymbols map[string][]definition
+
+// findEnclosingSymbols looks up the function, method and class definitions
+// of files in the symbol data of the index
+func findEnclosingSymbols(ctx context.Context, searcher zoekt.Searcher, files []zoekt.FileMatch) (enclosingSymbols, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	var repos []string
+	var names []query.Q
+	for _, fileMatch := range files {
+		if !slices.Contains(repos, fileMatch.Repository) {
+			repos = append(repos, fileMatch.Repository)
+		}
+		re, err := syntax.Parse("^"+regexp.QuoteMeta(fileMatch.FileName)+"$", syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file name: %w", err)
+		}
+		names = append(names, &query.Regexp{Regexp: re, FileName: true, CaseSensitive: true})
+	}
+	q := query.NewAnd(query.NewRepoSet(repos...), query.NewOr(names...), &query.Symbol{Expr: mustRegexpQuery(`\w`, false)})
+	result, err := searcher.Search(ctx, q, &zoekt.SearchOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up symbols: %w", err)
+	}
+
+	symbols := make(enclosingSymbols)
+	for _, fileMatch := range result.Files {
+		key := fileMatch.Repository + "\x00" + fileMatch.FileName
+		for _, lineMatch := range fileMatch.LineMatches {
+			for _, fragment := range lineMatch.LineFragments {
+				if label := definitionLabel(fragment.SymbolInfo, fileMatch.Language); label != "" {
+					symbols[key] = append(symbols[key], definition{line: lineMatch.LineNumber, label: label})
+					break
+				}
+			}
+		}
+		slices.SortStableFunc(symbols[key], func(a, b definition) int { return a.line - b.line })
+	}
+	return symbols, nil
+}
+
+// definitionLabel describes a symbol that encloses the lines after it, or
+// returns "" for other symbols such as variables and fields
+func definitionLabel(sym *zoekt.Symbol, language string) string {
+	if sym == nil || sym.Sym == "" {
+		return ""
+	}
+	kind := strings.ToLower(sym.Kind)
+	// Python methods are members of their class
+	if kind == "member" && language == "Python" {
+		kind = "method"
+	}
+	if !slices.Contains(enclosingKinds, kind) {
+		return ""
+	}
+	name := sym.Sym
+	if sym.Parent != "" && slices.Contains(classKinds, strings.ToLower(sym.ParentKind)) {
+		name = sym.Parent + "." + name
+		if kind == "function" || kind == "func" {
+			kind = "method"
+		}
+	}
+	return kind + " " + name
+}
+
+// label returns the label of the definition nearest before line of a file,
+// counting lines as Zoekt does for the file match, or "" if there is none.
+// Symbol data has no end lines, so a line after the end of a function is
+// still labeled with it.
+func (e enclosingSymbols) label(fileMatch zoekt.FileMatch, line int) string {
+	definitions := e[fileMatch.Repository+"\x00"+fileMatch.FileName]
+	i, _ := slices.BinarySearchFunc(definitions, line+1, func(d definition, line int) int { return d.line - line })
+	if i == 0 {
+		return ""
+	}
+	return definitions[i-1].label
+}
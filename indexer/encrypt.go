@@ -0,0 +1,379 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted files start with encryptedMagic and a random base nonce,
+// followed by length-prefixed AES-256-GCM sealed chunks. Each chunk's nonce
+// is the base nonce XORed with its index, and the last chunk is marked in
+// the additional data so truncated files are detected.
+var encryptedMagic = []byte("CIXENC01")
+
+// encryptedChunkSize is the plaintext size of each sealed chunk
+const encryptedChunkSize = 1 << 20
+
+// encryptedShardSuffix is appended to the names of encrypted shard files
+const encryptedShardSuffix = ".enc"
+
+// ErrEncryptedIndex is returned when encrypted index files are found but no
+// encryption key is configured
+var ErrEncryptedIndex = errors.New("index is encrypted; configure the encryption key")
+
+// ParseEncryptionKey decodes a 32 byte AES-256 key given as base64 or hex,
+// e.g. the output of "openssl rand -base64 32"
+func ParseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 32 bytes encoded as base64 or hex (generate one with: openssl rand -base64 32)")
+}
+
+// SetEncryptionKey enables encryption at rest. Shards and metadata written
+// afterwards are encrypted with key; searches decrypt shards into a private
+// temporary directory, preferably in memory, that Close removes.
+func (m *IndexManager) SetEncryptionKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	m.aead = aead
+	return nil
+}
+
+// Encrypted reports whether encryption at rest is enabled
+func (m *IndexManager) Encrypted() bool {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	return m.aead != nil
+}
+
+// Close removes decrypted shard copies. The manager can still be used
+// afterwards; shards are decrypted again when needed.
+func (m *IndexManager) Close() error {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	if m.plainDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(m.plainDir)
+	m.plainDir = ""
+	return err
+}
+
+// searchDir returns the directory to open searchers on. Without encryption
+// this is the index directory. With encryption, it is the decrypted shard
+// cache, brought up to date with the encrypted shards first.
+func (m *IndexManager) searchDir() (string, error) {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	if m.aead == nil {
+		return m.indexDir, nil
+	}
+
+	if m.plainDir == "" {
+		dir, err := os.MkdirTemp(plaintextTempBase(), "code-index-plain-*")
+		if err != nil {
+			return "", fmt.Errorf("failed to create decrypted shard directory: %w", err)
+		}
+		m.plainDir = dir
+	}
+
+	entries, err := os.ReadDir(m.indexDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// Decrypt new or changed shards; link shards built before encryption
+	// was enabled
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		src := filepath.Join(m.indexDir, name)
+		switch {
+		case strings.HasSuffix(name, ".zoekt"+encryptedShardSuffix):
+			plainName := strings.TrimSuffix(name, encryptedShardSuffix)
+			wanted[plainName] = true
+			if err := m.syncDecryptedShard(src, filepath.Join(m.plainDir, plainName)); err != nil {
+				return "", fmt.Errorf("failed to decrypt %s: %w", name, err)
+			}
+		case strings.HasSuffix(name, ".zoekt"):
+			wanted[name] = true
+			dst := filepath.Join(m.plainDir, name)
+			if _, err := os.Lstat(dst); err != nil {
+				if err := os.Symlink(src, dst); err != nil {
+					return "", fmt.Errorf("failed to link %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	// Drop copies of deleted shards
+	cached, err := os.ReadDir(m.plainDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range cached {
+		if strings.HasSuffix(entry.Name(), ".zoekt") && !wanted[entry.Name()] {
+			os.Remove(filepath.Join(m.plainDir, entry.Name()))
+		}
+	}
+
+	return m.plainDir, nil
+}
+
+// buildDir returns the directory the builder writes shards to. With
+// encryption, shards are built in a private temporary directory and sealed
+// into the index directory by sealBuiltShards; cleanup removes it.
+func (m *IndexManager) buildDir() (dir string, cleanup func(), err error) {
+	if !m.Encrypted() {
+		return m.indexDir, func() {}, nil
+	}
+
+	dir, err = os.MkdirTemp(plaintextTempBase(), "code-index-build-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create build directory: %w", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// sealBuiltShards encrypts the shards in dir into the index directory. It
+// does nothing if dir is the index directory itself.
+func (m *IndexManager) sealBuiltShards(dir string) error {
+	if dir == m.indexDir {
+		return nil
+	}
+
+	shards, err := filepath.Glob(filepath.Join(dir, "*.zoekt"))
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		dst := filepath.Join(m.indexDir, filepath.Base(shard)+encryptedShardSuffix)
+		if err := encryptFile(m.aead, shard, dst); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", filepath.Base(shard), err)
+		}
+	}
+	return nil
+}
+
+// syncDecryptedShard decrypts src to dst unless dst is already a copy of
+// the current src. Copies carry the modification time of their source.
+func (m *IndexManager) syncDecryptedShard(src string, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && dstInfo.ModTime().Equal(srcInfo.ModTime()) {
+		return nil
+	}
+
+	if err := decryptFile(m.aead, src, dst); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime())
+}
+
+// plaintextTempBase returns where decrypted data is staged: the in-memory
+// /dev/shm where available, so plaintext never reaches disk, otherwise the
+// default temporary directory
+func plaintextTempBase() string {
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+	return ""
+}
+
+// encryptFile encrypts src into dst, replacing dst atomically
+func encryptFile(aead cipher.AEAD, src string, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		return sealStream(aead, w, r)
+	})
+}
+
+// decryptFile decrypts src into dst, replacing dst atomically
+func decryptFile(aead cipher.AEAD, src string, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		return openStream(aead, w, r)
+	})
+}
+
+// transformFile writes transform(src) to a temporary file next to dst and
+// renames it into place
+func transformFile(src string, dst string, transform func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	w := bufio.NewWriter(out)
+	if err := transform(w, bufio.NewReader(in)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// sealBytes encrypts a small payload such as the metadata file
+func sealBytes(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := sealStream(aead, &buf, bytes.NewReader(plaintext)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openBytes decrypts a payload produced by sealBytes
+func openBytes(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openStream(aead, &buf, bytes.NewReader(ciphertext)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isEncrypted reports whether data starts with the encrypted file header
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// chunkNonce derives the nonce of chunk i from the base nonce
+func chunkNonce(base []byte, i uint64) []byte {
+	nonce := bytes.Clone(base)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+	return nonce
+}
+
+// chunkAD is the additional data of a chunk, marking the final one
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealStream encrypts r into w in the chunked format
+func sealStream(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	base := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(base); err != nil {
+		return err
+	}
+	if _, err := w.Write(encryptedMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(base); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, encryptedChunkSize)
+	buf := make([]byte, encryptedChunkSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// The chunk is final if nothing follows it
+		final := err != nil
+		if !final {
+			if _, peekErr := br.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+
+		sealed := aead.Seal(nil, chunkNonce(base, i), buf[:n], chunkAD(final))
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// openStream decrypts the chunked format from r into w
+func openStream(aead cipher.AEAD, w io.Writer, r io.Reader) error {
+	header := make([]byte, len(encryptedMagic)+aead.NonceSize())
+	if _, err := io.ReadFull(r, header); err != nil || !isEncrypted(header) {
+		return fmt.Errorf("not an encrypted index file")
+	}
+	base := header[len(encryptedMagic):]
+
+	maxSealed := encryptedChunkSize + aead.Overhead()
+	sealed := make([]byte, maxSealed)
+	for i := uint64(0); ; i++ {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return fmt.Errorf("encrypted file is truncated")
+		}
+		n := int(binary.BigEndian.Uint32(size[:]))
+		if n > maxSealed {
+			return fmt.Errorf("encrypted file is corrupt")
+		}
+		if _, err := io.ReadFull(r, sealed[:n]); err != nil {
+			return fmt.Errorf("encrypted file is truncated")
+		}
+
+		// Try the chunk as a middle chunk first, then as the last one
+		final := false
+		plain, err := aead.Open(nil, chunkNonce(base, i), sealed[:n], chunkAD(false))
+		if err != nil {
+			plain, err = aead.Open(nil, chunkNonce(base, i), sealed[:n], chunkAD(true))
+			final = true
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt: wrong key or corrupt file")
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package indexer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// testAEAD returns the AES-256-GCM cipher of a key filled with b
+func testAEAD(t *testing.T, b byte) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// testPlaintext returns n bytes of varying content
+func testPlaintext(n int) []byte {
+	plaintext := make([]byte, n)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	return plaintext
+}
+
+// sealTest encrypts plaintext in the chunked format
+func sealTest(t *testing.T, aead cipher.AEAD, plaintext []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	if err := sealStream(aead, &sealed, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("sealStream: %v", err)
+	}
+	return sealed.Bytes()
+}
+
+func TestSealStreamRoundTrip(t *testing.T) {
+	aead := testAEAD(t, 1)
+	for _, size := range []int{0, 1, encryptedChunkSize, encryptedChunkSize + 1} {
+		plaintext := testPlaintext(size)
+		sealed := sealTest(t, aead, plaintext)
+
+		var opened bytes.Buffer
+		if err := openStream(aead, &opened, bytes.NewReader(sealed)); err != nil {
+			t.Errorf("openStream of %d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(opened.Bytes(), plaintext) {
+			t.Errorf("openStream of %d bytes returned %d different bytes", size, opened.Len())
+		}
+	}
+}
+
+func TestOpenStreamRejectsTampering(t *testing.T) {
+	aead := testAEAD(t, 1)
+	header := len(encryptedMagic) + aead.NonceSize()
+	// Full chunks are sealed with a length prefix and the GCM tag
+	chunk := 4 + encryptedChunkSize + aead.Overhead()
+
+	// Three chunks, the first two full
+	sealed := sealTest(t, aead, testPlaintext(2*encryptedChunkSize+1))
+
+	swapped := bytes.Clone(sealed)
+	copy(swapped[header:], sealed[header+chunk:header+2*chunk])
+	copy(swapped[header+chunk:], sealed[header:header+chunk])
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		aead   cipher.AEAD
+	}{
+		{"truncated after the first chunk", sealed[:header+chunk], aead},
+		{"truncated after the second chunk", sealed[:header+2*chunk], aead},
+		{"truncated within a chunk", sealed[:header+chunk/2], aead},
+		{"chunks swapped", swapped, aead},
+		{"wrong key", sealed, testAEAD(t, 2)},
+		{"header only", sealed[:header], aead},
+		{"not encrypted", testPlaintext(100), aead},
+	}
+	for _, tt := range tests {
+		var opened bytes.Buffer
+		if err := openStream(tt.aead, &opened, bytes.NewReader(tt.sealed)); err == nil {
+			t.Errorf("%s: openStream succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestSealBytesRoundTrip(t *testing.T) {
+	aead := testAEAD(t, 1)
+	plaintext := []byte(`{"app_0123abcd":{}}`)
+	sealed, err := sealBytes(aead, plaintext)
+	if err != nil {
+		t.Fatalf("sealBytes: %v", err)
+	}
+	if !isEncrypted(sealed) {
+		t.Error("sealed bytes lack the encrypted file header")
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("sealed bytes contain the plaintext")
+	}
+	opened, err := openBytes(aead, sealed)
+	if err != nil {
+		t.Fatalf("openBytes: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("openBytes = %q, want %q", opened, plaintext)
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key := testPlaintext(32)
+	tests := []struct {
+		name  string
+		input string
+		ok    bool
+	}{
+		{"base64", base64.StdEncoding.EncodeToString(key), true},
+		{"base64 with newline", base64.StdEncoding.EncodeToString(key) + "\n", true},
+		{"hex", hex.EncodeToString(key), true},
+		{"upper case hex", strings.ToUpper(hex.EncodeToString(key)), true},
+		{"hex with spaces", "  " + hex.EncodeToString(key) + "  ", true},
+		{"short base64", base64.StdEncoding.EncodeToString(key[:16]), false},
+		{"short hex", hex.EncodeToString(key[:16]), false},
+		{"empty", "", false},
+		{"not encoded", "correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseEncryptionKey(tt.input)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: ParseEncryptionKey(%q) succeeded, want an error", tt.name, tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseEncryptionKey(%q): %v", tt.name, tt.input, err)
+		} else if !bytes.Equal(got, key) {
+			t.Errorf("%s: ParseEncryptionKey(%q) = %x, want %x", tt.name, tt.input, got, key)
+		}
+	}
+}
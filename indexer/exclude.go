@@ -0,0 +1,32 @@
+package indexer
+
+// defaultExcludes are gitignore-style patterns of files that are rarely
+// worth searching, per ecosystem: lockfiles, minified code, source maps and
+// test snapshots. Their generated content drowns out the code in results.
+// Indexes leave them out unless IndexOptions.NoDefaultExcludes is set, and
+// negated ignore patterns of an index bring single files back.
+var defaultExcludes = []struct {
+	ecosystem string
+	patterns  []string
+}{
+	{"JavaScript", []string{"package-lock.json", "npm-shrinkwrap.json", "yarn.lock", "pnpm-lock.yaml", "bun.lock", "*.min.js", "*.min.css", "*.map", "__snapshots__/", "*.snap"}},
+	{"Python", []string{"poetry.lock", "Pipfile.lock", "pdm.lock", "uv.lock"}},
+	{"Go", []string{"go.sum", "go.work.sum"}},
+	{"Rust", []string{"Cargo.lock"}},
+	{"Ruby", []string{"Gemfile.lock"}},
+	{"PHP", []string{"composer.lock"}},
+	{"Elixir", []string{"mix.lock"}},
+	{"Dart", []string{"pubspec.lock"}},
+	{"Swift", []string{"Package.resolved"}},
+	{".NET", []string{"packages.lock.json"}},
+}
+
+// defaultExcludePatterns returns the patterns of defaultExcludes of every
+// ecosystem
+func defaultExcludePatterns() []string {
+	var patterns []string
+	for _, ecosystem := range defaultExcludes {
+		patterns = append(patterns, ecosystem.patterns...)
+	}
+	return patterns
+}
@@ -0,0 +1,280 @@
+package indexer
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryTTL is how long the result of looking for the external tools is
+// used, so a tool installed while the server runs is found soon after
+const discoveryTTL = 5 * time.Minute
+
+// probeTimeout bounds running a tool to read its version and features
+const probeTimeout = 5 * time.Second
+
+// ExternalTool is an optional program some features need. Features whose
+// tool is missing report it rather than failing obscurely.
+type ExternalTool struct {
+	Name     string   `json:"name"`
+	UsedFor  string   `json:"used_for"`
+	Path     string   `json:"path,omitempty"` // Empty if the tool was not found or is not usable
+	Version  string   `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+	// Problem explains why the tool is not usable, e.g. that only an
+	// incompatible variant was found
+	Problem string `json:"problem,omitempty"`
+}
+
+// Available reports whether the tool was found and is usable
+func (t ExternalTool) Available() bool {
+	return t.Path != ""
+}
+
+// externalToolSpec describes how to find and check an external tool
+type externalToolSpec struct {
+	name    string
+	usedFor string
+	env     string   // Environment variable naming the binary
+	names   []string // Binary names to look for, in order
+	version []string // Arguments printing the version
+	// accept checks the version output, returning why the binary is not
+	// usable if it is not
+	accept func(version string) string
+	// features returns what the binary supports, of which require are
+	// needed
+	features func(ctx context.Context, path string) []string
+	require  []string
+}
+
+// Names of the external tools
+const (
+	toolCtags      = "universal-ctags"
+	toolScipCtags  = "scip-ctags"
+	toolGit        = "git"
+	toolTreeSitter = "tree-sitter"
+)
+
+// externalToolSpecs are the external tools, in the order they are reported
+var externalToolSpecs = []externalToolSpec{
+	{
+		name:    toolCtags,
+		usedFor: "symbol data for sym:, kind: and definition ranking (built when indexing)",
+		env:     "CTAGS_COMMAND",
+		// Debian packages install ctags-universal, Homebrew installs ctags
+		names:   []string{"universal-ctags", "ctags-universal", "uctags", "ctags"},
+		version: []string{"--version"},
+		accept: func(version string) string {
+			if !strings.Contains(version, "Universal Ctags") {
+				return "found a ctags that is not Universal Ctags (e.g. Exuberant or BSD ctags), which cannot produce symbol data"
+			}
+			return ""
+		},
+		features: func(ctx context.Context, path string) []string {
+			out, err := probe(ctx, path, "--list-features")
+			if err != nil {
+				return nil
+			}
+			var features []string
+			for _, line := range strings.Split(out, "\n") {
+				if fields := strings.Fields(line); len(fields) > 0 && fields[0] != "#NAME" {
+					features = append(features, fields[0])
+				}
+			}
+			return features
+		},
+		// Zoekt runs ctags in interactive mode, reading JSON output
+		require: []string{"json", "interactive"},
+	},
+	{
+		name:    toolScipCtags,
+		usedFor: "symbol data from SCIP ctags, for languages universal-ctags handles poorly (built when indexing)",
+		env:     "SCIP_CTAGS_COMMAND",
+		names:   []string{"scip-ctags"},
+		version: []string{"--version"},
+	},
+	{
+		name:    toolGit,
+		usedFor: "tracked_only, sparse checkouts, delta builds and search_history",
+		names:   []string{"git"},
+		version: []string{"--version"},
+	},
+	{
+		name:    toolTreeSitter,
+		usedFor: "ast_query",
+		env:     "CODE_INDEX_TREE_SITTER",
+		names:   []string{"tree-sitter"},
+		version: []string{"--version"},
+	},
+}
+
+// discovery caches the external tools found
+var discovery struct {
+	mu    sync.Mutex
+	at    time.Time
+	tools []ExternalTool
+}
+
+// ExternalTools returns the external tools and whether they are usable. The
+// result is cached for a few minutes.
+func ExternalTools() []ExternalTool {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+	if discovery.tools != nil && time.Since(discovery.at) < discoveryTTL {
+		return discovery.tools
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	tools := make([]ExternalTool, len(externalToolSpecs))
+	var wg sync.WaitGroup
+	for i, spec := range externalToolSpecs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tools[i] = spec.discover(ctx)
+		}()
+	}
+	wg.Wait()
+	discovery.tools, discovery.at = tools, time.Now()
+	return tools
+}
+
+// externalTool returns the path of the named external tool, or "" if it is
+// not usable
+func externalTool(name string) string {
+	for _, tool := range ExternalTools() {
+		if tool.Name == name {
+			return tool.Path
+		}
+	}
+	return ""
+}
+
+// gitBinary returns the git to run, falling back to the PATH lookup of
+// exec if git was not found, so the error names git
+func gitBinary() string {
+	if path := externalTool(toolGit); path != "" {
+		return path
+	}
+	return "git"
+}
+
+// discover looks for the tool: the binary named by its environment variable,
+// or the first of its names that is usable, on the PATH or in the common
+// install locations
+func (spec externalToolSpec) discover(ctx context.Context) ExternalTool {
+	tool := ExternalTool{Name: spec.name, UsedFor: spec.usedFor}
+	var problems []string
+	candidates := spec.names
+	if spec.env != "" {
+		if binary := os.Getenv(spec.env); binary != "" {
+			candidates = []string{binary}
+		}
+	}
+
+	for _, name := range candidates {
+		path := lookTool(name)
+		if path == "" {
+			continue
+		}
+		version, err := probe(ctx, path, spec.version...)
+		if err != nil {
+			problems = append(problems, "found "+path+" but it does not run: "+err.Error())
+			continue
+		}
+		if spec.accept != nil {
+			if problem := spec.accept(version); problem != "" {
+				problems = append(problems, problem+": "+path)
+				continue
+			}
+		}
+		var features []string
+		if spec.features != nil {
+			features = spec.features(ctx, path)
+		}
+		if missing := slices.DeleteFunc(slices.Clone(spec.require), func(f string) bool { return slices.Contains(features, f) }); len(missing) > 0 {
+			problems = append(problems, "found "+path+" but it was built without "+strings.Join(missing, " and ")+" support")
+			continue
+		}
+		tool.Path, tool.Features = path, features
+		tool.Version, _, _ = strings.Cut(strings.TrimSpace(version), "\n")
+		return tool
+	}
+	if len(problems) == 0 {
+		problems = append(problems, "not found on the PATH or in "+strings.Join(toolDirectories(), ", "))
+	}
+	tool.Problem = strings.Join(problems, "; ")
+	if spec.env != "" {
+		tool.Problem += "; set " + spec.env + " to the path of a usable binary"
+	}
+	return tool
+}
+
+// lookTool returns the path of a binary given by path or by name, looking
+// on the PATH and then in the common install locations, which are often
+// missing from the PATH of desktop apps
+func lookTool(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs
+		}
+		return path
+	}
+	if strings.ContainsRune(name, filepath.Separator) {
+		return ""
+	}
+	for _, dir := range toolDirectories() {
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// toolDirectories returns where package managers install binaries on this
+// platform and architecture, besides the PATH
+func toolDirectories() []string {
+	var dirs []string
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "darwin":
+		// Homebrew installs to /opt/homebrew on Apple Silicon and to
+		// /usr/local on Intel
+		if runtime.GOARCH == "arm64" {
+			dirs = append(dirs, "/opt/homebrew/bin")
+		}
+		dirs = append(dirs, "/usr/local/bin", "/opt/local/bin")
+	case "windows":
+		if local := os.Getenv("LOCALAPPDATA"); local != "" {
+			dirs = append(dirs, filepath.Join(local, "Microsoft", "WinGet", "Links"))
+		}
+		if home != "" {
+			dirs = append(dirs, filepath.Join(home, "scoop", "shims"))
+		}
+		if programData := os.Getenv("ProgramData"); programData != "" {
+			dirs = append(dirs, filepath.Join(programData, "chocolatey", "bin"))
+		}
+	default:
+		dirs = append(dirs, "/usr/local/bin", "/home/linuxbrew/.linuxbrew/bin", "/snap/bin")
+	}
+	if home != "" {
+		dirs = append(dirs, filepath.Join(home, ".local", "bin"), filepath.Join(home, "go", "bin"))
+	}
+	if gopath := os.Getenv("GOPATH"); gopath != "" && !slices.Contains(dirs, filepath.Join(gopath, "bin")) {
+		dirs = append(dirs, filepath.Join(gopath, "bin"))
+	}
+	return dirs
+}
+
+// probe runs a tool and returns its output
+func probe(ctx context.Context, path string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, path, args...).Output()
+	return string(out), err
+}
@@ -0,0 +1,167 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sourceFilter excludes paths from a source directory based on the git
+// checkout it belongs to (sparse checkout, ignore rules, tracked files and
+// submodules) and the ignore patterns of the index, on top of the built-in
+// skip rules
+type sourceFilter struct {
+	root string // Root of the git repository, "" outside of git
+	// repoPath is the source directory relative to the repository root,
+	// slash separated and "" at the root
+	repoPath string
+	sparse   *sparseCheckout
+	ignore   *gitIgnore
+	// submodules holds the submodule paths, which get indexes of their own
+	submodules map[string]bool
+
+	// tracked holds the files tracked by git and trackedDirs the
+	// directories containing them, if only tracked files are indexed
+	tracked     map[string]bool
+	trackedDirs map[string]bool
+
+	// ignorePatterns are the gitignore-style patterns of the index, relative
+	// to the source directory, and custom their parsed form
+	ignorePatterns []string
+	custom         []gitPattern
+	// defaults are the parsed defaultExcludes, unless noDefaultExcludes
+	// turns them off for the index
+	defaults          []gitPattern
+	noDefaultExcludes bool
+
+	// maxFileSize is the size in bytes above which files are left out; 0
+	// for no limit and -1 if the index turned off the default limit
+	maxFileSize int64
+	// followSymlinks walks the targets of symbolic links, see walkTree
+	followSymlinks bool
+}
+
+// oversized reports whether a file of the given size is over the size limit
+func (f *sourceFilter) oversized(size int64) bool {
+	return f.maxFileSize > 0 && size > f.maxFileSize
+}
+
+// newSourceFilter returns the filter for the source directory absPath. A
+// directory outside of git gets a filter that excludes nothing, unless opts
+// asks for tracked files only.
+func newSourceFilter(ctx context.Context, absPath string, opts IndexOptions) (*sourceFilter, error) {
+	root, gitDir := findGitDir(absPath)
+	if gitDir == "" {
+		if opts.TrackedOnly {
+			return nil, fmt.Errorf("cannot index tracked files only: %s is not in a git repository", absPath)
+		}
+		f := &sourceFilter{maxFileSize: max(opts.MaxFileSize, -1), followSymlinks: opts.FollowSymlinks}
+		f.setIgnorePatterns(opts.IgnorePatterns, opts.NoDefaultExcludes)
+		return f, nil
+	}
+
+	f := &sourceFilter{root: root, sparse: loadSparseCheckout(gitDir), submodules: gitSubmodules(root), maxFileSize: max(opts.MaxFileSize, -1), followSymlinks: opts.FollowSymlinks}
+	if rel, err := filepath.Rel(root, absPath); err == nil && rel != "." {
+		f.repoPath = filepath.ToSlash(rel)
+	}
+	f.setIgnorePatterns(opts.IgnorePatterns, opts.NoDefaultExcludes)
+
+	if !opts.TrackedOnly {
+		f.ignore = loadGitIgnore(root, gitDir)
+		return f, nil
+	}
+
+	// Tracked files are indexed even if they match ignore rules, as in git
+	tracked, err := gitTrackedFiles(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	f.tracked = make(map[string]bool, len(tracked))
+	f.trackedDirs = make(map[string]bool)
+	for _, name := range tracked {
+		f.tracked[name] = true
+		for dir := path.Dir(name); dir != "." && !f.trackedDirs[dir]; dir = path.Dir(dir) {
+			f.trackedDirs[dir] = true
+		}
+	}
+	return f, nil
+}
+
+// gitTrackedFiles lists the files tracked in the repository at root, slash
+// separated from the root
+func gitTrackedFiles(ctx context.Context, root string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, gitBinary(), "-C", root, "ls-files", "-z").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracked files: %w", err)
+	}
+	return splitNul(out), nil
+}
+
+// excludes reports whether relPath, relative to the source directory,
+// should not be indexed
+func (f *sourceFilter) excludes(relPath string, isDir bool) bool {
+	name := path.Join(f.repoPath, filepath.ToSlash(relPath))
+	if isDir && f.submodules[name] {
+		return true
+	}
+	if f.sparse != nil && !f.sparse.includes(name, isDir) {
+		return true
+	}
+	if f.ignore != nil && f.ignore.ignores(name, isDir) {
+		return true
+	}
+	// The patterns of the index apply to tracked files too, and can bring
+	// back files of the default excludes
+	_, excluded := matchGitPatterns(f.defaults, name, isDir)
+	if matched, ignored := matchGitPatterns(f.custom, name, isDir); matched {
+		excluded = ignored
+	}
+	if excluded {
+		return true
+	}
+	if f.tracked != nil {
+		if isDir {
+			return !f.trackedDirs[name]
+		}
+		return !f.tracked[name]
+	}
+	return false
+}
+
+// setIgnorePatterns sets the ignore patterns of the index, which are
+// relative to the source directory, and the default excludes unless
+// noDefaults is set
+func (f *sourceFilter) setIgnorePatterns(patterns []string, noDefaults bool) {
+	f.ignorePatterns = normalizeIgnorePatterns(patterns)
+	f.custom = parseGitPatterns(f.ignorePatterns, f.repoPath)
+	f.noDefaultExcludes = noDefaults
+	if !noDefaults {
+		f.defaults = parseGitPatterns(defaultExcludePatterns(), f.repoPath)
+	}
+}
+
+// normalizeIgnorePatterns trims the ignore patterns of an index and drops
+// empty and repeated ones, or returns nil if none are left
+func normalizeIgnorePatterns(patterns []string) []string {
+	var normalized []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" && !slices.Contains(normalized, pattern) {
+			normalized = append(normalized, pattern)
+		}
+	}
+	return normalized
+}
+
+// sparsePatterns returns the sparse-checkout definition applied by the
+// filter, if any
+func (f *sourceFilter) sparsePatterns() []string {
+	if f.sparse == nil {
+		return nil
+	}
+	return f.sparse.patterns
+}
@@ -0,0 +1,295 @@
+package indexer
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitIdentity returns the commit checked out in the git repository that
+// contains dir, followed by the path of dir within the repository, e.g.
+// "3f2a...:src/app". Clones and worktrees of the same repository at the same
+// commit have the same identity. It returns "" if dir is not in a git
+// repository or its HEAD cannot be resolved.
+func gitIdentity(dir string) string {
+	root, gitDir := findGitDir(dir)
+	if gitDir == "" {
+		return ""
+	}
+
+	commit := resolveGitHead(gitDir)
+	if commit == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return ""
+	}
+	return commit + ":" + filepath.ToSlash(rel)
+}
+
+// gitCommit returns the commit of an identity returned by gitIdentity
+func gitCommit(identity string) string {
+	commit, _, _ := strings.Cut(identity, ":")
+	return commit
+}
+
+// ShortHash abbreviates a commit hash for display
+func ShortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// gitBranch returns the branch checked out in the git repository that
+// contains dir, like "main", or "" if HEAD is detached or dir is not in a
+// git repository
+func gitBranch(dir string) string {
+	_, gitDir := findGitDir(dir)
+	if gitDir == "" {
+		return ""
+	}
+	content, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "ref:")
+	if !ok {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(ref), "refs/heads/")
+}
+
+// shardBranch returns the branch name the shards of dir record: the branch
+// checked out, or HEAD when it is detached
+func shardBranch(dir string) string {
+	if branch := gitBranch(dir); branch != "" {
+		return branch
+	}
+	return "HEAD"
+}
+
+// findGitDir walks up from dir to the repository root and returns the root
+// and its git directory. Worktrees and submodules have a .git file pointing
+// to their git directory instead of a .git directory.
+func findGitDir(dir string) (string, string) {
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return dir, dotGit
+			}
+			content, err := os.ReadFile(dotGit)
+			if err != nil {
+				return "", ""
+			}
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir:")
+			if !ok {
+				return "", ""
+			}
+			gitDir = strings.TrimSpace(gitDir)
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return dir, gitDir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// resolveGitHead returns the commit hash HEAD points to, or "" if it cannot
+// be resolved
+func resolveGitHead(gitDir string) string {
+	content, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	head := strings.TrimSpace(string(content))
+
+	ref, ok := strings.CutPrefix(head, "ref:")
+	if !ok {
+		// Detached HEAD
+		return head
+	}
+	ref = strings.TrimSpace(ref)
+
+	// Worktrees share refs with the main repository
+	commonDir := gitCommonDir(gitDir)
+
+	// Loose refs take precedence over packed refs
+	for _, dir := range []string{gitDir, commonDir} {
+		if content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(content))
+		}
+	}
+	return packedRef(commonDir, ref)
+}
+
+// gitCommonDir returns the git directory holding the refs and config shared
+// by all worktrees of the repository gitDir belongs to
+func gitCommonDir(gitDir string) string {
+	content, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(content))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return commonDir
+}
+
+// gitConfigBool reports whether section.key is true in the repository
+// config, including per-worktree config. Includes are not followed.
+func gitConfigBool(gitDir string, section string, key string) bool {
+	value, _ := gitConfigValue(repoConfigFiles(gitDir), section, key)
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// repoConfigFiles returns the config files of a checkout in the order git
+// reads them, so later files take precedence
+func repoConfigFiles(gitDir string) []string {
+	return []string{
+		filepath.Join(gitCommonDir(gitDir), "config"),
+		filepath.Join(gitDir, "config.worktree"),
+	}
+}
+
+// gitConfigValue returns the value of section.key from the last of files
+// that sets it
+func gitConfigValue(files []string, section string, key string) (string, bool) {
+	var value string
+	var found bool
+	for _, path := range files {
+		if v, ok := readGitConfig(path, section, key); ok {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// readGitConfig returns the last value of section.key in a git config file.
+// A key without a value is true.
+func readGitConfig(path string, section string, key string) (string, bool) {
+	values := readGitConfigAll(path, section, key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// readGitConfigAll returns every value of section.key in a git config file,
+// across all subsections such as [submodule "name"]. A section given with
+// its subsection, like `remote "origin"`, only matches that subsection.
+func readGitConfigAll(path string, section string, key string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var values []string
+	current, full := "", ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			header, subsection, _ := strings.Cut(strings.Trim(line, "[]"), " ")
+			current = strings.ToLower(header)
+			full = current + " " + strings.TrimSpace(subsection)
+			continue
+		}
+		if current != strings.ToLower(section) && full != section {
+			continue
+		}
+
+		name, v, hasValue := strings.Cut(line, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), key) {
+			continue
+		}
+		value := "true"
+		if hasValue {
+			// Drop trailing comments and quotes
+			v, _, _ = strings.Cut(v, " #")
+			v, _, _ = strings.Cut(v, " ;")
+			value = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// packedRef looks up ref in the packed-refs file of a git directory
+func packedRef(gitDir string, ref string) string {
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, name, ok := strings.Cut(scanner.Text(), " ")
+		if ok && name == ref {
+			return hash
+		}
+	}
+	return ""
+}
+
+// gitRemoteRepo returns the repository name of the origin remote of the git
+// checkout containing dir, like "github.com/org/repo", and the path of dir
+// within the checkout. It returns "" if dir is not in a checkout with an
+// origin remote.
+func gitRemoteRepo(dir string) (string, string) {
+	root, gitDir := findGitDir(dir)
+	if gitDir == "" {
+		return "", ""
+	}
+	url, ok := gitConfigValue(repoConfigFiles(gitDir), `remote "origin"`, "url")
+	if !ok {
+		return "", ""
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", ""
+	}
+	return normalizeRepoName(url), filepath.ToSlash(rel)
+}
+
+// normalizeRepoName turns a clone URL such as "git@github.com:org/repo.git"
+// or "https://github.com/org/repo" into a repository name like
+// "github.com/org/repo"
+func normalizeRepoName(url string) string {
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		url = rest
+	} else if host, path, ok := strings.Cut(url, ":"); ok && !strings.Contains(host, "/") {
+		// scp-like syntax
+		url = host + "/" + path
+	}
+	// Drop credentials and ports
+	if _, rest, ok := strings.Cut(url, "@"); ok {
+		url = rest
+	}
+	if host, path, ok := strings.Cut(url, "/"); ok {
+		host, _, _ = strings.Cut(host, ":")
+		url = host + "/" + path
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+}
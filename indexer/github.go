@@ -0,0 +1,149 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultGitHubAPI is the API of github.com
+const defaultGitHubAPI = "https://api.github.com"
+
+// githubRemote searches the GitHub code search API. It is a fallback for
+// code not indexed locally: results from repositories with a local index
+// are left out.
+type githubRemote struct {
+	name   string
+	api    string
+	host   string // Host repositories are named under, e.g. "github.com"
+	token  string
+	client *http.Client
+}
+
+// newGitHubRemote creates a GitHub backend for the API at api, which is
+// api.github.com or the /api/v3 endpoint of GitHub Enterprise Server
+func newGitHubRemote(name string, api string, token string, client *http.Client) (*githubRemote, error) {
+	u, err := url.Parse(api)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("remote backend %s has invalid url %q", name, api)
+	}
+	host := strings.TrimPrefix(u.Hostname(), "api.")
+	return &githubRemote{name: name, api: api, host: host, token: token, client: client}, nil
+}
+
+func (r *githubRemote) Name() string {
+	return r.name
+}
+
+func (r *githubRemote) fallback() bool {
+	return true
+}
+
+func (r *githubRemote) Search(ctx context.Context, query string, opts SearchOptions) ([]RemoteFile, error) {
+	// GitHub code search has no regular expressions; the query is sent as
+	// written, with the language as its qualifier
+	if opts.Language != "" {
+		query += " language:" + opts.Language
+	}
+	params := url.Values{
+		"q":        {query},
+		"per_page": {strconv.Itoa(min(opts.MaxFiles, 100))},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.api+"/search/code?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	// Text matches hold the fragments of the files that matched
+	req.Header.Set("Accept", "application/vnd.github.text-match+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Message string `json:"message"`
+		Items   []struct {
+			Path       string `json:"path"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+			TextMatches []struct {
+				Property string        `json:"property"`
+				Fragment string        `json:"fragment"`
+				Matches  []githubMatch `json:"matches"`
+			} `json:"text_matches"`
+		} `json:"items"`
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(content, &reply); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("backend returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && r.token == "":
+			return nil, fmt.Errorf("GitHub code search needs a token: %s", reply.Message)
+		case reply.Message != "":
+			return nil, fmt.Errorf("backend returned %s: %s", resp.Status, reply.Message)
+		}
+		return nil, fmt.Errorf("backend returned %s", resp.Status)
+	}
+
+	var files []RemoteFile
+	for _, item := range reply.Items {
+		file := RemoteFile{Repository: r.host + "/" + item.Repository.FullName, Path: item.Path}
+		for _, match := range item.TextMatches {
+			if match.Property != "content" {
+				continue
+			}
+			file.Lines = append(file.Lines, fragmentLines(match.Fragment, match.Matches)...)
+		}
+		file.Matches = len(file.Lines)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// githubMatch is a match in a text match fragment
+type githubMatch struct {
+	Indices []int `json:"indices"` // Start and end offset in the fragment
+}
+
+// fragmentLines returns the lines of a GitHub text match fragment that hold
+// a match, once each. GitHub does not report line numbers.
+func fragmentLines(fragment string, matches []githubMatch) []RemoteLine {
+	var lines []RemoteLine
+	lastStart := -1
+	for _, match := range matches {
+		if len(match.Indices) == 0 || match.Indices[0] > len(fragment) {
+			continue
+		}
+		start := strings.LastIndexByte(fragment[:match.Indices[0]], '\n') + 1
+		if start == lastStart {
+			continue
+		}
+		lastStart = start
+		end := strings.IndexByte(fragment[start:], '\n')
+		if end < 0 {
+			end = len(fragment) - start
+		}
+		lines = append(lines, RemoteLine{Text: fragment[start : start+end]})
+	}
+	return lines
+}
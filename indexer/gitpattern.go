@@ -0,0 +1,117 @@
+package indexer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// gitPattern is one line of a gitignore-style pattern file
+type gitPattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseGitPatterns parses gitignore-style pattern lines. base is the
+// directory the patterns are relative to, as a slash separated path from the
+// repository root ("" for the root). Invalid patterns are ignored.
+func parseGitPatterns(lines []string, base string) []gitPattern {
+	var patterns []gitPattern
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are ignored unless escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimSuffix(line, " ")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p gitPattern
+		if rest, ok := strings.CutPrefix(line, "!"); ok {
+			p.negate = true
+			line = rest
+		}
+		if rest, ok := strings.CutSuffix(line, "/"); ok {
+			p.dirOnly = true
+			line = rest
+		}
+		// A slash anywhere but at the end anchors the pattern to base
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		expr := "^"
+		if base != "" {
+			expr += regexp.QuoteMeta(base) + "/"
+		}
+		if !anchored {
+			expr += "(?:.*/)?"
+		}
+		re, err := regexp.Compile(expr + globToRegexp(line) + "$")
+		if err != nil {
+			continue
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// globToRegexp converts a gitignore glob to a regular expression. "*" and
+// "?" do not match "/", while "**" matches across directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "/**":
+			b.WriteString("/.*")
+			i += 2
+		case glob[i:] == "**":
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// matchGitPatterns returns whether any pattern matches path, a slash
+// separated path from the repository root, and if so whether the last
+// matching pattern is positive (not negated)
+func matchGitPatterns(patterns []gitPattern, path string, isDir bool) (matched bool, positive bool) {
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(path) {
+			matched, positive = true, !p.negate
+		}
+	}
+	return matched, positive
+}
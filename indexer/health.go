@@ -0,0 +1,374 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// Reasons recorded in indexMetadata.Skipped
+const (
+	skipBinaryExtension = "binary_extension"
+	skipBinaryContent   = "binary_content"
+	// Sampled text with too many control characters or invalid UTF-8
+	skipBinaryRatio = "binary_ratio"
+	// Sampled text with null bytes after the sample; the name is indexed
+	skipBinaryAfterSample = "binary_after_sample"
+	skipUnreadable        = "unreadable"
+	skipTooLarge          = "too_large"
+	// Over the max file size of the index; left out, name included
+	skipMaxFileSize = "over_max_file_size"
+)
+
+// NgramStat is the posting list size of one trigram
+type NgramStat struct {
+	Ngram    string `json:"ngram"`
+	Postings int    `json:"postings_bytes"`
+}
+
+// IndexHealth holds diagnostics for a single index
+type IndexHealth struct {
+	Name          string         `json:"name"`
+	SourceDir     string         `json:"source_dir"`
+	Shards        int            `json:"shards"`
+	ShardBytes    int64          `json:"shard_bytes"`
+	Documents     int            `json:"documents"`
+	ContentBytes  int64          `json:"content_bytes"`
+	MemoryBytes   int64          `json:"memory_bytes"`
+	IndexOverhead float64        `json:"index_overhead"`
+	Lines         uint64         `json:"lines"`
+	Ngrams        int            `json:"ngrams"`
+	ShardNgrams   map[string]int `json:"shard_ngrams,omitempty"`
+	TopNgrams     []NgramStat    `json:"top_ngrams,omitempty"`
+	Skipped       map[string]int `json:"skipped_files,omitempty"`
+	Warnings      []string       `json:"warnings,omitempty"`
+}
+
+// topNgramCount is how many of the largest posting lists are reported
+const topNgramCount = 10
+
+// IndexHealth returns diagnostics for the index of sourceDir, or for all
+// indexes if sourceDir is empty
+func (m *IndexManager) IndexHealth(ctx context.Context, sourceDir string) ([]IndexHealth, error) {
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	metadata := m.loadAllMetadata()
+
+	// Compressed shards are restored so they can be inspected, counting as
+	// use so they are not compressed again meanwhile
+	m.markSearched(prefixes, metadata)
+	if err := m.decompressIndexes(prefixes, metadata); err != nil {
+		return nil, err
+	}
+
+	// Load per-repository statistics from Zoekt
+	searchDir, err := m.searchDir()
+	if err != nil {
+		return nil, err
+	}
+	searcher, corrupt, err := m.openSearcher(searchDir)
+	if err != nil {
+		return nil, err
+	}
+	defer searcher.Close()
+
+	repos, err := searcher.List(ctx, &query.Const{Value: true}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	stats := make(map[string]zoekt.RepoStats)
+	for _, entry := range repos.Repos {
+		stats[entry.Repository.Name] = entry.Stats
+	}
+
+	var result []IndexHealth
+	for _, prefix := range prefixes {
+		health := IndexHealth{
+			Name:      prefix,
+			SourceDir: metadata[prefix].dir(),
+			Skipped:   metadata[prefix].Skipped,
+		}
+
+		// The index no longer matches a checkout whose sparse-checkout
+		// definition changed
+		if !slices.Equal(metadata[prefix].Sparse, currentSparsePatterns(health.SourceDir)) {
+			health.Warnings = append(health.Warnings, "the git sparse-checkout definition changed since indexing; re-index the directory")
+		}
+
+		shardPrefix := metadata[prefix].shardPrefix(prefix)
+		if st, ok := stats[shardPrefix]; ok {
+			health.Documents = st.Documents
+			health.ContentBytes = st.ContentBytes
+			health.MemoryBytes = st.IndexBytes
+			health.Lines = st.NewLinesCount
+		}
+
+		shards, err := m.shardFiles(shardPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards: %w", err)
+		}
+		// Posting sizes of the same trigram are summed across shards
+		postings := make(map[string]int)
+		for _, shard := range shards {
+			if info, err := os.Stat(shard); err == nil {
+				health.ShardBytes += info.Size()
+			}
+			// Encrypted shards are loaded, and reported, as decrypted copies
+			plainName := strings.TrimSuffix(filepath.Base(shard), encryptedShardSuffix)
+			if err := corrupt[plainName]; err != nil {
+				health.Warnings = append(health.Warnings, fmt.Sprintf("shard %s cannot be loaded and is left out of searches: %v; re-index the directory", filepath.Base(shard), err))
+				continue
+			}
+			shardNgrams, err := readNgramStats(filepath.Join(searchDir, plainName))
+			if err != nil {
+				health.Warnings = append(health.Warnings, fmt.Sprintf("failed to read ngrams of %s: %v", filepath.Base(shard), err))
+				continue
+			}
+			if health.ShardNgrams == nil {
+				health.ShardNgrams = make(map[string]int)
+			}
+			health.ShardNgrams[filepath.Base(shard)] = len(shardNgrams)
+			for _, stat := range shardNgrams {
+				postings[stat.Ngram] += stat.Postings
+			}
+		}
+		health.Shards = len(shards)
+
+		ngrams := make([]NgramStat, 0, len(postings))
+		for ngram, size := range postings {
+			ngrams = append(ngrams, NgramStat{Ngram: ngram, Postings: size})
+		}
+		health.Ngrams = len(ngrams)
+		sort.Slice(ngrams, func(i, j int) bool { return ngrams[i].Postings > ngrams[j].Postings })
+		health.TopNgrams = ngrams[:min(topNgramCount, len(ngrams))]
+		if health.ContentBytes > 0 {
+			health.IndexOverhead = float64(health.ShardBytes) / float64(health.ContentBytes)
+		}
+
+		health.Warnings = append(health.Warnings, healthWarnings(health)...)
+		result = append(result, health)
+	}
+
+	return result, nil
+}
+
+// healthWarnings points out common causes of slow searches
+func healthWarnings(h IndexHealth) []string {
+	var warnings []string
+	if h.Shards == 0 {
+		warnings = append(warnings, "no shard files found; re-index the directory")
+	}
+	if h.IndexOverhead > 4 {
+		warnings = append(warnings, fmt.Sprintf("index is %.1fx the content size; minified or generated files inflate the index", h.IndexOverhead))
+	}
+	if len(h.TopNgrams) > 0 && h.ContentBytes > 0 && int64(h.TopNgrams[0].Postings) > h.ContentBytes/10 {
+		warnings = append(warnings, fmt.Sprintf("trigram %q is extremely common; queries built from it will scan most files", h.TopNgrams[0].Ngram))
+	}
+	if h.Skipped[skipTooLarge] > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d files exceeded the size limit and only their names are searchable; see chunk_large_files", h.Skipped[skipTooLarge]))
+	}
+	if h.Skipped[skipMaxFileSize] > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d files over the max file size of the index were left out entirely; re-index with a larger max_file_size to search them", h.Skipped[skipMaxFileSize]))
+	}
+	if h.Skipped[skipBinaryRatio] > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d files without null bytes were skipped as binary for their share of control characters and invalid UTF-8; raise binary_ratio if they are text", h.Skipped[skipBinaryRatio]))
+	}
+	if h.Skipped[skipBinaryAfterSample] > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d files looked like text at their start but contain null bytes further on, so only their names are searchable; raise binary_sample_kb to skip such files up front", h.Skipped[skipBinaryAfterSample]))
+	}
+	return warnings
+}
+
+// Layout of a shard as written by Zoekt: the file ends with the offset and
+// size of the table of contents, which lists the offset and size of each
+// section
+const (
+	// A table of contents starting with a section count of 0 lists each
+	// section by tag and kind
+	tocTagged = 0
+	// Kinds of a tagged section; simple sections are an offset and size,
+	// compound ones are followed by the offset and size of their index
+	sectionSimple       = 0
+	sectionCompound     = 1
+	sectionCompoundLazy = 2
+	// Each trigram is stored as 3 runes of 21 bits in 8 bytes
+	ngramEncoding = 8
+	ngramRuneBits = 21
+)
+
+// shardSection is the offset and size of a section of a shard
+type shardSection struct {
+	Off uint32
+	Sz  uint32
+}
+
+// readNgramStats returns the posting list size of every trigram in a shard.
+// Zoekt only exposes these through PrintNgramStats, which writes to stdout,
+// so the trigram and posting sections are located in the table of contents
+// and read directly.
+func readNgramStats(shard string) ([]NgramStat, error) {
+	f, err := os.Open(shard)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 8 {
+		return nil, errors.New("shard is too short")
+	}
+	var toc shardSection
+	if err := binary.Read(io.NewSectionReader(f, info.Size()-8, 8), binary.BigEndian, &toc); err != nil {
+		return nil, err
+	}
+	contents, err := readShardSection(f, info.Size(), toc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table of contents: %w", err)
+	}
+
+	ngramText, postings, postingIndex, err := ngramSections(contents)
+	if err != nil {
+		return nil, err
+	}
+	text, err := readShardSection(f, info.Size(), ngramText)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trigrams: %w", err)
+	}
+	index, err := readShardSection(f, info.Size(), postingIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read posting index: %w", err)
+	}
+	count := len(text) / ngramEncoding
+	if len(index) != 4*count {
+		return nil, fmt.Errorf("%d trigrams but %d posting lists", count, len(index)/4)
+	}
+
+	// Posting lists are stored back to back, so each ends where the next
+	// starts and the last at the end of the posting data
+	stats := make([]NgramStat, count)
+	end := postings.Off + postings.Sz
+	for i := count - 1; i >= 0; i-- {
+		start := binary.BigEndian.Uint32(index[4*i:])
+		if start > end {
+			return nil, fmt.Errorf("posting list of trigram %d is out of order", i)
+		}
+		ngram := binary.BigEndian.Uint64(text[ngramEncoding*i:])
+		const runeMask = 1<<ngramRuneBits - 1
+		runes := []rune{
+			rune((ngram >> (2 * ngramRuneBits)) & runeMask),
+			rune((ngram >> ngramRuneBits) & runeMask),
+			rune(ngram & runeMask),
+		}
+		stats[i] = NgramStat{Ngram: string(runes), Postings: int(end - start)}
+		end = start
+	}
+	return stats, nil
+}
+
+// legacySections are the kinds of the leading sections of a shard with an
+// untagged table of contents, which lists them in this fixed order
+var legacySections = []struct {
+	tag  string
+	kind uint64
+}{
+	{"metaData", sectionSimple},
+	{"repoMetaData", sectionSimple},
+	{"fileContents", sectionCompound},
+	{"fileNames", sectionCompound},
+	{"fileSections", sectionCompound},
+	{"fileEndSymbol", sectionSimple},
+	{"symbolMap", sectionCompoundLazy},
+	{"symbolKindMap", sectionCompound},
+	{"symbolMetaData", sectionSimple},
+	{"newlines", sectionCompound},
+	{"ngramText", sectionSimple},
+	{"postings", sectionCompound},
+}
+
+// ngramSections finds the trigram section and the posting data and index
+// sections in a table of contents
+func ngramSections(contents []byte) (ngramText, postings, postingIndex shardSection, err error) {
+	r := bytes.NewReader(contents)
+	var sectionCount uint32
+	if err := binary.Read(r, binary.BigEndian, &sectionCount); err != nil {
+		return ngramText, postings, postingIndex, err
+	}
+
+	var foundText, foundPostings bool
+	for i := 0; r.Len() > 0; i++ {
+		var tag string
+		var kind uint64
+		if sectionCount == tocTagged {
+			tagLen, err := binary.ReadUvarint(r)
+			if err != nil {
+				return ngramText, postings, postingIndex, err
+			}
+			buf := make([]byte, tagLen)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return ngramText, postings, postingIndex, err
+			}
+			tag = string(buf)
+			if kind, err = binary.ReadUvarint(r); err != nil {
+				return ngramText, postings, postingIndex, err
+			}
+		} else if i < len(legacySections) {
+			tag, kind = legacySections[i].tag, legacySections[i].kind
+		} else {
+			// The trigram sections come before the remaining ones
+			break
+		}
+
+		var data, index shardSection
+		if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+			return ngramText, postings, postingIndex, err
+		}
+		switch kind {
+		case sectionSimple:
+		case sectionCompound, sectionCompoundLazy:
+			if err := binary.Read(r, binary.BigEndian, &index); err != nil {
+				return ngramText, postings, postingIndex, err
+			}
+		default:
+			return ngramText, postings, postingIndex, fmt.Errorf("unknown kind %d of section %s", kind, tag)
+		}
+
+		switch {
+		case tag == "ngramText" && kind == sectionSimple:
+			ngramText, foundText = data, true
+		case tag == "postings" && kind == sectionCompound:
+			postings, postingIndex, foundPostings = data, index, true
+		}
+	}
+	if !foundText || !foundPostings {
+		return ngramText, postings, postingIndex, errors.New("shard has no trigram sections")
+	}
+	return ngramText, postings, postingIndex, nil
+}
+
+// readShardSection reads one section of a shard of the given size
+func readShardSection(f *os.File, size int64, sec shardSection) ([]byte, error) {
+	if int64(sec.Off)+int64(sec.Sz) > size {
+		return nil, fmt.Errorf("section at %d of %d bytes is past the end of the shard", sec.Off, sec.Sz)
+	}
+	buf := make([]byte, sec.Sz)
+	if _, err := f.ReadAt(buf, int64(sec.Off)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
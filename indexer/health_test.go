@@ -0,0 +1,34 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIndexHealthNgrams(t *testing.T) {
+	m, src := indexFiles(t, 3)
+
+	health, err := m.IndexHealth(context.Background(), src)
+	if err != nil {
+		t.Fatalf("IndexHealth: %v", err)
+	}
+	if len(health) != 1 {
+		t.Fatalf("got health of %d indexes, want 1", len(health))
+	}
+	h := health[0]
+	if h.Ngrams == 0 {
+		t.Errorf("no trigrams reported, warnings: %v", h.Warnings)
+	}
+	if len(h.ShardNgrams) != h.Shards {
+		t.Errorf("trigrams reported for %d of %d shards", len(h.ShardNgrams), h.Shards)
+	}
+	for shard, n := range h.ShardNgrams {
+		// The index counts the distinct trigrams of all its shards
+		if n == 0 || n > h.Ngrams {
+			t.Errorf("shard %s has %d trigrams, index has %d", shard, n, h.Ngrams)
+		}
+	}
+	if len(h.TopNgrams) == 0 || h.TopNgrams[0].Postings == 0 {
+		t.Errorf("top trigrams = %v, want the largest posting lists", h.TopNgrams)
+	}
+}
@@ -0,0 +1,150 @@
+package indexer
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+)
+
+// DefaultHighlightStart and DefaultHighlightEnd are the markers put around
+// matched text when highlighting is requested without markers of its own
+const (
+	DefaultHighlightStart = "«"
+	DefaultHighlightEnd   = "»"
+)
+
+// ColorHighlightStart and ColorHighlightEnd are the ANSI escape sequences
+// put around matched text in color output: bold red, then a reset
+const (
+	ColorHighlightStart = "\x1b[1;31m"
+	ColorHighlightEnd   = "\x1b[0m"
+)
+
+// ANSI escape sequences dimming the file locations of color output
+const (
+	ansiDim   = "\x1b[2m"
+	ansiReset = "\x1b[0m"
+)
+
+// dim returns a file location dimmed if opts asks for color output
+func (opts SearchOptions) dim(location string) string {
+	if !opts.Color {
+		return location
+	}
+	return ansiDim + location + ansiReset
+}
+
+// span is a byte range of a line
+type span struct{ start, end int }
+
+// lineMatchSpans returns the matched byte ranges of a line match
+func lineMatchSpans(lineMatch zoekt.LineMatch) []span {
+	spans := make([]span, 0, len(lineMatch.LineFragments))
+	for _, fragment := range lineMatch.LineFragments {
+		spans = append(spans, span{fragment.LineOffset, fragment.LineOffset + fragment.MatchLength})
+	}
+	return spans
+}
+
+// chunkLineSpans returns the matched byte ranges of the line of a chunk
+// match that starts lineStart bytes into the chunk and is lineLen bytes long
+func chunkLineSpans(chunk zoekt.ChunkMatch, lineStart int, lineLen int) []span {
+	var spans []span
+	for _, r := range chunk.Ranges {
+		start := int(r.Start.ByteOffset) - int(chunk.ContentStart.ByteOffset) - lineStart
+		end := int(r.End.ByteOffset) - int(chunk.ContentStart.ByteOffset) - lineStart
+		if end <= 0 || start >= lineLen {
+			continue
+		}
+		spans = append(spans, span{max(start, 0), min(end, lineLen)})
+	}
+	return spans
+}
+
+// highlightLine shortens a matched line to opts.MaxLineLength runes like
+// truncateLine, and puts opts.HighlightStart and opts.HighlightEnd around
+// the matched byte ranges spans, which do not count towards the length. A
+// line too long to show whole is cut around its first match instead of at
+// its end, so the match stays visible.
+func highlightLine(line string, spans []span, opts SearchOptions) string {
+	maxLen := opts.MaxLineLength
+	if (opts.HighlightStart == "" && opts.HighlightEnd == "") || len(spans) == 0 || maxLen <= 6 {
+		return truncateLine(line, maxLen)
+	}
+
+	// Merge overlapping matches, dropping those beyond the line
+	spans = slices.Clone(spans)
+	slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+	var merged []span
+	for _, s := range spans {
+		s.end = min(s.end, len(line))
+		switch {
+		case s.start >= s.end:
+		case len(merged) > 0 && s.start <= merged[len(merged)-1].end:
+			merged[len(merged)-1].end = max(merged[len(merged)-1].end, s.end)
+		default:
+			merged = append(merged, s)
+		}
+	}
+	if len(merged) == 0 {
+		return truncateLine(line, maxLen)
+	}
+
+	// Byte offset of each rune; invalid bytes count as one rune each
+	var starts []int
+	for i := range line {
+		starts = append(starts, i)
+	}
+	runeAt := func(offset int) int { return sort.SearchInts(starts, offset) }
+
+	// Runes [from, to) are shown, leaving room for "..." where cut
+	from, to := 0, len(starts)
+	if len(starts) > maxLen {
+		to = maxLen - 3
+		if first := merged[0]; runeAt(first.end) > to {
+			// Show some context before the match
+			from = runeAt(first.start) - (maxLen-6)/4
+			to = from + maxLen - 6
+			if to >= len(starts) {
+				to = len(starts)
+				from = to - (maxLen - 3)
+			}
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("...")
+	}
+	next := 0 // First match not yet closed
+	open := false
+	for i := from; i < to; i++ {
+		offset := starts[i]
+		for !open && next < len(merged) && merged[next].end <= offset {
+			next++
+		}
+		if open && merged[next].end <= offset {
+			b.WriteString(opts.HighlightEnd)
+			open = false
+			next++
+		}
+		if !open && next < len(merged) && merged[next].start <= offset {
+			b.WriteString(opts.HighlightStart)
+			open = true
+		}
+		end := len(line)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		b.WriteString(strings.ToValidUTF8(line[offset:end], "\uFFFD"))
+	}
+	if open {
+		b.WriteString(opts.HighlightEnd)
+	}
+	if to < len(starts) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
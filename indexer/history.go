@@ -0,0 +1,186 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultHistoryCommits is how many commits SearchHistory returns per
+// repository unless asked otherwise
+const defaultHistoryCommits = 20
+
+// maxHistoryLines is how many matching patch lines are shown per commit
+const maxHistoryLines = 3
+
+// HistoryOptions selects the commits SearchHistory returns. The criteria
+// given must all match.
+type HistoryOptions struct {
+	Message    string // Regex the commit message matches
+	Added      string // String whose number of occurrences the commit changes, as with git log -S
+	Changed    string // Regex matching a line the commit adds or removes, as with git log -G
+	Path       string // Only commits touching this path, relative to the indexed directory
+	Author     string // Regex the author name or email matches
+	Since      string // Only commits after this date, e.g. "2024-01-01" or "3 months ago"
+	IgnoreCase bool   // Match Message and Author in either case
+	MaxCommits int    // Commits returned per repository (default: 20)
+}
+
+// HistoryCommit is a commit found by SearchHistory
+type HistoryCommit struct {
+	Repository string   `json:"repository"` // Root of the checkout
+	Hash       string   `json:"hash"`
+	Author     string   `json:"author"`
+	Date       string   `json:"date"`
+	Subject    string   `json:"subject"`
+	Files      []string `json:"files,omitempty"` // Files changed, relative to the repository root
+	Lines      []string `json:"lines,omitempty"` // Added (+) or removed (-) lines matching Added or Changed
+}
+
+// SearchHistory searches the git history of the index of sourceDir, or of
+// all indexes, for commits by message and by the changes they made. Only
+// commits touching the indexed directory are searched, newest first; an
+// index that is not a git checkout is skipped.
+func (m *IndexManager) SearchHistory(ctx context.Context, sourceDir string, opts HistoryOptions) ([]HistoryCommit, error) {
+	if opts.Message == "" && opts.Added == "" && opts.Changed == "" && opts.Author == "" {
+		return nil, errors.New("a message, added, changed or author pattern is needed")
+	}
+	if opts.Added != "" && opts.Changed != "" {
+		return nil, errors.New("added and changed cannot be combined")
+	}
+	if opts.MaxCommits <= 0 {
+		opts.MaxCommits = defaultHistoryCommits
+	}
+	var changed *regexp.Regexp
+	if opts.Changed != "" {
+		var err error
+		if changed, err = regexp.Compile(opts.Changed); err != nil {
+			return nil, fmt.Errorf("invalid changed pattern: %w", err)
+		}
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	metadata := m.visibleMetadata(ctx)
+
+	// Indexes of the same checkout share its history
+	var commits []HistoryCommit
+	searched := make(map[string]bool)
+	inGit := false
+	for _, prefix := range prefixes {
+		dir := metadata[prefix].dir()
+		root, gitDir := findGitDir(dir)
+		if gitDir == "" {
+			continue
+		}
+		inGit = true
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			continue
+		}
+		if opts.Path != "" {
+			rel = filepath.Join(rel, opts.Path)
+		}
+		key := root + "\x00" + rel
+		if searched[key] {
+			continue
+		}
+		searched[key] = true
+
+		found, err := gitLog(ctx, root, rel, opts, changed)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, found...)
+	}
+	if !inGit {
+		return nil, errors.New("no searched index is in a git checkout")
+	}
+	return commits, nil
+}
+
+// gitLog runs git log in the checkout at root for the commits touching rel
+// that match opts
+func gitLog(ctx context.Context, root string, rel string, opts HistoryOptions, changed *regexp.Regexp) ([]HistoryCommit, error) {
+	// Records start with a record separator; fields are split by a unit
+	// separator and followed by the changed files or the patch
+	args := []string{"-C", root, "log", "--no-color", "--no-ext-diff", "-n", fmt.Sprint(opts.MaxCommits),
+		"--format=%x1e%H%x1f%an <%ae>%x1f%ad%x1f%s", "--date=short"}
+	if opts.Message != "" {
+		args = append(args, "-E", "--grep="+opts.Message)
+	}
+	if opts.Author != "" {
+		args = append(args, "-E", "--author="+opts.Author)
+	}
+	if opts.IgnoreCase {
+		args = append(args, "--regexp-ignore-case")
+	}
+	if opts.Since != "" {
+		args = append(args, "--since="+opts.Since)
+	}
+	pickaxe := opts.Added != "" || opts.Changed != ""
+	switch {
+	case opts.Added != "":
+		args = append(args, "-S"+opts.Added, "-p", "--unified=0")
+	case opts.Changed != "":
+		args = append(args, "-G"+opts.Changed, "-p", "--unified=0")
+	default:
+		args = append(args, "--name-only")
+	}
+	args = append(args, "--", filepath.ToSlash(rel))
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gitBinary(), args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("git log failed in %s: %s", root, strings.TrimSpace(stderr.String()))
+	}
+
+	var commits []HistoryCommit
+	for _, record := range strings.Split(string(out), "\x1e") {
+		header, body, _ := strings.Cut(record, "\n")
+		fields := strings.Split(header, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commit := HistoryCommit{Repository: root, Hash: fields[0], Author: fields[1], Date: fields[2], Subject: fields[3]}
+		oldName := ""
+		for _, line := range strings.Split(body, "\n") {
+			switch {
+			case !pickaxe:
+				if line != "" {
+					commit.Files = append(commit.Files, line)
+				}
+			case strings.HasPrefix(line, "--- "):
+				oldName = strings.TrimPrefix(line[4:], "a/")
+			case strings.HasPrefix(line, "+++ "):
+				// The new name of a changed file, or the old one of a deleted file
+				if name, ok := strings.CutPrefix(line[4:], "b/"); ok {
+					commit.Files = append(commit.Files, name)
+				} else {
+					commit.Files = append(commit.Files, oldName)
+				}
+			case strings.HasPrefix(line, "+"), strings.HasPrefix(line, "-"):
+				if len(commit.Lines) >= maxHistoryLines {
+					continue
+				}
+				if (opts.Added != "" && strings.Contains(line[1:], opts.Added)) || (changed != nil && changed.MatchString(line[1:])) {
+					commit.Lines = append(commit.Lines, truncateLine(line, 200))
+				}
+			}
+		}
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
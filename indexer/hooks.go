@@ -0,0 +1,174 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// defaultHookTimeout limits a hook command unless configured otherwise
+const defaultHookTimeout = 5 * time.Minute
+
+// maxHookOutput is how much of the end of the output of a hook command is
+// recorded
+const maxHookOutput = 4 << 10
+
+// Phases of hook commands
+const (
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+// HookConfig sets shell commands run around the builds of an index, e.g.
+// git fetch or go generate before the build and a notification after it
+type HookConfig struct {
+	Directory string `json:"directory"` // The indexed directory
+	// Pre commands run before the build in order; if one fails, the build
+	// and the commands after it are skipped
+	Pre []string `json:"pre,omitempty"`
+	// Post commands run after the build, whether it succeeded or not
+	Post []string `json:"post,omitempty"`
+	// TimeoutSeconds limits each command (default 300)
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// HookRun is the outcome of a hook command, recorded with the index
+type HookRun struct {
+	Phase      string    `json:"phase"` // "pre" or "post"
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`  // Why the command failed, e.g. a timeout
+	Output     string    `json:"output,omitempty"` // End of its combined stdout and stderr
+}
+
+// SetHooks sets the commands run around the builds of directories. Hooks
+// run on every build, including scheduled re-indexes, but not for the
+// submodules of a directory unless configured for them.
+func (m *IndexManager) SetHooks(hooks []HookConfig) {
+	m.hooks = nil
+	for _, hook := range hooks {
+		if hook.Directory == "" {
+			continue
+		}
+		dir, err := resolvePath(hook.Directory)
+		if err != nil {
+			continue
+		}
+		hook.Directory = dir
+		m.hooks = append(m.hooks, hook)
+	}
+}
+
+// hookFor returns the hooks of the directory absPath, or nil
+func (m *IndexManager) hookFor(absPath string) *HookConfig {
+	for i := range m.hooks {
+		if m.hooks[i].Directory == absPath {
+			return &m.hooks[i]
+		}
+	}
+	return nil
+}
+
+// buildWithHooks runs build between the pre and post commands of hook and
+// records the commands that ran with the index. A failed post command does
+// not fail the build.
+func (m *IndexManager) buildWithHooks(ctx context.Context, hook *HookConfig, build func() error) error {
+	runs, err := hook.run(ctx, hookPre, hook.Pre, "")
+	if err != nil {
+		err = fmt.Errorf("pre-build hook failed: %w", err)
+	} else {
+		err = build()
+	}
+
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	postRuns, _ := hook.run(ctx, hookPost, hook.Post, status)
+	runs = append(runs, postRuns...)
+
+	// A directory that was never built has no index to record them with
+	if recordErr := m.updateMetadata(m.getIndexPrefix(hook.Directory), func(meta *indexMetadata) {
+		meta.Hooks = runs
+	}); err == nil {
+		err = recordErr
+	}
+	return err
+}
+
+// run runs the commands of a phase in order in the hooked directory,
+// stopping at the first that fails. Commands run with the shell, with
+// CODE_INDEX_DIRECTORY and CODE_INDEX_HOOK set, and CODE_INDEX_STATUS (ok
+// or failed) after the build.
+func (hook *HookConfig) run(ctx context.Context, phase string, commands []string, status string) ([]HookRun, error) {
+	timeout := defaultHookTimeout
+	if hook.TimeoutSeconds > 0 {
+		timeout = time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	env := append(os.Environ(), "CODE_INDEX_DIRECTORY="+hook.Directory, "CODE_INDEX_HOOK="+phase)
+	if status != "" {
+		env = append(env, "CODE_INDEX_STATUS="+status)
+	}
+
+	var runs []HookRun
+	for _, command := range commands {
+		run := runHookCommand(ctx, hook.Directory, command, env, timeout)
+		run.Phase = phase
+		runs = append(runs, run)
+		if run.Error != "" {
+			return runs, fmt.Errorf("%s: %s", command, run.Error)
+		}
+	}
+	return runs, nil
+}
+
+// runHookCommand runs a command with the shell in dir, for at most timeout
+func runHookCommand(ctx context.Context, dir string, command string, env []string, timeout time.Duration) HookRun {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Dir = longPath(dir)
+	cmd.Env = env
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait for background processes the command left holding the output
+	cmd.WaitDelay = time.Second
+
+	run := HookRun{Command: command, StartedAt: time.Now().UTC()}
+	err := cmd.Run()
+	run.DurationMS = time.Since(run.StartedAt).Milliseconds()
+	if out := output.Bytes(); len(out) > maxHookOutput {
+		run.Output = "..." + string(out[len(out)-maxHookOutput:])
+	} else {
+		run.Output = string(out)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		run.ExitCode = -1
+		run.Error = fmt.Sprintf("timed out after %s", timeout)
+	case errors.As(err, &exitErr):
+		run.ExitCode = exitErr.ExitCode()
+		run.Error = fmt.Sprintf("exit status %d", run.ExitCode)
+	default:
+		run.ExitCode = -1
+		run.Error = err.Error()
+	}
+	return run
+}
@@ -0,0 +1,141 @@
+package indexer
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// identifierSeparator matches what may separate the words of an identifier
+// in a smart identifier pattern: nothing, as in userID, or _ or -
+const identifierSeparator = "[_-]?"
+
+// plainWord matches a query term that can be part of an identifier
+var plainWord = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// splitIdentifier splits an identifier into its words at underscores,
+// hyphens and case changes, e.g. parseHTTPRequest_v2 into parse, HTTP,
+// Request and v2
+func splitIdentifier(identifier string) []string {
+	var words []string
+	for _, part := range strings.FieldsFunc(identifier, func(r rune) bool { return r == '_' || r == '-' }) {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			prev, cur := runes[i-1], runes[i]
+			// A word starts at an upper case letter after a lower case one
+			// or a digit, or at the last capital of an acronym before a
+			// lower case letter
+			if unicode.IsUpper(cur) && (unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+// identifierPattern returns a pattern matching the words in any of the
+// usual identifier styles, e.g. userID, user_id, UserId and USER-ID for
+// user and id. It is lower case, so case:auto matches it in either case.
+func identifierPattern(words []string) string {
+	lower := make([]string, len(words))
+	for i, word := range words {
+		lower[i] = strings.ToLower(word)
+	}
+	return strings.Join(lower, identifierSeparator)
+}
+
+// smartIdentifierQuery rewrites the plain words of queryStr to match
+// identifiers however they are written. A run of plain words, or a quoted
+// phrase of them, becomes one identifier, so "user id" matches userID and
+// user_id, and a single identifier matches its other styles, so userId
+// matches user_id too. Field atoms such as file:, negations, operators and
+// regexes are kept as they are and end a run.
+func smartIdentifierQuery(queryStr string) string {
+	var out, run []string
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		var words []string
+		for _, term := range run {
+			words = append(words, splitIdentifier(term)...)
+		}
+		if len(words) > 1 {
+			out = append(out, identifierPattern(words))
+		} else {
+			out = append(out, run...)
+		}
+		run = nil
+	}
+
+	for _, token := range queryTokens(queryStr) {
+		switch {
+		case plainWord.MatchString(token) && token != "or":
+			run = append(run, token)
+		case len(token) > 2 && token[0] == '"' && token[len(token)-1] == '"' && plainPhrase(token[1:len(token)-1]):
+			flush()
+			run = strings.Fields(token[1 : len(token)-1])
+			flush()
+		default:
+			flush()
+			out = append(out, token)
+		}
+	}
+	flush()
+	return strings.Join(out, " ")
+}
+
+// plainPhrase reports whether a quoted phrase consists of plain words only
+func plainPhrase(phrase string) bool {
+	words := strings.Fields(phrase)
+	for _, word := range words {
+		if !plainWord.MatchString(word) {
+			return false
+		}
+	}
+	return len(words) > 0
+}
+
+// queryTokens splits a query at spaces outside quotes, with parentheses as
+// tokens of their own unless escaped or quoted
+func queryTokens(queryStr string) []string {
+	var tokens []string
+	var current strings.Builder
+	end := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+	quoted, escaped := false, false
+	for _, r := range queryStr {
+		switch {
+		case escaped:
+			escaped = false
+			current.WriteRune(r)
+		case r == '\\':
+			escaped = true
+			current.WriteRune(r)
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case quoted:
+			current.WriteRune(r)
+		case unicode.IsSpace(r):
+			end()
+		case (r == '(' || r == ')') && current.Len() == 0:
+			tokens = append(tokens, string(r))
+		case r == ')' && !strings.Contains(current.String(), "("):
+			end()
+			tokens = append(tokens, ")")
+		default:
+			current.WriteRune(r)
+		}
+	}
+	end()
+	return tokens
+}
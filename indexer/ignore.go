@@ -0,0 +1,115 @@
+package indexer
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// gitIgnore applies the rules git uses to ignore untracked files: the
+// user's global excludes file (core.excludesFile), info/exclude and the
+// .gitignore files of the repository
+type gitIgnore struct {
+	root string       // Repository root
+	base []gitPattern // Global excludes followed by info/exclude
+	// dirs caches the parsed .gitignore of each directory, keyed by slash
+	// separated path from the root ("." for the root)
+	dirs map[string][]gitPattern
+}
+
+// loadGitIgnore returns the ignore rules of the repository at root
+func loadGitIgnore(root string, gitDir string) *gitIgnore {
+	var lines []string
+	if excludesFile := globalExcludesFile(gitDir); excludesFile != "" {
+		lines = append(lines, readPatternFile(excludesFile)...)
+	}
+	lines = append(lines, readPatternFile(filepath.Join(gitCommonDir(gitDir), "info", "exclude"))...)
+
+	return &gitIgnore{
+		root: root,
+		base: parseGitPatterns(lines, ""),
+		dirs: make(map[string][]gitPattern),
+	}
+}
+
+// globalExcludesFile returns the path of the user's global excludes file:
+// core.excludesFile from the git config, or git's default
+// $XDG_CONFIG_HOME/git/ignore
+func globalExcludesFile(gitDir string) string {
+	home, _ := os.UserHomeDir()
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+
+	// Later files take precedence, as in git
+	var files []string
+	if xdg != "" {
+		files = append(files, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+	files = append(files, repoConfigFiles(gitDir)...)
+
+	excludesFile, ok := gitConfigValue(files, "core", "excludesFile")
+	if !ok {
+		if xdg == "" {
+			return ""
+		}
+		return filepath.Join(xdg, "git", "ignore")
+	}
+	if rest, ok := strings.CutPrefix(excludesFile, "~/"); ok && home != "" {
+		excludesFile = filepath.Join(home, rest)
+	}
+	return excludesFile
+}
+
+// readPatternFile returns the lines of a pattern file, or nil if it cannot
+// be read
+func readPatternFile(path string) []string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(content), "\n")
+}
+
+// ignores reports whether a path, slash separated from the repository root,
+// is ignored. Patterns in deeper .gitignore files take precedence.
+func (g *gitIgnore) ignores(name string, isDir bool) bool {
+	_, ignored := matchGitPatterns(g.base, name, isDir)
+
+	var dirs []string
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == "." {
+			break
+		}
+	}
+	slices.Reverse(dirs)
+
+	for _, dir := range dirs {
+		if matched, positive := matchGitPatterns(g.patternsIn(dir), name, isDir); matched {
+			ignored = positive
+		}
+	}
+	return ignored
+}
+
+// patternsIn returns the parsed .gitignore of a directory
+func (g *gitIgnore) patternsIn(dir string) []gitPattern {
+	if patterns, ok := g.dirs[dir]; ok {
+		return patterns
+	}
+
+	base := dir
+	if dir == "." {
+		base = ""
+	}
+	patterns := parseGitPatterns(readPatternFile(filepath.Join(g.root, filepath.FromSlash(dir), ".gitignore")), base)
+	g.dirs[dir] = patterns
+	return patterns
+}
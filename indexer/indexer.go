@@ -1,24 +1,88 @@
 package indexer
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io/fs"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/sourcegraph/zoekt"
 	"github.com/sourcegraph/zoekt/index"
 	"github.com/sourcegraph/zoekt/query"
-	"github.com/sourcegraph/zoekt/search"
 )
 
-// IndexManager handles creating and managing code indexes
+// ErrNotIndexed is returned when an operation targets a directory that has
+// no index
+var ErrNotIndexed = errors.New("directory is not indexed")
+
+// IndexManager handles creating and managing code indexes. All methods are
+// safe to call from multiple goroutines, but building the same directory
+// twice concurrently is not supported.
 type IndexManager struct {
-	indexDir string
+	indexDir     string
+	buildOptions BuildOptions
+
+	// Encryption at rest; plainDir caches decrypted shards for searching
+	cacheMu  sync.Mutex
+	aead     cipher.AEAD
+	plainDir string
+
+	// metadataMu serializes read-modify-write updates of metadata.json
+	metadataMu sync.Mutex
+	// compressMu serializes compressing and decompressing shards, and
+	// guards the holds keeping shards from being compressed: by shard
+	// prefix, and of every index
+	compressMu sync.Mutex
+	held       map[string]int
+	heldAll    int
+
+	// results holds recent searches for RefineSearch, oldest first
+	resultsMu sync.Mutex
+	results   []*searchRecord
+
+	// searchCache holds recent search results, least recently used first
+	searchCacheMu sync.Mutex
+	searchCache   []*cachedSearch
+
+	// workspacesMu serializes read-modify-write updates of workspaces.json
+	workspacesMu sync.Mutex
+
+	// buildLocks serialize the builds of each index, by prefix
+	buildLocksMu sync.Mutex
+	buildLocks   map[string]*buildLock
+
+	// shardChecks caches which shard files load, by path, so corrupt
+	// shards can be left out of searches
+	shardChecksMu sync.Mutex
+	shardChecks   map[string]shardCheck
+
+	// remotes are searched along with the local indexes when requested
+	remotes []Remote
+
+	// pathMappings map the directories recorded in indexes to this machine
+	pathMappings []PathMapping
+
+	// hooks are commands run around the builds of directories
+	hooks []HookConfig
+
+	// searchLimiter caps the searches run at once; nil for no cap
+	searchLimiter *SearchLimiter
 }
 
 // NewIndexManager creates a new index manager with the given base directory
@@ -26,6 +90,11 @@ func NewIndexManager(indexDir string) *IndexManager {
 	return &IndexManager{indexDir: indexDir}
 }
 
+// SetBuildOptions sets the builder tuning used for subsequent index builds
+func (m *IndexManager) SetBuildOptions(opts BuildOptions) {
+	m.buildOptions = opts
+}
+
 // GetIndexDir returns the base index directory
 func (m *IndexManager) GetIndexDir() string {
 	return m.indexDir
@@ -33,24 +102,111 @@ func (m *IndexManager) GetIndexDir() string {
 
 // getIndexPrefix returns a unique prefix for index files based on the source directory
 func (m *IndexManager) getIndexPrefix(sourceDir string) string {
+	return indexPrefix(sourceDir)
+}
+
+// indexPrefix names the index of a source directory: its base name and a
+// hash of its path
+func indexPrefix(sourceDir string) string {
 	hash := sha256.Sum256([]byte(sourceDir))
 	hashStr := hex.EncodeToString(hash[:8])
 	baseName := filepath.Base(sourceDir)
 	// Sanitize base name to be safe for file names
-	baseName = strings.ReplaceAll(baseName, " ", "_")
+	baseName = strings.NewReplacer(" ", "_", ":", "_", `\`, "_", "/", "_").Replace(baseName)
+	if strings.Trim(baseName, "_.") == "" {
+		// Drive and share roots (C:\, \\server\share\) have no usable base name
+		baseName = "root"
+	}
 	return fmt.Sprintf("%s_%s", baseName, hashStr)
 }
 
-// IndexDirectory indexes the given source directory
-func (m *IndexManager) IndexDirectory(sourceDir string) error {
-	// Resolve to absolute path
+// resolvePath returns the absolute, canonical form of a source directory path
+func resolvePath(sourceDir string) (string, error) {
 	absPath, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return "", err
+	}
+	return canonicalPath(absPath), nil
+}
+
+// IndexOptions controls which files of a directory are indexed
+type IndexOptions struct {
+	// TrackedOnly indexes only the files tracked by git, leaving out
+	// untracked scratch files and local dumps
+	TrackedOnly bool
+	// IgnorePatterns are gitignore-style patterns of files to leave out,
+	// relative to the source directory, such as "**/generated/**" or
+	// "*.min.js". They apply to tracked files too.
+	IgnorePatterns []string
+	// MaxFileSize leaves files larger than this many bytes out, names
+	// included. 0 uses the limit of the build options and a negative value
+	// sets no limit.
+	MaxFileSize int64
+	// FollowSymlinks indexes the directories and files symbolic links point
+	// to, under the paths of the links. Links into the directory itself
+	// and to targets indexed before are skipped, so cycles end.
+	FollowSymlinks bool
+	// NoDefaultExcludes indexes the lockfiles, minified files, source maps
+	// and snapshots that are left out by default
+	NoDefaultExcludes bool
+}
+
+// IndexDirectory indexes the given source directory, replacing any existing
+// index for it. Re-indexing keeps the options the index was created with.
+// Cancelling ctx, or the build timeout of the build options passing, stops
+// the build and removes the shards written since its last checkpoint; the
+// next build of a large directory resumes from that checkpoint. A clone or
+// worktree with the same content as an indexed one shares its shards instead
+// of building new ones.
+func (m *IndexManager) IndexDirectory(ctx context.Context, sourceDir string) error {
+	return m.indexDirectory(ctx, sourceDir, nil)
+}
+
+// IndexDirectoryWithOptions is like IndexDirectory but indexes with opts
+// instead of the options of the existing index
+func (m *IndexManager) IndexDirectoryWithOptions(ctx context.Context, sourceDir string, opts IndexOptions) error {
+	return m.indexDirectory(ctx, sourceDir, &opts)
+}
+
+// indexDirectory implements IndexDirectory, using the recorded options of
+// the existing index if indexOpts is nil
+func (m *IndexManager) indexDirectory(ctx context.Context, sourceDir string, indexOpts *IndexOptions) error {
+	// Resolve to absolute path
+	absPath, err := resolvePath(sourceDir)
 	if err != nil {
 		return fmt.Errorf("failed to resolve path: %w", err)
 	}
+	// Wait for other builds of the directory, which would write the same
+	// shards
+	prefix := m.getIndexPrefix(absPath)
+	unlock, err := m.lockBuild(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Two directories whose names hash alike cannot share an index name
+	existing, indexed := m.loadAllMetadata()[prefix]
+	if indexed && existing.SourceDir != absPath {
+		return fmt.Errorf("index name %s of %s is taken by the index of %s; delete or move that index first", prefix, absPath, existing.SourceDir)
+	}
+	if indexOpts == nil {
+		indexOpts = &IndexOptions{}
+		if indexed {
+			indexOpts.TrackedOnly = existing.TrackedOnly
+			indexOpts.IgnorePatterns = existing.IgnorePatterns
+			indexOpts.MaxFileSize = existing.MaxFileSize
+			indexOpts.FollowSymlinks = existing.FollowSymlinks
+			indexOpts.NoDefaultExcludes = existing.NoDefaultExcludes
+		}
+	}
+
+	// Use the extended-length form for file access so deep trees and UNC
+	// shares work on Windows
+	walkRoot := longPath(absPath)
 
 	// Check if directory exists
-	info, err := os.Stat(absPath)
+	info, err := os.Stat(walkRoot)
 	if err != nil {
 		return fmt.Errorf("failed to access directory: %w", err)
 	}
@@ -63,104 +219,686 @@ func (m *IndexManager) IndexDirectory(sourceDir string) error {
 		return fmt.Errorf("failed to create index directory: %w", err)
 	}
 
-	// Delete any existing index files for this directory
-	if err := m.deleteIndexFiles(absPath); err != nil {
-		return fmt.Errorf("failed to clean up old index: %w", err)
+	// Give up on builds that run longer than the configured timeout
+	if timeout := m.buildOptions.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Run the hooks configured for the directory around the build
+	if hook := m.hookFor(absPath); hook != nil {
+		err = m.buildWithHooks(ctx, hook, func() error {
+			return m.buildIndex(ctx, absPath, walkRoot, indexOpts)
+		})
+	} else {
+		err = m.buildIndex(ctx, absPath, walkRoot, indexOpts)
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("indexing %s timed out: %w", absPath, err)
+	}
+	return err
+}
 
+// buildIndex builds the index of absPath, whose files are read under
+// walkRoot, as indexDirectory does
+func (m *IndexManager) buildIndex(ctx context.Context, absPath string, walkRoot string, indexOpts *IndexOptions) error {
 	// Create builder options - use flat structure with unique name prefix
 	indexPrefix := m.getIndexPrefix(absPath)
 	opts := index.Options{
-		IndexDir: m.indexDir,
 		RepositoryDescription: zoekt.Repository{
 			Name:   indexPrefix,
 			Source: absPath,
 		},
 	}
 	opts.SetDefaults()
+	setCTagsPaths(&opts)
+	m.buildOptions.apply(&opts)
+
+	// Leave out paths excluded by the git checkout, and files over the size
+	// limit of the index or else of the build options
+	filterOpts := *indexOpts
+	if filterOpts.MaxFileSize == 0 {
+		filterOpts.MaxFileSize = m.buildOptions.maxFileSize()
+	}
+	filter, err := newSourceFilter(ctx, absPath, filterOpts)
+	if err != nil {
+		return err
+	}
 
-	// Create the builder
-	builder, err := index.NewBuilder(opts)
+	// Reuse the shards of another checkout of the same commit, or update
+	// only the files git reports as changed since the last index. The
+	// shards of an interrupted build are incomplete, so it is resumed or
+	// rebuilt instead.
+	gitHead := gitIdentity(absPath)
+	// Record the checked out branch and commit in the shards
+	if commit := gitCommit(gitHead); commit != "" {
+		opts.RepositoryDescription.Branches = []zoekt.RepositoryBranch{{Name: shardBranch(absPath), Version: commit}}
+	}
+	journal, interrupted := m.loadBuildJournal(indexPrefix)
+	// Stale shards cannot be updated or shared, only rebuilt
+	stale := false
+	if meta, ok := m.loadAllMetadata()[indexPrefix]; ok {
+		stale = meta.Stale != ""
+	}
+	var built bool
+	if !interrupted && !stale {
+		built, err = m.shareIdenticalIndex(ctx, absPath, walkRoot, filter, gitHead, opts.SizeMax)
+		if err == nil && !built {
+			built, err = m.deltaIndex(ctx, absPath, walkRoot, filter, gitHead, opts)
+		}
+	}
+	if err == nil && !built {
+		if !journal.resumes(absPath, gitHead, opts) {
+			journal = nil
+		}
+		err = m.fullIndex(ctx, absPath, walkRoot, filter, gitHead, opts, journal)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create builder: %w", err)
+		return err
 	}
 
-	// Walk the directory and add files
-	err = filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
+	// Map the files of a Bazel workspace to the targets that build them
+	if err := m.saveBazelTargets(ctx, absPath, walkRoot, filter); err != nil {
+		return err
+	}
+
+	// Record who owns which files for who_owns and annotated results
+	if err := m.saveCodeOwners(absPath); err != nil {
+		return err
+	}
+
+	// Record the repository results link to
+	if err := m.saveRemote(absPath); err != nil {
+		return err
+	}
+
+	// Submodules get indexes of their own
+	return m.indexSubmodules(ctx, absPath, filter)
+}
+
+// branchNames returns the names of the branches of the repository opts
+// builds, which every document belongs to
+func branchNames(opts index.Options) []string {
+	var names []string
+	for _, branch := range opts.RepositoryDescription.Branches {
+		names = append(names, branch.Name)
+	}
+	return names
+}
+
+// fullIndex builds the index of absPath from scratch, replacing its shards,
+// or resumes the interrupted build recorded in journal if it is not nil.
+// Large builds are committed in batches, recording their progress in a
+// journal next to the shards.
+func (m *IndexManager) fullIndex(ctx context.Context, absPath string, walkRoot string, filter *sourceFilter, gitHead string, opts index.Options, journal *buildJournal) error {
+	indexPrefix := opts.RepositoryDescription.Name
+	indexedCommit, dirtyFiles := deltaBase(ctx, filter, gitHead)
+
+	// Resume after the last batch of files the interrupted build committed
+	walk := newSourceWalk()
+	if journal != nil {
+		resumed, err := m.resumeShards(journal, opts)
 		if err != nil {
 			return err
 		}
-
-		// Skip hidden directories and common non-code directories
-		if info.IsDir() {
-			base := filepath.Base(path)
-			if strings.HasPrefix(base, ".") || isSkippedDir(base) {
-				return filepath.SkipDir
-			}
-			return nil
+		if resumed {
+			walk, err = journal.Checkpoint.resume()
 		}
-
-		// Skip hidden files and non-text files
-		if strings.HasPrefix(filepath.Base(path), ".") {
-			return nil
+		if !resumed || err != nil {
+			journal = nil
+			walk = newSourceWalk()
 		}
+	}
 
-		// Skip files that are likely binary
-		if isBinaryFile(path) {
-			return nil
+	if journal == nil {
+		// Delete any existing index files for this directory
+		if err := m.deleteIndexFiles(absPath); err != nil {
+			return fmt.Errorf("failed to clean up old index: %w", err)
 		}
+		if err := m.removeTempShards(indexPrefix); err != nil {
+			return fmt.Errorf("failed to clean up old index: %w", err)
+		}
+		journal = &buildJournal{Source: absPath, GitHead: gitHead, Branches: branchNames(opts), Options: opts.GetHash(), Owner: ownerFromContext(ctx)}
+	}
 
-		// Read file content
-		content, err := os.ReadFile(path)
-		if err != nil {
-			// Skip files we can't read
-			return nil
+	// Count the files to walk, so progress is reported as a share of them
+	total, err := countCandidates(ctx, walkRoot, filter)
+	if err != nil {
+		return fmt.Errorf("failed to index files: %w", err)
+	}
+	progress := newBuildProgress(total, walk.walked, journal.Progress)
+	journal.Progress = progress
+	report := indexProgressFromContext(ctx)
+	if report != nil {
+		report(progress.report(absPath))
+	}
+
+	// Encrypted indexes are built elsewhere and sealed afterwards, so they
+	// cannot be resumed
+	checkpointBytes := m.buildOptions.checkpointBytes()
+	if m.Encrypted() {
+		checkpointBytes = 0
+	}
+	if checkpointBytes > 0 {
+		if err := m.saveBuildJournal(indexPrefix, journal); err != nil {
+			return err
 		}
+	}
+	buildDir, cleanup, err := m.buildDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	opts.IndexDir = buildDir
+
+	// Keep memory use under the configured ceiling while building
+	defer m.buildOptions.setMemoryLimit()()
 
-		// Skip binary content
-		if isBinaryContent(content) {
+	// Create the builder. Batches after the first are added to the shards
+	// of the batches before them.
+	opts.IsDelta = journal.Shards > 0
+	builder, err := index.NewBuilder(opts)
+	if err != nil {
+		return fmt.Errorf("failed to create builder: %w", err)
+	}
+
+	// Commit a batch of shards and record the walk after enough content
+	batchBytes := 0
+	add := func(doc index.Document) error {
+		batchBytes += len(doc.Content)
+		doc.Branches = branchNames(opts)
+		return builder.Add(doc)
+	}
+	walked := func(walk *sourceWalk) error {
+		progress.Done = walk.walked
+		if now := time.Now(); progress.due(now) {
+			progress.UpdatedAt = now.UTC()
+			if report != nil {
+				report(progress.report(absPath))
+			}
+			if checkpointBytes > 0 {
+				if err := m.saveBuildJournal(indexPrefix, journal); err != nil {
+					return err
+				}
+			}
+		}
+		if checkpointBytes == 0 || batchBytes < checkpointBytes {
 			return nil
 		}
-
-		// Get relative path from source directory
-		relPath, err := filepath.Rel(absPath, path)
+		if err := builder.Finish(); err != nil {
+			return fmt.Errorf("failed to finish index: %w", err)
+		}
+		checkpoint, err := walk.checkpoint()
 		if err != nil {
-			return nil
+			return err
 		}
-
-		// Add file to index
-		doc := index.Document{
-			Name:    relPath,
-			Content: content,
+		journal.Checkpoint = checkpoint
+		journal.Shards = len(opts.FindAllShards())
+		if err := m.saveBuildJournal(indexPrefix, journal); err != nil {
+			return err
 		}
+		opts.IsDelta = true
+		if builder, err = index.NewBuilder(opts); err != nil {
+			return fmt.Errorf("failed to create builder: %w", err)
+		}
+		batchBytes = 0
+		return nil
+	}
 
-		return builder.Add(doc)
-	})
-
+	// Walk the directory and add files
+	stats, err := m.walkSourceFrom(ctx, walkRoot, filter, opts.SizeMax, walk, add, walked)
 	if err != nil {
+		// Wait for the shards being written before removing them
 		builder.Finish()
-		return fmt.Errorf("failed to index files: %w", err)
+		return m.discardUnfinished(journal, opts, fmt.Errorf("failed to index files: %w", err))
 	}
 
 	// Finish building the index
 	if err := builder.Finish(); err != nil {
-		return fmt.Errorf("failed to finish index: %w", err)
+		return m.discardUnfinished(journal, opts, fmt.Errorf("failed to finish index: %w", err))
+	}
+	if err := m.sealBuiltShards(buildDir); err != nil {
+		return err
+	}
+	if err := m.removeCompressedShards(indexPrefix); err != nil {
+		return fmt.Errorf("failed to remove old compressed shards: %w", err)
 	}
 
 	// Save metadata about the indexed directory
-	if err := m.saveIndexMetadata(absPath); err != nil {
+	meta := &indexMetadata{
+		IndexedAt:   time.Now().UTC(),
+		Files:       stats.files,
+		Bytes:       stats.bytes,
+		Languages:   stats.languages,
+		Skipped:     stats.skipped,
+		GitHead:     gitHead,
+		Fingerprint: stats.fingerprint,
+		Sparse:      filter.sparsePatterns(),
+		TrackedOnly: filter.tracked != nil,
+
+		IndexedCommit: indexedCommit,
+		DirtyFiles:    dirtyFiles,
+		Submodules:    filter.submodulePaths(),
+		Symbols:       hasSymbols(opts),
+
+		IgnorePatterns:    filter.ignorePatterns,
+		MaxFileSize:       filter.maxFileSize,
+		FollowSymlinks:    filter.followSymlinks,
+		Branch:            gitBranch(absPath),
+		Commit:            gitCommit(gitHead),
+		NoDefaultExcludes: filter.noDefaultExcludes,
+	}
+	if owner := ownerFromContext(ctx); owner != "" {
+		meta.Owners = []string{owner}
+	}
+	if err := m.saveIndexMetadata(absPath, meta); err != nil {
 		return fmt.Errorf("failed to save metadata: %w", err)
 	}
+	if err := m.removeBuildJournal(indexPrefix); err != nil {
+		return err
+	}
+
+	// Checkouts that shared the replaced shards need their own index now
+	return m.reindexSharers(ctx, indexPrefix)
+}
+
+// sourceStats summarizes the files found while walking a source directory
+type sourceStats struct {
+	files     int
+	bytes     int64
+	languages map[string]int // Indexed files per language
+	skipped   map[string]int // Skipped files per reason
+	// fingerprint hashes the name and content of every document, so two
+	// directories with the same fingerprint produce the same index
+	fingerprint string
+}
+
+// sourceWalk is the state of a walk over a source directory, which a
+// checkpoint saves so the walk can resume after its last file
+type sourceWalk struct {
+	stats  *sourceStats
+	hash   hash.Hash // Fingerprint of the documents so far
+	last   string    // Last file walked, relative to the walk root
+	walked int       // Files walked so far
+}
+
+// newSourceWalk returns the state of a walk that has not started
+func newSourceWalk() *sourceWalk {
+	return &sourceWalk{stats: newSourceStats(), hash: sha256.New()}
+}
+
+// newSourceStats returns empty statistics
+func newSourceStats() *sourceStats {
+	return &sourceStats{
+		languages: make(map[string]int),
+		skipped:   make(map[string]int),
+	}
+}
+
+// add adds the counts of other to s
+func (s *sourceStats) add(other *sourceStats) {
+	s.files += other.files
+	s.bytes += other.bytes
+	for language, n := range other.languages {
+		s.languages[language] += n
+	}
+	for reason, n := range other.skipped {
+		s.skipped[reason] += n
+	}
+}
+
+// fileRead is a file of a walk that a read worker turns into documents
+type fileRead struct {
+	path    string
+	relPath string
+	stats   *sourceStats // Counts of the file alone
+	docs    []index.Document
+	err     error
+	done    chan struct{} // Closed once the file is read
+}
+
+// walkSource reads the indexable files under walkRoot that filter does not
+// exclude and passes them to add, split into chunks if the build options ask
+// for it
+func (m *IndexManager) walkSource(ctx context.Context, walkRoot string, filter *sourceFilter, sizeMax int, add func(index.Document) error) (*sourceStats, error) {
+	return m.walkSourceFrom(ctx, walkRoot, filter, sizeMax, newSourceWalk(), add, nil)
+}
+
+// walkSourceFrom is like walkSource, but continues walk after its last file
+// and calls walked, if set, after each file. Files are walked in lexical
+// order, so the files before the last one were all walked.
+//
+// Files are read by a pool of workers while the documents read so far are
+// passed to add, which sees them in walk order all the same, so the
+// fingerprint and checkpoints do not depend on the number of workers.
+func (m *IndexManager) walkSourceFrom(ctx context.Context, walkRoot string, filter *sourceFilter, sizeMax int, walk *sourceWalk, add func(index.Document) error, walked func(*sourceWalk) error) (*sourceStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Files are queued in walk order for add, and read ahead of it by at
+	// most twice the number of workers
+	workers := m.buildOptions.readWorkers()
+	jobs := make(chan *fileRead)
+	queue := make(chan *fileRead, 2*workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				file.err = m.walkFile(file.path, file.relPath, sizeMax, file.stats, func(doc index.Document) error {
+					file.docs = append(file.docs, doc)
+					return nil
+				})
+				close(file.done)
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		walkErr = walkTree(walkRoot, filter.followSymlinks, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// Skip hidden directories and common non-code directories
+			if d.IsDir() {
+				base := filepath.Base(path)
+				if strings.HasPrefix(base, ".") || isSkippedDir(base) {
+					return filepath.SkipDir
+				}
+				relDir, err := filepath.Rel(walkRoot, path)
+				if err != nil || relDir == "." {
+					return nil
+				}
+				// Skip directories outside the sparse checkout or ignored by git
+				if filter.excludes(relDir, true) {
+					return filepath.SkipDir
+				}
+				// Skip directories walked before the walk was resumed
+				if walk.last != "" && walkOrder(relDir, walk.last) < 0 && !strings.HasPrefix(walk.last, relDir+string(filepath.Separator)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Skip hidden files and non-text files
+			if strings.HasPrefix(filepath.Base(path), ".") {
+				return nil
+			}
+
+			// Get relative path from source directory
+			relPath, err := filepath.Rel(walkRoot, path)
+			if err != nil {
+				return nil
+			}
+			if filter.excludes(relPath, false) {
+				return nil
+			}
+			if walk.last != "" && walkOrder(relPath, walk.last) <= 0 {
+				return nil
+			}
+
+			// Files over the size limit are counted without being read
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			file := &fileRead{path: path, relPath: relPath, stats: newSourceStats(), done: make(chan struct{})}
+			oversized := filter.oversized(info.Size())
+			if oversized {
+				file.stats.skipped[skipMaxFileSize]++
+				close(file.done)
+			}
+			select {
+			case queue <- file:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if oversized {
+				return nil
+			}
+			select {
+			case jobs <- file:
+			case <-ctx.Done():
+				// The file was queued, so it is finished unread
+				file.err = ctx.Err()
+				close(file.done)
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+
+	// Count indexed files per language so searches can validate lang filters,
+	// and skipped files per reason for index_health
+	stats := walk.stats
+	var err error
+	for file := range queue {
+		<-file.done
+		if err != nil {
+			continue
+		}
+		if err = file.err; err == nil {
+			err = walk.addFile(file, add)
+		}
+		if err == nil && walked != nil {
+			err = walked(walk)
+		}
+		if err != nil {
+			// Stop the walk and drain the queue
+			cancel()
+		}
+	}
+	wg.Wait()
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	stats.fingerprint = hex.EncodeToString(walk.hash.Sum(nil))
+	return stats, nil
+}
+
+// addFile passes the documents of a file that was read to add and records
+// it as the last file of the walk
+func (w *sourceWalk) addFile(file *fileRead, add func(index.Document) error) error {
+	w.stats.add(file.stats)
+	for _, doc := range file.docs {
+		fmt.Fprintf(w.hash, "%s\x00%d\x00", doc.Name, len(doc.Content))
+		w.hash.Write(doc.Content)
+		if err := add(doc); err != nil {
+			return err
+		}
+	}
+	w.last = file.relPath
+	w.walked++
 	return nil
 }
 
+// walkFile reads a file found by walkSource and passes it to add, unless it
+// is binary. Only the start of a file is read until it is known to be
+// indexed, and its content is allocated once at its final size, so files
+// that are skipped or too large cost no more memory than the sample.
+func (m *IndexManager) walkFile(path string, relPath string, sizeMax int, stats *sourceStats, add func(index.Document) error) error {
+	// Skip files that are likely binary
+	if isBinaryFile(path) {
+		stats.skipped[skipBinaryExtension]++
+		return m.catalogBinary(path, relPath, stats, add)
+	}
+
+	// Read the start of the file
+	f, err := os.Open(path)
+	if err != nil {
+		// Skip files we can't read
+		stats.skipped[skipUnreadable]++
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		stats.skipped[skipUnreadable]++
+		return nil
+	}
+	buf := sampleBuffers.Get().(*[]byte)
+	defer sampleBuffers.Put(buf)
+	if sampleSize := m.buildOptions.binarySampleSize(); len(*buf) < sampleSize {
+		*buf = make([]byte, sampleSize)
+	}
+	sample, err := readSample(f, (*buf)[:m.buildOptions.binarySampleSize()])
+	if err != nil {
+		stats.skipped[skipUnreadable]++
+		return nil
+	}
+
+	// Skip binary content. UTF-16 text is full of null bytes, so it is
+	// recognized by its byte order mark and indexed as UTF-8 instead.
+	utf16 := isUTF16(sample)
+	if !utf16 {
+		if reason := m.buildOptions.binarySample(sample); reason != "" {
+			stats.skipped[reason]++
+			return m.catalogBinary(path, relPath, stats, add)
+		}
+	}
+
+	size := int(info.Size())
+	chunked := m.buildOptions.chunkFile(size, sizeMax)
+
+	// Zoekt keeps only the name of files over its size limit, so their
+	// content is not read past the sample
+	if size > sizeMax && !chunked {
+		stats.skipped[skipTooLarge]++
+		return m.addNameOnly(relPath, sample, info.Size(), index.SkipReasonTooLarge, stats, add)
+	}
+
+	content, err := readRest(f, sample, size)
+	if err != nil {
+		stats.skipped[skipUnreadable]++
+		return nil
+	}
+	if utf16 {
+		content = decodeUTF16(content)
+	} else if bytes.IndexByte(content[len(sample):], 0) >= 0 {
+		// The sample looked like text, but Zoekt would skip the content
+		stats.skipped[skipBinaryAfterSample]++
+		return m.addNameOnly(relPath, sample, int64(len(content)), index.SkipReasonBinary, stats, add)
+	}
+
+	// Fill in the language for files Zoekt cannot classify by name alone
+	language := detectLanguage(relPath, content)
+	if language != "" {
+		stats.languages[language]++
+	}
+	stats.files++
+	stats.bytes += int64(len(content))
+
+	// Split files over Zoekt's size limit into separately indexed
+	// chunks instead of letting the builder skip their content
+	if chunked {
+		for _, chunk := range splitContent(content, sizeMax) {
+			doc := index.Document{
+				Name:     chunkName(relPath, chunk.LineOffset),
+				Content:  chunk.Content,
+				Language: language,
+			}
+			if err := add(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Zoekt keeps only the name of files that grew over its size limit
+	// since they were opened
+	if len(content) > sizeMax {
+		stats.skipped[skipTooLarge]++
+	}
+
+	// Add file to index
+	doc := index.Document{
+		Name:     relPath,
+		Content:  content,
+		Language: language,
+	}
+
+	return add(doc)
+}
+
+// addNameOnly passes a file whose content is not indexed to add, so its name
+// is still searchable. Its language is detected from the sample.
+func (m *IndexManager) addNameOnly(relPath string, sample []byte, size int64, reason index.SkipReason, stats *sourceStats, add func(index.Document) error) error {
+	if isUTF16(sample) {
+		sample = decodeUTF16(sample)
+	}
+	language := detectLanguage(relPath, sample)
+	if language != "" {
+		stats.languages[language]++
+	}
+	stats.files++
+	stats.bytes += size
+	return add(index.Document{
+		Name:       relPath,
+		Language:   language,
+		SkipReason: reason,
+	})
+}
+
 // SearchOptions controls search behavior
 type SearchOptions struct {
-	MaxFiles        int  // Maximum number of files to return (default: 20)
-	MaxLinesPerFile int  // Maximum matches per file (default: 3)
-	MaxLineLength   int  // Truncate lines longer than this (default: 200)
-	FilesOnly       bool // Only return file paths, no line content
+	MaxFiles        int    // Maximum number of files to return (default: 20)
+	MaxLinesPerFile int    // Maximum matches per file (default: 3)
+	MaxLineLength   int    // Truncate lines longer than this many runes (default: 200)
+	FilesOnly       bool   // Only return file paths, no line content
+	OnePerFile      bool   // Only show the best line of each file, ranking files by all their matches (BM25)
+	Enclosing       bool   // Label each line with the function or class it is in, from symbol data
+	Language        string // Restrict results to this language (name or alias)
+	Terse           bool   // Only output matched lines, leaving counts to the result fields
+	Workspace       string // Search the directories of this workspace rather than sourceDir
+	Remote          bool   // Also search the remote backends, when searching all indexes
+	Owners          bool   // Annotate each file with its owners from CODEOWNERS
+	Permalinks      bool   // Annotate each file with a web link pinned to the indexed commit
+	Color           bool   // Dim file locations with ANSI escapes, for terminals; see also ColorHighlightStart
+	RelativePaths   bool   // Show paths relative to the root of the indexes, stated once before the lines
+	// SmartIdentifiers matches the plain words of the query as identifiers
+	// in any style, so "user id" matches userID and user_id
+	SmartIdentifiers bool
+	// ExpandAliases searches for the terms of the query by their aliases
+	// too, as set with SetAliases
+	ExpandAliases bool
+	// SpellFallback, SpellSuggest or SpellInclude, looks for near misses of
+	// an identifier that matched nothing, e.g. HandleRequest for
+	// HandelRequest
+	SpellFallback string
+	// Scope, ScopeComments or ScopeStrings, only matches text inside the
+	// comments or string literals of files in languages with known syntax
+	Scope string
+
+	// HighlightStart and HighlightEnd, if either is set, are put around the
+	// matched text in each line, e.g. DefaultHighlightStart and
+	// DefaultHighlightEnd
+	HighlightStart string
+	HighlightEnd   string
+
+	// Regex flags applied to every pattern in the query
+	IgnoreCase bool // Match letters in either case, overriding case:auto
+	DotAll     bool // Let . match newlines
+	OneLine    bool // Make ^ and $ match only at the start and end of a file
+
+	// OnProgress, if set, streams the search and is called as matching
+	// files are found, before the final result is returned
+	OnProgress func(SearchProgress)
+	// OnQueued, if set, is called with the position of the search in the
+	// queue while it waits for other searches to finish first
+	OnQueued func(position int)
 }
 
 // DefaultSearchOptions returns sensible defaults for context-efficient search
@@ -175,14 +913,75 @@ func DefaultSearchOptions() SearchOptions {
 
 // SearchResult holds the search output in a compact format
 type SearchResult struct {
-	TotalFiles   int      // Total number of files that matched
-	TotalMatches int      // Total number of line matches
-	Lines        []string // Compact output lines: "file:line: content" or just "file"
+	TotalFiles      int      // Total number of files that matched
+	TotalMatches    int      // Total number of matches
+	TotalsEstimated bool     // Search stopped early, so the totals are lower bounds
+	ID              string   // Identifies the result for RefineSearch and OpenResult, if there are matches
+	ShownFiles      int      // Number of files in Lines
+	Lines           []string // Compact output lines: "file:line: content" or just "file"
+	// MoreMatches counts the matches per file left out of Lines beyond
+	// MaxLinesPerFile
+	MoreMatches map[string]int
+
+	// Owners of the files in Lines by path, if requested and known
+	Owners map[string][]string
+	// Permalinks to the first match of the files in Lines by path, if
+	// requested and the index has a GitHub or GitLab remote
+	Permalinks map[string]string
+
+	// RelativeTo is the directory the paths in Lines and the maps are
+	// relative to, if any
+	RelativeTo string
+
+	// Warnings about likely mistakes in the query, also listed before Lines
+	// unless the search is terse
+	Warnings []string
+
+	// Suggestions are near misses of a query that matched nothing, with
+	// SearchOptions.SpellFallback
+	Suggestions []string
+
+	// Metrics measure what the limits of the search left out
+	Metrics SearchMetrics
+
+	// Remote searches: files found per backend beyond those found locally,
+	// and the backends that failed
+	RemoteFiles  map[string]int
+	RemoteErrors []string
+
+	// CorruptIndexes are the searched indexes left out because a shard of
+	// theirs cannot be loaded; they need to be re-indexed
+	CorruptIndexes []CorruptIndex
+
+	// QueueWait is how long the search waited for other searches to finish,
+	// with the searches run at once capped
+	QueueWait time.Duration
+
+	files []resultFile // Files in Lines, in order, for OpenResult
+}
+
+// Search performs a search across all indexes or, if sourceDir is set, the
+// index of that directory. It returns compact grep-like output to minimize
+// context usage. A result with matches gets an ID for RefineSearch and
+// OpenResult. With opts.Remote, a search across all indexes also searches
+// the remote backends, whose files follow the local ones.
+func (m *IndexManager) Search(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions) (*SearchResult, error) {
+	if opts.Remote && len(m.remotes) > 0 && sourceDir == "" && opts.Workspace == "" && opts.Scope == "" {
+		return m.federatedSearch(ctx, queryStr, opts)
+	}
+	if opts.SpellFallback != "" && opts.SpellFallback != SpellSuggest && opts.SpellFallback != SpellInclude {
+		return nil, fmt.Errorf("invalid spell fallback %q: use %s or %s", opts.SpellFallback, SpellSuggest, SpellInclude)
+	}
+	sr, err := m.search(ctx, queryStr, sourceDir, opts, nil)
+	if err == nil && sr.TotalFiles == 0 && opts.SpellFallback != "" {
+		return m.spellFallback(ctx, queryStr, sourceDir, opts, sr)
+	}
+	return sr, err
 }
 
-// Search performs a search across all indexes or a specific index
-// Returns compact grep-like output to minimize context usage
-func (m *IndexManager) Search(queryStr string, sourceDir string, opts SearchOptions) (*SearchResult, error) {
+// search implements Search and RefineSearch, limiting the search to the
+// files matched by all of within
+func (m *IndexManager) search(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions, within []searchStep) (*SearchResult, error) {
 	// Apply defaults for zero values
 	if opts.MaxFiles <= 0 {
 		opts.MaxFiles = 20
@@ -193,193 +992,749 @@ func (m *IndexManager) Search(queryStr string, sourceDir string, opts SearchOpti
 	if opts.MaxLineLength <= 0 {
 		opts.MaxLineLength = 200
 	}
+	if err := validateScope(opts.Scope); err != nil {
+		return nil, err
+	}
 
-	// Always search in the base index directory (flat structure)
-	searchDir := m.indexDir
-
-	// If a specific directory is requested, add a repo filter to the query
-	if sourceDir != "" {
-		absPath, err := filepath.Abs(sourceDir)
+	// Load metadata to map repo names to source directories
+	metadata := m.visibleMetadata(ctx)
+	owner := ownerFromContext(ctx)
+
+	// Shards shared by several clones report results under one of them
+	repos := shardView(metadata)
+
+	// If a specific directory or workspace is requested, search its indexes
+	// and those of their submodules
+	var dirs []string
+	switch {
+	case opts.Workspace != "" && sourceDir != "":
+		return nil, errors.New("directory and workspace cannot be combined; add the directory to the workspace instead")
+	case opts.Workspace != "":
+		workspaceDirs, err := m.WorkspaceDirectories(ctx, opts.Workspace)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve path: %w", err)
+			return nil, err
 		}
-		prefix := m.getIndexPrefix(absPath)
-		// Add repo filter to query
-		queryStr = fmt.Sprintf("repo:%s %s", prefix, queryStr)
+		dirs = workspaceDirs
+	case sourceDir != "":
+		dirs = []string{sourceDir}
+	}
+	var scoped, scope []string
+	if dirs != nil {
+		prefixes, err := m.scopePrefixes(ctx, metadata, dirs)
+		if err != nil {
+			return nil, err
+		}
+		scoped = prefixes
+		for _, p := range scoped {
+			shardPrefix := p
+			if meta, ok := metadata[p]; ok {
+				shardPrefix = meta.shardPrefix(p)
+				repos[shardPrefix] = meta
+			}
+			scope = append(scope, shardPrefix)
+		}
+	}
+
+	searched := scoped
+	if dirs == nil {
+		searched = slices.Collect(maps.Keys(metadata))
+	}
+
+	// Repeated searches of unchanged indexes are answered from the cache
+	cacheKey := searchCacheKey(ctx, queryStr, sourceDir, opts, within, indexGeneration(metadata, searched))
+	if cached, ok := m.cachedResult(cacheKey); ok {
+		m.markSearched(searched, metadata)
+		if cached.ID != "" {
+			cached.ID = m.rememberSearch(ctx, sourceDir, append(slices.Clone(within), searchStep{query: queryStr, opts: opts}), cached.files)
+		}
+		return cached, nil
+	}
+
+	// Restore compressed shards of the indexes being searched, recording
+	// the search first so they are not compressed again meanwhile
+	m.markSearched(searched, metadata)
+	if err := m.decompressIndexes(searched, metadata); err != nil {
+		return nil, err
+	}
+
+	// Always search in the base index directory (flat structure), or its
+	// decrypted copy for encrypted indexes
+	searchDir, err := m.searchDir()
+	if err != nil {
+		return nil, err
 	}
 
-	// Load the searcher
-	searcher, err := search.NewDirectorySearcher(searchDir)
+	// Wait for a slot if too many searches are running
+	queueWait, release, err := m.searchLimiter.acquire(ctx, opts.OnQueued)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load index: %w", err)
+		return nil, err
+	}
+	defer release()
+
+	// Load the searcher, leaving out shards that fail to load
+	searcher, corrupt, err := m.openSearcher(searchDir)
+	if err != nil {
+		return nil, err
 	}
 	defer searcher.Close()
 
 	// Parse the query
-	q, err := query.Parse(queryStr)
+	warnings := lintQuery(queryStr)
+	parsed, err := m.parseSearchQuery(queryStr, opts, metadata, searched, scoped)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse query: %w", err)
+		return nil, lintError(err, warnings)
+	}
+	kinds, definitions := parsed.kinds, parsed.definitions
+
+	// Only search the requested directory, and the indexes the owner can see
+	var filters []query.Q
+	if scope != nil {
+		filters = append(filters, query.NewRepoSet(scope...))
+	}
+	if owner != "" {
+		filters = append(filters, query.NewRepoSet(slices.Collect(maps.Keys(repos))...))
+	}
+	// Leave out the paths muted in the searched indexes
+	muted, err := mutedQuery(metadata, searched)
+	if err != nil {
+		return nil, err
+	}
+	if muted != nil {
+		filters = append(filters, muted)
+	}
+	q := query.NewAnd(append([]query.Q{parsed.q}, filters...)...)
+
+	// Refining a previous search only searches the files it matched
+	refineEstimated := false
+	if within != nil {
+		files, truncated, err := m.refineFiles(ctx, searcher, within, filters, metadata, searched, scoped)
+		if err != nil {
+			return nil, err
+		}
+		q = query.NewAnd(q, files)
+		refineEstimated = truncated
 	}
 
-	// Set search options - request more than we need to get accurate totals
+	// Set search options
 	zoektOpts := &zoekt.SearchOptions{
-		MaxDocDisplayCount: opts.MaxFiles * 2, // Get extra for total count
+		MaxDocDisplayCount: opts.MaxFiles * 2, // Get extra candidates for files_only ordering
+		UseBM25Scoring:     opts.OnePerFile,
+	}
+	if opts.Scope != "" {
+		// Scoped matches are found in the content of more candidates
+		zoektOpts.Whole = true
+		zoektOpts.MaxDocDisplayCount = max(zoektOpts.MaxDocDisplayCount, scopeCandidates)
 	}
 
-	// Perform the search
-	result, err := searcher.Search(context.Background(), q, zoektOpts)
+	// Perform the search, streaming partial results if requested
+	var result *zoekt.SearchResult
+	if opts.OnProgress != nil {
+		result, err = streamSearch(ctx, searcher, q, zoektOpts, repos, opts.OnProgress)
+	} else {
+		result, err = searcher.Search(ctx, q, zoektOpts)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("search failed: %w", err)
 	}
 
-	// Load metadata to map repo names to source directories
-	metadata := m.loadAllMetadata()
-
 	// Build compact output
 	sr := &SearchResult{
-		TotalFiles:   len(result.Files),
-		TotalMatches: 0,
+		TotalFiles:   result.Stats.FileCount,
+		TotalMatches: result.Stats.MatchCount,
+		// Zoekt stops evaluating candidates once enough matches are found
+		TotalsEstimated: result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0 || refineEstimated,
+	}
+	if sr.TotalFiles < len(result.Files) {
+		sr.TotalFiles = len(result.Files)
+	}
+
+	// Keep only definitions of the requested symbol kinds, counting what is
+	// left
+	if kinds != nil {
+		result.Files = filterSymbolKinds(result.Files, kinds)
+		sr.TotalFiles, sr.TotalMatches = len(result.Files), 0
+		for _, fileMatch := range result.Files {
+			sr.TotalMatches += len(fileMatch.LineMatches)
+		}
+	}
+
+	// Keep only matches in comments or strings, counting what is left.
+	// Files beyond the fetched candidates cannot be checked.
+	if opts.Scope != "" {
+		sr.TotalsEstimated = sr.TotalsEstimated || sr.TotalFiles > len(result.Files)
+		result.Files = filterScope(result.Files, opts.Scope)
+		sr.TotalFiles, sr.TotalMatches = len(result.Files), 0
+		for _, fileMatch := range result.Files {
+			sr.TotalMatches += len(fileMatch.LineMatches)
+		}
+	}
+
+	files := result.Files
+	if definitions {
+		files = rankDefinitions(files)
+	}
+	if opts.FilesOnly {
+		// List the densest files first so they can be read first, after
+		// the files defining the symbol
+		files = slices.Clone(files)
+		sort.SliceStable(files, func(i, j int) bool {
+			if defI, defJ := hasDefinition(files[i]), hasDefinition(files[j]); defI != defJ {
+				return defI
+			}
+			return fileMatchCount(files[i]) > fileMatchCount(files[j])
+		})
 	}
 
+	var owners *ownerLookup
+	if opts.Owners {
+		owners = m.newOwnerLookup(repos)
+	}
+
+	// Label matched lines with the functions and classes around them
+	var scopes enclosingSymbols
+	if opts.Enclosing && !opts.FilesOnly && symbolsIndexed(metadata, searched) {
+		if scopes, err = findEnclosingSymbols(ctx, searcher, files[:min(len(files), opts.MaxFiles)]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Paths can be shown relative to the root of the shown files
+	base := relativeBase(files[:min(len(files), opts.MaxFiles)], repos, opts)
+
 	filesProcessed := 0
-	for _, fileMatch := range result.Files {
+	for _, fileMatch := range files {
 		if filesProcessed >= opts.MaxFiles {
 			break
 		}
 		filesProcessed++
 
-		// Get source directory for full path
-		baseDir := ""
-		if meta, ok := metadata[fileMatch.Repository]; ok {
-			baseDir = meta.SourceDir
+		fullPath := resultPath(fileMatch, repos)
+		fileName, lineOffset := splitChunkName(fileMatch.FileName)
+		sr.files = append(sr.files, resultFile{repo: fileMatch.Repository, name: fileName, path: fullPath})
+		fullPath = relativeTo(fullPath, base)
+
+		// Owners and permalinks are listed after the lines of the file
+		var annotations []string
+		if owners != nil {
+			if fileOwners := owners.lookup(fileMatch.Repository, filepath.ToSlash(fileName)); fileOwners != nil {
+				if sr.Owners == nil {
+					sr.Owners = make(map[string][]string)
+				}
+				sr.Owners[fullPath] = fileOwners
+				if !opts.Terse {
+					annotations = append(annotations, "  owners: "+strings.Join(fileOwners, " "))
+				}
+			}
 		}
-
-		fullPath := fileMatch.FileName
-		if baseDir != "" {
-			fullPath = filepath.Join(baseDir, fileMatch.FileName)
+		if opts.Permalinks {
+			if link := permalink(repos[fileMatch.Repository], filepath.ToSlash(fileName), firstMatchLine(fileMatch, lineOffset)); link != "" {
+				if sr.Permalinks == nil {
+					sr.Permalinks = make(map[string]string)
+				}
+				sr.Permalinks[fullPath] = link
+				if !opts.Terse {
+					annotations = append(annotations, "  link: "+link)
+				}
+			}
 		}
 
 		if opts.FilesOnly {
-			sr.Lines = append(sr.Lines, fullPath)
+			switch count := fileMatchCount(fileMatch); count {
+			case 0:
+				sr.Lines = append(sr.Lines, opts.dim(fullPath))
+			case 1:
+				sr.Lines = append(sr.Lines, fmt.Sprintf("%s (1 match)", opts.dim(fullPath)))
+			default:
+				sr.Lines = append(sr.Lines, fmt.Sprintf("%s (%d matches)", opts.dim(fullPath), count))
+			}
+			sr.Lines = append(sr.Lines, annotations...)
 			continue
 		}
 
-		// Collect matches from LineMatches
-		linesAdded := 0
-		for _, lineMatch := range fileMatch.LineMatches {
-			sr.TotalMatches++
-			if linesAdded >= opts.MaxLinesPerFile {
-				continue
-			}
-			linesAdded++
-
-			content := strings.TrimRight(string(lineMatch.Line), "\n\r")
-			content = truncateLine(content, opts.MaxLineLength)
-
-			sr.Lines = append(sr.Lines, fmt.Sprintf("%s:%d: %s",
-				fullPath, lineMatch.LineNumber, content))
-		}
-
-		// Handle ChunkMatches if LineMatches is empty
-		if len(fileMatch.LineMatches) == 0 {
-			for _, chunk := range fileMatch.ChunkMatches {
-				lines := strings.Split(string(chunk.Content), "\n")
-				for i, line := range lines {
-					if strings.TrimSpace(line) == "" {
-						continue
-					}
-					sr.TotalMatches++
-					if linesAdded >= opts.MaxLinesPerFile {
-						continue
-					}
-					linesAdded++
-
-					content := truncateLine(strings.TrimRight(line, "\r"), opts.MaxLineLength)
-					lineNum := int(chunk.ContentStart.LineNumber) + i
-
-					sr.Lines = append(sr.Lines, fmt.Sprintf("%s:%d: %s",
-						fullPath, lineNum, content))
+		sr.addMatchLines(fileMatch, fullPath, lineOffset, opts, scopes)
+		sr.Lines = append(sr.Lines, annotations...)
+	}
+	sr.ShownFiles = filesProcessed
+	sr.addRelativeHeader(base, opts)
+	if err := lintResult(sr, warnings, opts); err != nil {
+		return nil, err
+	}
+	sr.addCorruptWarnings(corruptIndexes(corrupt, metadata, searched), opts)
+	if sr.TotalFiles > 0 {
+		sr.ID = m.rememberSearch(ctx, sourceDir, append(slices.Clone(within), searchStep{query: queryStr, opts: opts}), sr.files)
+	}
+
+	// Add summary if results were truncated
+	switch {
+	case opts.Terse:
+	case sr.TotalsEstimated:
+		sr.Lines = append(sr.Lines, fmt.Sprintf("\n[Showing %d of at least %d files (search stopped early). Narrow the query to see all matches]",
+			filesProcessed, sr.TotalFiles))
+	case sr.TotalFiles > opts.MaxFiles:
+		sr.Lines = append(sr.Lines, fmt.Sprintf("\n[Showing %d of %d files. Use max_files to see more]",
+			opts.MaxFiles, sr.TotalFiles))
+	}
+
+	sr.measure(opts)
+	m.cacheResult(cacheKey, sr)
+	sr.QueueWait = queueWait
+	return sr, nil
+}
+
+// addMatchLines adds the matching lines of a file to the output, up to
+// opts.MaxLinesPerFile or only the best one with opts.OnePerFile, and notes
+// how many more it has
+func (sr *SearchResult) addMatchLines(fileMatch zoekt.FileMatch, fullPath string, lineOffset int, opts SearchOptions, scopes enclosingSymbols) {
+	// Zoekt orders the lines of a file best first
+	limit := opts.MaxLinesPerFile
+	if opts.OnePerFile {
+		limit = 1
+	}
+
+	// Collect matches from LineMatches
+	linesAdded := 0
+	for _, lineMatch := range fileMatch.LineMatches {
+		if linesAdded >= limit {
+			continue
+		}
+		linesAdded++
+
+		content := strings.TrimRight(string(lineMatch.Line), "\n\r")
+		sr.Metrics.countLine(content, opts.MaxLineLength)
+		content = highlightLine(content, lineMatchSpans(lineMatch), opts)
+
+		sr.Lines = append(sr.Lines, fmt.Sprintf("%s: %s",
+			opts.dim(matchLocation(fullPath, lineMatch.LineNumber+lineOffset, scopes.label(fileMatch, lineMatch.LineNumber))), content))
+	}
+
+	// Handle ChunkMatches if LineMatches is empty
+	if len(fileMatch.LineMatches) == 0 {
+		for _, chunk := range fileMatch.ChunkMatches {
+			lines := strings.Split(string(chunk.Content), "\n")
+			lineStart := 0 // Byte offset of line in the chunk
+			for i, line := range lines {
+				start := lineStart
+				lineStart += len(line) + 1
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				if linesAdded >= limit {
+					continue
 				}
+				linesAdded++
+
+				line = strings.TrimRight(line, "\r")
+				sr.Metrics.countLine(line, opts.MaxLineLength)
+				content := highlightLine(line, chunkLineSpans(chunk, start, len(line)), opts)
+				lineNum := int(chunk.ContentStart.LineNumber) + i
+
+				sr.Lines = append(sr.Lines, fmt.Sprintf("%s: %s",
+					opts.dim(matchLocation(fullPath, lineNum+lineOffset, scopes.label(fileMatch, lineNum))), content))
 			}
 		}
+	}
 
-		// Add indicator if there are more matches in this file
-		totalInFile := len(fileMatch.LineMatches)
-		if totalInFile == 0 {
-			for _, chunk := range fileMatch.ChunkMatches {
-				totalInFile += strings.Count(string(chunk.Content), "\n") + 1
-			}
+	// Add indicator if there are more matches in this file, except with one
+	// line per file, whose point is to be dense
+	totalInFile := fileMatchCount(fileMatch)
+	if totalInFile > limit {
+		if sr.MoreMatches == nil {
+			sr.MoreMatches = make(map[string]int)
 		}
-		if totalInFile > opts.MaxLinesPerFile {
+		sr.MoreMatches[fullPath] = totalInFile - limit
+		if !opts.Terse && !opts.OnePerFile {
 			sr.Lines = append(sr.Lines, fmt.Sprintf("  ... and %d more matches in this file",
-				totalInFile-opts.MaxLinesPerFile))
+				totalInFile-limit))
 		}
 	}
+}
 
-	// Add summary if results were truncated
-	if sr.TotalFiles > opts.MaxFiles {
-		sr.Lines = append(sr.Lines, fmt.Sprintf("\n[Showing %d of %d files. Use max_files to see more]",
-			opts.MaxFiles, sr.TotalFiles))
+// matchLocation formats the location of a matched line, with the label of
+// its enclosing symbol if known, e.g. "pkg/auth/token.go:87 (func Validate)"
+func matchLocation(fullPath string, line int, enclosing string) string {
+	if enclosing == "" {
+		return fmt.Sprintf("%s:%d", fullPath, line)
 	}
+	return fmt.Sprintf("%s:%d (%s)", fullPath, line, enclosing)
+}
 
-	return sr, nil
+// searchQuery is a parsed search query
+type searchQuery struct {
+	q           query.Q
+	kinds       []string // Symbol kinds to keep, from kind: atoms
+	definitions bool     // Lines defining a matched symbol are marked
 }
 
-// truncateLine shortens a line to maxLen, adding ellipsis if truncated
+// parseSearchQuery parses queryStr with the regex flags and language filter
+// of opts, for a search of the indexes named searched. scoped lists the
+// indexes of the requested directory, if any.
+func (m *IndexManager) parseSearchQuery(queryStr string, opts SearchOptions, metadata map[string]*indexMetadata, searched []string, scoped []string) (*searchQuery, error) {
+	// Symbol kind filters are applied to the results
+	queryStr, kinds, err := extractKinds(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	if kinds != nil {
+		if err := requireSymbols(metadata, searched); err != nil {
+			return nil, err
+		}
+	}
+	queryStr, targets, err := extractTargets(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ExpandAliases {
+		queryStr = expandAliases(queryStr, aliasGroups(metadata, searched))
+	}
+	if opts.SmartIdentifiers {
+		queryStr = smartIdentifierQuery(queryStr)
+	}
+
+	// A query of only target: atoms lists the files of the targets
+	var q query.Q = &query.Const{Value: true}
+	if queryStr != "" || targets == nil {
+		q, err = query.Parse(queryStr)
+	}
+	if err != nil {
+		// Explain regex syntax from other engines instead of the parser error
+		if explained := explainUnsupportedRegexp(queryStr, err); explained != nil {
+			return nil, explained
+		}
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+	if q, err = applyRegexpFlags(queryStr, q, opts); err != nil {
+		return nil, err
+	}
+	// Mark the lines defining a matched symbol, so they can be ranked above
+	// usages
+	definitions := kinds == nil && symbolsIndexed(metadata, searched)
+	if kinds != nil {
+		q = symbolQuery(q)
+	} else if definitions {
+		q = definitionQuery(q)
+	}
+
+	// Only match the files of the Bazel targets
+	for _, target := range targets {
+		files, err := m.targetQuery(target, metadata, searched)
+		if err != nil {
+			return nil, err
+		}
+		q = query.NewAnd(q, files)
+	}
+
+	// Apply the language filter after validating it against the index
+	if opts.Language != "" {
+		lang, err := resolveLanguage(opts.Language, metadata, scoped)
+		if err != nil {
+			return nil, err
+		}
+		q = query.NewAnd(q, &query.Language{Language: lang})
+	}
+	return &searchQuery{q: q, kinds: kinds, definitions: definitions}, nil
+}
+
+// resultPath returns the full path of a matched file, using the metadata to
+// find the source directory of the index it came from
+func resultPath(fileMatch zoekt.FileMatch, metadata map[string]*indexMetadata) string {
+	fileName, _ := splitChunkName(fileMatch.FileName)
+	fullPath := fileName
+	if meta, ok := metadata[fileMatch.Repository]; ok && meta.SourceDir != "" {
+		fullPath = filepath.Join(meta.dir(), fileName)
+	}
+	return strings.ToValidUTF8(fullPath, "\uFFFD")
+}
+
+// fileMatchCount returns the number of matching lines in a file match
+func fileMatchCount(fileMatch zoekt.FileMatch) int {
+	count := len(fileMatch.LineMatches)
+	if count == 0 {
+		for _, chunk := range fileMatch.ChunkMatches {
+			count += strings.Count(string(chunk.Content), "\n") + 1
+		}
+	}
+	return count
+}
+
+// firstMatchLine returns the line number of the first match shown for a
+// file, counting from the start of a chunked file, or 0 if only its name
+// matched
+func firstMatchLine(fileMatch zoekt.FileMatch, lineOffset int) int {
+	switch {
+	case len(fileMatch.LineMatches) > 0:
+		return fileMatch.LineMatches[0].LineNumber + lineOffset
+	case len(fileMatch.ChunkMatches) > 0:
+		return int(fileMatch.ChunkMatches[0].ContentStart.LineNumber) + lineOffset
+	}
+	return 0
+}
+
+// truncateLine shortens a line to maxLen runes, adding ellipsis if truncated.
+// Invalid UTF-8 is replaced first so the output is always valid text.
 func truncateLine(s string, maxLen int) string {
-	if len(s) <= maxLen {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if utf8.RuneCountInString(s) <= maxLen {
 		return s
 	}
 	if maxLen <= 3 {
-		return s[:maxLen]
+		return string([]rune(s)[:maxLen])
 	}
-	return s[:maxLen-3] + "..."
+	return string([]rune(s)[:maxLen-3]) + "..."
 }
 
 // IndexInfo contains information about an index
 type IndexInfo struct {
-	Name      string `json:"name"`
-	SourceDir string `json:"source_dir"`
+	Name      string         `json:"name"`
+	SourceDir string         `json:"source_dir"`
+	Files     int            `json:"files,omitempty"` // Files indexed
+	Bytes     int64          `json:"bytes,omitempty"` // Total size of the indexed files
+	IndexedAt time.Time      `json:"indexed_at,omitzero"`
+	Schedule  string         `json:"schedule,omitempty"` // Cron expression for automatic re-indexing
+	Watched   bool           `json:"watched,omitempty"`  // Re-indexed automatically when files change
+	Languages map[string]int `json:"languages,omitempty"`
+	// LastSearched is when the index was last searched, at hourly precision
+	LastSearched time.Time `json:"last_searched,omitzero"`
+	Compressed   bool      `json:"compressed,omitempty"`      // Shards are compressed until the next search
+	SharedWith   string    `json:"shared_with,omitempty"`     // Index whose shards this identical checkout uses
+	Sparse       []string  `json:"sparse_checkout,omitempty"` // Sparse-checkout definition limiting what was indexed
+	TrackedOnly  bool      `json:"tracked_only,omitempty"`    // Only files tracked by git were indexed
+	Parent       string    `json:"parent,omitempty"`          // Index of the repository this submodule belongs to
+	Symbols      bool      `json:"symbols,omitempty"`         // Symbol data for sym: and kind: was built
+	BazelTargets int       `json:"bazel_targets,omitempty"`   // Bazel targets recorded for target: and find_target
+	CodeOwners   int       `json:"code_owners,omitempty"`     // CODEOWNERS rules recorded for who_owns
+	Remote       string    `json:"remote,omitempty"`          // Repository of the origin remote, for permalinks
+	Attached     string    `json:"attached,omitempty"`        // Directory of externally built shards the index links to
+	Hooks        []HookRun `json:"hooks,omitempty"`           // Hook commands run around the last build
+	Muted        []string  `json:"muted,omitempty"`           // Path patterns left out of search results
+	// Aliases lists the terms expand_aliases searches for along with each
+	// term
+	Aliases map[string][]string `json:"aliases,omitempty"`
+	// IgnorePatterns are the patterns of files left out of the index, which
+	// re-indexing keeps
+	IgnorePatterns []string `json:"ignore_patterns,omitempty"`
+	// Stale explains why the shards cannot be used by this server's Zoekt
+	// version until the index is rebuilt
+	Stale string `json:"stale,omitempty"`
+	// MaxFileSize is the size in bytes above which files were left out,
+	// which re-indexing keeps; 0 for no limit and -1 if the default limit
+	// was turned off for the index
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// Skipped counts the files of the last build that were left out or
+	// indexed by name only, per reason
+	Skipped map[string]int `json:"skipped_files,omitempty"`
+	// FollowSymlinks tells whether symbolic links were followed, which
+	// re-indexing keeps
+	FollowSymlinks bool `json:"follow_symlinks,omitempty"`
+	// NoDefaultExcludes tells whether the default excludes, such as
+	// lockfiles and minified files, were indexed, which re-indexing keeps
+	NoDefaultExcludes bool `json:"no_default_excludes,omitempty"`
+	// Branch and Commit are the git branch and commit checked out when the
+	// directory was indexed, i.e. the snapshot searches see. Branch is empty
+	// for a detached HEAD.
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
 }
 
-// ListIndexes returns a list of all indexes
-func (m *IndexManager) ListIndexes() ([]IndexInfo, error) {
-	metadata := m.loadAllMetadata()
+// ListIndexes returns all indexes sorted by name
+func (m *IndexManager) ListIndexes(ctx context.Context) ([]IndexInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	metadata := m.visibleMetadata(ctx)
 
 	var indexes []IndexInfo
 	for name, meta := range metadata {
 		indexes = append(indexes, IndexInfo{
 			Name:      name,
-			SourceDir: meta.SourceDir,
+			SourceDir: meta.dir(),
+			Files:     meta.Files,
+			Bytes:     meta.Bytes,
+			IndexedAt: meta.IndexedAt,
+			Schedule:  meta.Schedule,
+			Watched:   meta.Watched,
+			Languages: meta.Languages,
+
+			LastSearched: meta.LastSearched,
+			Compressed:   meta.Compressed,
+			SharedWith:   meta.SharedWith,
+			Sparse:       meta.Sparse,
+			TrackedOnly:  meta.TrackedOnly,
+			Parent:       meta.Parent,
+			Symbols:      meta.Symbols,
+			BazelTargets: meta.BazelTargets,
+			CodeOwners:   meta.CodeOwners,
+			Remote:       meta.Remote,
+			Attached:     meta.Attached,
+			Hooks:        meta.Hooks,
+			Muted:        meta.Muted,
+			Aliases:      meta.Aliases,
+
+			IgnorePatterns:    meta.IgnorePatterns,
+			Stale:             meta.Stale,
+			MaxFileSize:       meta.MaxFileSize,
+			Skipped:           meta.Skipped,
+			FollowSymlinks:    meta.FollowSymlinks,
+			Branch:            meta.Branch,
+			Commit:            meta.Commit,
+			NoDefaultExcludes: meta.NoDefaultExcludes,
 		})
 	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
 
 	return indexes, nil
 }
 
-// DeleteIndex removes an index for the given source directory
-func (m *IndexManager) DeleteIndex(sourceDir string) error {
-	absPath, err := filepath.Abs(sourceDir)
+// DeleteIndex removes the index for the given source directory
+func (m *IndexManager) DeleteIndex(ctx context.Context, sourceDir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	absPath, err := m.resolveIndexPath(sourceDir)
 	if err != nil {
 		return fmt.Errorf("failed to resolve path: %w", err)
 	}
 
-	// Delete the zoekt files
-	if err := m.deleteIndexFiles(absPath); err != nil {
-		return err
-	}
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
 
-	// Delete the metadata
 	prefix := m.getIndexPrefix(absPath)
 	metadata := m.loadAllMetadata()
-	delete(metadata, prefix)
+
+	// The indexes of submodules go with the index of their repository
+	deleted := append([]string{prefix}, linkedIndexes(metadata, prefix)...)
+
+	// An owner can only delete its own indexes, and only drops its claim
+	// while other owners still use the index
+	if owner := ownerFromContext(ctx); owner != "" {
+		meta, ok := metadata[prefix]
+		if !ok || !meta.ownedBy(owner) {
+			return fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+		}
+		if len(meta.Owners) > 1 {
+			for _, p := range deleted {
+				metadata[p].Owners = slices.DeleteFunc(metadata[p].Owners, func(o string) bool { return o == owner })
+			}
+			return m.saveAllMetadata(metadata)
+		}
+	}
+
+	// Delete the metadata, and the zoekt files unless another clone or
+	// worktree still shares them
+	for _, p := range deleted {
+		if err := m.removeIndex(metadata, p); err != nil {
+			return err
+		}
+	}
 
 	return m.saveAllMetadata(metadata)
 }
 
+// indexPrefixes returns the index name for sourceDir, or the names of all
+// indexes if sourceDir is empty. It fails with ErrNotIndexed if sourceDir
+// has no index.
+func (m *IndexManager) indexPrefixes(ctx context.Context, sourceDir string) ([]string, error) {
+	metadata := m.visibleMetadata(ctx)
+
+	if sourceDir != "" {
+		absPath, err := m.resolveIndexPath(sourceDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		prefix := m.getIndexPrefix(absPath)
+		if _, ok := metadata[prefix]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+		}
+		return []string{prefix}, nil
+	}
+
+	prefixes := make([]string, 0, len(metadata))
+	for prefix := range metadata {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
 // indexMetadata stores information about an indexed directory
 type indexMetadata struct {
-	SourceDir string `json:"source_dir"`
+	SourceDir string         `json:"source_dir"`
+	Files     int            `json:"files,omitempty"`
+	Bytes     int64          `json:"bytes,omitempty"`
+	Languages map[string]int `json:"languages,omitempty"`
+	Skipped   map[string]int `json:"skipped,omitempty"`
+	Owners    []string       `json:"owners,omitempty"`
+	Schedule  string         `json:"schedule,omitempty"`
+	Watched   bool           `json:"watched,omitempty"`
+	IndexedAt time.Time      `json:"indexed_at,omitzero"`
+	// LastSearched and Compressed drive compression of cold indexes
+	LastSearched time.Time `json:"last_searched,omitzero"`
+	Compressed   bool      `json:"compressed,omitempty"`
+	// GitHead and Fingerprint identify identical checkouts, which store
+	// their index once; SharedWith names the shards such an index uses
+	GitHead     string `json:"git_head,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	SharedWith  string `json:"shared_with,omitempty"`
+	// Sparse is the git sparse-checkout definition the index was built with
+	Sparse      []string `json:"sparse_checkout,omitempty"`
+	TrackedOnly bool     `json:"tracked_only,omitempty"`
+	// IgnorePatterns are the gitignore-style patterns of files left out,
+	// relative to the source directory
+	IgnorePatterns []string `json:"ignore_patterns,omitempty"`
+	// Stale is why the shards need a rebuild for the linked Zoekt version,
+	// found at startup
+	Stale string `json:"stale,omitempty"`
+	// MaxFileSize is the size in bytes above which files were left out; 0
+	// for no limit and -1 if the default limit was turned off
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// FollowSymlinks tells whether symbolic links were followed
+	FollowSymlinks bool `json:"follow_symlinks,omitempty"`
+	// NoDefaultExcludes tells whether the default excludes were indexed
+	NoDefaultExcludes bool `json:"no_default_excludes,omitempty"`
+	// Branch and Commit are the git checkout the index was built from
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// IndexedCommit and DirtyFiles (uncommitted changes at that time) are the
+	// base for delta builds, and DeltaBuilds counts them since the last full
+	// build
+	IndexedCommit string   `json:"indexed_commit,omitempty"`
+	DirtyFiles    []string `json:"dirty_files,omitempty"`
+	DeltaBuilds   int      `json:"delta_builds,omitempty"`
+	// Submodules lists the submodule paths left out of the shards; Parent
+	// names the index of the repository a submodule index is linked to
+	Submodules []string `json:"submodules,omitempty"`
+	Parent     string   `json:"parent,omitempty"`
+	// Symbols reports whether the shards contain ctags symbol data
+	Symbols bool `json:"symbols,omitempty"`
+	// BazelTargets counts the targets recorded for a Bazel workspace
+	BazelTargets int `json:"bazel_targets,omitempty"`
+	// CodeOwners counts the rules recorded from the CODEOWNERS file
+	CodeOwners int `json:"code_owners,omitempty"`
+	// Remote is the repository the origin remote points to, e.g.
+	// "github.com/org/repo"
+	Remote string `json:"remote,omitempty"`
+	// Attached is the directory of externally built shards the index links
+	// to, named by SharedWith
+	Attached string `json:"attached,omitempty"`
+	// Hooks records the hook commands run around the last build
+	Hooks []HookRun `json:"hooks,omitempty"`
+	// Muted lists the gitignore-style patterns of paths left out of search
+	// results
+	Muted []string `json:"muted,omitempty"`
+	// Aliases maps lower case terms to the other names they are searched
+	// for with expand_aliases, e.g. k8s to kubernetes
+	Aliases map[string][]string `json:"aliases,omitempty"`
+
+	// localDir is where SourceDir is on this machine, by the path mappings
+	localDir string
+}
+
+// dir returns where the indexed directory is on this machine
+func (meta *indexMetadata) dir() string {
+	if meta.localDir != "" {
+		return meta.localDir
+	}
+	return meta.SourceDir
 }
 
 func (m *IndexManager) getMetadataPath() string {
@@ -387,8 +1742,7 @@ func (m *IndexManager) getMetadataPath() string {
 }
 
 func (m *IndexManager) loadAllMetadata() map[string]*indexMetadata {
-	metaPath := m.getMetadataPath()
-	content, err := os.ReadFile(metaPath)
+	content, err := m.readIndexFile(m.getMetadataPath())
 	if err != nil {
 		return make(map[string]*indexMetadata)
 	}
@@ -397,6 +1751,9 @@ func (m *IndexManager) loadAllMetadata() map[string]*indexMetadata {
 	if err := json.Unmarshal(content, &metadata); err != nil {
 		return make(map[string]*indexMetadata)
 	}
+	for _, meta := range metadata {
+		meta.localDir = m.localPath(meta.SourceDir)
+	}
 
 	return metadata
 }
@@ -406,36 +1763,141 @@ func (m *IndexManager) saveAllMetadata(metadata map[string]*indexMetadata) error
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(m.getMetadataPath(), content, 0644)
+	return m.writeIndexFile(m.getMetadataPath(), content)
+}
+
+// readIndexFile reads a file kept in the index directory, decrypting it if
+// it is encrypted
+func (m *IndexManager) readIndexFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncrypted(content) {
+		return content, nil
+	}
+
+	m.cacheMu.Lock()
+	aead := m.aead
+	m.cacheMu.Unlock()
+	if aead == nil {
+		return nil, ErrEncryptedIndex
+	}
+	return openBytes(aead, content)
+}
+
+// writeIndexFile writes a file kept in the index directory, encrypting it
+// if encryption at rest is enabled
+func (m *IndexManager) writeIndexFile(path string, content []byte) error {
+	m.cacheMu.Lock()
+	aead := m.aead
+	m.cacheMu.Unlock()
+	if aead == nil {
+		// Never replace an encrypted file that could not be read
+		if existing, err := os.ReadFile(path); err == nil && isEncrypted(existing) {
+			return ErrEncryptedIndex
+		}
+		return os.WriteFile(path, content, 0644)
+	}
+
+	content, err := sealBytes(aead, content)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", filepath.Base(path), err)
+	}
+	return os.WriteFile(path, content, 0600)
 }
 
-func (m *IndexManager) saveIndexMetadata(sourceDir string) error {
+func (m *IndexManager) saveIndexMetadata(sourceDir string, meta *indexMetadata) error {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
 	prefix := m.getIndexPrefix(sourceDir)
 	metadata := m.loadAllMetadata()
-	metadata[prefix] = &indexMetadata{SourceDir: sourceDir}
-	return m.saveAllMetadata(metadata)
+	meta.SourceDir = sourceDir
+	// Re-indexing keeps the existing owners, schedule, watching, muted
+	// paths, aliases and link to the repository of a submodule
+	oldShards := ""
+	if existing, ok := metadata[prefix]; ok {
+		oldShards = existing.shardPrefix(prefix)
+		meta.Schedule = existing.Schedule
+		meta.Watched = existing.Watched
+		meta.Muted = existing.Muted
+		meta.Aliases = existing.Aliases
+		meta.Parent = existing.Parent
+		for _, owner := range existing.Owners {
+			if !slices.Contains(meta.Owners, owner) {
+				meta.Owners = append(meta.Owners, owner)
+			}
+		}
+	}
+	metadata[prefix] = meta
+	if err := m.saveAllMetadata(metadata); err != nil {
+		return err
+	}
+
+	// Drop shards that were only kept for this index
+	if oldShards != "" && oldShards != meta.shardPrefix(prefix) {
+		return m.releaseShards(metadata, oldShards)
+	}
+	return nil
 }
 
 func (m *IndexManager) deleteIndexFiles(sourceDir string) error {
-	prefix := m.getIndexPrefix(sourceDir)
+	shards, err := m.shardFiles(m.getIndexPrefix(sourceDir))
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		if err := removeShard(shard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// removeShard deletes a shard file and the metadata overlay Zoekt writes
+// beside shards updated by delta builds, which would otherwise apply to a
+// new shard of the same name
+func removeShard(shard string) error {
+	if err := os.Remove(shard); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	plain := strings.TrimSuffix(strings.TrimSuffix(shard, compressedShardSuffix), encryptedShardSuffix)
+	if err := os.Remove(plain + ".meta"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// shardFiles returns the paths of the .zoekt shard files (plain, encrypted or
+// compressed) for an index prefix
+func (m *IndexManager) shardFiles(prefix string) ([]string, error) {
 	entries, err := os.ReadDir(m.indexDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
 
+	// Zoekt query-escapes repository names in shard file names, followed by
+	// the index format version, e.g. "name_v16.00000.zoekt"
+	plain, escaped := prefix+"_v", url.QueryEscape(prefix)+"_v"
+
+	var shards []string
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) && strings.HasSuffix(entry.Name(), ".zoekt") {
-			if err := os.Remove(filepath.Join(m.indexDir, entry.Name())); err != nil {
-				return err
-			}
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasPrefix(name, plain) || strings.HasPrefix(name, escaped)) &&
+			(strings.HasSuffix(name, ".zoekt") ||
+				strings.HasSuffix(name, ".zoekt"+encryptedShardSuffix) ||
+				strings.HasSuffix(name, ".zoekt"+compressedShardSuffix)) {
+			shards = append(shards, filepath.Join(m.indexDir, entry.Name()))
 		}
 	}
 
-	return nil
+	return shards, nil
 }
 
 // isSkippedDir returns true if the directory should be skipped
@@ -479,18 +1941,3 @@ func isBinaryFile(path string) bool {
 	}
 	return binaryExts[ext]
 }
-
-// isBinaryContent checks if content appears to be binary
-func isBinaryContent(content []byte) bool {
-	// Check first 8KB for null bytes
-	checkLen := len(content)
-	if checkLen > 8192 {
-		checkLen = 8192
-	}
-	for i := 0; i < checkLen; i++ {
-		if content[i] == 0 {
-			return true
-		}
-	}
-	return false
-}
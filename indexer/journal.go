@@ -0,0 +1,232 @@
+package indexer
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// defaultCheckpointMB is how much content a full build indexes between
+// checkpoints unless configured otherwise
+const defaultCheckpointMB = 1024
+
+// buildJournal records the progress of a full build next to its shards, so
+// a build that is interrupted resumes after the last batch of files it
+// committed instead of starting over
+type buildJournal struct {
+	Source  string `json:"source"`
+	GitHead string `json:"git_head,omitempty"`
+	Options string `json:"options"` // Hash of the builder options
+	// Branches are the branch names of the shards, which the shards of the
+	// resumed build must share
+	Branches []string `json:"branches,omitempty"`
+	// Shards is the number of shards committed at the checkpoint. Shards
+	// written after it are dropped when the build resumes.
+	Shards     int             `json:"shards"`
+	Checkpoint *walkCheckpoint `json:"checkpoint,omitempty"`
+	// Progress is updated every few seconds for IndexProgress, whose
+	// results are limited to the builds of the owner
+	Progress *buildProgress `json:"progress,omitempty"`
+	Owner    string         `json:"owner,omitempty"`
+}
+
+// walkCheckpoint is the state of a walk over a source directory after a
+// file, from which the walk can resume
+type walkCheckpoint struct {
+	Last      string         `json:"last"`   // Last file walked, relative to the walk root
+	Walked    int            `json:"walked"` // Files walked, whether indexed or skipped
+	Files     int            `json:"files"`
+	Bytes     int64          `json:"bytes"`
+	Languages map[string]int `json:"languages,omitempty"`
+	Skipped   map[string]int `json:"skipped,omitempty"`
+	Hash      []byte         `json:"hash"` // State of the fingerprint hash
+}
+
+// checkpoint saves the state of the walk
+func (w *sourceWalk) checkpoint() (*walkCheckpoint, error) {
+	state, err := w.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save fingerprint: %w", err)
+	}
+	return &walkCheckpoint{
+		Last:      w.last,
+		Walked:    w.walked,
+		Files:     w.stats.files,
+		Bytes:     w.stats.bytes,
+		Languages: maps.Clone(w.stats.languages),
+		Skipped:   maps.Clone(w.stats.skipped),
+		Hash:      state,
+	}, nil
+}
+
+// resume returns the state of a walk resuming at the checkpoint
+func (c *walkCheckpoint) resume() (*sourceWalk, error) {
+	walk := newSourceWalk()
+	if err := walk.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.Hash); err != nil {
+		return nil, fmt.Errorf("failed to restore fingerprint: %w", err)
+	}
+	walk.last = c.Last
+	walk.walked = c.Walked
+	walk.stats.files = c.Files
+	walk.stats.bytes = c.Bytes
+	maps.Copy(walk.stats.languages, c.Languages)
+	maps.Copy(walk.stats.skipped, c.Skipped)
+	return walk, nil
+}
+
+// checkpointBytes returns how much content a full build indexes between
+// checkpoints, or 0 if builds are not checkpointed
+func (b BuildOptions) checkpointBytes() int {
+	switch {
+	case b.CheckpointMB < 0:
+		return 0
+	case b.CheckpointMB == 0:
+		return defaultCheckpointMB << 20
+	}
+	return b.CheckpointMB << 20
+}
+
+// buildJournalPath returns the path of the build journal of the index named
+// prefix
+func (m *IndexManager) buildJournalPath(prefix string) string {
+	return filepath.Join(m.indexDir, prefix+journalSuffix)
+}
+
+// loadBuildJournal returns the journal of an interrupted build of the index
+// named prefix, and whether there is one. The journal is nil if it cannot
+// be read.
+func (m *IndexManager) loadBuildJournal(prefix string) (*buildJournal, bool) {
+	content, err := m.readIndexFile(m.buildJournalPath(prefix))
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	var journal buildJournal
+	if err != nil || json.Unmarshal(content, &journal) != nil {
+		return nil, true
+	}
+	return &journal, true
+}
+
+// saveBuildJournal records the progress of a build of the index named prefix
+func (m *IndexManager) saveBuildJournal(prefix string, journal *buildJournal) error {
+	content, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	if err := m.writeIndexFile(m.buildJournalPath(prefix), content); err != nil {
+		return fmt.Errorf("failed to save build journal: %w", err)
+	}
+	return nil
+}
+
+// removeBuildJournal deletes the journal of the index named prefix once its
+// build is complete or the index is deleted
+func (m *IndexManager) removeBuildJournal(prefix string) error {
+	if err := os.Remove(m.buildJournalPath(prefix)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove build journal: %w", err)
+	}
+	return nil
+}
+
+// resumes reports whether a build of source at gitHead with opts can resume
+// from the journal
+func (j *buildJournal) resumes(source string, gitHead string, opts index.Options) bool {
+	return j != nil && j.Checkpoint != nil && j.Shards > 0 &&
+		j.Source == source && j.GitHead == gitHead && j.Options == opts.GetHash() &&
+		slices.Equal(j.Branches, branchNames(opts))
+}
+
+// resumeShards prepares the shards of an interrupted build to resume from
+// its journal: shards written after the checkpoint are removed, and so are
+// the temporary files of shards that were being written. It returns false if
+// shards committed at the checkpoint are missing.
+func (m *IndexManager) resumeShards(journal *buildJournal, opts index.Options) (bool, error) {
+	prefix := opts.RepositoryDescription.Name
+	if err := m.removeTempShards(prefix); err != nil {
+		return false, err
+	}
+	opts.IndexDir = m.indexDir
+	shards := opts.FindAllShards()
+	if len(shards) < journal.Shards {
+		return false, nil
+	}
+	for _, shard := range shards[journal.Shards:] {
+		if err := removeShard(shard); err != nil {
+			return false, fmt.Errorf("failed to remove unfinished shard: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// discardUnfinished removes the shards a full build that failed with err,
+// for example because it was cancelled, wrote after its last checkpoint, so
+// searches do not see a partial index. A build without a checkpoint is
+// removed entirely along with its journal. It returns err.
+func (m *IndexManager) discardUnfinished(journal *buildJournal, opts index.Options, err error) error {
+	prefix := opts.RepositoryDescription.Name
+	if cleanupErr := m.removeTempShards(prefix); cleanupErr != nil {
+		return errors.Join(err, cleanupErr)
+	}
+	shards := opts.FindAllShards()
+	keep := 0
+	if journal.Checkpoint != nil {
+		keep = min(journal.Shards, len(shards))
+	}
+	for _, shard := range shards[keep:] {
+		if cleanupErr := removeShard(shard); cleanupErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to remove unfinished shard: %w", cleanupErr))
+		}
+	}
+	if keep == 0 {
+		if cleanupErr := m.removeBuildJournal(prefix); cleanupErr != nil {
+			return errors.Join(err, cleanupErr)
+		}
+	}
+	return err
+}
+
+// removeTempShards deletes the temporary files Zoekt writes shards to
+// before renaming them, left behind when a build is interrupted
+func (m *IndexManager) removeTempShards(prefix string) error {
+	entries, err := os.ReadDir(m.indexDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	plain, escaped := prefix+"_v", url.QueryEscape(prefix)+"_v"
+	for _, entry := range entries {
+		name := entry.Name()
+		if (strings.HasPrefix(name, plain) || strings.HasPrefix(name, escaped)) &&
+			strings.Contains(name, ".zoekt.") && strings.HasSuffix(name, ".tmp") {
+			if err := os.Remove(filepath.Join(m.indexDir, name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove temporary shard: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// walkOrder compares two paths relative to the walk root in the order
+// filepath.Walk visits them: by their elements, a directory before its
+// contents
+func walkOrder(a string, b string) int {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
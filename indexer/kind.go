@@ -0,0 +1,171 @@
+package indexer
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// kindAtom matches a kind: atom, whose value lists symbol kinds separated
+// by |
+var kindAtom = regexp.MustCompile(`(^|\s)kind:(\S*)`)
+
+// symbolKinds maps the kinds accepted by kind: to the ctags kinds of the
+// languages that have them. Other kinds are compared with the ctags kind
+// directly.
+var symbolKinds = map[string][]string{
+	"function": {"function", "func"},
+	"method":   {"method", "methodSpec"},
+	"class":    {"class", "struct", "interface", "trait", "type"},
+	"const":    {"const", "constant"},
+}
+
+// classKinds are the ctags kinds whose functions are methods
+var classKinds = []string{"class", "struct", "interface", "trait", "type"}
+
+// extractKinds removes the kind: atoms from queryStr, returning the rest
+// of the query and the requested symbol kinds
+func extractKinds(queryStr string) (string, []string, error) {
+	var kinds []string
+	var invalid bool
+	rest := kindAtom.ReplaceAllStringFunc(queryStr, func(atom string) string {
+		value := kindAtom.FindStringSubmatch(atom)[2]
+		for kind := range strings.SplitSeq(value, "|") {
+			if kind == "" {
+				invalid = true
+			}
+			kinds = append(kinds, strings.ToLower(kind))
+		}
+		return " "
+	})
+	if len(kinds) == 0 {
+		return queryStr, nil, nil
+	}
+	if invalid {
+		return "", nil, errors.New("kind: needs symbol kinds separated by |, e.g. kind:function|method")
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return "", nil, errors.New("kind: needs a symbol name to search for, e.g. kind:function Parse")
+	}
+	return rest, kinds, nil
+}
+
+// symbolQuery turns the content atoms of q into symbol definition searches,
+// leaving file name and other filters as they are
+func symbolQuery(q query.Q) query.Q {
+	return mapContentAtoms(q, func(atom query.Q) query.Q {
+		return &query.Symbol{Expr: atom}
+	})
+}
+
+// mapContentAtoms replaces the substring and regex atoms of q that match
+// file content
+func mapContentAtoms(q query.Q, f func(query.Q) query.Q) query.Q {
+	return query.Map(q, func(q query.Q) query.Q {
+		switch atom := q.(type) {
+		case *query.Substring:
+			if atom.Content || !atom.FileName {
+				return f(atom)
+			}
+		case *query.Regexp:
+			if atom.Content || !atom.FileName {
+				return f(atom)
+			}
+		}
+		return q
+	})
+}
+
+// filterSymbolKinds keeps the matched lines defining a symbol of one of
+// kinds, dropping files without any
+func filterSymbolKinds(files []zoekt.FileMatch, kinds []string) []zoekt.FileMatch {
+	var filtered []zoekt.FileMatch
+	for _, fileMatch := range files {
+		var lines []zoekt.LineMatch
+		for _, lineMatch := range fileMatch.LineMatches {
+			if slices.ContainsFunc(lineMatch.LineFragments, func(fragment zoekt.LineFragmentMatch) bool {
+				return symbolHasKind(fragment.SymbolInfo, kinds)
+			}) {
+				lines = append(lines, lineMatch)
+			}
+		}
+		if len(lines) > 0 {
+			fileMatch.LineMatches = lines
+			filtered = append(filtered, fileMatch)
+		}
+	}
+	return filtered
+}
+
+// symbolHasKind reports whether sym is of one of kinds. Functions defined
+// in a class or type count as methods rather than functions.
+func symbolHasKind(sym *zoekt.Symbol, kinds []string) bool {
+	if sym == nil {
+		return false
+	}
+	kind := strings.ToLower(sym.Kind)
+	inClass := slices.Contains(classKinds, strings.ToLower(sym.ParentKind))
+	for _, want := range kinds {
+		aliases, ok := symbolKinds[want]
+		if !ok {
+			aliases = []string{want}
+		}
+		matches := slices.ContainsFunc(aliases, func(alias string) bool { return strings.EqualFold(alias, kind) })
+		switch want {
+		case "function":
+			matches = matches && !inClass
+		case "method":
+			matches = matches || (inClass && slices.Contains(symbolKinds["function"], kind))
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// setCTagsPaths sets the ctags binaries Zoekt did not find itself, as it
+// only looks for universal-ctags and scip-ctags on the PATH
+func setCTagsPaths(opts *index.Options) {
+	if opts.DisableCTags {
+		return
+	}
+	if opts.CTagsPath == "" {
+		opts.CTagsPath = externalTool(toolCtags)
+	}
+	if opts.ScipCTagsPath == "" {
+		opts.ScipCTagsPath = externalTool(toolScipCtags)
+	}
+}
+
+// hasSymbols reports whether shards built with opts contain ctags symbol
+// data, which Zoekt adds when a ctags binary is installed
+func hasSymbols(opts index.Options) bool {
+	return !opts.DisableCTags && (opts.CTagsPath != "" || opts.ScipCTagsPath != "")
+}
+
+// symbolsIndexed reports whether any of the indexes named prefixes has
+// symbol data
+func symbolsIndexed(metadata map[string]*indexMetadata, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if meta, ok := metadata[prefix]; ok && meta.Symbols {
+			return true
+		}
+	}
+	return false
+}
+
+// requireSymbols fails if none of the indexes named prefixes has symbol
+// data to filter by kind
+func requireSymbols(metadata map[string]*indexMetadata, prefixes []string) error {
+	if !symbolsIndexed(metadata, prefixes) {
+		return errors.New("kind: filters need symbol data, which is only built when universal-ctags is installed; install it and re-index")
+	}
+	return nil
+}
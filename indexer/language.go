@@ -0,0 +1,221 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/languages"
+)
+
+// shebangInterpreters maps interpreter names found in #! lines to the
+// language names Zoekt uses for lang: filters
+var shebangInterpreters = map[string]string{
+	"sh":        "Shell",
+	"bash":      "Shell",
+	"zsh":       "Shell",
+	"ksh":       "Shell",
+	"dash":      "Shell",
+	"ash":       "Shell",
+	"fish":      "fish",
+	"python":    "Python",
+	"pypy":      "Python",
+	"node":      "JavaScript",
+	"nodejs":    "JavaScript",
+	"bun":       "JavaScript",
+	"deno":      "TypeScript",
+	"ts-node":   "TypeScript",
+	"tsx":       "TypeScript",
+	"ruby":      "Ruby",
+	"perl":      "Perl",
+	"php":       "PHP",
+	"lua":       "Lua",
+	"luajit":    "Lua",
+	"rscript":   "R",
+	"pwsh":      "PowerShell",
+	"tclsh":     "Tcl",
+	"wish":      "Tcl",
+	"awk":       "Awk",
+	"gawk":      "Awk",
+	"make":      "Makefile",
+	"groovy":    "Groovy",
+	"scala":     "Scala",
+	"elixir":    "Elixir",
+	"escript":   "Erlang",
+	"osascript": "AppleScript",
+	"julia":     "Julia",
+	"swift":     "Swift",
+	"kotlin":    "Kotlin",
+	"guile":     "Scheme",
+	"racket":    "Racket",
+	"sbcl":      "Common Lisp",
+	"crystal":   "Crystal",
+	"nim":       "Nim",
+	"dart":      "Dart",
+	"go":        "Go",
+}
+
+// interpreterVersionSuffix matches version suffixes such as python3.11 or perl5
+var interpreterVersionSuffix = regexp.MustCompile(`[0-9.]+$`)
+
+// makeTargetLine matches a Makefile rule header like "build: deps"
+var makeTargetLine = regexp.MustCompile(`^[A-Za-z0-9_./%$(){}-]+\s*::?(\s|$)`)
+
+// detectLanguage returns the language of a file. Zoekt's own extension,
+// filename and shebang based detection is tried first; when it finds nothing,
+// fallbacks cover extensionless scripts and oddly named build files so that
+// lang: filters also work for them. It returns "" if no language is found.
+func detectLanguage(name string, content []byte) string {
+	if langs := languages.GetLanguagesFromContent(name, content); len(langs) > 0 {
+		return langs[0]
+	}
+	if lang := languageFromFilename(name); lang != "" {
+		return lang
+	}
+	if lang := languageFromShebang(content); lang != "" {
+		return lang
+	}
+	return languageFromContent(content)
+}
+
+// languageFromFilename recognizes build files with non-standard names such as
+// Dockerfile.prod, api.Containerfile or Makefile-release
+func languageFromFilename(name string) string {
+	base := strings.ToLower(filepath.Base(name))
+	switch {
+	case strings.Contains(base, "dockerfile"), strings.Contains(base, "containerfile"):
+		return "Dockerfile"
+	case strings.Contains(base, "makefile"):
+		return "Makefile"
+	case strings.Contains(base, "jenkinsfile"):
+		return "Groovy"
+	case strings.Contains(base, "vagrantfile"), strings.Contains(base, "gemfile"), strings.Contains(base, "rakefile"):
+		return "Ruby"
+	}
+	return ""
+}
+
+// languageFromShebang maps the interpreter in a #! line to a language,
+// handling "/usr/bin/env [-S] interp" and versioned interpreters like python3
+func languageFromShebang(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return ""
+	}
+	line := content[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" {
+		// Skip env options such as -S or -i and VAR=value assignments
+		interp = ""
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+				continue
+			}
+			interp = filepath.Base(f)
+			break
+		}
+	}
+
+	interp = strings.ToLower(interp)
+	if lang, ok := shebangInterpreters[interp]; ok {
+		return lang
+	}
+	return shebangInterpreters[interpreterVersionSuffix.ReplaceAllString(interp, "")]
+}
+
+// languageFromContent looks at the first lines of a file for the telltale
+// structure of Dockerfiles and Makefiles
+func languageFromContent(content []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lines := 0
+	makeTargets := 0
+	recipeLines := 0
+	for scanner.Scan() && lines < 50 {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines++
+
+		// A Dockerfile's first instruction is FROM (optionally preceded by ARG)
+		if makeTargets == 0 && (strings.HasPrefix(trimmed, "FROM ") || strings.HasPrefix(trimmed, "ARG ")) {
+			if strings.HasPrefix(trimmed, "FROM ") {
+				return "Dockerfile"
+			}
+			continue
+		}
+
+		if makeTargetLine.MatchString(line) {
+			makeTargets++
+		} else if strings.HasPrefix(line, "\t") && makeTargets > 0 {
+			recipeLines++
+		}
+	}
+
+	if makeTargets > 0 && recipeLines > 0 {
+		return "Makefile"
+	}
+	return ""
+}
+
+// resolveLanguage maps a user supplied language name or alias (e.g. "golang",
+// "py") to the name used in the index, and checks that files of that
+// language were actually indexed. If prefixes is set, only those indexes are
+// considered. Indexes built before language tracking are not validated.
+func resolveLanguage(name string, metadata map[string]*indexMetadata, prefixes []string) (string, error) {
+	available := make(map[string]bool)
+	tracked := false
+	for p, meta := range metadata {
+		if prefixes != nil && !slices.Contains(prefixes, p) {
+			continue
+		}
+		if meta.Languages != nil {
+			tracked = true
+		}
+		for lang := range meta.Languages {
+			available[lang] = true
+		}
+	}
+
+	lang, ok := languages.GetLanguageByNameOrAlias(name)
+	if !ok {
+		// Fall back to a case-insensitive match against indexed languages
+		for candidate := range available {
+			if strings.EqualFold(candidate, name) {
+				return candidate, nil
+			}
+		}
+		return "", fmt.Errorf("unknown language %q%s", name, availableLanguagesHint(available))
+	}
+
+	if tracked && !available[lang] {
+		return "", fmt.Errorf("no %s files in the index%s", lang, availableLanguagesHint(available))
+	}
+	return lang, nil
+}
+
+// availableLanguagesHint formats the indexed languages for error messages
+func availableLanguagesHint(available map[string]bool) string {
+	if len(available) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(available))
+	for lang := range available {
+		names = append(names, lang)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf(". Available languages: %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,160 @@
+package indexer
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// licenseHeaderLines is how far into a file a license notice counts as its
+// header rather than text that mentions a license
+const licenseHeaderLines = 30
+
+// maxLicenseExamples is how many files are listed per header license
+const maxLicenseExamples = 5
+
+// LicenseReport is the distribution of licenses over indexed files
+type LicenseReport struct {
+	// LicenseFiles are files like LICENSE and COPYING with the license they
+	// hold, e.g. those of vendored packages
+	LicenseFiles []LicenseFile `json:"license_files,omitempty"`
+	// Headers counts the files with a license header by license, and
+	// Examples lists some of them
+	Headers  map[string]int      `json:"headers,omitempty"`
+	Examples map[string][]string `json:"examples,omitempty"`
+	// FilesWithHeader and Files count the files with a header and all
+	// indexed files
+	FilesWithHeader int `json:"files_with_header"`
+	Files           int `json:"files"`
+}
+
+// LicenseFile is a license file and the license it holds
+type LicenseFile struct {
+	Path    string `json:"path"`
+	License string `json:"license"` // SPDX identifier, or "unknown"
+}
+
+// licenseFileNames matches the names of license files
+var licenseFileNames = mustRegexpQuery(`(?i)(^|/)(licen[cs]e|copying|unlicense|notice)([._-][^/]*)?$`, true)
+
+// licenseMarkers match lines that state a license, to find headers
+var licenseMarkers = mustRegexpQuery(`(?i)spdx-license-identifier:|licensed under|permission is hereby granted|general public license|mozilla public license|redistribution and use in source and binary forms|eclipse public license|boost software license`, false)
+
+// spdxIdentifier matches an SPDX license identifier line
+var spdxIdentifier = regexp.MustCompile(`(?im)SPDX-License-Identifier:[ \t]*([^*\n]*?)[ \t]*(\*/|-->|#}|$)`)
+
+// licenseTexts identify licenses by phrases of their text or notices,
+// checked in order so the more specific ones come first
+var licenseTexts = []struct {
+	id      string
+	phrases []string // All must appear, ignoring case
+}{
+	{"AGPL-3.0", []string{"affero general public license"}},
+	{"LGPL-3.0", []string{"lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"lesser general public license", "version 2.1"}},
+	{"LGPL", []string{"lesser general public license"}},
+	{"GPL-3.0", []string{"general public license", "version 3"}},
+	{"GPL-2.0", []string{"general public license", "version 2"}},
+	{"GPL", []string{"general public license"}},
+	{"Apache-2.0", []string{"apache license", "2.0"}},
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"EPL-2.0", []string{"eclipse public license", "2.0"}},
+	{"EPL-1.0", []string{"eclipse public license"}},
+	{"BSL-1.0", []string{"boost software license"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"MIT", []string{"mit license"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+	{"Zlib", []string{"this software is provided 'as-is'", "altered source versions must be plainly marked"}},
+}
+
+// identifyLicense returns the SPDX identifier of the license text, or
+// "unknown"
+func identifyLicense(text string) string {
+	if match := spdxIdentifier.FindStringSubmatch(text); match != nil && match[1] != "" {
+		return match[1]
+	}
+	lower := strings.ToLower(text)
+	for _, license := range licenseTexts {
+		found := true
+		for _, phrase := range license.phrases {
+			if !strings.Contains(lower, phrase) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return license.id
+		}
+	}
+	return "unknown"
+}
+
+// LicenseReport identifies the license files and the license headers of the
+// files of the index of sourceDir, or of all indexes. A file's header is a
+// license notice in its first lines, identified by its SPDX-License-Identifier
+// or its wording.
+func (m *IndexManager) LicenseReport(ctx context.Context, sourceDir string) (*LicenseReport, error) {
+	report := &LicenseReport{Headers: make(map[string]int), Examples: make(map[string][]string)}
+
+	// License files are identified by their whole text
+	result, repos, err := m.searchIndexes(ctx, sourceDir, licenseFileNames, &zoekt.SearchOptions{Whole: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, fileMatch := range result.Files {
+		if name, _ := splitChunkName(fileMatch.FileName); name != fileMatch.FileName {
+			continue
+		}
+		report.LicenseFiles = append(report.LicenseFiles, LicenseFile{
+			Path:    resultPath(fileMatch, repos),
+			License: identifyLicense(string(fileMatch.Content)),
+		})
+	}
+	slices.SortFunc(report.LicenseFiles, func(a, b LicenseFile) int { return strings.Compare(a.Path, b.Path) })
+
+	// Headers are identified by the lines around the first notice
+	result, repos, err = m.searchIndexes(ctx, sourceDir, query.NewAnd(licenseMarkers, &query.Not{Child: licenseFileNames}), &zoekt.SearchOptions{NumContextLines: 3})
+	if err != nil {
+		return nil, err
+	}
+	for _, fileMatch := range result.Files {
+		// Only the first chunk of a large file holds its header
+		if _, lineOffset := splitChunkName(fileMatch.FileName); lineOffset > 0 || len(fileMatch.LineMatches) == 0 {
+			continue
+		}
+		first := fileMatch.LineMatches[0]
+		for _, lineMatch := range fileMatch.LineMatches {
+			if lineMatch.LineNumber < first.LineNumber {
+				first = lineMatch
+			}
+		}
+		if first.LineNumber > licenseHeaderLines {
+			continue
+		}
+
+		license := identifyLicense(string(first.Before) + string(first.Line) + string(first.After))
+		report.Headers[license]++
+		report.FilesWithHeader++
+		if len(report.Examples[license]) < maxLicenseExamples {
+			report.Examples[license] = append(report.Examples[license], resultPath(fileMatch, repos))
+		}
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	metadata := m.visibleMetadata(ctx)
+	for _, prefix := range prefixes {
+		report.Files += metadata[prefix].Files
+	}
+	return report, nil
+}
@@ -0,0 +1,141 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrSearchQueueFull is returned by searches that would have to wait behind
+// more searches than the queue of the SearchLimiter holds
+var ErrSearchQueueFull = errors.New("too many searches are waiting")
+
+// defaultSearchQueue is how many searches wait for a slot unless configured
+const defaultSearchQueue = 32
+
+// SearchLimiter caps the Zoekt searches that run at once, as each loads the
+// shards it searches into memory. Searches beyond the cap wait in a queue, in
+// the order they came, and fail with ErrSearchQueueFull if it is full. One
+// limiter can be shared by several IndexManagers, e.g. the named stores, to
+// cap the searches of a whole process.
+type SearchLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	queueMax int
+	running  int
+	waiting  []*searchWaiter
+}
+
+// searchWaiter is a search waiting for a slot
+type searchWaiter struct {
+	ready  chan struct{} // Closed when the search is handed a slot
+	report func(position int)
+}
+
+// NewSearchLimiter returns a limiter running at most limit searches at
+// once, with at most queue more waiting (default 32 if queue is 0). It
+// returns nil, which limits nothing, if limit is not positive.
+func NewSearchLimiter(limit int, queue int) *SearchLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	if queue <= 0 {
+		queue = defaultSearchQueue
+	}
+	return &SearchLimiter{limit: limit, queueMax: queue}
+}
+
+// acquire waits for a slot to search in, reporting the position of the
+// search in the queue to report, if not nil, whenever it changes. It returns
+// how long the search waited and the function releasing the slot.
+func (l *SearchLimiter) acquire(ctx context.Context, report func(position int)) (time.Duration, func(), error) {
+	if l == nil {
+		return 0, func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.running < l.limit && len(l.waiting) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return 0, l.release, nil
+	}
+	if len(l.waiting) >= l.queueMax {
+		running, waiting := l.running, len(l.waiting)
+		l.mu.Unlock()
+		return 0, nil, fmt.Errorf("%w: %d searches running and %d waiting; retry shortly", ErrSearchQueueFull, running, waiting)
+	}
+	w := &searchWaiter{ready: make(chan struct{}), report: report}
+	l.waiting = append(l.waiting, w)
+	position := len(l.waiting)
+	l.mu.Unlock()
+
+	if report != nil {
+		report(position)
+	}
+	start := time.Now()
+	select {
+	case <-w.ready:
+		return time.Since(start), l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		i := slices.Index(l.waiting, w)
+		if i >= 0 {
+			l.waiting = slices.Delete(l.waiting, i, i+1)
+		}
+		moved := l.waitersFrom(max(i, 0))
+		l.mu.Unlock()
+		if i < 0 {
+			// Handed a slot meanwhile, which goes to the next search
+			l.release()
+		} else {
+			reportPositions(moved, i)
+		}
+		return 0, nil, ctx.Err()
+	}
+}
+
+// release hands the slot of a finished search to the first waiting search,
+// or frees it
+func (l *SearchLimiter) release() {
+	l.mu.Lock()
+	if len(l.waiting) == 0 {
+		l.running--
+		l.mu.Unlock()
+		return
+	}
+	next := l.waiting[0]
+	l.waiting = l.waiting[1:]
+	close(next.ready)
+	moved := l.waitersFrom(0)
+	l.mu.Unlock()
+	reportPositions(moved, 0)
+}
+
+// waitersFrom returns the waiting searches from index i on, whose positions
+// changed. The caller holds l.mu.
+func (l *SearchLimiter) waitersFrom(i int) []*searchWaiter {
+	if i >= len(l.waiting) {
+		return nil
+	}
+	return slices.Clone(l.waiting[i:])
+}
+
+// reportPositions tells the searches waiting from index offset of the queue
+// on their new positions. It is called without holding the lock, as the
+// reports may be sent to clients.
+func reportPositions(waiters []*searchWaiter, offset int) {
+	for i, w := range waiters {
+		if w.report != nil {
+			w.report(offset + i + 1)
+		}
+	}
+}
+
+// SetSearchLimiter caps the searches run at once with limiter, which may be
+// shared with other managers; nil removes the cap
+func (m *IndexManager) SetSearchLimiter(limiter *SearchLimiter) {
+	m.searchLimiter = limiter
+}
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// queryMistake is query syntax that is valid, or fails with an unhelpful
+// parse error, but usually means something else than what was written
+type queryMistake struct {
+	pattern *regexp.Regexp
+	// warning explains the submatches of pattern and how to fix them
+	warning func(match []string) string
+}
+
+// queryMistakes are checked in order; every one that matches is reported
+var queryMistakes = []queryMistake{
+	{
+		// A call written as is groups its arguments instead. Groups of
+		// alternatives, e.g. get(User|Account), are meant as groups.
+		pattern: regexp.MustCompile(unescaped + `([A-Za-z_][A-Za-z0-9_.]*)\((?:[^|()?][^|()]*)?(?:\)|$)`),
+		warning: func(match []string) string {
+			return fmt.Sprintf("parentheses group regex patterns, so %s( does not match a literal parenthesis; escape it to match a call, e.g. %s\\(", match[1], match[1])
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`(?:^|\s)-?(?:f|file):([^\s"]*\*\S*)`),
+		warning: func(match []string) string {
+			return fmt.Sprintf("file: takes a regex, not a glob, so file:%s does not mean what it would in a shell; e.g. file:*.go becomes file:\\.go$", match[1])
+		},
+	},
+	{
+		pattern: regexp.MustCompile(`(?:^|\s)\*([^\s*]+)`),
+		warning: func(match []string) string {
+			return fmt.Sprintf("a leading * is not a wildcard, and patterns already match anywhere in a line; search %s instead of *%s", match[1], match[1])
+		},
+	},
+	{
+		// A path with a space is cut at it, leaving the rest as content
+		pattern: regexp.MustCompile(`(?:^|\s)-?(?:f|file):([^\s"]\S*)\s+([^\s:()]*(?:/[^\s:()]*|\.[a-z]{1,4}))(?:\s|$)`),
+		warning: func(match []string) string {
+			return fmt.Sprintf("a file: value ends at the first space, so %s is searched for as content; match the space with \\s, e.g. file:%s\\s%s", match[2], match[1], match[2])
+		},
+	},
+}
+
+// lintQuery returns warnings about likely mistakes in queryStr
+func lintQuery(queryStr string) []string {
+	var warnings []string
+	for _, mistake := range queryMistakes {
+		if match := mistake.pattern.FindStringSubmatch(queryStr); match != nil {
+			warnings = append(warnings, mistake.warning(match))
+		}
+	}
+	return warnings
+}
+
+// lintError adds the warnings about a query to the error its search failed
+// with
+func lintError(err error, warnings []string) error {
+	if len(warnings) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (possible mistake: %s)", err, strings.Join(warnings, "; "))
+}
+
+// errLintNoMatches is returned for a search that matched nothing and whose
+// query has likely mistakes
+var errLintNoMatches = errors.New("no matches")
+
+// lintResult adds the warnings about the query of a search to its result,
+// before its lines unless opts.Terse is set. An empty result is turned into
+// an error explaining the likely mistakes, which are probably why nothing
+// matched.
+func lintResult(sr *SearchResult, warnings []string, opts SearchOptions) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+	if sr.TotalFiles == 0 {
+		return lintError(errLintNoMatches, warnings)
+	}
+	sr.Warnings = warnings
+	if !opts.Terse {
+		lines := make([]string, 0, len(warnings)+len(sr.Lines))
+		for _, warning := range warnings {
+			lines = append(lines, "[Warning: "+warning+"]")
+		}
+		sr.Lines = append(lines, sr.Lines...)
+	}
+	return nil
+}
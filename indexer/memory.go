@@ -0,0 +1,623 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// maxMemoryFileSize is the size above which MemoryIndex leaves a file out
+const maxMemoryFileSize = 2 << 20
+
+// MemoryIndex is a Backend that builds and searches its indexes in memory,
+// without an index directory. It is meant for tests of code using the
+// handlers, and for embedders indexing content they already hold. Indexing,
+// searching, opening results, listing and deleting indexes are supported;
+// the other operations return ErrNotSupported.
+type MemoryIndex struct {
+	mu      sync.Mutex
+	indexes map[string]*memoryShard // By index name
+
+	// results holds the files of recent searches for OpenResult, oldest
+	// first
+	results []*searchRecord
+}
+
+// memoryShard is an index of MemoryIndex
+type memoryShard struct {
+	meta     *indexMetadata
+	files    map[string][]byte // Content by slash-separated path, for OpenResult
+	searcher zoekt.Searcher
+}
+
+// memoryFile is a shard held in memory, read by the zoekt searcher
+type memoryFile struct {
+	name string
+	data []byte
+}
+
+func (f *memoryFile) Read(off uint32, sz uint32) ([]byte, error) {
+	if uint64(off)+uint64(sz) > uint64(len(f.data)) {
+		return nil, fmt.Errorf("read of %d bytes at %d beyond the end of %s", sz, off, f.name)
+	}
+	return f.data[off : off+sz], nil
+}
+
+func (f *memoryFile) Size() (uint32, error) { return uint32(len(f.data)), nil }
+func (f *memoryFile) Close()                {}
+func (f *memoryFile) Name() string          { return f.name }
+
+var _ Backend = (*MemoryIndex)(nil)
+
+// NewMemoryIndex creates an empty in-memory index
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{indexes: make(map[string]*memoryShard)}
+}
+
+// AddFiles indexes files, given by slash-separated path relative to
+// sourceDir, as the content of sourceDir, replacing any index of it. The
+// directory does not need to exist.
+func (m *MemoryIndex) AddFiles(sourceDir string, files map[string][]byte) error {
+	absPath, err := resolvePath(sourceDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+	prefix := indexPrefix(absPath)
+	builder, err := index.NewShardBuilder(&zoekt.Repository{Name: prefix, Source: absPath})
+	if err != nil {
+		return fmt.Errorf("failed to create shard builder: %w", err)
+	}
+
+	meta := &indexMetadata{SourceDir: absPath, IndexedAt: time.Now(), Languages: make(map[string]int)}
+	kept := make(map[string][]byte, len(files))
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		content := files[name]
+		name = path.Clean(strings.TrimPrefix(name, "/"))
+		doc := index.Document{Name: name, Content: content, Language: detectLanguage(name, content)}
+		if err := builder.Add(doc); err != nil {
+			return fmt.Errorf("failed to add %s: %w", name, err)
+		}
+		kept[name] = content
+		meta.Files++
+		meta.Bytes += int64(len(content))
+		if doc.Language != "" {
+			meta.Languages[doc.Language]++
+		}
+	}
+
+	var shard bytes.Buffer
+	if err := builder.Write(&shard); err != nil {
+		return fmt.Errorf("failed to build index: %w", err)
+	}
+	searcher, err := index.NewSearcher(&memoryFile{name: prefix, data: shard.Bytes()})
+	if err != nil {
+		return fmt.Errorf("failed to load index: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.indexes[prefix]; ok {
+		old.searcher.Close()
+	}
+	m.indexes[prefix] = &memoryShard{meta: meta, files: kept, searcher: searcher}
+	return nil
+}
+
+// IndexFS indexes the files of fsys as the content of sourceDir, like
+// AddFiles. Hidden files and directories, such as .git, and files over
+// 2 MB are left out.
+func (m *MemoryIndex) IndexFS(ctx context.Context, sourceDir string, fsys fs.FS) error {
+	return m.indexFS(ctx, sourceDir, fsys, nil)
+}
+
+// indexFS is IndexFS, also leaving out the paths matching ignore
+func (m *MemoryIndex) indexFS(ctx context.Context, sourceDir string, fsys fs.FS, ignore []gitPattern) error {
+	files := make(map[string][]byte)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if _, ignored := matchGitPatterns(ignore, name, entry.IsDir()); ignored {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err != nil || info.Size() > maxMemoryFileSize {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		files[name] = content
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", sourceDir, err)
+	}
+	return m.AddFiles(sourceDir, files)
+}
+
+// IndexDirectory indexes the files of sourceDir on disk, like IndexFS
+func (m *MemoryIndex) IndexDirectory(ctx context.Context, sourceDir string) error {
+	return m.indexDirectory(ctx, sourceDir, nil)
+}
+
+// indexDirectory is IndexDirectory, leaving out the paths matching ignore
+func (m *MemoryIndex) indexDirectory(ctx context.Context, sourceDir string, ignore []gitPattern) error {
+	absPath, err := resolvePath(sourceDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to access directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("path is not a directory: %s", absPath)
+	}
+	return m.indexFS(ctx, absPath, os.DirFS(absPath), ignore)
+}
+
+// IndexDirectoryWithOptions is like IndexDirectory, leaving out the files
+// matching the ignore patterns of opts. TrackedOnly selects files by git
+// state, which MemoryIndex does not track, so it is ignored, as are
+// MaxFileSize, in favor of the fixed limit of memory indexes, and
+// FollowSymlinks. The default excludes of IndexManager do not apply, so
+// NoDefaultExcludes has no effect either.
+func (m *MemoryIndex) IndexDirectoryWithOptions(ctx context.Context, sourceDir string, opts IndexOptions) error {
+	return m.indexDirectory(ctx, sourceDir, parseGitPatterns(normalizeIgnorePatterns(opts.IgnorePatterns), ""))
+}
+
+// ListIndexes returns all indexes sorted by name
+func (m *MemoryIndex) ListIndexes(ctx context.Context) ([]IndexInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	indexes := make([]IndexInfo, 0, len(m.indexes))
+	for name, shard := range m.indexes {
+		meta := shard.meta
+		indexes = append(indexes, IndexInfo{
+			Name:      name,
+			SourceDir: meta.SourceDir,
+			Files:     meta.Files,
+			Bytes:     meta.Bytes,
+			IndexedAt: meta.IndexedAt,
+			Languages: meta.Languages,
+		})
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes, nil
+}
+
+// DeleteIndex removes the index of sourceDir
+func (m *MemoryIndex) DeleteIndex(ctx context.Context, sourceDir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	absPath, err := resolvePath(sourceDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+	prefix := indexPrefix(absPath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	shard, ok := m.indexes[prefix]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+	}
+	shard.searcher.Close()
+	delete(m.indexes, prefix)
+	return nil
+}
+
+// ProjectStatus reports the index containing path, or path itself if it
+// is not indexed. Memory indexes hold the files they were given, so they
+// are never stale.
+func (m *MemoryIndex) ProjectStatus(ctx context.Context, path string) (*ProjectStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	absPath, err := resolvePath(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := &ProjectStatus{Directory: absPath}
+	for _, shard := range m.indexes {
+		dir := shard.meta.SourceDir
+		if containsPath(dir, absPath) && (!status.Indexed || len(dir) > len(status.Directory)) {
+			status.Directory, status.Indexed = dir, true
+		}
+	}
+	return status, nil
+}
+
+// Search searches all indexes or, if sourceDir is set, the index of that
+// directory, with the output of IndexManager.Search. Owners, permalinks,
+// workspaces, remote backends, symbol filters and the spelling fallback are
+// not supported.
+func (m *MemoryIndex) Search(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions) (*SearchResult, error) {
+	if opts.Workspace != "" {
+		return nil, fmt.Errorf("%w: workspaces", ErrNotSupported)
+	}
+	if opts.Scope != "" {
+		return nil, fmt.Errorf("%w: syntax scopes", ErrNotSupported)
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 20
+	}
+	if opts.MaxLinesPerFile <= 0 {
+		opts.MaxLinesPerFile = 3
+	}
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = 200
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Select the indexes to search
+	metadata := make(map[string]*indexMetadata, len(m.indexes))
+	for name, shard := range m.indexes {
+		metadata[name] = shard.meta
+	}
+	var scoped []string
+	if sourceDir != "" {
+		absPath, err := resolvePath(sourceDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		prefix := indexPrefix(absPath)
+		if _, ok := m.indexes[prefix]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+		}
+		scoped = []string{prefix}
+	}
+
+	// Parse the query with the flags and language filter of opts
+	warnings := lintQuery(queryStr)
+	if opts.SmartIdentifiers {
+		queryStr = smartIdentifierQuery(queryStr)
+	}
+	q, err := query.Parse(queryStr)
+	if err != nil {
+		if explained := explainUnsupportedRegexp(queryStr, err); explained != nil {
+			return nil, explained
+		}
+		return nil, lintError(fmt.Errorf("failed to parse query: %w", err), warnings)
+	}
+	if q, err = applyRegexpFlags(queryStr, q, opts); err != nil {
+		return nil, err
+	}
+	if opts.Language != "" {
+		lang, err := resolveLanguage(opts.Language, metadata, scoped)
+		if err != nil {
+			return nil, err
+		}
+		q = query.NewAnd(q, &query.Language{Language: lang})
+	}
+
+	// Search each index, ranking the files of all of them together
+	sr := &SearchResult{}
+	var files []zoekt.FileMatch
+	for name, shard := range m.indexes {
+		if scoped != nil && !slices.Contains(scoped, name) {
+			continue
+		}
+		result, err := shard.searcher.Search(ctx, q, &zoekt.SearchOptions{MaxDocDisplayCount: opts.MaxFiles * 2, UseBM25Scoring: opts.OnePerFile})
+		if err != nil {
+			return nil, fmt.Errorf("search failed: %w", err)
+		}
+		sr.TotalFiles += max(result.Stats.FileCount, len(result.Files))
+		sr.TotalMatches += result.Stats.MatchCount
+		sr.TotalsEstimated = sr.TotalsEstimated || result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0
+		files = append(files, result.Files...)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Score != files[j].Score {
+			return files[i].Score > files[j].Score
+		}
+		return resultPath(files[i], metadata) < resultPath(files[j], metadata)
+	})
+	if opts.FilesOnly {
+		sort.SliceStable(files, func(i, j int) bool { return fileMatchCount(files[i]) > fileMatchCount(files[j]) })
+	}
+
+	var shown []resultFile
+	base := relativeBase(files[:min(len(files), opts.MaxFiles)], metadata, opts)
+	for _, fileMatch := range files[:min(len(files), opts.MaxFiles)] {
+		fullPath := resultPath(fileMatch, metadata)
+		shown = append(shown, resultFile{repo: fileMatch.Repository, name: fileMatch.FileName, path: fullPath})
+		fullPath = relativeTo(fullPath, base)
+		if !opts.FilesOnly {
+			sr.addMatchLines(fileMatch, fullPath, 0, opts, nil)
+			continue
+		}
+		switch count := fileMatchCount(fileMatch); count {
+		case 0:
+			sr.Lines = append(sr.Lines, opts.dim(fullPath))
+		case 1:
+			sr.Lines = append(sr.Lines, fmt.Sprintf("%s (1 match)", opts.dim(fullPath)))
+		default:
+			sr.Lines = append(sr.Lines, fmt.Sprintf("%s (%d matches)", opts.dim(fullPath), count))
+		}
+	}
+	sr.ShownFiles = len(shown)
+	sr.addRelativeHeader(base, opts)
+	if err := lintResult(sr, warnings, opts); err != nil {
+		return nil, err
+	}
+	if sr.TotalFiles > 0 {
+		sr.ID = m.rememberSearch(sourceDir, shown)
+	}
+
+	// Add summary if results were truncated
+	switch {
+	case opts.Terse:
+	case sr.TotalsEstimated:
+		sr.Lines = append(sr.Lines, fmt.Sprintf("\n[Showing %d of at least %d files (search stopped early). Narrow the query to see all matches]",
+			sr.ShownFiles, sr.TotalFiles))
+	case sr.TotalFiles > opts.MaxFiles:
+		sr.Lines = append(sr.Lines, fmt.Sprintf("\n[Showing %d of %d files. Use max_files to see more]",
+			opts.MaxFiles, sr.TotalFiles))
+	}
+	sr.measure(opts)
+	return sr, nil
+}
+
+// rememberSearch records the files a search showed for OpenResult and
+// returns the ID of the result. m.mu must be held.
+func (m *MemoryIndex) rememberSearch(sourceDir string, files []resultFile) string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	record := &searchRecord{id: hex.EncodeToString(id), sourceDir: sourceDir, files: files}
+	m.results = append(m.results, record)
+	if len(m.results) > maxSearchRecords {
+		m.results = slices.Delete(m.results, 0, len(m.results)-maxSearchRecords)
+	}
+	return record.id
+}
+
+// OpenResult reads file number number of the search result with ID
+// resultID, like IndexManager.OpenResult
+func (m *MemoryIndex) OpenResult(ctx context.Context, resultID string, number int, startLine int, maxLines int) (*OpenedFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.results, func(r *searchRecord) bool { return r.id == resultID })
+	if i < 0 {
+		return nil, fmt.Errorf("%w %q; run the search again", ErrUnknownResult, resultID)
+	}
+	record := m.results[i]
+	if number < 1 || number > len(record.files) {
+		return nil, fmt.Errorf("result %s has files 1 to %d, not %d", resultID, len(record.files), number)
+	}
+	file := record.files[number-1]
+	if startLine <= 0 {
+		startLine = 1
+	}
+	if maxLines <= 0 {
+		maxLines = defaultOpenLines
+	}
+
+	shard, ok := m.indexes[file.repo]
+	if !ok {
+		return nil, fmt.Errorf("%s is no longer in the index; run the search again", file.path)
+	}
+	content, ok := shard.files[file.name]
+	if !ok {
+		return nil, fmt.Errorf("%s is no longer in the index; run the search again", file.path)
+	}
+	lines := strings.Split(string(bytes.TrimSuffix(content, []byte("\n"))), "\n")
+	if startLine > len(lines) {
+		return nil, fmt.Errorf("%s has %d lines", file.path, len(lines))
+	}
+	opened := &OpenedFile{
+		Path:       file.path,
+		StartLine:  startLine,
+		TotalLines: len(lines),
+	}
+	for _, line := range lines[startLine-1 : min(startLine-1+maxLines, len(lines))] {
+		opened.Lines = append(opened.Lines, truncateLine(strings.TrimRight(line, "\r"), maxOpenLineLength))
+	}
+	return opened, nil
+}
+
+// GetIndexDir returns "", as there is no index directory
+func (m *MemoryIndex) GetIndexDir() string { return "" }
+
+// Encrypted reports false; the indexes are never written out
+func (m *MemoryIndex) Encrypted() bool { return false }
+
+// Close releases the indexes
+func (m *MemoryIndex) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, shard := range m.indexes {
+		shard.searcher.Close()
+		delete(m.indexes, name)
+	}
+	m.results = nil
+	return nil
+}
+
+// Settings for building on disk, remote backends, path mappings and hooks
+// do not apply to MemoryIndex and are ignored.
+
+func (m *MemoryIndex) SetBuildOptions(opts BuildOptions)      {}
+func (m *MemoryIndex) SetRemotes(remotes []Remote)            {}
+func (m *MemoryIndex) SetPathMappings(mappings []PathMapping) {}
+func (m *MemoryIndex) SetHooks(hooks []HookConfig)            {}
+
+// SetSearchLimiter has no effect, as searching memory loads no shards
+func (m *MemoryIndex) SetSearchLimiter(limiter *SearchLimiter) {}
+
+// The remaining operations need data recorded by IndexManager or files on
+// disk, and are not supported.
+
+func (m *MemoryIndex) AttachIndexDir(ctx context.Context, shardDir string, sourceDir string, repository string) (*AttachedIndex, error) {
+	return nil, fmt.Errorf("%w: attaching indexes", ErrNotSupported)
+}
+
+func (m *MemoryIndex) AttachIndexServer(ctx context.Context, shardDir string, root string) ([]*AttachedIndex, []string, error) {
+	return nil, nil, fmt.Errorf("%w: attaching indexes", ErrNotSupported)
+}
+
+// Building is always false, as in-memory indexes are built within the call
+func (m *MemoryIndex) Building(sourceDir string) bool {
+	return false
+}
+
+func (m *MemoryIndex) MoveIndex(ctx context.Context, oldDir string, newDir string) (int, error) {
+	return 0, fmt.Errorf("%w: moving indexes", ErrNotSupported)
+}
+
+func (m *MemoryIndex) SetSchedule(ctx context.Context, sourceDir string, schedule string) error {
+	return fmt.Errorf("%w: schedules", ErrNotSupported)
+}
+
+func (m *MemoryIndex) SetWatched(ctx context.Context, sourceDir string, watched bool) error {
+	return fmt.Errorf("%w: watching directories", ErrNotSupported)
+}
+
+func (m *MemoryIndex) MutePaths(ctx context.Context, sourceDir string, patterns []string, unmute bool) ([]string, error) {
+	return nil, fmt.Errorf("%w: muting paths", ErrNotSupported)
+}
+
+func (m *MemoryIndex) SetAliases(ctx context.Context, sourceDir string, term string, aliases []string) (map[string][]string, error) {
+	return nil, fmt.Errorf("%w: aliases", ErrNotSupported)
+}
+
+func (m *MemoryIndex) WarmIndex(ctx context.Context, sourceDir string) (*WarmResult, error) {
+	return nil, fmt.Errorf("%w: warming indexes", ErrNotSupported)
+}
+
+// HoldIndexes does nothing, as in-memory indexes are never compressed
+func (m *MemoryIndex) HoldIndexes(repos []string) (func(), error) {
+	return func() {}, nil
+}
+
+func (m *MemoryIndex) IndexHealth(ctx context.Context, sourceDir string) ([]IndexHealth, error) {
+	return nil, fmt.Errorf("%w: index health", ErrNotSupported)
+}
+
+// IndexProgress returns no builds, since AddFiles builds an index before it
+// returns
+func (m *MemoryIndex) IndexProgress(ctx context.Context, sourceDir string) ([]IndexProgress, error) {
+	return nil, nil
+}
+
+func (m *MemoryIndex) RefineSearch(ctx context.Context, resultID string, queryStr string, opts SearchOptions) (*SearchResult, error) {
+	return nil, fmt.Errorf("%w: refining searches", ErrNotSupported)
+}
+
+func (m *MemoryIndex) SearchHistory(ctx context.Context, sourceDir string, opts HistoryOptions) ([]HistoryCommit, error) {
+	return nil, fmt.Errorf("%w: history search", ErrNotSupported)
+}
+
+func (m *MemoryIndex) UsageStats(ctx context.Context, sourceDir string, queryStr string, opts UsageOptions) (*UsageStats, error) {
+	return nil, fmt.Errorf("%w: usage statistics", ErrNotSupported)
+}
+
+func (m *MemoryIndex) PossiblyUnreferenced(ctx context.Context, sourceDir string, opts UnreferencedOptions) (*UnreferencedResult, error) {
+	return nil, fmt.Errorf("%w: unreferenced symbols", ErrNotSupported)
+}
+
+func (m *MemoryIndex) StructuralSearch(ctx context.Context, sourceDir string, template string, opts StructuralOptions) (*StructuralResult, error) {
+	return nil, fmt.Errorf("%w: structural search", ErrNotSupported)
+}
+
+func (m *MemoryIndex) QueryAST(ctx context.Context, sourceDir string, treeQuery string, opts ASTOptions) (*ASTResult, error) {
+	return nil, fmt.Errorf("%w: AST queries", ErrNotSupported)
+}
+
+func (m *MemoryIndex) FindTargets(ctx context.Context, sourceDir string, file string, target string) ([]BazelTarget, error) {
+	return nil, fmt.Errorf("%w: Bazel targets", ErrNotSupported)
+}
+
+func (m *MemoryIndex) WhoOwns(ctx context.Context, file string) (*CodeOwnership, error) {
+	return nil, fmt.Errorf("%w: code owners", ErrNotSupported)
+}
+
+func (m *MemoryIndex) FindEndpoints(ctx context.Context, sourceDir string, text string, method string) ([]Endpoint, error) {
+	return nil, fmt.Errorf("%w: endpoints", ErrNotSupported)
+}
+
+func (m *MemoryIndex) FindMessages(ctx context.Context, sourceDir string, name string, field string) ([]SchemaMessage, error) {
+	return nil, fmt.Errorf("%w: schema messages", ErrNotSupported)
+}
+
+func (m *MemoryIndex) FindResources(ctx context.Context, sourceDir string, kind string, name string) ([]Resource, error) {
+	return nil, fmt.Errorf("%w: resources", ErrNotSupported)
+}
+
+func (m *MemoryIndex) LicenseReport(ctx context.Context, sourceDir string) (*LicenseReport, error) {
+	return nil, fmt.Errorf("%w: license reports", ErrNotSupported)
+}
+
+func (m *MemoryIndex) PreviewReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ReplaceOptions) (*ReplacePreview, error) {
+	return nil, fmt.Errorf("%w: replacing", ErrNotSupported)
+}
+
+func (m *MemoryIndex) ApplyReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ApplyOptions) (*ReplaceResult, error) {
+	return nil, fmt.Errorf("%w: replacing", ErrNotSupported)
+}
+
+func (m *MemoryIndex) CreateWorkspace(ctx context.Context, name string, dirs []string) (*Workspace, error) {
+	return nil, fmt.Errorf("%w: workspaces", ErrNotSupported)
+}
+
+// ListWorkspaces returns no workspaces
+func (m *MemoryIndex) ListWorkspaces(ctx context.Context) ([]Workspace, error) {
+	return nil, nil
+}
+
+func (m *MemoryIndex) DeleteWorkspace(ctx context.Context, name string) error {
+	return fmt.Errorf("%w: workspaces", ErrNotSupported)
+}
+
+func (m *MemoryIndex) WorkspaceDirectories(ctx context.Context, name string) ([]string, error) {
+	return nil, fmt.Errorf("%w: workspaces", ErrNotSupported)
+}
+
+func (m *MemoryIndex) WorkspaceRepositories(ctx context.Context, name string) ([]string, error) {
+	return nil, fmt.Errorf("%w: workspaces", ErrNotSupported)
+}
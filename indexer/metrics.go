@@ -0,0 +1,56 @@
+package indexer
+
+import "unicode/utf8"
+
+// SearchMetrics measures how much of what a search matched its limits left
+// out of the result, so the limits can be tuned with data
+type SearchMetrics struct {
+	ShownMatches   int `json:"shown_matches"`   // Matching lines in Lines
+	OmittedMatches int `json:"omitted_matches"` // Matches left out by max_files and max_lines_per_file
+	OmittedFiles   int `json:"omitted_files"`   // Files left out by max_files
+	TruncatedLines int `json:"truncated_lines"` // Lines shortened to max_line_runes
+	TruncatedBytes int `json:"truncated_bytes"` // Bytes cut from those lines
+	ReturnedBytes  int `json:"returned_bytes"`  // Size of Lines
+}
+
+// countLine records a matching line shown, and how much of it is cut at
+// maxLen runes
+func (sm *SearchMetrics) countLine(line string, maxLen int) {
+	sm.ShownMatches++
+	if maxLen <= 0 || utf8.RuneCountInString(line) <= maxLen {
+		return
+	}
+	kept, runes := 0, 0
+	for kept = range line {
+		if runes == maxLen {
+			break
+		}
+		runes++
+	}
+	sm.TruncatedLines++
+	sm.TruncatedBytes += len(line) - kept
+}
+
+// measure completes the metrics of a search once its lines are final. Only
+// the local indexes count towards the matches and files left out, and
+// matches are not counted as left out when only files are listed.
+func (sr *SearchResult) measure(opts SearchOptions) {
+	sr.Metrics.OmittedFiles = max(0, sr.TotalFiles-sr.ShownFiles)
+	if !opts.FilesOnly {
+		sr.Metrics.OmittedMatches = max(0, sr.TotalMatches-sr.Metrics.ShownMatches)
+	}
+	sr.Metrics.ReturnedBytes = 0
+	for _, line := range sr.Lines {
+		sr.Metrics.ReturnedBytes += len(line) + 1
+	}
+}
+
+// Add adds the metrics of another search
+func (sm *SearchMetrics) Add(other SearchMetrics) {
+	sm.ShownMatches += other.ShownMatches
+	sm.OmittedMatches += other.OmittedMatches
+	sm.OmittedFiles += other.OmittedFiles
+	sm.TruncatedLines += other.TruncatedLines
+	sm.TruncatedBytes += other.TruncatedBytes
+	sm.ReturnedBytes += other.ReturnedBytes
+}
@@ -0,0 +1,140 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// indexMove is the new name and source directory of a moved index
+type indexMove struct {
+	prefix    string
+	sourceDir string
+}
+
+// MoveIndex rebinds the index of oldDir to newDir, where the directory was
+// renamed or moved to, without rebuilding it. The indexes of its submodules
+// move along. The shards keep their name, recorded as shared with the new
+// index, until the next build writes them under the new name. Schedules,
+// watching, muted paths, aliases, owners and workspaces follow the index.
+// It returns how many indexes were moved.
+func (m *IndexManager) MoveIndex(ctx context.Context, oldDir string, newDir string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	oldPath, err := m.resolveIndexPath(oldDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	newPath, err := m.resolveIndexPath(newDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	if oldPath == newPath {
+		return 0, errors.New("the new directory is the indexed directory itself")
+	}
+	if containsPath(oldPath, newPath) {
+		return 0, errors.New("an index cannot move into its own directory")
+	}
+	localPath, err := resolvePath(newDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	info, err := os.Stat(longPath(localPath))
+	if err != nil {
+		return 0, fmt.Errorf("failed to access directory: %w", err)
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("path is not a directory: %s", localPath)
+	}
+
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	prefix := m.getIndexPrefix(oldPath)
+	meta, ok := metadata[prefix]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrNotIndexed, oldPath)
+	}
+	if owner := ownerFromContext(ctx); owner != "" && !meta.ownedBy(owner) {
+		return 0, fmt.Errorf("%w: %s", ErrNotIndexed, oldPath)
+	}
+
+	// The indexes of submodules move with the index of their repository,
+	// keeping their place inside it
+	moves := map[string]indexMove{prefix: {prefix: m.getIndexPrefix(newPath), sourceDir: newPath}}
+	for _, linked := range linkedIndexes(metadata, prefix) {
+		rel, err := filepath.Rel(oldPath, metadata[linked].SourceDir)
+		if err != nil || !containsPath(oldPath, metadata[linked].SourceDir) {
+			continue
+		}
+		sourceDir := filepath.Join(newPath, rel)
+		moves[linked] = indexMove{prefix: m.getIndexPrefix(sourceDir), sourceDir: sourceDir}
+	}
+	for from, to := range moves {
+		if _, err := os.Stat(m.buildJournalPath(from)); err == nil {
+			return 0, fmt.Errorf("the build of %s was interrupted; re-index it before moving", metadata[from].SourceDir)
+		}
+		if other, ok := metadata[to.prefix]; ok {
+			return 0, fmt.Errorf("%s is already indexed; delete its index first", other.SourceDir)
+		}
+	}
+
+	for from, to := range moves {
+		entry := metadata[from]
+		entry.SharedWith = entry.shardPrefix(from)
+		entry.SourceDir = to.sourceDir
+		if parent, ok := moves[entry.Parent]; ok {
+			entry.Parent = parent.prefix
+		}
+		delete(metadata, from)
+		metadata[to.prefix] = entry
+
+		for _, path := range []func(string) string{m.bazelTargetsPath, m.codeOwnersPath} {
+			if err := os.Rename(path(from), path(to.prefix)); err != nil && !os.IsNotExist(err) {
+				return 0, fmt.Errorf("failed to move index data: %w", err)
+			}
+		}
+	}
+	if err := m.saveAllMetadata(metadata); err != nil {
+		return 0, fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	if err := m.moveWorkspaceDirectories(oldPath, newPath); err != nil {
+		return len(moves), err
+	}
+	return len(moves), nil
+}
+
+// moveWorkspaceDirectories replaces the workspace directories in oldPath
+// with their place in newPath
+func (m *IndexManager) moveWorkspaceDirectories(oldPath string, newPath string) error {
+	m.workspacesMu.Lock()
+	defer m.workspacesMu.Unlock()
+
+	workspaces := m.loadWorkspaces()
+	changed := false
+	for _, w := range workspaces {
+		for i, dir := range w.Directories {
+			if !containsPath(oldPath, dir) {
+				continue
+			}
+			if rel, err := filepath.Rel(oldPath, dir); err == nil {
+				w.Directories[i] = filepath.Join(newPath, rel)
+				changed = true
+			}
+		}
+		w.Directories = slices.Compact(slices.Sorted(slices.Values(w.Directories)))
+	}
+	if !changed {
+		return nil
+	}
+	if err := m.saveWorkspaces(workspaces); err != nil {
+		return fmt.Errorf("failed to save workspaces: %w", err)
+	}
+	return nil
+}
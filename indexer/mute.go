@@ -0,0 +1,97 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// MutePaths adds gitignore-style patterns, e.g. migrations/**, to the paths
+// of the index of sourceDir that are left out of search results, or removes
+// them if unmute is set. Muting takes effect with the next search, without
+// re-indexing, and is kept when the directory is re-indexed. It returns the
+// patterns muted afterwards.
+func (m *IndexManager) MutePaths(ctx context.Context, sourceDir string, patterns []string, unmute bool) ([]string, error) {
+	if sourceDir == "" {
+		return nil, fmt.Errorf("a directory is required")
+	}
+	patterns = slices.Clone(patterns)
+	for i, pattern := range patterns {
+		patterns[i] = strings.TrimSpace(pattern)
+		if _, err := mutedPathRegexp(patterns[i : i+1]); err != nil {
+			return nil, err
+		}
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var muted []string
+	err = m.updateMetadata(prefixes[0], func(meta *indexMetadata) {
+		for _, pattern := range patterns {
+			switch {
+			case unmute:
+				meta.Muted = slices.DeleteFunc(meta.Muted, func(p string) bool { return p == pattern })
+			case !slices.Contains(meta.Muted, pattern):
+				meta.Muted = append(meta.Muted, pattern)
+			}
+		}
+		muted = slices.Clone(meta.Muted)
+	})
+	return muted, err
+}
+
+// mutedPathRegexp returns a regular expression matching the file names of
+// an index that are muted by patterns
+func mutedPathRegexp(patterns []string) (string, error) {
+	var alternatives []string
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			return "", fmt.Errorf("negated pattern %q cannot be muted; unmute the pattern covering it instead", pattern)
+		}
+		parsed := parseGitPatterns([]string{pattern}, "")
+		if len(parsed) != 1 || parsed[0].negate {
+			return "", fmt.Errorf("invalid pattern %q", pattern)
+		}
+		// Files in a muted directory, and the chunks of muted files, are
+		// muted too
+		expr := strings.TrimSuffix(parsed[0].re.String(), "$")
+		alternatives = append(alternatives, expr+"(?:/.*)?(?:"+regexp.QuoteMeta(chunkSeparator)+"[0-9]+)?$")
+	}
+	return "(?:" + strings.Join(alternatives, ")|(?:") + ")", nil
+}
+
+// mutedQuery returns a query leaving out the muted paths of the indexes
+// named searched, or nil if none of them has muted paths
+func mutedQuery(metadata map[string]*indexMetadata, searched []string) (query.Q, error) {
+	var muted []query.Q
+	for _, prefix := range searched {
+		meta, ok := metadata[prefix]
+		if !ok || len(meta.Muted) == 0 {
+			continue
+		}
+		expr, err := mutedPathRegexp(meta.Muted)
+		if err != nil {
+			return nil, err
+		}
+		re, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse muted paths of %s: %w", meta.dir(), err)
+		}
+		muted = append(muted, query.NewAnd(
+			query.NewRepoSet(meta.shardPrefix(prefix)),
+			&query.Regexp{Regexp: re, FileName: true, CaseSensitive: true},
+		))
+	}
+	if muted == nil {
+		return nil, nil
+	}
+	return &query.Not{Child: query.NewOr(muted...)}, nil
+}
@@ -0,0 +1,114 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// defaultOpenLines is how many lines OpenResult returns by default
+const defaultOpenLines = 200
+
+// maxOpenLineLength truncates long lines returned by OpenResult, such as
+// those of minified files
+const maxOpenLineLength = 500
+
+// resultFile is a file shown in a search result, which OpenResult reads by
+// its position in the result
+type resultFile struct {
+	repo string // Repository of the file in the index
+	name string // File name in the repository, without a chunk suffix
+	path string // Full path as shown in the result
+}
+
+// OpenedFile holds lines of a file of a search result
+type OpenedFile struct {
+	Path       string   // Full path of the file
+	StartLine  int      // Line number of the first of Lines
+	TotalLines int      // Number of lines in the file
+	Lines      []string // Lines of the file, without line endings
+}
+
+// OpenResult reads file number number, counting from 1 in the order shown,
+// of the search result with ID resultID, so the file can be referenced
+// without copying its path. Up to maxLines lines are returned from
+// startLine on. The file is read from the current index, not from disk.
+func (m *IndexManager) OpenResult(ctx context.Context, resultID string, number int, startLine int, maxLines int) (*OpenedFile, error) {
+	record := m.searchRecord(ctx, resultID)
+	if record == nil {
+		return nil, fmt.Errorf("%w %q; run the search again", ErrUnknownResult, resultID)
+	}
+	if number < 1 || number > len(record.files) {
+		return nil, fmt.Errorf("result %s has files 1 to %d, not %d", resultID, len(record.files), number)
+	}
+	file := record.files[number-1]
+	if startLine <= 0 {
+		startLine = 1
+	}
+	if maxLines <= 0 {
+		maxLines = defaultOpenLines
+	}
+
+	metadata := m.visibleMetadata(ctx)
+	m.markSearched([]string{file.repo}, metadata)
+	if err := m.decompressIndexes([]string{file.repo}, metadata); err != nil {
+		return nil, err
+	}
+	searchDir, err := m.searchDir()
+	if err != nil {
+		return nil, err
+	}
+	searcher, _, err := m.openSearcher(searchDir)
+	if err != nil {
+		return nil, err
+	}
+	defer searcher.Close()
+
+	// Large files are indexed as several chunks, which are read in order
+	re, err := syntax.Parse("^"+regexp.QuoteMeta(file.name)+"("+regexp.QuoteMeta(chunkSeparator)+"[0-9]+)?$", syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file name: %w", err)
+	}
+	q := query.NewAnd(
+		query.NewRepoSet(file.repo),
+		&query.Regexp{Regexp: re, FileName: true, CaseSensitive: true},
+	)
+	result, err := searcher.Search(ctx, q, &zoekt.SearchOptions{Whole: true})
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	if len(result.Files) == 0 {
+		return nil, fmt.Errorf("%s is no longer in the index; run the search again", file.path)
+	}
+	chunks := result.Files
+	sort.Slice(chunks, func(i, j int) bool {
+		_, offsetI := splitChunkName(chunks[i].FileName)
+		_, offsetJ := splitChunkName(chunks[j].FileName)
+		return offsetI < offsetJ
+	})
+	var content []byte
+	for _, chunk := range chunks {
+		content = append(content, chunk.Content...)
+	}
+
+	lines := strings.Split(string(bytes.TrimSuffix(content, []byte("\n"))), "\n")
+	if startLine > len(lines) {
+		return nil, fmt.Errorf("%s has %d lines", file.path, len(lines))
+	}
+	opened := &OpenedFile{
+		Path:       file.path,
+		StartLine:  startLine,
+		TotalLines: len(lines),
+	}
+	for _, line := range lines[startLine-1 : min(startLine-1+maxLines, len(lines))] {
+		opened.Lines = append(opened.Lines, truncateLine(strings.TrimRight(line, "\r"), maxOpenLineLength))
+	}
+	return opened, nil
+}
@@ -0,0 +1,94 @@
+package indexer
+
+import (
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIMethods are the operations of an OpenAPI path item
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// parseOpenAPI returns the operations and schemas of an OpenAPI 3 or
+// Swagger 2 document in YAML or JSON. It returns nothing for other
+// documents.
+func parseOpenAPI(file string, content []byte) ([]SchemaMessage, []Endpoint) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if mappingValue(root, "openapi") == nil && mappingValue(root, "swagger") == nil {
+		return nil, nil
+	}
+
+	var endpoints []Endpoint
+	if paths := mappingValue(root, "paths"); paths != nil {
+		forEachMapping(paths, func(path *yaml.Node, item *yaml.Node) {
+			forEachMapping(item, func(method *yaml.Node, operation *yaml.Node) {
+				if !slices.Contains(openAPIMethods, strings.ToLower(method.Value)) {
+					return
+				}
+				endpoint := Endpoint{
+					Method: strings.ToUpper(method.Value),
+					Path:   path.Value,
+					File:   file,
+					Line:   method.Line,
+				}
+				if id := mappingValue(operation, "operationId"); id != nil {
+					endpoint.OperationID = id.Value
+				}
+				if summary := mappingValue(operation, "summary"); summary != nil {
+					endpoint.Summary = summary.Value
+				}
+				endpoints = append(endpoints, endpoint)
+			})
+		})
+	}
+
+	// OpenAPI 3 keeps schemas in components, Swagger 2 in definitions
+	schemas := mappingValue(mappingValue(root, "components"), "schemas")
+	if schemas == nil {
+		schemas = mappingValue(root, "definitions")
+	}
+	var messages []SchemaMessage
+	forEachMapping(schemas, func(name *yaml.Node, schema *yaml.Node) {
+		message := SchemaMessage{Name: name.Value, Kind: "schema", File: file, Line: name.Line}
+		forEachMapping(mappingValue(schema, "properties"), func(property *yaml.Node, value *yaml.Node) {
+			field := SchemaField{Name: property.Value, Line: property.Line}
+			if typ := mappingValue(value, "type"); typ != nil {
+				field.Type = typ.Value
+			} else if ref := mappingValue(value, "$ref"); ref != nil {
+				field.Type = ref.Value[strings.LastIndex(ref.Value, "/")+1:]
+			}
+			message.Fields = append(message.Fields, field)
+		})
+		messages = append(messages, message)
+	})
+	return messages, endpoints
+}
+
+// mappingValue returns the value of key in the YAML mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// forEachMapping calls f with the keys and values of the YAML mapping node
+// in order
+func forEachMapping(node *yaml.Node, f func(key *yaml.Node, value *yaml.Node)) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		f(node.Content[i], node.Content[i+1])
+	}
+}
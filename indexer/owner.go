@@ -0,0 +1,47 @@
+package indexer
+
+import (
+	"context"
+	"slices"
+)
+
+// ownerKey is the context key for the owner set by WithOwner
+type ownerKey struct{}
+
+// WithOwner returns a context that scopes IndexManager calls to owner, for
+// example an MCP session ID. Directories indexed with it are recorded as
+// owned by owner, and listing, searching, deleting, warming and health
+// checks only see indexes owned by it. Without an owner every index is
+// visible.
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// ownerFromContext returns the owner set by WithOwner, or ""
+func ownerFromContext(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
+
+// ownedBy reports whether the index is visible to owner
+func (meta *indexMetadata) ownedBy(owner string) bool {
+	return owner == "" || slices.Contains(meta.Owners, owner)
+}
+
+// visibleMetadata returns the metadata of the indexes visible to the owner
+// in ctx
+func (m *IndexManager) visibleMetadata(ctx context.Context) map[string]*indexMetadata {
+	metadata := m.loadAllMetadata()
+	owner := ownerFromContext(ctx)
+	if owner == "" {
+		return metadata
+	}
+
+	visible := make(map[string]*indexMetadata)
+	for prefix, meta := range metadata {
+		if meta.ownedBy(owner) {
+			visible[prefix] = meta
+		}
+	}
+	return visible
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package indexer
+
+// longPath returns the path unchanged; extended-length paths are Windows-only
+func longPath(path string) string {
+	return path
+}
+
+// canonicalPath returns the path unchanged; only Windows paths need normalizing
+func canonicalPath(path string) string {
+	return path
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package indexer
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath converts an absolute path to its extended-length form (\\?\C:\...
+// or \\?\UNC\server\share\...) so file operations are not limited by MAX_PATH
+func longPath(path string) string {
+	if !filepath.IsAbs(path) || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+// canonicalPath strips any extended-length prefix and upper-cases the drive
+// letter, so that c:\src and C:\src map to the same index
+func canonicalPath(path string) string {
+	switch {
+	case strings.HasPrefix(path, `\\?\UNC\`):
+		path = `\\` + path[len(`\\?\UNC\`):]
+	case strings.HasPrefix(path, `\\?\`):
+		path = path[len(`\\?\`):]
+	}
+	if len(path) >= 2 && path[1] == ':' {
+		path = strings.ToUpper(path[:1]) + path[1:]
+	}
+	return path
+}
@@ -0,0 +1,108 @@
+//go:build windows
+
+package indexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`C:\src\app`, `\\?\C:\src\app`},
+		{`c:\src\app`, `\\?\c:\src\app`},
+		{`C:\`, `\\?\C:\`},
+		{`\\server\share\app`, `\\?\UNC\server\share\app`},
+		{`\\server\share\`, `\\?\UNC\server\share\`},
+		// Already extended-length
+		{`\\?\C:\src\app`, `\\?\C:\src\app`},
+		{`\\?\UNC\server\share\app`, `\\?\UNC\server\share\app`},
+		// Relative paths cannot be extended
+		{`src\app`, `src\app`},
+		{`C:src`, `C:src`},
+	}
+	for _, tt := range tests {
+		if got := longPath(tt.path); got != tt.want {
+			t.Errorf("longPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`C:\src\app`, `C:\src\app`},
+		{`c:\src\app`, `C:\src\app`},
+		// Only the drive letter is normalized; the rest keeps its case
+		{`c:\Src\App`, `C:\Src\App`},
+		{`\\?\c:\src\app`, `C:\src\app`},
+		{`\\?\UNC\server\share\app`, `\\server\share\app`},
+		{`\\server\share\app`, `\\server\share\app`},
+		{`\\Server\Share\App`, `\\Server\Share\App`},
+	}
+	for _, tt := range tests {
+		if got := canonicalPath(tt.path); got != tt.want {
+			t.Errorf("canonicalPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalPathRoundTrip(t *testing.T) {
+	for _, path := range []string{`C:\src\app`, `\\server\share\app`} {
+		if got := canonicalPath(longPath(path)); got != path {
+			t.Errorf("canonicalPath(longPath(%q)) = %q", path, got)
+		}
+	}
+}
+
+func TestGetIndexPrefix(t *testing.T) {
+	m := NewIndexManager(t.TempDir())
+
+	// Spellings of the same directory share an index
+	same := [][]string{
+		{`C:\src\app`, `c:\src\app`, `\\?\C:\src\app`, `\\?\c:\src\app`},
+		{`\\server\share\app`, `\\?\UNC\server\share\app`},
+	}
+	for _, paths := range same {
+		want := m.getIndexPrefix(canonicalPath(paths[0]))
+		if !strings.HasPrefix(want, "app_") {
+			t.Errorf("getIndexPrefix(%q) = %q, want the base name app", paths[0], want)
+		}
+		for _, path := range paths[1:] {
+			if got := m.getIndexPrefix(canonicalPath(path)); got != want {
+				t.Errorf("getIndexPrefix(%q) = %q, want %q as for %q", path, got, want, paths[0])
+			}
+		}
+	}
+
+	// Other directories, including a local and a UNC path with the same
+	// base name, get other indexes
+	local := m.getIndexPrefix(canonicalPath(`C:\src\app`))
+	unc := m.getIndexPrefix(canonicalPath(`\\server\share\app`))
+	other := m.getIndexPrefix(canonicalPath(`D:\src\app`))
+	if local == unc || local == other || unc == other {
+		t.Errorf("prefixes of different directories collide: %q, %q, %q", local, unc, other)
+	}
+
+	// Path components other than the drive letter keep their case
+	if m.getIndexPrefix(canonicalPath(`C:\Src\App`)) == local {
+		t.Errorf("getIndexPrefix(%q) matches %q, but only drive letters are case-folded", `C:\Src\App`, `C:\src\app`)
+	}
+
+	// Roots have no usable base name
+	roots := []string{`C:\`, `\\server\share\`, `\\?\C:\`}
+	for _, root := range roots {
+		prefix := m.getIndexPrefix(canonicalPath(root))
+		if !strings.HasPrefix(prefix, "root_") {
+			t.Errorf("getIndexPrefix(%q) = %q, want a root_ prefix", root, prefix)
+		}
+		if strings.ContainsAny(prefix, `\/:`) {
+			t.Errorf("getIndexPrefix(%q) = %q, which is not a valid file name", root, prefix)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PathMapping maps a directory as indexes record it to the same directory
+// on this machine, e.g. the /workspace of the devcontainer or CI job that
+// built the indexes to the checkout on the host
+type PathMapping struct {
+	From string `json:"from"` // Directory as recorded in the indexes
+	To   string `json:"to"`   // The same directory on this machine
+}
+
+// SetPathMappings sets the mappings applied to the directories of indexes.
+// Results and index listings show the mapped paths, and directories given
+// on this machine find the indexes built at the recorded paths. Indexes
+// built here keep the paths they were built at.
+func (m *IndexManager) SetPathMappings(mappings []PathMapping) {
+	m.pathMappings = nil
+	for _, mapping := range mappings {
+		if mapping.From == "" || mapping.To == "" {
+			continue
+		}
+		m.pathMappings = append(m.pathMappings, PathMapping{
+			From: canonicalPath(filepath.Clean(mapping.From)),
+			To:   canonicalPath(filepath.Clean(mapping.To)),
+		})
+	}
+}
+
+// localPath returns where a path recorded in an index is on this machine
+func (m *IndexManager) localPath(path string) string {
+	return m.mapPath(path, func(mapping PathMapping) (string, string) { return mapping.From, mapping.To })
+}
+
+// indexedPath returns the path an index records for a path on this machine
+func (m *IndexManager) indexedPath(path string) string {
+	return m.mapPath(path, func(mapping PathMapping) (string, string) { return mapping.To, mapping.From })
+}
+
+// mapPath replaces the longest matching directory of the mappings at the
+// start of path, as given by dirs
+func (m *IndexManager) mapPath(path string, dirs func(PathMapping) (string, string)) string {
+	best, replacement := "", ""
+	for _, mapping := range m.pathMappings {
+		from, to := dirs(mapping)
+		if len(from) > len(best) && withinDir(path, from) {
+			best, replacement = from, to
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return filepath.Join(replacement, path[len(best):])
+}
+
+// withinDir reports whether path is dir or inside it
+func withinDir(path string, dir string) bool {
+	rest, ok := strings.CutPrefix(path, dir)
+	return ok && (rest == "" || os.IsPathSeparator(rest[0]) || strings.HasSuffix(dir, string(filepath.Separator)))
+}
+
+// resolveIndexPath resolves a directory given on this machine to the path
+// its index records
+func (m *IndexManager) resolveIndexPath(dir string) (string, error) {
+	absPath, err := resolvePath(dir)
+	if err != nil {
+		return "", err
+	}
+	return m.indexedPath(absPath), nil
+}
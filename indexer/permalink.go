@@ -0,0 +1,50 @@
+package indexer
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// saveRemote records the repository the origin remote of the checkout
+// containing absPath points to, for permalinks to its results
+func (m *IndexManager) saveRemote(absPath string) error {
+	repo, _ := gitRemoteRepo(absPath)
+	return m.updateMetadata(m.getIndexPrefix(absPath), func(meta *indexMetadata) { meta.Remote = repo })
+}
+
+// permalink returns the web URL of line of the file name in an index, pinned
+// to the commit the index was built from, or "" if the index has no GitHub or
+// GitLab remote or was not built from a commit. Line 0 links to the file.
+func permalink(meta *indexMetadata, name string, line int) string {
+	if meta == nil || meta.Remote == "" {
+		return ""
+	}
+	// GitHead is the commit and the indexed directory within the checkout
+	commit, rel, ok := strings.Cut(meta.GitHead, ":")
+	if !ok || commit == "" {
+		return ""
+	}
+	host, _, _ := strings.Cut(meta.Remote, "/")
+
+	var blob string
+	switch host = strings.ToLower(host); {
+	case strings.Contains(host, "github"):
+		blob = "/blob/"
+	case strings.Contains(host, "gitlab"):
+		blob = "/-/blob/"
+	default:
+		return ""
+	}
+
+	segments := strings.Split(path.Join(rel, name), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	link := "https://" + meta.Remote + blob + commit + "/" + strings.Join(segments, "/")
+	if line > 0 {
+		link += fmt.Sprintf("#L%d", line)
+	}
+	return link
+}
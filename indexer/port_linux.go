@@ -0,0 +1,50 @@
+//go:build linux
+
+package indexer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listeningProcess returns the process listening on the TCP port, found by
+// the inode of the listening socket in procfs and the process holding it.
+// The pid is 0 if the socket or its process cannot be found, e.g. when it
+// belongs to another user.
+func listeningProcess(port int) portProcess {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		content, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != "0A" {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if p, err := strconv.ParseUint(hexPort, 16, 16); ok && err == nil && int(p) == port && fields[9] != "0" {
+				inodes[fmt.Sprintf("socket:[%s]", fields[9])] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return portProcess{}
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && inodes[link] {
+			procDir := filepath.Dir(filepath.Dir(fd))
+			pid, _ := strconv.Atoi(filepath.Base(procDir))
+			name, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+			return portProcess{pid: pid, name: strings.TrimSpace(string(name))}
+		}
+	}
+	return portProcess{}
+}
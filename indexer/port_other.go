@@ -0,0 +1,31 @@
+//go:build !linux && !windows
+
+package indexer
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listeningProcess returns the process listening on the TCP port, as
+// reported by lsof. The pid is 0 if lsof is missing or finds none.
+func listeningProcess(port int) portProcess {
+	out, err := exec.Command("lsof", "-nP", "-iTCP:"+strconv.Itoa(port), "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return portProcess{}
+	}
+	// Fields are one per line, prefixed with their type: p for the pid,
+	// followed by c for its command
+	var process portProcess
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p") && process.pid == 0:
+			process.pid, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "c") && process.pid != 0:
+			process.name = line[1:]
+			return process
+		}
+	}
+	return process
+}
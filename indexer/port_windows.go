@@ -0,0 +1,40 @@
+//go:build windows
+
+package indexer
+
+import (
+	"encoding/csv"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listeningProcess returns the process listening on the TCP port, as
+// reported by netstat and tasklist. The pid is 0 if it cannot be found.
+func listeningProcess(port int) portProcess {
+	out, err := exec.Command("netstat", "-ano", "-p", "TCP").Output()
+	if err != nil {
+		return portProcess{}
+	}
+	suffix := ":" + strconv.Itoa(port)
+	for _, line := range strings.Split(string(out), "\n") {
+		// Proto Local-Address Foreign-Address State PID
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[3] != "LISTENING" || !strings.HasSuffix(fields[1], suffix) {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil || pid == 0 {
+			continue
+		}
+		process := portProcess{pid: pid}
+		// "Image Name","PID","Session Name","Session#","Mem Usage"
+		if out, err := exec.Command("tasklist", "/FI", "PID eq "+fields[4], "/FO", "CSV", "/NH").Output(); err == nil {
+			if record, err := csv.NewReader(strings.NewReader(string(out))).Read(); err == nil && len(record) > 1 && record[1] == fields[4] {
+				process.name = record[0]
+			}
+		}
+		return process
+	}
+	return portProcess{}
+}
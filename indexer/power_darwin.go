@@ -0,0 +1,27 @@
+//go:build darwin
+
+package indexer
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// onBatteryPower reports whether the Mac runs on battery or has Low Power
+// Mode enabled, as reported by pmset
+func onBatteryPower() bool {
+	if out, err := exec.Command("pmset", "-g", "batt").Output(); err == nil {
+		if strings.Contains(string(out), "'Battery Power'") {
+			return true
+		}
+	}
+	if out, err := exec.Command("pmset", "-g").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "lowpowermode" && fields[1] == "1" {
+				return true
+			}
+		}
+	}
+	return false
+}
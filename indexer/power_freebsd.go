@@ -0,0 +1,18 @@
+//go:build freebsd
+
+package indexer
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// onBatteryPower reports whether the machine runs on battery, using the
+// ACPI AC line state. Machines without ACPI battery support report false.
+func onBatteryPower() bool {
+	out, err := exec.Command("sysctl", "-n", "hw.acpi.acline").Output()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(out)) == "0"
+}
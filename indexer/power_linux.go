@@ -0,0 +1,46 @@
+//go:build linux
+
+package indexer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// onBatteryPower reports whether the machine runs on battery, based on the
+// power supplies in sysfs. Machines without a battery are never on battery.
+func onBatteryPower() bool {
+	supplies, err := filepath.Glob("/sys/class/power_supply/*")
+	if err != nil {
+		return false
+	}
+
+	discharging := false
+	for _, supply := range supplies {
+		switch readSysfs(filepath.Join(supply, "type")) {
+		case "Mains", "USB", "USB_C", "USB_PD":
+			if readSysfs(filepath.Join(supply, "online")) == "1" {
+				return false
+			}
+		case "Battery":
+			// Skip peripheral batteries such as those of wireless mice
+			if readSysfs(filepath.Join(supply, "scope")) == "Device" {
+				continue
+			}
+			if readSysfs(filepath.Join(supply, "status")) == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	return discharging
+}
+
+// readSysfs returns the trimmed content of a sysfs attribute, or ""
+func readSysfs(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package indexer
+
+// onBatteryPower always reports false where power state detection is not
+// implemented
+func onBatteryPower() bool {
+	return false
+}
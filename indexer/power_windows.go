@@ -0,0 +1,31 @@
+//go:build windows
+
+package indexer
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// systemPowerStatus mirrors the Win32 SYSTEM_POWER_STATUS structure
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+var procGetSystemPowerStatus = syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemPowerStatus")
+
+// onBatteryPower reports whether the machine runs on battery or has battery
+// saver enabled
+func onBatteryPower() bool {
+	var status systemPowerStatus
+	if ret, _, _ := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ret == 0 {
+		return false
+	}
+	// ACLineStatus is 0 when offline; SystemStatusFlag is 1 with battery saver on
+	return status.ACLineStatus == 0 || status.SystemStatusFlag == 1
+}
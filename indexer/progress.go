@@ -0,0 +1,175 @@
+package indexer
+
+import (
+	"context"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// progressInterval is how often a full build reports its progress and
+// records it in its journal
+const progressInterval = 5 * time.Second
+
+// journalSuffix ends the names of build journals in the index directory
+const journalSuffix = ".journal.json"
+
+// IndexProgress reports how far a full build of a directory has come
+type IndexProgress struct {
+	SourceDir  string  `json:"source_dir"`
+	FilesDone  int     `json:"files_done"`
+	FilesTotal int     `json:"files_total"` // Files counted before the build started
+	Percent    float64 `json:"percent"`
+	// ETASeconds estimates the time left from the rate of the build so
+	// far, or 0 if it is not known yet
+	ETASeconds int       `json:"eta_seconds,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// progressKey is the context key for the callback set by WithIndexProgress
+type progressKey struct{}
+
+// WithIndexProgress returns a context that makes full builds started with
+// it call report as they walk the directory, every few seconds
+func WithIndexProgress(ctx context.Context, report func(IndexProgress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// indexProgressFromContext returns the callback set by WithIndexProgress,
+// or nil
+func indexProgressFromContext(ctx context.Context) func(IndexProgress) {
+	report, _ := ctx.Value(progressKey{}).(func(IndexProgress))
+	return report
+}
+
+// buildProgress is the progress of a full build, recorded in its journal
+type buildProgress struct {
+	Total     int       `json:"total"`
+	Done      int       `json:"done"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// ResumedAt and ResumedDone are when and how far the current run of the
+	// build started, which the estimate of the time left is based on
+	ResumedAt   time.Time `json:"resumed_at"`
+	ResumedDone int       `json:"resumed_done"`
+}
+
+// newBuildProgress returns the progress of a build of total files starting
+// after done of them. A resumed build keeps the start of the interrupted
+// one.
+func newBuildProgress(total int, done int, resumed *buildProgress) *buildProgress {
+	now := time.Now().UTC()
+	p := &buildProgress{Total: total, Done: done, StartedAt: now, UpdatedAt: now, ResumedAt: now, ResumedDone: done}
+	if resumed != nil && done > 0 {
+		p.StartedAt = resumed.StartedAt
+	}
+	return p
+}
+
+// due reports whether progress should be reported and recorded again
+func (p *buildProgress) due(now time.Time) bool {
+	return now.Sub(p.UpdatedAt) >= progressInterval
+}
+
+// report returns the progress of the build of sourceDir
+func (p *buildProgress) report(sourceDir string) IndexProgress {
+	progress := IndexProgress{
+		SourceDir:  sourceDir,
+		FilesDone:  p.Done,
+		FilesTotal: p.Total,
+		StartedAt:  p.StartedAt,
+		UpdatedAt:  p.UpdatedAt,
+	}
+	// Files added since the count make the share exceed 100
+	if p.Total > 0 {
+		progress.Percent = min(100, math.Round(float64(p.Done)*1000/float64(p.Total))/10)
+	}
+	elapsed := p.UpdatedAt.Sub(p.ResumedAt)
+	if walked := p.Done - p.ResumedDone; walked > 0 && elapsed > 0 && p.Total > p.Done {
+		eta := time.Duration(float64(elapsed) * float64(p.Total-p.Done) / float64(walked))
+		progress.ETASeconds = int(eta.Round(time.Second).Seconds())
+	}
+	return progress
+}
+
+// countCandidates counts the files under walkRoot that a build walks, as the
+// total of its progress. Only directories are read, so counting costs a
+// fraction of the build.
+func countCandidates(ctx context.Context, walkRoot string, filter *sourceFilter) (int, error) {
+	count := 0
+	err := walkTree(walkRoot, filter.followSymlinks, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		rel, err := filepath.Rel(walkRoot, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(name, ".") || isSkippedDir(name) || filter.excludes(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(name, ".") && !filter.excludes(rel, false) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// IndexProgress returns the progress of the full build of sourceDir, or of
+// all full builds if sourceDir is empty. The progress is read from the
+// journals builds record it in, so builds running in other processes and
+// interrupted builds, whose progress stops being updated, are included.
+// Builds are only recorded if checkpoints are enabled and the index is not
+// encrypted.
+func (m *IndexManager) IndexProgress(ctx context.Context, sourceDir string) ([]IndexProgress, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	if sourceDir != "" {
+		absPath, err := m.resolveIndexPath(sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = []string{m.getIndexPrefix(absPath)}
+	} else {
+		entries, err := os.ReadDir(m.indexDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); strings.HasSuffix(name, journalSuffix) {
+				prefixes = append(prefixes, strings.TrimSuffix(name, journalSuffix))
+			}
+		}
+	}
+
+	owner := ownerFromContext(ctx)
+	var builds []IndexProgress
+	for _, prefix := range prefixes {
+		journal, ok := m.loadBuildJournal(prefix)
+		if !ok || journal == nil || journal.Progress == nil {
+			continue
+		}
+		if owner != "" && journal.Owner != owner {
+			continue
+		}
+		builds = append(builds, journal.Progress.report(m.localPath(journal.Source)))
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].SourceDir < builds[j].SourceDir })
+	return builds, nil
+}
@@ -0,0 +1,147 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errChanged stops the walk of changedSince at the first changed file
+var errChanged = errors.New("changed")
+
+// ProjectStatus is the state of the index of the project containing a path
+type ProjectStatus struct {
+	// Directory is the root of the project: the indexed directory containing
+	// the path, else the root of its git repository, else the path itself
+	Directory string `json:"directory"`
+	Indexed   bool   `json:"indexed"`
+	// Stale is why the index is behind the files of the directory, if it is
+	Stale string `json:"stale,omitempty"`
+}
+
+// ProjectStatus finds the project containing path, which may be a file or
+// any directory within it, and reports whether its index is missing or
+// behind: built for an older Zoekt version, at another git commit, or before
+// a file was last modified. Files are checked by walking the directory
+// until the first modified one, so files deleted outside of git commits are
+// not noticed. Indexes of attached shards are never stale, as they are
+// built elsewhere.
+func (m *IndexManager) ProjectStatus(ctx context.Context, path string) (*ProjectStatus, error) {
+	absPath, err := resolvePath(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	info, err := os.Stat(longPath(absPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to access path: %w", err)
+	}
+
+	// The deepest index containing the path is the project
+	var meta *indexMetadata
+	for _, candidate := range m.visibleMetadata(ctx) {
+		dir := candidate.dir()
+		if containsPath(dir, absPath) && (meta == nil || len(dir) > len(meta.dir())) {
+			meta = candidate
+		}
+	}
+	if meta == nil {
+		dir := absPath
+		if !info.IsDir() {
+			dir = filepath.Dir(absPath)
+		}
+		if root, _ := findGitDir(dir); root != "" {
+			dir = root
+		}
+		return &ProjectStatus{Directory: dir}, nil
+	}
+
+	status := &ProjectStatus{Directory: meta.dir(), Indexed: true}
+	if meta.Attached != "" {
+		return status, nil
+	}
+	status.Stale, err = m.staleness(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// staleness returns why the index of meta is behind its directory, or ""
+func (m *IndexManager) staleness(ctx context.Context, meta *indexMetadata) (string, error) {
+	dir := meta.dir()
+	if meta.Stale != "" {
+		return meta.Stale, nil
+	}
+	if head := gitIdentity(dir); meta.GitHead != "" && head != meta.GitHead {
+		if commit := gitCommit(head); commit != "" {
+			return fmt.Sprintf("the checkout is at commit %s, but was indexed at %s", ShortHash(commit), ShortHash(gitCommit(meta.GitHead))), nil
+		}
+	}
+
+	filter, err := newSourceFilter(ctx, dir, IndexOptions{
+		TrackedOnly:       meta.TrackedOnly,
+		IgnorePatterns:    meta.IgnorePatterns,
+		MaxFileSize:       meta.MaxFileSize,
+		FollowSymlinks:    meta.FollowSymlinks,
+		NoDefaultExcludes: meta.NoDefaultExcludes,
+	})
+	if err != nil {
+		return "", err
+	}
+	changed, err := changedSince(ctx, longPath(dir), filter, meta.IndexedAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to check for changes: %w", err)
+	}
+	if changed != "" {
+		return fmt.Sprintf("%s was modified after the directory was indexed", filepath.ToSlash(changed)), nil
+	}
+	return "", nil
+}
+
+// changedSince returns the first file under walkRoot that a build indexes
+// and that was modified after t, relative to walkRoot, or "" if there is
+// none
+func changedSince(ctx context.Context, walkRoot string, filter *sourceFilter, t time.Time) (string, error) {
+	var changed string
+	err := walkTree(walkRoot, filter.followSymlinks, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		rel, err := filepath.Rel(walkRoot, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(name, ".") || isSkippedDir(name) || filter.excludes(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || filter.excludes(rel, false) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed meanwhile
+			return nil
+		}
+		if info.ModTime().After(t) {
+			changed = rel
+			return errChanged
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errChanged) {
+		return "", err
+	}
+	return changed, nil
+}
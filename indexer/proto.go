@@ -0,0 +1,179 @@
+package indexer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// protoDecl matches the declarations of a .proto file that open a block
+var protoDecl = regexp.MustCompile(`^(message|enum|service|oneof)\s+([A-Za-z_][A-Za-z0-9_]*)\s*\{`)
+
+// protoField matches a message field, e.g. "repeated string tags = 4;",
+// or an enum value, e.g. "ACTIVE = 1;"
+var protoField = regexp.MustCompile(`^(?:(?:repeated|optional|required)\s+)?(?:([A-Za-z_][A-Za-z0-9_.<>, ]*?)\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=\s*-?[0-9]`)
+
+// protoRPC matches an rpc of a service, e.g.
+// "rpc GetUser(GetUserRequest) returns (User)"
+var protoRPC = regexp.MustCompile(`^rpc\s+([A-Za-z_][A-Za-z0-9_]*)\s*\(\s*(?:stream\s+)?([A-Za-z0-9_.]+)\s*\)\s*returns\s*\(\s*(?:stream\s+)?([A-Za-z0-9_.]+)\s*\)`)
+
+// protoHTTPRule matches the HTTP mapping of an rpc in a google.api.http
+// option, e.g. `get: "/v1/users/{id}"`
+var protoHTTPRule = regexp.MustCompile(`\b(get|put|post|delete|patch)\s*:\s*"([^"]*)"`)
+
+// protoPackage matches the package declaration of a .proto file
+var protoPackage = regexp.MustCompile(`^package\s+([A-Za-z0-9_.]+)\s*;`)
+
+// protoBlock is a message, enum or service being parsed
+type protoBlock struct {
+	kind    string
+	name    string // Fully qualified name
+	message *SchemaMessage
+	depth   int // Brace depth inside the block
+}
+
+// parseProto returns the messages, enums and rpcs declared in a .proto
+// file. It understands the common layout of one declaration per line.
+func parseProto(file string, content string) ([]SchemaMessage, []Endpoint) {
+	var messages []*SchemaMessage
+	var endpoints []Endpoint
+	var stack []*protoBlock
+	rpc := -1 // Index of the last rpc in endpoints
+	pkg := ""
+
+	for i, line := range strings.Split(stripProtoComments(content), "\n") {
+		lineNum := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if match := protoPackage.FindStringSubmatch(line); match != nil {
+			pkg = match[1]
+			continue
+		}
+
+		var top *protoBlock
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch match := protoDecl.FindStringSubmatch(line); {
+		case match != nil && match[1] == "oneof" && top != nil:
+			// The fields of a oneof belong to the message
+			stack = append(stack, &protoBlock{kind: "oneof", name: top.name, message: top.message})
+		case match != nil:
+			name := match[2]
+			if top != nil {
+				name = top.name + "." + name
+			} else if pkg != "" {
+				name = pkg + "." + name
+			}
+			block := &protoBlock{kind: match[1], name: name}
+			if block.kind != "service" {
+				block.message = &SchemaMessage{Name: name, Kind: block.kind, File: file, Line: lineNum}
+				messages = append(messages, block.message)
+			}
+			stack = append(stack, block)
+		case top != nil && top.kind == "service":
+			if rpcMatch := protoRPC.FindStringSubmatch(line); rpcMatch != nil {
+				endpoints = append(endpoints, Endpoint{
+					Method:      "RPC",
+					Path:        "/" + top.name + "/" + rpcMatch[1],
+					OperationID: rpcMatch[1],
+					Summary:     rpcMatch[2] + " returns " + rpcMatch[3],
+					File:        file,
+					Line:        lineNum,
+				})
+				rpc = len(endpoints) - 1
+			}
+			// An HTTP mapping makes the rpc reachable as a REST route too
+			if httpMatch := protoHTTPRule.FindStringSubmatch(line); httpMatch != nil && rpc >= 0 {
+				endpoints = append(endpoints, Endpoint{
+					Method:      strings.ToUpper(httpMatch[1]),
+					Path:        httpMatch[2],
+					OperationID: endpoints[rpc].OperationID,
+					Summary:     endpoints[rpc].Path,
+					File:        file,
+					Line:        lineNum,
+				})
+			}
+		case top != nil && top.message != nil && top.depth == 0:
+			if fieldMatch := protoField.FindStringSubmatch(line); fieldMatch != nil && !strings.HasPrefix(line, "option") {
+				top.message.Fields = append(top.message.Fields, SchemaField{
+					Name: fieldMatch[2],
+					Type: strings.TrimSpace(fieldMatch[1]),
+					Line: lineNum,
+				})
+			}
+		}
+
+		// Track nested braces, e.g. of options, and the end of blocks. The
+		// brace opening a declaration belongs to its block.
+		braces := strings.Count(line, "{") - strings.Count(line, "}")
+		if protoDecl.MatchString(line) {
+			braces--
+		}
+		for ; braces < 0 && len(stack) > 0; braces++ {
+			if top := stack[len(stack)-1]; top.depth > 0 {
+				top.depth--
+			} else {
+				stack = stack[:len(stack)-1]
+				if top.kind == "service" {
+					rpc = -1
+				}
+			}
+		}
+		if braces > 0 && len(stack) > 0 {
+			stack[len(stack)-1].depth += braces
+		}
+	}
+
+	result := make([]SchemaMessage, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, *message)
+	}
+	return result, endpoints
+}
+
+// stripProtoComments blanks out // and /* */ comments, keeping line breaks
+// so line numbers stay the same
+func stripProtoComments(content string) string {
+	var b strings.Builder
+	inString, inBlock := false, false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case inBlock:
+			if c == '*' && i+1 < len(content) && content[i+1] == '/' {
+				inBlock = false
+				i++
+			} else if c == '\n' {
+				b.WriteByte('\n')
+			}
+			continue
+		case inString:
+			if c == '\\' && i+1 < len(content) {
+				b.WriteByte(c)
+				i++
+				c = content[i]
+			} else if c == '"' || c == '\n' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(content) && content[i+1] == '/':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			if i < len(content) {
+				b.WriteByte('\n')
+			}
+			continue
+		case c == '/' && i+1 < len(content) && content[i+1] == '*':
+			inBlock = true
+			i++
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
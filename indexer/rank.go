@@ -0,0 +1,48 @@
+package indexer
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// definitionQuery also matches the content atoms of q as symbol
+// definitions. What matches does not change, but Zoekt then reports which
+// matched lines define a symbol.
+func definitionQuery(q query.Q) query.Q {
+	return mapContentAtoms(q, func(atom query.Q) query.Q {
+		return query.NewOr(&query.Symbol{Expr: atom}, atom)
+	})
+}
+
+// isDefinition reports whether a matched line defines a symbol
+func isDefinition(lineMatch zoekt.LineMatch) bool {
+	return slices.ContainsFunc(lineMatch.LineFragments, func(fragment zoekt.LineFragmentMatch) bool {
+		return fragment.SymbolInfo != nil
+	})
+}
+
+// hasDefinition reports whether any matched line of a file defines a symbol
+func hasDefinition(fileMatch zoekt.FileMatch) bool {
+	return slices.ContainsFunc(fileMatch.LineMatches, isDefinition)
+}
+
+// rankDefinitions moves the files defining a matched symbol before the files
+// only using it, and the defining lines first within each file. Otherwise
+// the order by score is kept.
+func rankDefinitions(files []zoekt.FileMatch) []zoekt.FileMatch {
+	ranked := slices.Clone(files)
+	for i := range ranked {
+		lines := slices.Clone(ranked[i].LineMatches)
+		sort.SliceStable(lines, func(a, b int) bool {
+			return isDefinition(lines[a]) && !isDefinition(lines[b])
+		})
+		ranked[i].LineMatches = lines
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		return hasDefinition(ranked[a]) && !hasDefinition(ranked[b])
+	})
+	return ranked
+}
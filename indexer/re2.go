@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// pcreConstruct is a regex construct from PCRE (Perl, PHP, JavaScript) that
+// RE2 does not support, with advice on rewriting it
+type pcreConstruct struct {
+	name    string
+	pattern *regexp.Regexp
+	rewrite string
+}
+
+// unescaped matches the start of the query or a character that does not
+// escape what follows
+const unescaped = `(?:^|[^\\])(?:\\\\)*`
+
+// pcreConstructs are checked in order; the first match explains the error
+var pcreConstructs = []pcreConstruct{
+	{
+		name:    "lookahead (?=...) or (?!...)",
+		pattern: regexp.MustCompile(unescaped + `\(\?[=!]`),
+		rewrite: "match the text directly instead, e.g. foo(?=bar) becomes foobar, or negate a separate term to leave out files, e.g. foo -foobar",
+	},
+	{
+		name:    "lookbehind (?<=...) or (?<!...)",
+		pattern: regexp.MustCompile(unescaped + `\(\?<[=!]`),
+		rewrite: "match the text directly instead, e.g. (?<=get)User becomes getUser, or negate a separate term to leave out files, e.g. User -getUser",
+	},
+	{
+		name:    "backreference \\1",
+		pattern: regexp.MustCompile(unescaped + `\\(?:[1-9]|k<|k\{|g\{?-?[0-9])`),
+		rewrite: "spell out the alternatives the group can match, e.g. (['\"]).*\\1 becomes (\".*\"|'.*')",
+	},
+	{
+		name:    "atomic group (?>...)",
+		pattern: regexp.MustCompile(unescaped + `\(\?>`),
+		rewrite: "use a non-capturing group (?:...) instead",
+	},
+	{
+		name:    "conditional or recursive pattern (?(...) or (?R)",
+		pattern: regexp.MustCompile(unescaped + `\(\?(?:\(|R\)|[0-9]+\)|&)`),
+		rewrite: "split it into separate, simpler queries joined with or",
+	},
+	{
+		name:    "possessive quantifier or doubled +",
+		pattern: regexp.MustCompile(unescaped + `[*+?}]\+`),
+		rewrite: "use a plain quantifier such as * or +; to match a literal + escape it, e.g. c\\+\\+",
+	},
+	{
+		name:    `escape \Z, \G, \h or \R`,
+		pattern: regexp.MustCompile(unescaped + `\\[ZGhR]`),
+		rewrite: `use \z or $ for the end of the text, [ \t] for horizontal space and \r?\n for a line break`,
+	},
+}
+
+// explainUnsupportedRegexp returns an error explaining why queryStr, which
+// failed to parse with parseErr, uses regex syntax RE2 does not support and
+// how to rewrite it. It returns nil if no such construct is found.
+func explainUnsupportedRegexp(queryStr string, parseErr error) error {
+	for _, construct := range pcreConstructs {
+		if construct.pattern.MatchString(queryStr) {
+			return fmt.Errorf("search patterns use RE2, which does not support the %s: %s (%v)",
+				construct.name, construct.rewrite, parseErr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package indexer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// ErrUnknownResult is returned when refining a search result that does not
+// exist or is no longer kept
+var ErrUnknownResult = errors.New("unknown or expired search result")
+
+// maxSearchRecords is how many recent search results can be refined
+const maxSearchRecords = 100
+
+// maxRefineFiles caps the files of a previous result that a refined search
+// is limited to
+const maxRefineFiles = 10000
+
+// searchStep is one query of a chain of refined searches
+type searchStep struct {
+	query string
+	opts  SearchOptions
+}
+
+// searchRecord keeps a search so it can be refined. The queries are run
+// again when refining, so the result reflects the current index.
+type searchRecord struct {
+	id        string
+	owner     string
+	sourceDir string
+	steps     []searchStep
+	files     []resultFile // Files shown, for OpenResult
+}
+
+// RefineSearch searches the files matched by the search result with ID
+// resultID for queryStr, e.g. to find which of the files also mention
+// something else. The refined result has an ID of its own, so refinements
+// can be chained.
+func (m *IndexManager) RefineSearch(ctx context.Context, resultID string, queryStr string, opts SearchOptions) (*SearchResult, error) {
+	record := m.searchRecord(ctx, resultID)
+	if record == nil {
+		return nil, fmt.Errorf("%w %q; run the search again", ErrUnknownResult, resultID)
+	}
+	// Refined searches cover the same directories
+	opts.Workspace = record.steps[0].opts.Workspace
+	return m.search(ctx, queryStr, record.sourceDir, opts, record.steps)
+}
+
+// rememberSearch records the steps of a search with matches and the files
+// it showed, and returns the ID to refine it with. The oldest record is
+// dropped when there are too many.
+func (m *IndexManager) rememberSearch(ctx context.Context, sourceDir string, steps []searchStep, files []resultFile) string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	// Progress is reported to the original caller only
+	for i := range steps {
+		steps[i].opts.OnProgress, steps[i].opts.OnQueued = nil, nil
+	}
+	record := &searchRecord{
+		id:        hex.EncodeToString(id),
+		owner:     ownerFromContext(ctx),
+		sourceDir: sourceDir,
+		steps:     steps,
+		files:     files,
+	}
+
+	m.resultsMu.Lock()
+	defer m.resultsMu.Unlock()
+	m.results = append(m.results, record)
+	if len(m.results) > maxSearchRecords {
+		m.results = slices.Delete(m.results, 0, len(m.results)-maxSearchRecords)
+	}
+	return record.id
+}
+
+// searchRecord returns the recorded search with ID id, if the caller may
+// see it
+func (m *IndexManager) searchRecord(ctx context.Context, id string) *searchRecord {
+	m.resultsMu.Lock()
+	defer m.resultsMu.Unlock()
+	for _, record := range m.results {
+		if record.id == id && record.owner == ownerFromContext(ctx) {
+			return record
+		}
+	}
+	return nil
+}
+
+// refineFiles returns a query matching the files matched by every step,
+// searched with the same filters. It reports whether the files may be
+// incomplete because a step matched too many.
+func (m *IndexManager) refineFiles(ctx context.Context, searcher zoekt.Searcher, steps []searchStep, filters []query.Q, metadata map[string]*indexMetadata, searched []string, scoped []string) (query.Q, bool, error) {
+	var files map[string]map[string]bool // Repository to file names
+	truncated := false
+	for _, step := range steps {
+		parsed, err := m.parseSearchQuery(step.query, step.opts, metadata, searched, scoped)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to repeat the refined search: %w", err)
+		}
+		q := query.NewAnd(append([]query.Q{parsed.q}, filters...)...)
+		result, err := searcher.Search(ctx, q, &zoekt.SearchOptions{MaxDocDisplayCount: maxRefineFiles})
+		if err != nil {
+			return nil, false, fmt.Errorf("search failed: %w", err)
+		}
+		matched := result.Files
+		if parsed.kinds != nil {
+			matched = filterSymbolKinds(matched, parsed.kinds)
+		}
+		if len(result.Files) >= maxRefineFiles || result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0 {
+			truncated = true
+		}
+
+		stepFiles := make(map[string]map[string]bool)
+		for _, fileMatch := range matched {
+			if files != nil && !files[fileMatch.Repository][fileMatch.FileName] {
+				continue
+			}
+			if stepFiles[fileMatch.Repository] == nil {
+				stepFiles[fileMatch.Repository] = make(map[string]bool)
+			}
+			stepFiles[fileMatch.Repository][fileMatch.FileName] = true
+		}
+		files = stepFiles
+	}
+
+	// Match each file name only in the repository it was found in
+	var sets []query.Q
+	for _, repo := range slices.Sorted(maps.Keys(files)) {
+		sets = append(sets, query.NewAnd(
+			query.NewRepoSet(repo),
+			query.NewFileNameSet(slices.Sorted(maps.Keys(files[repo]))...),
+		))
+	}
+	if len(sets) == 0 {
+		return &query.Const{Value: false}, truncated, nil
+	}
+	return query.NewOr(sets...), truncated, nil
+}
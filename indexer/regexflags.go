@@ -0,0 +1,75 @@
+package indexer
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// inlineFlags matches RE2 inline flag groups such as (?i) or (?s-m:...)
+var inlineFlags = regexp.MustCompile(`\(\?[imsU]*-?[imsU]+[:)]`)
+
+// applyRegexpFlags applies the regex flags of opts to every atom of q,
+// parsed from queryStr. Flags that conflict with the query are an error
+// rather than silently overriding it.
+func applyRegexpFlags(queryStr string, q query.Q, opts SearchOptions) (query.Q, error) {
+	if !opts.IgnoreCase && !opts.DotAll && !opts.OneLine {
+		return q, nil
+	}
+	if inlineFlags.MatchString(queryStr) {
+		return nil, errors.New("regex flag parameters cannot be combined with inline flags like (?i) in the query; use one or the other")
+	}
+	if opts.IgnoreCase && slices.Contains(strings.Fields(queryStr), "case:yes") {
+		return nil, errors.New("ignore_case conflicts with case:yes in the query")
+	}
+	return applyAtomFlags(q, opts), nil
+}
+
+// applyAtomFlags applies the flags to the atoms of q, including those
+// inside symbol queries
+func applyAtomFlags(q query.Q, opts SearchOptions) query.Q {
+	return query.Map(q, func(q query.Q) query.Q {
+		switch atom := q.(type) {
+		case *query.Substring:
+			if opts.IgnoreCase {
+				flagged := *atom
+				flagged.CaseSensitive = false
+				return &flagged
+			}
+		case *query.Regexp:
+			flagged := *atom
+			flagged.Regexp = rewriteRegexp(atom.Regexp, opts)
+			if opts.IgnoreCase {
+				flagged.CaseSensitive = false
+			}
+			return &flagged
+		case *query.Symbol:
+			return &query.Symbol{Expr: applyAtomFlags(atom.Expr, opts)}
+		}
+		return q
+	})
+}
+
+// rewriteRegexp returns a copy of re with the dot and anchor operators
+// changed as if it had been parsed with the flags
+func rewriteRegexp(re *syntax.Regexp, opts SearchOptions) *syntax.Regexp {
+	rewritten := *re
+	switch {
+	case opts.DotAll && re.Op == syntax.OpAnyCharNotNL:
+		rewritten.Op = syntax.OpAnyChar
+	case opts.OneLine && re.Op == syntax.OpBeginLine:
+		rewritten.Op = syntax.OpBeginText
+	case opts.OneLine && re.Op == syntax.OpEndLine:
+		rewritten.Op = syntax.OpEndText
+		rewritten.Flags |= syntax.WasDollar
+	}
+	rewritten.Sub = make([]*syntax.Regexp, len(re.Sub))
+	for i, sub := range re.Sub {
+		rewritten.Sub[i] = rewriteRegexp(sub, opts)
+	}
+	return &rewritten
+}
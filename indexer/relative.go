@@ -0,0 +1,71 @@
+package indexer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+)
+
+// relativeBase returns the directory the paths of files are shown relative
+// to with opts.RelativePaths: the root of the index they came from, or the
+// deepest directory containing the roots of all of them. It returns "" if
+// paths are shown in full.
+func relativeBase(files []zoekt.FileMatch, metadata map[string]*indexMetadata, opts SearchOptions) string {
+	if !opts.RelativePaths {
+		return ""
+	}
+	base := ""
+	for _, fileMatch := range files {
+		meta, ok := metadata[fileMatch.Repository]
+		if !ok || meta.SourceDir == "" {
+			// Files without a known root are shown as they are
+			continue
+		}
+		root := meta.dir()
+		if base == "" {
+			base = root
+			continue
+		}
+		for !containsPath(base, root) {
+			parent := filepath.Dir(base)
+			if parent == base {
+				return ""
+			}
+			base = parent
+		}
+	}
+	return base
+}
+
+// containsPath reports whether path is dir or inside it
+func containsPath(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// relativeTo returns fullPath relative to base, or fullPath if base is ""
+// or does not contain it
+func relativeTo(fullPath string, base string) string {
+	if base == "" || !containsPath(base, fullPath) {
+		return fullPath
+	}
+	rel, err := filepath.Rel(base, fullPath)
+	if err != nil {
+		return fullPath
+	}
+	return rel
+}
+
+// addRelativeHeader states the directory paths are relative to once,
+// before the lines of a result, unless opts.Terse is set
+func (sr *SearchResult) addRelativeHeader(base string, opts SearchOptions) {
+	if base == "" {
+		return
+	}
+	sr.RelativeTo = base
+	if !opts.Terse {
+		sr.Lines = append([]string{fmt.Sprintf("[Paths relative to %s]", base)}, sr.Lines...)
+	}
+}
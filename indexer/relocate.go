@@ -0,0 +1,28 @@
+package indexer
+
+import "path/filepath"
+
+// RelocateStore updates the paths recorded in the metadata of the store
+// that point into oldDir, where the store was before it was moved to the
+// index directory of m, such as the shard directories of attached indexes
+// kept in the store. It returns how many paths were updated.
+func (m *IndexManager) RelocateStore(oldDir string) (int, error) {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	updated := 0
+	for _, meta := range metadata {
+		if meta.Attached == "" || !containsPath(oldDir, meta.Attached) {
+			continue
+		}
+		if rel, err := filepath.Rel(oldDir, meta.Attached); err == nil {
+			meta.Attached = filepath.Join(m.indexDir, rel)
+			updated++
+		}
+	}
+	if updated == 0 {
+		return 0, nil
+	}
+	return updated, m.saveAllMetadata(metadata)
+}
@@ -0,0 +1,350 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRemoteTimeout bounds a search of a remote backend unless configured
+// otherwise, so a slow backend does not hold up local results
+const defaultRemoteTimeout = 20 * time.Second
+
+// RemoteConfig configures a remote search backend
+type RemoteConfig struct {
+	Name string `json:"name"` // Label of the backend's results
+	Type string `json:"type"` // Backend kind: "zoekt", "sourcegraph" or "github"
+	URL  string `json:"url"`  // Base URL of the backend; GitHub defaults to api.github.com
+
+	// Token authenticates with the backend. TokenEnv names an environment
+	// variable holding it instead, which keeps it out of the config file.
+	Token    string `json:"token,omitempty"`
+	TokenEnv string `json:"token_env,omitempty"`
+
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"` // Default: 20
+}
+
+// Remote is a search backend outside the local index directory
+type Remote interface {
+	// Name labels the results of the backend
+	Name() string
+	// Search runs query on the backend, returning at most opts.MaxFiles
+	// files
+	Search(ctx context.Context, query string, opts SearchOptions) ([]RemoteFile, error)
+}
+
+// RemoteFile is a file matched by a remote backend
+type RemoteFile struct {
+	Repository string       // Repository name, e.g. "github.com/org/repo"
+	Path       string       // Path of the file in the repository
+	Matches    int          // Number of matching lines in the file
+	Lines      []RemoteLine // Matching lines, in order
+}
+
+// RemoteLine is a matching line of a RemoteFile
+type RemoteLine struct {
+	Number int // 1-based line number, or 0 if the backend does not report it
+	Text   string
+}
+
+// NewRemote creates the backend described by cfg
+func NewRemote(cfg RemoteConfig) (Remote, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("remote backend has no name")
+	}
+	if cfg.URL == "" && cfg.Type == "github" {
+		cfg.URL = defaultGitHubAPI
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("remote backend %s has no url", cfg.Name)
+	}
+	token := cfg.Token
+	switch {
+	case cfg.TokenEnv != "":
+		token = os.Getenv(cfg.TokenEnv)
+	case token == "" && cfg.Type == "github":
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	timeout := defaultRemoteTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	switch cfg.Type {
+	case "zoekt", "":
+		return &zoektRemote{name: cfg.Name, url: strings.TrimSuffix(cfg.URL, "/"), token: token, client: client}, nil
+	case "sourcegraph":
+		return &sourcegraphRemote{name: cfg.Name, url: strings.TrimSuffix(cfg.URL, "/"), token: token, client: client}, nil
+	case "github":
+		return newGitHubRemote(cfg.Name, strings.TrimSuffix(cfg.URL, "/"), token, client)
+	default:
+		return nil, fmt.Errorf("remote backend %s has unknown type %q", cfg.Name, cfg.Type)
+	}
+}
+
+// SetRemotes sets the backends searched along with the local indexes
+func (m *IndexManager) SetRemotes(remotes []Remote) {
+	m.remotes = remotes
+}
+
+// zoektRemote searches a zoekt-webserver started with -rpc through its JSON
+// API
+type zoektRemote struct {
+	name   string
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (r *zoektRemote) Name() string {
+	return r.name
+}
+
+func (r *zoektRemote) Search(ctx context.Context, query string, opts SearchOptions) ([]RemoteFile, error) {
+	if opts.Language != "" {
+		query = fmt.Sprintf("(%s) lang:%s", query, opts.Language)
+	}
+	body, err := json.Marshal(map[string]any{
+		"Q":    query,
+		"Opts": map[string]any{"MaxDocDisplayCount": opts.MaxFiles},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/api/search", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Error  string
+		Result struct {
+			FileMatches []struct {
+				Repository  string
+				FileName    string
+				LineMatches []struct {
+					Line       []byte
+					LineNumber int
+				}
+			}
+		}
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(content, &reply); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("backend returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend returned %s", resp.Status)
+	}
+
+	var files []RemoteFile
+	for _, match := range reply.Result.FileMatches {
+		file := RemoteFile{Repository: match.Repository, Path: match.FileName, Matches: len(match.LineMatches)}
+		for _, line := range match.LineMatches {
+			file.Lines = append(file.Lines, RemoteLine{Number: line.LineNumber, Text: string(line.Line)})
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// fallbackRemote is implemented by backends that only answer for
+// repositories without a local index
+type fallbackRemote interface {
+	fallback() bool
+}
+
+// remoteResult is the outcome of searching one remote backend
+type remoteResult struct {
+	files []RemoteFile
+	err   error
+}
+
+// federatedSearch searches the local indexes and every remote backend at
+// once, appending the remote files not also found locally to the local
+// result, each labeled with its backend. A backend that fails is reported in
+// the result rather than failing the search.
+func (m *IndexManager) federatedSearch(ctx context.Context, queryStr string, opts SearchOptions) (*SearchResult, error) {
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 20
+	}
+	if opts.MaxLinesPerFile <= 0 {
+		opts.MaxLinesPerFile = 3
+	}
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = 200
+	}
+
+	results := make([]remoteResult, len(m.remotes))
+	var wg sync.WaitGroup
+	for i, remote := range m.remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files, err := remote.Search(ctx, queryStr, opts)
+			results[i] = remoteResult{files: files, err: err}
+		}()
+	}
+
+	// Streaming progress only covers the local indexes
+	local, err := m.search(ctx, queryStr, "", opts, nil)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	// The local result may be cached, so it is copied before adding to it
+	sr := *local
+	sr.Lines = slices.Clone(local.Lines)
+	sr.RemoteFiles = make(map[string]int)
+
+	seen := m.localFileKeys(ctx, local.files)
+	var localRepos map[string]bool
+	for i, remote := range m.remotes {
+		label := "[" + remote.Name() + "] "
+		if results[i].err != nil {
+			sr.RemoteErrors = append(sr.RemoteErrors, fmt.Sprintf("%s: %v", remote.Name(), results[i].err))
+			sr.Lines = append(sr.Lines, fmt.Sprintf("%ssearch failed: %v", label, results[i].err))
+			continue
+		}
+		fallback := false
+		if f, ok := remote.(fallbackRemote); ok && f.fallback() {
+			fallback = true
+			if localRepos == nil {
+				localRepos = m.localRepos(ctx)
+			}
+		}
+
+		shown := 0
+		for _, file := range results[i].files {
+			if fallback && localRepos[remoteFileKey(file.Repository, "")] {
+				continue
+			}
+			key := remoteFileKey(file.Repository, file.Path)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			sr.RemoteFiles[remote.Name()]++
+			if shown >= opts.MaxFiles {
+				continue
+			}
+			shown++
+
+			name := strings.ToValidUTF8(file.Repository+"/"+file.Path, "\uFFFD")
+			if opts.FilesOnly {
+				switch file.Matches {
+				case 0:
+					sr.Lines = append(sr.Lines, opts.dim(label+name))
+				case 1:
+					sr.Lines = append(sr.Lines, fmt.Sprintf("%s (1 match)", opts.dim(label+name)))
+				default:
+					sr.Lines = append(sr.Lines, fmt.Sprintf("%s (%d matches)", opts.dim(label+name), file.Matches))
+				}
+				continue
+			}
+			for j, line := range file.Lines {
+				if j >= opts.MaxLinesPerFile {
+					break
+				}
+				content := truncateLine(strings.TrimRight(line.Text, "\n\r"), opts.MaxLineLength)
+				if line.Number == 0 {
+					sr.Lines = append(sr.Lines, fmt.Sprintf("%s: %s", opts.dim(label+name), content))
+				} else {
+					sr.Lines = append(sr.Lines, fmt.Sprintf("%s: %s", opts.dim(fmt.Sprintf("%s%s:%d", label, name, line.Number)), content))
+				}
+			}
+			if file.Matches > opts.MaxLinesPerFile && !opts.Terse {
+				sr.Lines = append(sr.Lines, fmt.Sprintf("  ... and %d more matches in this file", file.Matches-opts.MaxLinesPerFile))
+			}
+		}
+		if shown < sr.RemoteFiles[remote.Name()] && !opts.Terse {
+			sr.Lines = append(sr.Lines, fmt.Sprintf("%s[Showing %d of %d files]", label, shown, sr.RemoteFiles[remote.Name()]))
+		}
+	}
+	sr.measure(opts)
+	return &sr, nil
+}
+
+// localFileKeys returns the repository keys of local result files, so
+// remote results for the same files can be dropped. A local index is
+// identified by the repository name of attached shards, or else the origin
+// remote of its git checkout.
+func (m *IndexManager) localFileKeys(ctx context.Context, files []resultFile) map[string]bool {
+	keys := make(map[string]bool)
+	repos := shardView(m.visibleMetadata(ctx))
+	type origin struct{ repo, rel string }
+	origins := make(map[string]origin) // By shard prefix
+	for _, file := range files {
+		o, ok := origins[file.repo]
+		if !ok {
+			if meta, found := repos[file.repo]; found {
+				if meta.Attached != "" {
+					o.repo = file.repo
+				} else {
+					o.repo, o.rel = gitRemoteRepo(meta.dir())
+				}
+			}
+			origins[file.repo] = o
+		}
+		if o.repo != "" {
+			keys[remoteFileKey(o.repo, path.Join(o.rel, file.name))] = true
+		}
+	}
+	return keys
+}
+
+// localRepos returns the keys of the repositories with a local index, by the
+// repository name of attached shards or the origin remote of the checkout
+func (m *IndexManager) localRepos(ctx context.Context) map[string]bool {
+	repos := make(map[string]bool)
+	for prefix, meta := range m.visibleMetadata(ctx) {
+		repo := ""
+		if meta.Attached != "" {
+			repo = meta.shardPrefix(prefix)
+		} else {
+			repo, _ = gitRemoteRepo(meta.dir())
+		}
+		if repo != "" {
+			repos[remoteFileKey(repo, "")] = true
+		}
+	}
+	return repos
+}
+
+// remoteFileKey identifies a file across backends by its repository and
+// path, ignoring URL schemes, .git suffixes and case in the repository name
+func remoteFileKey(repository string, name string) string {
+	repository = strings.ToLower(normalizeRepoName(repository))
+	return path.Join(repository, strings.TrimPrefix(name, "/"))
+}
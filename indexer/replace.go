@@ -0,0 +1,376 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// diffContext is the number of unchanged lines around each change of a diff
+const diffContext = 3
+
+// ReplaceOptions narrows down the files a replacement is previewed for
+type ReplaceOptions struct {
+	Filter   string // Search query the files must match as well
+	Language string // Only replace in files of this language (name or alias)
+	MaxFiles int    // Maximum number of file diffs to return (default: 20)
+}
+
+// ReplacePreview is the outcome of a replacement, without writing files
+type ReplacePreview struct {
+	Files        int    // Files that would change
+	Replacements int    // Matches that would be replaced
+	ShownFiles   int    // Files in Diff
+	Diff         string // Unified diff of the shown files
+}
+
+// lineChange replaces lines of a file
+type lineChange struct {
+	start, end int      // Replaced lines, 0-based with end exclusive
+	lines      []string // Replacement lines
+}
+
+// PreviewReplace returns a unified diff of replacing every match of the
+// regular expression pattern with replacement in the files of the index of
+// sourceDir, or of all indexes. replacement may refer to submatches as $1 or
+// ${name}. The files are read from the index and are not changed.
+func (m *IndexManager) PreviewReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ReplaceOptions) (*ReplacePreview, error) {
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 20
+	}
+	re, q, err := m.replaceQuery(ctx, sourceDir, pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &ReplacePreview{}
+	var diff strings.Builder
+	err = m.wholeFiles(ctx, sourceDir, q, func(path string, content []byte) {
+		changes, replaced := replaceLines(re, replacement, string(content))
+		if replaced == 0 {
+			return
+		}
+		preview.Files++
+		preview.Replacements += replaced
+		if preview.ShownFiles < opts.MaxFiles {
+			preview.ShownFiles++
+			writeUnifiedDiff(&diff, path, string(content), changes)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	preview.Diff = diff.String()
+	return preview, nil
+}
+
+// replaceQuery compiles the pattern of a replacement and returns it with
+// the query for the files it may change
+func (m *IndexManager) replaceQuery(ctx context.Context, sourceDir string, pattern string, opts ReplaceOptions) (*regexp.Regexp, query.Q, error) {
+	if pattern == "" {
+		return nil, nil, errors.New("the pattern is empty")
+	}
+
+	// ^ and $ match at line boundaries, as in search_code
+	re, err := regexp.Compile("(?m)" + pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	parsedRe, err := syntax.Parse("(?m)"+pattern, syntax.Perl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	// Only files matching the pattern and the filter change
+	var q query.Q = &query.Regexp{Regexp: parsedRe, Content: true, CaseSensitive: true}
+	if opts.Filter != "" || opts.Language != "" {
+		prefixes, err := m.indexPrefixes(ctx, sourceDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		parsed, err := m.parseSearchQuery(opts.Filter, SearchOptions{Language: opts.Language}, m.visibleMetadata(ctx), prefixes, prefixes)
+		if err != nil {
+			return nil, nil, err
+		}
+		q = query.NewAnd(q, parsed.q)
+	}
+	return re, q, nil
+}
+
+// ApplyOptions narrows down the files a replacement is applied to and
+// limits what it may change
+type ApplyOptions struct {
+	Filter     string // Search query the files must match as well
+	Language   string // Only replace in files of this language (name or alias)
+	MaxFiles   int    // Refuse to replace if more files would change (default: 20)
+	MaxPerFile int    // Skip files with more replacements than this (default: 100)
+	// Force replaces beyond the limits, in files changed since they were
+	// indexed, and overwrites existing backups
+	Force bool
+}
+
+// ReplacedFile is a file changed by ApplyReplace
+type ReplacedFile struct {
+	Path         string `json:"path"`
+	Replacements int    `json:"replacements"`
+	Backup       string `json:"backup"` // Copy of the file before the replacement
+}
+
+// SkippedFile is a file ApplyReplace left unchanged, and why
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// ReplaceResult is the outcome of ApplyReplace
+type ReplaceResult struct {
+	Replaced []ReplacedFile `json:"replaced,omitempty"`
+	Skipped  []SkippedFile  `json:"skipped,omitempty"`
+}
+
+// plannedFile is a file a replacement is about to change
+type plannedFile struct {
+	path    string
+	content []byte // As indexed
+	count   int
+}
+
+// ApplyReplace replaces every match of pattern with replacement, as
+// previewed by PreviewReplace, in the source files. Each file is copied to
+// <file>.orig first. Files changed since they were indexed are skipped, so
+// what is replaced is what was previewed. If more than maxParsedFiles files
+// match, nothing is replaced, even with Force, as not every match could be.
+func (m *IndexManager) ApplyReplace(ctx context.Context, sourceDir string, pattern string, replacement string, opts ApplyOptions) (*ReplaceResult, error) {
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 20
+	}
+	if opts.MaxPerFile <= 0 {
+		opts.MaxPerFile = 100
+	}
+	re, q, err := m.replaceQuery(ctx, sourceDir, pattern, ReplaceOptions{Filter: opts.Filter, Language: opts.Language})
+	if err != nil {
+		return nil, err
+	}
+
+	var planned []plannedFile
+	truncated, err := m.wholeFilesUpTo(ctx, sourceDir, q, maxParsedFiles, func(path string, content []byte) {
+		if _, replaced := replaceLines(re, replacement, string(content)); replaced > 0 {
+			planned = append(planned, plannedFile{path: path, content: content, count: replaced})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		return nil, fmt.Errorf("the pattern matches more than %d files, more than a replacement can change at once; narrow it down with a filter or language", maxParsedFiles)
+	}
+	if len(planned) > opts.MaxFiles && !opts.Force {
+		return nil, fmt.Errorf("the replacement would change %d files, more than the limit of %d; narrow it down or raise the limit", len(planned), opts.MaxFiles)
+	}
+
+	result := &ReplaceResult{}
+	for _, file := range planned {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if file.count > opts.MaxPerFile && !opts.Force {
+			result.Skipped = append(result.Skipped, SkippedFile{Path: file.path, Reason: fmt.Sprintf("%d replacements, more than the limit of %d per file", file.count, opts.MaxPerFile)})
+			continue
+		}
+		backup, err := replaceInFile(re, replacement, file, opts.Force)
+		if err != nil {
+			result.Skipped = append(result.Skipped, SkippedFile{Path: file.path, Reason: err.Error()})
+			continue
+		}
+		result.Replaced = append(result.Replaced, ReplacedFile{Path: file.path, Replacements: file.count, Backup: backup})
+	}
+	return result, nil
+}
+
+// replaceInFile applies a replacement to a source file after backing it
+// up, returning the path of the backup
+func replaceInFile(re *regexp.Regexp, replacement string, file plannedFile, force bool) (string, error) {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	content, err := os.ReadFile(file.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	if !bytes.Equal(content, file.content) && !force {
+		return "", errors.New("changed since it was indexed; re-index it and preview again")
+	}
+
+	// Never overwrite the backup of an earlier replacement unless forced
+	backup := file.path + ".orig"
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(backup, flags, info.Mode().Perm())
+	if errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("backup %s already exists; remove it first", backup)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	replaced := re.ReplaceAll(content, []byte(replacement))
+	if err := os.WriteFile(file.path, replaced, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	return backup, nil
+}
+
+// replaceLines replaces the matches of re in content, returning the changed
+// lines and the number of replacements. Matches on the same or adjacent
+// lines form one change.
+func replaceLines(re *regexp.Regexp, replacement string, content string) ([]lineChange, int) {
+	matches := re.FindAllStringSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return nil, 0
+	}
+
+	// Offsets at which lines start
+	lineStarts := []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	lineOf := func(offset int) int {
+		lo, hi := 0, len(lineStarts)-1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			if lineStarts[mid] <= offset {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		return lo
+	}
+	lineEnd := func(line int) int {
+		if line+1 < len(lineStarts) {
+			return lineStarts[line+1] - 1
+		}
+		return len(content)
+	}
+
+	var changes []lineChange
+	replaced := 0
+	for i := 0; i < len(matches); {
+		// A change runs from the line a match starts on to the line it ends
+		// on, and takes in the matches starting on or right after those
+		start := lineOf(matches[i][0])
+		end := start + 1
+		var text []byte
+		offset := lineStarts[start]
+		for ; i < len(matches) && lineOf(matches[i][0]) <= end; i++ {
+			match := matches[i]
+			end = max(end, lineOf(match[1])+1)
+			text = append(text, content[offset:match[0]]...)
+			text = re.ExpandString(text, replacement, content, match)
+			offset = match[1]
+			replaced++
+		}
+		text = append(text, content[offset:lineEnd(end-1)]...)
+
+		// Leave out the lines the replacement kept
+		oldLines := strings.Split(content[lineStarts[start]:lineEnd(end-1)], "\n")
+		newLines := strings.Split(string(text), "\n")
+		for len(oldLines) > 0 && len(newLines) > 0 && oldLines[0] == newLines[0] {
+			oldLines, newLines = oldLines[1:], newLines[1:]
+			start++
+		}
+		for len(oldLines) > 0 && len(newLines) > 0 && oldLines[len(oldLines)-1] == newLines[len(newLines)-1] {
+			oldLines, newLines = oldLines[:len(oldLines)-1], newLines[:len(newLines)-1]
+			end--
+		}
+		if len(oldLines) > 0 || len(newLines) > 0 {
+			changes = append(changes, lineChange{start: start, end: end, lines: newLines})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, 0
+	}
+	return changes, replaced
+}
+
+// writeUnifiedDiff writes the diff of applying changes to the lines of a
+// file, with diffContext lines of context and nearby changes in one hunk
+func writeUnifiedDiff(b *strings.Builder, path string, content string, changes []lineChange) {
+	fmt.Fprintf(b, "--- %s\n+++ %s\n", path, path)
+	lines := strings.Split(content, "\n")
+	contextEnd := len(lines)
+	if strings.HasSuffix(content, "\n") {
+		// The newline ending the file doesn't start another line
+		contextEnd--
+	}
+	shift := 0 // Lines added minus lines removed before the hunk
+	for i := 0; i < len(changes); {
+		// Take the changes whose context overlaps
+		j := i + 1
+		for j < len(changes) && changes[j].start-changes[j-1].end <= 2*diffContext {
+			j++
+		}
+		first := max(changes[i].start-diffContext, 0)
+		last := max(min(changes[j-1].end+diffContext, contextEnd), changes[j-1].end)
+
+		var body []string
+		oldCount, newCount := 0, 0
+		pos := first
+		for _, change := range changes[i:j] {
+			for ; pos < change.start; pos++ {
+				body = append(body, " "+lines[pos])
+			}
+			for ; pos < change.end; pos++ {
+				body = append(body, "-"+lines[pos])
+			}
+			for _, line := range change.lines {
+				body = append(body, "+"+line)
+			}
+			oldCount += change.end - change.start
+			newCount += len(change.lines)
+		}
+		for ; pos < last; pos++ {
+			body = append(body, " "+lines[pos])
+		}
+		unchanged := (last - first) - oldCount
+		oldCount += unchanged
+		newCount += unchanged
+
+		fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(first, oldCount), hunkRange(first+shift, newCount))
+		for _, line := range body {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+		shift += newCount - oldCount
+		i = j
+	}
+}
+
+// hunkRange formats the start and length of a hunk, counting lines from 1
+// and from the line before an empty range
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// indexFiles writes n files containing old to a new directory, indexes it
+// and returns the manager and the directory
+func indexFiles(t *testing.T, n int) (*IndexManager, string) {
+	t.Helper()
+	src := t.TempDir()
+	for i := range n {
+		path := filepath.Join(src, fmt.Sprintf("file%d.go", i))
+		if err := os.WriteFile(path, []byte("package p\n\nconst name = \"old\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewIndexManager(t.TempDir())
+	if err := m.IndexDirectory(context.Background(), src); err != nil {
+		t.Fatalf("IndexDirectory: %v", err)
+	}
+	return m, src
+}
+
+// unchangedFiles returns how many of the n files written by indexFiles
+// still contain old
+func unchangedFiles(t *testing.T, src string, n int) int {
+	t.Helper()
+	unchanged := 0
+	for i := range n {
+		content, err := os.ReadFile(filepath.Join(src, fmt.Sprintf("file%d.go", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) == "package p\n\nconst name = \"old\"\n" {
+			unchanged++
+		}
+	}
+	return unchanged
+}
+
+func TestApplyReplaceAtFileLimit(t *testing.T) {
+	m, src := indexFiles(t, maxParsedFiles)
+
+	result, err := m.ApplyReplace(context.Background(), src, `"old"`, `"new"`, ApplyOptions{Force: true})
+	if err != nil {
+		t.Fatalf("ApplyReplace: %v", err)
+	}
+	if len(result.Replaced) != maxParsedFiles {
+		t.Errorf("replaced %d files, want %d", len(result.Replaced), maxParsedFiles)
+	}
+	if n := unchangedFiles(t, src, maxParsedFiles); n != 0 {
+		t.Errorf("%d files were left unchanged", n)
+	}
+}
+
+func TestApplyReplaceBeyondFileLimit(t *testing.T) {
+	files := maxParsedFiles + 1
+	m, src := indexFiles(t, files)
+
+	// Replacing only the first files found would silently miss the others,
+	// so nothing is replaced, even with force
+	result, err := m.ApplyReplace(context.Background(), src, `"old"`, `"new"`, ApplyOptions{Force: true})
+	if err == nil {
+		t.Fatalf("ApplyReplace of %d files succeeded with %d files replaced, want an error", files, len(result.Replaced))
+	}
+	if n := unchangedFiles(t, src, files); n != files {
+		t.Errorf("%d of %d files were changed", files-n, files)
+	}
+}
@@ -0,0 +1,138 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+	"gopkg.in/yaml.v3"
+)
+
+// Resource is a Kubernetes object declared in a YAML manifest, or a
+// resource, data source or module call declared in a Terraform file
+type Resource struct {
+	Kind      string `json:"kind"`                // e.g. Deployment, aws_s3_bucket, data.aws_iam_policy or module
+	Name      string `json:"name"`                // metadata.name, or the Terraform block label
+	Namespace string `json:"namespace,omitempty"` // Kubernetes namespace, if set
+	Source    string `json:"source,omitempty"`    // Source of a Terraform module call
+	Module    string `json:"module,omitempty"`    // Directory of the Terraform module declaring it
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+}
+
+// resourceDocuments are the files that may declare resources
+var resourceDocuments = query.NewOr(
+	query.NewAnd(
+		mustRegexpQuery(`\.ya?ml$`, true),
+		mustRegexpQuery(`(?m)^kind:`, false),
+	),
+	mustRegexpQuery(`\.tf$`, true),
+)
+
+// terraformBlock matches the start of a Terraform resource, data source or
+// module block
+var terraformBlock = regexp.MustCompile(`^\s*(resource|data)\s+"([^"]+)"\s+"([^"]+)"\s*\{|^\s*module\s+"([^"]+)"\s*\{`)
+
+// terraformSource matches the source argument of a module block
+var terraformSource = regexp.MustCompile(`^\s*source\s*=\s*"([^"]*)"`)
+
+// FindResources returns the Kubernetes objects and Terraform resources of
+// the index of sourceDir, or of all indexes, of kind whose name contains
+// name, ignoring case. Either may be empty to match any.
+func (m *IndexManager) FindResources(ctx context.Context, sourceDir string, kind string, name string) ([]Resource, error) {
+	if kind == "" && name == "" {
+		return nil, errors.New("either a kind or a name is needed")
+	}
+	q := resourceDocuments
+	for _, text := range []string{strings.TrimPrefix(kind, "data."), name} {
+		if text != "" {
+			q = query.NewAnd(q, &query.Substring{Pattern: text, Content: true})
+		}
+	}
+
+	var found []Resource
+	err := m.wholeFiles(ctx, sourceDir, q, func(path string, content []byte) {
+		var resources []Resource
+		if strings.HasSuffix(path, ".tf") {
+			resources = parseTerraform(path, string(content))
+		} else {
+			resources = parseKubernetes(path, content)
+		}
+		for _, resource := range resources {
+			if kind != "" && !strings.EqualFold(resource.Kind, kind) {
+				continue
+			}
+			if name != "" && !containsFold(resource.Name, name) {
+				continue
+			}
+			found = append(found, resource)
+		}
+	})
+	return found, err
+}
+
+// parseKubernetes returns the objects of the documents of a YAML manifest
+// that have a kind and a metadata.name. Parsing stops at a document that is
+// not valid YAML, such as a Helm template.
+func parseKubernetes(file string, content []byte) []Resource {
+	var resources []Resource
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			break
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		root := doc.Content[0]
+		kind := mappingValue(root, "kind")
+		metadata := mappingValue(root, "metadata")
+		name := mappingValue(metadata, "name")
+		if kind == nil || name == nil {
+			continue
+		}
+		resource := Resource{Kind: kind.Value, Name: name.Value, File: file, Line: kind.Line}
+		if namespace := mappingValue(metadata, "namespace"); namespace != nil {
+			resource.Namespace = namespace.Value
+		}
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+// parseTerraform returns the resource, data and module blocks of a
+// Terraform file. Every directory of .tf files is a module.
+func parseTerraform(file string, content string) []Resource {
+	var resources []Resource
+	module := filepath.Dir(file)
+	inModule := -1 // Index of the module block being read, for its source
+	for i, line := range strings.Split(content, "\n") {
+		if match := terraformBlock.FindStringSubmatch(line); match != nil {
+			resource := Resource{Module: module, File: file, Line: i + 1}
+			switch match[1] {
+			case "resource":
+				resource.Kind, resource.Name = match[2], match[3]
+			case "data":
+				resource.Kind, resource.Name = "data."+match[2], match[3]
+			default:
+				resource.Kind, resource.Name = "module", match[4]
+			}
+			resources = append(resources, resource)
+			inModule = -1
+			if resource.Kind == "module" {
+				inModule = len(resources) - 1
+			}
+			continue
+		}
+		if match := terraformSource.FindStringSubmatch(line); match != nil && inModule >= 0 {
+			resources[inModule].Source = match[1]
+			inModule = -1
+		}
+	}
+	return resources
+}
@@ -0,0 +1,338 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SetSchedule sets the cron expression used to re-index sourceDir
+// automatically while a Scheduler is running. An empty schedule removes it.
+func (m *IndexManager) SetSchedule(ctx context.Context, sourceDir string, schedule string) error {
+	if sourceDir == "" {
+		return fmt.Errorf("a directory is required")
+	}
+	if schedule != "" {
+		if _, err := ParseCron(schedule); err != nil {
+			return err
+		}
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return err
+	}
+
+	return m.updateMetadata(prefixes[0], func(meta *indexMetadata) {
+		meta.Schedule = schedule
+	})
+}
+
+// Scheduler re-indexes directories according to their schedules, and
+// watched directories when their files change. Due directories are queued
+// and indexed one at a time.
+type Scheduler struct {
+	manager *IndexManager
+	jobs    chan string
+
+	mu      sync.Mutex
+	queued  map[string]bool // Source directories waiting or being indexed
+	running string          // Source directory being indexed, if any
+	rerun   map[string]bool // Source directories changed while being indexed
+	paused  bool
+	resumed chan struct{} // Closed when a pause ends
+
+	// deferOnBattery holds queued re-indexes while on battery power
+	deferOnBattery bool
+	deferred       bool
+
+	// compressAfter is how long an index may go unsearched before its
+	// shards are compressed; zero disables compression
+	compressAfter time.Duration
+	compressing   bool
+
+	// watched maps the local roots of watched directories to their source
+	// directories; watchSync asks the watch goroutine to update them
+	watched   map[string]string
+	watchSync chan struct{}
+}
+
+// powerPollInterval is how often a deferred re-index rechecks the power state
+const powerPollInterval = time.Minute
+
+// SchedulerStatus describes what the scheduler is doing
+type SchedulerStatus struct {
+	Paused  bool     `json:"paused"`
+	Running string   `json:"running,omitempty"`
+	Queued  []string `json:"queued,omitempty"`
+	Watched []string `json:"watched,omitempty"` // Directories re-indexed when their files change
+	// Queued re-indexes are waiting for the machine to leave battery power
+	DeferredOnBattery bool `json:"deferred_on_battery,omitempty"`
+}
+
+// NewScheduler creates a scheduler for the indexes of manager
+func NewScheduler(manager *IndexManager) *Scheduler {
+	return &Scheduler{
+		manager: manager,
+		jobs:    make(chan string, 64),
+		queued:  make(map[string]bool),
+		rerun:   make(map[string]bool),
+
+		watchSync: make(chan struct{}, 1),
+
+		deferOnBattery: true,
+	}
+}
+
+// SetDeferOnBattery controls whether queued re-indexes wait while the
+// machine runs on battery or in a low power mode. It is enabled by default.
+func (s *Scheduler) SetDeferOnBattery(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deferOnBattery = enabled
+}
+
+// SetCompressAfter enables hourly compression of indexes that have not been
+// searched for d. Zero disables it.
+func (s *Scheduler) SetCompressAfter(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compressAfter = d
+}
+
+// Run checks the schedules at the start of every minute and re-indexes due
+// and changed watched directories until ctx is cancelled. Indexes with stale
+// shards are rebuilt when it starts.
+func (s *Scheduler) Run(ctx context.Context) {
+	go s.work(ctx)
+	go s.watch(ctx)
+	s.enqueueStale()
+
+	for {
+		// Wake up at the next minute boundary
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case tick := <-timer.C:
+			s.enqueueDue(tick)
+			// Watching may have been turned on by another process
+			s.SyncWatches()
+			if tick.Minute() == 0 {
+				s.compressCold(ctx)
+			}
+		}
+	}
+}
+
+// enqueueStale queues a rebuild of the directories whose shards the linked
+// Zoekt version cannot use as they are, e.g. after an upgrade
+func (s *Scheduler) enqueueStale() {
+	dirs, err := s.manager.MarkStaleIndexes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to check shard versions: %v\n", err)
+		return
+	}
+	for _, dir := range dirs {
+		fmt.Fprintf(os.Stderr, "Rebuilding the index of %s: its shards are stale\n", dir)
+		s.enqueue(dir)
+	}
+}
+
+// enqueueDue queues every directory whose schedule fires at t
+func (s *Scheduler) enqueueDue(t time.Time) {
+	for _, meta := range s.manager.loadAllMetadata() {
+		if meta.Schedule == "" {
+			continue
+		}
+		schedule, err := ParseCron(meta.Schedule)
+		if err != nil || !schedule.Matches(t) {
+			continue
+		}
+		// Skipped if the previous run has not finished yet
+		s.enqueue(meta.SourceDir)
+	}
+}
+
+// enqueue queues a re-index of sourceDir unless one is queued or running
+func (s *Scheduler) enqueue(sourceDir string) {
+	s.mu.Lock()
+	if s.queued[sourceDir] {
+		s.mu.Unlock()
+		return
+	}
+	s.queued[sourceDir] = true
+	s.mu.Unlock()
+
+	select {
+	case s.jobs <- sourceDir:
+	default:
+		s.mu.Lock()
+		delete(s.queued, sourceDir)
+		s.mu.Unlock()
+	}
+}
+
+// work re-indexes queued directories one at a time. A build of the same
+// directory started elsewhere finishes first, as IndexDirectory waits for it.
+func (s *Scheduler) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sourceDir := <-s.jobs:
+			if !s.waitUntilReady(ctx) {
+				return
+			}
+			s.mu.Lock()
+			s.running = sourceDir
+			s.mu.Unlock()
+
+			if err := s.manager.IndexDirectory(ctx, sourceDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: scheduled re-index of %s failed: %v\n", sourceDir, err)
+			}
+			s.mu.Lock()
+			delete(s.queued, sourceDir)
+			s.running = ""
+			rerun := s.rerun[sourceDir]
+			delete(s.rerun, sourceDir)
+			s.mu.Unlock()
+			if rerun {
+				s.enqueue(sourceDir)
+			}
+		}
+	}
+}
+
+// compressCold compresses cold indexes in the background unless the
+// scheduler is paused, deferring on battery or already compressing
+func (s *Scheduler) compressCold(ctx context.Context) {
+	s.mu.Lock()
+	idle := s.compressAfter
+	skip := idle <= 0 || s.paused || s.compressing || (s.deferOnBattery && onBatteryPower())
+	if !skip {
+		s.compressing = true
+	}
+	s.mu.Unlock()
+	if skip {
+		return
+	}
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.compressing = false
+			s.mu.Unlock()
+		}()
+		if _, err := s.manager.CompressColdIndexes(ctx, idle); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Warning: compressing cold indexes failed: %v\n", err)
+		}
+	}()
+}
+
+// Pause stops queued re-indexes from starting until Resume is called.
+// Schedules that fire meanwhile are queued and run once after resuming. A
+// re-index that is already running is allowed to finish, since stopping it
+// midway would leave the directory without an index.
+func (s *Scheduler) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.paused {
+		s.paused = true
+		s.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets queued re-indexes run again
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		s.paused = false
+		close(s.resumed)
+	}
+}
+
+// Status returns whether the scheduler is paused and which directories are
+// running or queued
+func (s *Scheduler) Status() SchedulerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SchedulerStatus{
+		Paused:            s.paused,
+		Running:           s.running,
+		DeferredOnBattery: s.deferred,
+	}
+	for sourceDir := range s.queued {
+		if sourceDir != s.running {
+			status.Queued = append(status.Queued, sourceDir)
+		}
+	}
+	sort.Strings(status.Queued)
+	for root := range s.watched {
+		status.Watched = append(status.Watched, root)
+	}
+	sort.Strings(status.Watched)
+	return status
+}
+
+// waitUntilReady blocks while the scheduler is paused or, if enabled, the
+// machine is on battery power. It returns false if ctx is cancelled first.
+func (s *Scheduler) waitUntilReady(ctx context.Context) bool {
+	defer func() {
+		s.mu.Lock()
+		s.deferred = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		if !s.waitWhilePaused(ctx) {
+			return false
+		}
+
+		s.mu.Lock()
+		deferOnBattery := s.deferOnBattery
+		s.mu.Unlock()
+		if !deferOnBattery || !onBatteryPower() {
+			return true
+		}
+
+		s.mu.Lock()
+		s.deferred = true
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(powerPollInterval):
+		}
+	}
+}
+
+// waitWhilePaused blocks until the scheduler is not paused. It returns false
+// if ctx is cancelled first.
+func (s *Scheduler) waitWhilePaused(ctx context.Context) bool {
+	for {
+		s.mu.Lock()
+		if !s.paused {
+			s.mu.Unlock()
+			return true
+		}
+		resumed := s.resumed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-resumed:
+		}
+	}
+}
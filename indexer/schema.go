@@ -0,0 +1,251 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// maxParsedFiles caps the candidate files parsed per structural lookup
+const maxParsedFiles = 500
+
+// Endpoint is an API operation declared in an OpenAPI document, or an rpc
+// (and its HTTP mapping) declared in a .proto file
+type Endpoint struct {
+	Method      string `json:"method"` // HTTP method, or RPC for gRPC methods
+	Path        string `json:"path"`   // Route path, or /package.Service/Method
+	OperationID string `json:"operation_id,omitempty"`
+	Summary     string `json:"summary,omitempty"`
+	File        string `json:"file"`
+	Line        int    `json:"line"`
+}
+
+// SchemaMessage is a protobuf message or enum, or an OpenAPI schema
+type SchemaMessage struct {
+	Name   string        `json:"name"` // Fully qualified for protobuf
+	Kind   string        `json:"kind"` // message, enum or schema
+	File   string        `json:"file"`
+	Line   int           `json:"line"`
+	Fields []SchemaField `json:"fields,omitempty"`
+}
+
+// SchemaField is a field of a message, a value of an enum or a property of
+// a schema
+type SchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Line int    `json:"line"`
+}
+
+// schemaDocuments are the files that may declare endpoints or messages
+var schemaDocuments = query.NewOr(
+	mustRegexpQuery(`\.proto$`, true),
+	query.NewAnd(
+		mustRegexpQuery(`\.(ya?ml|json)$`, true),
+		mustRegexpQuery(`(?m)^\s*\{?\s*"?(openapi|swagger)"?\s*:`, false),
+	),
+)
+
+// mustRegexpQuery returns a case insensitive query matching pattern against
+// file names or content
+func mustRegexpQuery(pattern string, fileName bool) query.Q {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		panic(err)
+	}
+	return &query.Regexp{Regexp: re, FileName: fileName, Content: !fileName}
+}
+
+// FindEndpoints returns the endpoints declared in OpenAPI documents and
+// .proto files of the index of sourceDir, or of all indexes, whose path or
+// operation ID contains text, ignoring case. method limits them to an HTTP
+// method, or RPC for gRPC methods.
+func (m *IndexManager) FindEndpoints(ctx context.Context, sourceDir string, text string, method string) ([]Endpoint, error) {
+	if text == "" && method == "" {
+		return nil, errors.New("either text to search for or a method is needed")
+	}
+	files, err := m.schemaFiles(ctx, sourceDir, text)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Endpoint
+	for _, file := range files {
+		for _, endpoint := range file.endpoints {
+			if method != "" && !strings.EqualFold(endpoint.Method, method) {
+				continue
+			}
+			if text != "" && !containsFold(endpoint.Path, text) && !containsFold(endpoint.OperationID, text) {
+				continue
+			}
+			found = append(found, endpoint)
+		}
+	}
+	return found, nil
+}
+
+// FindMessages returns the protobuf messages and enums and OpenAPI schemas
+// of the index of sourceDir, or of all indexes, whose name contains name
+// and that have a field containing field, ignoring case. With field, only
+// the matching fields are returned.
+func (m *IndexManager) FindMessages(ctx context.Context, sourceDir string, name string, field string) ([]SchemaMessage, error) {
+	if name == "" && field == "" {
+		return nil, errors.New("either a name or a field is needed")
+	}
+	candidate := name
+	if field != "" {
+		candidate = field
+	}
+	files, err := m.schemaFiles(ctx, sourceDir, candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []SchemaMessage
+	for _, file := range files {
+		for _, message := range file.messages {
+			if name != "" && !containsFold(message.Name, name) {
+				continue
+			}
+			if field != "" {
+				var fields []SchemaField
+				for _, f := range message.Fields {
+					if containsFold(f.Name, field) {
+						fields = append(fields, f)
+					}
+				}
+				if fields == nil {
+					continue
+				}
+				message.Fields = fields
+			}
+			found = append(found, message)
+		}
+	}
+	return found, nil
+}
+
+// schemaFile holds what a spec or .proto file declares
+type schemaFile struct {
+	messages  []SchemaMessage
+	endpoints []Endpoint
+}
+
+// schemaFiles parses the OpenAPI documents and .proto files of the index of
+// sourceDir, or of all indexes, that mention text
+func (m *IndexManager) schemaFiles(ctx context.Context, sourceDir string, text string) ([]schemaFile, error) {
+	q := schemaDocuments
+	if text != "" {
+		q = query.NewAnd(q, &query.Substring{Pattern: text, Content: true})
+	}
+	var files []schemaFile
+	err := m.wholeFiles(ctx, sourceDir, q, func(path string, content []byte) {
+		var file schemaFile
+		if strings.HasSuffix(path, ".proto") {
+			file.messages, file.endpoints = parseProto(path, string(content))
+		} else {
+			file.messages, file.endpoints = parseOpenAPI(path, content)
+		}
+		files = append(files, file)
+	})
+	return files, err
+}
+
+// wholeFiles calls f with the path and content of up to maxParsedFiles files
+// of the index of sourceDir, or of all indexes, that match q. The index
+// narrows the files down before they are parsed.
+func (m *IndexManager) wholeFiles(ctx context.Context, sourceDir string, q query.Q, f func(path string, content []byte)) error {
+	_, err := m.wholeFilesUpTo(ctx, sourceDir, q, maxParsedFiles, f)
+	return err
+}
+
+// wholeFilesUpTo is like wholeFiles for up to limit files, and reports
+// whether more files matched than f was called with
+func (m *IndexManager) wholeFilesUpTo(ctx context.Context, sourceDir string, q query.Q, limit int, f func(path string, content []byte)) (bool, error) {
+	// One file more than the limit tells whether there are more
+	result, repos, err := m.searchIndexes(ctx, sourceDir, q, &zoekt.SearchOptions{Whole: true, MaxDocDisplayCount: limit + 1})
+	if err != nil {
+		return false, err
+	}
+	files := result.Files
+	truncated := len(files) > limit || result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	for _, fileMatch := range files {
+		// Chunks of large files cannot be parsed on their own
+		if name, _ := splitChunkName(fileMatch.FileName); name != fileMatch.FileName {
+			continue
+		}
+		f(resultPath(fileMatch, repos), fileMatch.Content)
+	}
+	return truncated, nil
+}
+
+// searchIndexes runs q on the index of sourceDir, or on all indexes, and
+// returns the result with the metadata to name its files by
+func (m *IndexManager) searchIndexes(ctx context.Context, sourceDir string, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, map[string]*indexMetadata, error) {
+	var result *zoekt.SearchResult
+	var repos map[string]*indexMetadata
+	err := m.withSearcher(ctx, sourceDir, func(searcher zoekt.Searcher, scope query.Q, metadata map[string]*indexMetadata) error {
+		var err error
+		result, err = searcher.Search(ctx, query.NewAnd(q, scope), opts)
+		if err != nil {
+			return fmt.Errorf("search failed: %w", err)
+		}
+		repos = metadata
+		return nil
+	})
+	return result, repos, err
+}
+
+// withSearcher calls f with a searcher of the loaded index directory, the
+// query limiting it to the index of sourceDir or to all indexes, and the
+// metadata to name the files by, for running several searches
+func (m *IndexManager) withSearcher(ctx context.Context, sourceDir string, f func(searcher zoekt.Searcher, scope query.Q, repos map[string]*indexMetadata) error) error {
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return err
+	}
+	metadata := m.visibleMetadata(ctx)
+	m.markSearched(prefixes, metadata)
+	if err := m.decompressIndexes(prefixes, metadata); err != nil {
+		return err
+	}
+
+	// Name the files after the directories searched
+	repos := shardView(metadata)
+	var shardRepos []string
+	for _, prefix := range prefixes {
+		shardPrefix := metadata[prefix].shardPrefix(prefix)
+		repos[shardPrefix] = metadata[prefix]
+		shardRepos = append(shardRepos, shardPrefix)
+	}
+
+	searchDir, err := m.searchDir()
+	if err != nil {
+		return err
+	}
+	_, release, err := m.searchLimiter.acquire(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+	searcher, _, err := m.openSearcher(searchDir)
+	if err != nil {
+		return err
+	}
+	defer searcher.Close()
+
+	return f(searcher, query.NewRepoSet(shardRepos...), repos)
+}
+
+// containsFold reports whether substr is within s, ignoring case
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
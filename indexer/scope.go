@@ -0,0 +1,211 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sourcegraph/zoekt"
+)
+
+// Syntax scopes of SearchOptions.Scope
+const (
+	ScopeComments = "comments" // Only matches inside comments
+	ScopeStrings  = "strings"  // Only matches inside string literals
+)
+
+// scopeCandidates is how many matching files a scoped search fetches to
+// filter, as the matches of many can be outside the scope
+const scopeCandidates = 200
+
+// stringDelimiter delimits string literals of a language
+type stringDelimiter struct {
+	delim     string
+	raw       bool // Backslashes do not escape
+	multiline bool // The literal may span lines
+}
+
+// languageSyntax describes where the comments and strings of a language
+// are, enough to tell whether a match is inside one
+type languageSyntax struct {
+	block   [][2]string       // Block comment delimiters, checked first
+	line    []string          // Line comment starts
+	strings []stringDelimiter // Longest delimiters first
+}
+
+var (
+	doubleQuoted = stringDelimiter{delim: `"`}
+	singleQuoted = stringDelimiter{delim: `'`}
+	tripleQuoted = []stringDelimiter{{delim: `"""`, multiline: true}, {delim: `'''`, multiline: true}}
+
+	cLike      = languageSyntax{block: [][2]string{{"/*", "*/"}}, line: []string{"//"}, strings: []stringDelimiter{doubleQuoted, singleQuoted}}
+	jsLike     = languageSyntax{block: cLike.block, line: cLike.line, strings: []stringDelimiter{doubleQuoted, singleQuoted, {delim: "`", multiline: true}}}
+	jvmLike    = languageSyntax{block: cLike.block, line: cLike.line, strings: []stringDelimiter{tripleQuoted[0], doubleQuoted, singleQuoted}}
+	hashLike   = languageSyntax{line: []string{"#"}, strings: []stringDelimiter{doubleQuoted, singleQuoted}}
+	markupLike = languageSyntax{block: [][2]string{{"<!--", "-->"}}}
+)
+
+// syntaxByLanguage maps the language names of the index to their syntax
+var syntaxByLanguage = map[string]languageSyntax{
+	"C":           cLike,
+	"C++":         cLike,
+	"C#":          cLike,
+	"Java":        cLike,
+	"Objective-C": cLike,
+	"Dart":        cLike,
+	"Go":          {block: cLike.block, line: cLike.line, strings: []stringDelimiter{doubleQuoted, singleQuoted, {delim: "`", raw: true, multiline: true}}},
+	"Rust":        {block: cLike.block, line: cLike.line, strings: []stringDelimiter{doubleQuoted}}, // ' also starts lifetimes
+	"JavaScript":  jsLike,
+	"TypeScript":  jsLike,
+	"TSX":         jsLike,
+	"Kotlin":      jvmLike,
+	"Scala":       jvmLike,
+	"Swift":       jvmLike,
+	"Groovy":      jvmLike,
+	"PHP":         {block: cLike.block, line: []string{"//", "#"}, strings: cLike.strings},
+	"CSS":         {block: cLike.block, strings: cLike.strings},
+	"SCSS":        cLike,
+	"Python":      {line: []string{"#"}, strings: append(tripleQuoted, doubleQuoted, singleQuoted)},
+	"Ruby":        {block: [][2]string{{"=begin", "=end"}}, line: []string{"#"}, strings: hashLike.strings},
+	"Shell":       {line: []string{"#"}, strings: []stringDelimiter{{delim: `"`, multiline: true}, {delim: `'`, raw: true, multiline: true}}},
+	"PowerShell":  {block: [][2]string{{"<#", "#>"}}, line: []string{"#"}, strings: hashLike.strings},
+	"Perl":        hashLike,
+	"R":           hashLike,
+	"Elixir":      {line: []string{"#"}, strings: append(tripleQuoted[:1:1], doubleQuoted, singleQuoted)},
+	"YAML":        hashLike,
+	"TOML":        {line: []string{"#"}, strings: append(tripleQuoted, doubleQuoted, stringDelimiter{delim: `'`, raw: true})},
+	"Makefile":    {line: []string{"#"}},
+	"Dockerfile":  hashLike,
+	"SQL":         {block: cLike.block, line: []string{"--"}, strings: []stringDelimiter{{delim: `'`, raw: true, multiline: true}}},
+	"Lua":         {block: [][2]string{{"--[[", "]]"}}, line: []string{"--"}, strings: cLike.strings},
+	"Haskell":     {block: [][2]string{{"{-", "-}"}}, line: []string{"--"}, strings: []stringDelimiter{doubleQuoted}},
+	"Erlang":      {line: []string{"%"}, strings: []stringDelimiter{doubleQuoted}},
+	"Clojure":     {line: []string{";"}, strings: []stringDelimiter{{delim: `"`, multiline: true}}},
+	"HTML":        markupLike,
+	"XML":         markupLike,
+}
+
+// validateScope checks the syntax scope of a search
+func validateScope(scope string) error {
+	switch scope {
+	case "", ScopeComments, ScopeStrings:
+		return nil
+	}
+	return fmt.Errorf("invalid scope %q: use %s or %s", scope, ScopeComments, ScopeStrings)
+}
+
+// regions returns the byte ranges of the comments and string literals of
+// content
+func (syntax languageSyntax) regions(content []byte) (comments []span, literals []span) {
+	i := 0
+next:
+	for i < len(content) {
+		for _, block := range syntax.block {
+			if bytes.HasPrefix(content[i:], []byte(block[0])) {
+				end := len(content)
+				if j := bytes.Index(content[i+len(block[0]):], []byte(block[1])); j >= 0 {
+					end = i + len(block[0]) + j + len(block[1])
+				}
+				comments = append(comments, span{i, end})
+				i = end
+				continue next
+			}
+		}
+		for _, start := range syntax.line {
+			if bytes.HasPrefix(content[i:], []byte(start)) {
+				end := len(content)
+				if j := bytes.IndexByte(content[i:], '\n'); j >= 0 {
+					end = i + j
+				}
+				comments = append(comments, span{i, end})
+				i = end
+				continue next
+			}
+		}
+		for _, delim := range syntax.strings {
+			if bytes.HasPrefix(content[i:], []byte(delim.delim)) {
+				end := delim.end(content, i+len(delim.delim))
+				literals = append(literals, span{i, end})
+				i = end
+				continue next
+			}
+		}
+		i++
+	}
+	return comments, literals
+}
+
+// end returns the offset after the string literal whose content starts at
+// i. An unterminated literal ends at the end of its line, or of content if
+// it may span lines.
+func (d stringDelimiter) end(content []byte, i int) int {
+	for i < len(content) {
+		switch {
+		case !d.raw && content[i] == '\\':
+			i += 2
+			continue
+		case bytes.HasPrefix(content[i:], []byte(d.delim)):
+			return i + len(d.delim)
+		case content[i] == '\n' && !d.multiline:
+			return i
+		}
+		i++
+	}
+	return len(content)
+}
+
+// inRegions reports whether the byte range [start, end) lies within one of
+// regions, which are in order
+func inRegions(regions []span, start int, end int) bool {
+	for _, region := range regions {
+		if region.start > start {
+			return false
+		}
+		if end <= region.end {
+			return true
+		}
+	}
+	return false
+}
+
+// filterScope keeps the matches of files that are inside the comments or
+// strings of their language, per scope. Files of languages without known
+// syntax are left out. The files must have been fetched with their
+// content, which is dropped.
+func filterScope(files []zoekt.FileMatch, scope string) []zoekt.FileMatch {
+	var filtered []zoekt.FileMatch
+	for _, fileMatch := range files {
+		syntax, ok := syntaxByLanguage[fileMatch.Language]
+		if !ok || fileMatch.Content == nil {
+			continue
+		}
+		comments, literals := syntax.regions(fileMatch.Content)
+		regions := comments
+		if scope == ScopeStrings {
+			regions = literals
+		}
+
+		var lines []zoekt.LineMatch
+		for _, lineMatch := range fileMatch.LineMatches {
+			if lineMatch.FileName {
+				continue
+			}
+			var fragments []zoekt.LineFragmentMatch
+			for _, fragment := range lineMatch.LineFragments {
+				start := int(fragment.Offset)
+				if inRegions(regions, start, start+fragment.MatchLength) {
+					fragments = append(fragments, fragment)
+				}
+			}
+			if len(fragments) > 0 {
+				lineMatch.LineFragments = fragments
+				lines = append(lines, lineMatch)
+			}
+		}
+		if len(lines) > 0 {
+			fileMatch.LineMatches = lines
+			fileMatch.Content = nil
+			filtered = append(filtered, fileMatch)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,86 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxCachedSearches is how many recent search results are kept to answer
+// repeated searches
+const maxCachedSearches = 50
+
+// cachedSearch is the result of a search, valid while the searched indexes
+// have the generation it was made at
+type cachedSearch struct {
+	key    string
+	result SearchResult
+}
+
+// searchCacheKey identifies a search by everything its result depends on:
+// the query and options, the caller, the steps it refines and the
+// generation of the indexes it searches
+func searchCacheKey(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions, within []searchStep, generation string) string {
+	// Progress callbacks do not change the result
+	opts.OnProgress, opts.OnQueued = nil, nil
+	return fmt.Sprintf("%q\x00%q\x00%q\x00%+v\x00%+v\x00%s",
+		ownerFromContext(ctx), sourceDir, queryStr, opts, within, generation)
+}
+
+// indexGeneration describes the state of the indexes named prefixes. It
+// changes whenever one of them, or the index whose shards it shares, is
+// rebuilt or deleted, or its muted paths change, but not when its shards
+// are compressed.
+func indexGeneration(metadata map[string]*indexMetadata, prefixes []string) string {
+	var b strings.Builder
+	for _, prefix := range slices.Sorted(slices.Values(prefixes)) {
+		meta, ok := metadata[prefix]
+		if !ok {
+			fmt.Fprintf(&b, "%s:-;", prefix)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d", prefix, meta.IndexedAt.UnixNano())
+		if len(meta.Muted) > 0 {
+			fmt.Fprintf(&b, ":%q", meta.Muted)
+		}
+		if len(meta.Aliases) > 0 {
+			fmt.Fprintf(&b, ":%v", meta.Aliases)
+		}
+		if shardPrefix := meta.shardPrefix(prefix); shardPrefix != prefix {
+			if shared, ok := metadata[shardPrefix]; ok {
+				fmt.Fprintf(&b, ":%s:%d", shardPrefix, shared.IndexedAt.UnixNano())
+			}
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// cachedResult returns a copy of the cached result for key, if any
+func (m *IndexManager) cachedResult(key string) (*SearchResult, bool) {
+	m.searchCacheMu.Lock()
+	defer m.searchCacheMu.Unlock()
+	for i, cached := range m.searchCache {
+		if cached.key == key {
+			// Move it to the end so the least recently used is dropped first
+			m.searchCache = append(slices.Delete(m.searchCache, i, i+1), cached)
+			result := cached.result
+			return &result, true
+		}
+	}
+	return nil, false
+}
+
+// cacheResult keeps a copy of result for key, dropping the least recently
+// used result when there are too many. Results of indexes that have since
+// changed are never looked up again and age out the same way.
+func (m *IndexManager) cacheResult(key string, result *SearchResult) {
+	m.searchCacheMu.Lock()
+	defer m.searchCacheMu.Unlock()
+	m.searchCache = slices.DeleteFunc(m.searchCache, func(cached *cachedSearch) bool { return cached.key == key })
+	m.searchCache = append(m.searchCache, &cachedSearch{key: key, result: *result})
+	if len(m.searchCache) > maxCachedSearches {
+		m.searchCache = slices.Delete(m.searchCache, 0, len(m.searchCache)-maxCachedSearches)
+	}
+}
@@ -0,0 +1,341 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// selfTestRepo is the sample repository SelfTest indexes, by slash-separated
+// path
+var selfTestRepo = map[string]string{
+	"main.go": `package main
+
+import "fmt"
+
+// greetUser returns the greeting printed by main
+func greetUser(name string) string {
+	return "Hello, " + name
+}
+
+func main() {
+	fmt.Println(greetUser("selftest"))
+}
+`,
+	"util/strings.py": `def shout_text(text):
+    """Return text in upper case."""
+    return text.upper()
+
+
+def whisper_text(text):
+    return text.lower()
+`,
+	"README.md": `# Sample repository
+
+Indexed by the self-test. The marker SELFTEST_MARKER is matched case-sensitively.
+`,
+}
+
+// Status of a self-test check
+const (
+	SelfTestPass = "pass"
+	SelfTestFail = "fail"
+	SelfTestSkip = "skip" // The check needs an external tool that is not usable
+)
+
+// SelfTestCheck is the outcome of one step of SelfTest
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"` // Why the check failed or was skipped
+}
+
+// SelfTestReport is the outcome of SelfTest
+type SelfTestReport struct {
+	Passed   bool            `json:"passed"` // No check failed
+	Checks   []SelfTestCheck `json:"checks"`
+	Duration string          `json:"duration"`
+}
+
+// selfTest runs the checks of SelfTest, recording their outcome
+type selfTest struct {
+	report  *SelfTestReport
+	stopped bool // A check the others depend on failed
+}
+
+// check runs fn as the named check unless an earlier essential check failed.
+// fn returns a non-empty reason to skip the check, or an error to fail it.
+func (t *selfTest) check(name string, essential bool, fn func() (skip string, err error)) {
+	if t.stopped {
+		t.report.Checks = append(t.report.Checks, SelfTestCheck{Name: name, Status: SelfTestSkip, Detail: "an earlier check failed"})
+		return
+	}
+	check := SelfTestCheck{Name: name, Status: SelfTestPass}
+	skip, err := fn()
+	switch {
+	case err != nil:
+		check.Status, check.Detail = SelfTestFail, err.Error()
+		t.report.Passed = false
+		t.stopped = essential
+	case skip != "":
+		check.Status, check.Detail = SelfTestSkip, skip
+	}
+	t.report.Checks = append(t.report.Checks, check)
+}
+
+// SelfTest checks that the installation works end to end: it writes a small
+// sample repository, indexes it in a scratch directory inside indexDir, runs
+// canonical queries and compares their results with the expected ones. This
+// covers permissions of the index directory, symbol data from ctags, git and
+// platform quirks. Checks needing an external tool that is missing are
+// skipped. The sample repository and its index are removed afterwards.
+func SelfTest(ctx context.Context, indexDir string) *SelfTestReport {
+	start := time.Now()
+	t := &selfTest{report: &SelfTestReport{Passed: true}}
+	var sourceDir, scratchIndexDir string
+	var manager *IndexManager
+	defer func() {
+		if manager != nil {
+			manager.Close()
+		}
+		if sourceDir != "" {
+			os.RemoveAll(sourceDir)
+		}
+		if scratchIndexDir != "" {
+			os.RemoveAll(scratchIndexDir)
+		}
+	}()
+
+	t.check("create index directory", true, func() (string, error) {
+		if err := os.MkdirAll(indexDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", indexDir, err)
+		}
+		dir, err := os.MkdirTemp(indexDir, ".selftest-")
+		if err != nil {
+			return "", fmt.Errorf("%s is not writable: %w", indexDir, err)
+		}
+		scratchIndexDir = dir
+		manager = NewIndexManager(dir)
+		return "", nil
+	})
+
+	t.check("write sample repository", true, func() (string, error) {
+		dir, err := os.MkdirTemp("", "code-index-selftest-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		sourceDir = dir
+		for name, content := range selfTestRepo {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	})
+
+	// The sample is committed so the history and git features are covered
+	git := externalTool(toolGit)
+	t.check("commit sample with git", false, func() (string, error) {
+		if git == "" {
+			return "git is not usable; see external_tools in index_info", nil
+		}
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"add", "."},
+			{"-c", "user.name=selftest", "-c", "user.email=selftest@example.com", "-c", "commit.gpgsign=false",
+				"commit", "-q", "-m", "Add selftest sample"},
+		} {
+			cmd := exec.CommandContext(ctx, git, append([]string{"-C", sourceDir}, args...)...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return "", fmt.Errorf("git %s failed: %s", args[len(args)-1], strings.TrimSpace(string(out)))
+			}
+		}
+		return "", nil
+	})
+	committed := t.report.Checks[len(t.report.Checks)-1].Status == SelfTestPass
+
+	t.check("build index", true, func() (string, error) {
+		if err := manager.IndexDirectory(ctx, sourceDir); err != nil {
+			return "", err
+		}
+		indexes, err := manager.ListIndexes(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(indexes) != 1 || indexes[0].Files != len(selfTestRepo) {
+			return "", fmt.Errorf("expected 1 index of %d files, got %+v", len(selfTestRepo), indexes)
+		}
+		return "", nil
+	})
+
+	var greetResult *SearchResult
+	t.check("literal search", false, func() (string, error) {
+		result, err := manager.Search(ctx, "greetUser", sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		greetResult = result
+		return "", expectLines(result,
+			"main.go:5: // greetUser returns the greeting printed by main",
+			"main.go:6: func greetUser(name string) string {",
+			"main.go:11: \tfmt.Println(greetUser(\"selftest\"))")
+	})
+
+	t.check("regex search", false, func() (string, error) {
+		result, err := manager.Search(ctx, `def \w+_text`, sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		return "", expectLines(result, "util/strings.py:1: def shout_text(text):", "util/strings.py:6: def whisper_text(text):")
+	})
+
+	t.check("case-sensitive search", false, func() (string, error) {
+		result, err := manager.Search(ctx, "case:yes SELFTEST_MARKER", sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		if err := expectFiles(result, "README.md"); err != nil {
+			return "", err
+		}
+		result, err = manager.Search(ctx, "case:yes selftest_marker", sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		return "", expectFiles(result)
+	})
+
+	t.check("language filter", false, func() (string, error) {
+		opts := DefaultSearchOptions()
+		opts.Language = "python"
+		result, err := manager.Search(ctx, "text", sourceDir, opts)
+		if err != nil {
+			return "", err
+		}
+		return "", expectFiles(result, "util/strings.py")
+	})
+
+	t.check("file name search", false, func() (string, error) {
+		result, err := manager.Search(ctx, `file:strings\.py$`, sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		return "", expectFiles(result, "util/strings.py")
+	})
+
+	t.check("open result", false, func() (string, error) {
+		if greetResult == nil || greetResult.ID == "" {
+			return "", fmt.Errorf("the literal search returned no result to open")
+		}
+		file, err := manager.OpenResult(ctx, greetResult.ID, 1, 6, 1)
+		if err != nil {
+			return "", err
+		}
+		if want := "func greetUser(name string) string {"; len(file.Lines) != 1 || file.Lines[0] != want {
+			return "", fmt.Errorf("expected line 6 to be %q, got %q", want, file.Lines)
+		}
+		return "", nil
+	})
+
+	t.check("symbol search", false, func() (string, error) {
+		if externalTool(toolCtags) == "" {
+			return "universal-ctags is not usable, so no symbol data is built; see external_tools in index_info", nil
+		}
+		result, err := manager.Search(ctx, "sym:greetUser", sourceDir, DefaultSearchOptions())
+		if err != nil {
+			return "", err
+		}
+		return "", expectLines(result, "main.go:6: func greetUser(name string) string {")
+	})
+
+	t.check("history search", false, func() (string, error) {
+		if !committed {
+			return "the sample was not committed", nil
+		}
+		commits, err := manager.SearchHistory(ctx, sourceDir, HistoryOptions{Message: "selftest sample"})
+		if err != nil {
+			return "", err
+		}
+		if len(commits) != 1 || len(commits[0].Files) != len(selfTestRepo) {
+			return "", fmt.Errorf("expected 1 commit of %d files, got %d commits", len(selfTestRepo), len(commits))
+		}
+		return "", nil
+	})
+
+	t.check("delete index", false, func() (string, error) {
+		if err := manager.DeleteIndex(ctx, sourceDir); err != nil {
+			return "", err
+		}
+		indexes, err := manager.ListIndexes(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(indexes) != 0 {
+			return "", fmt.Errorf("%d indexes left after deleting", len(indexes))
+		}
+		return "", nil
+	})
+
+	t.report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return t.report
+}
+
+// expectLines checks that the lines of a search result are exactly want, by
+// path relative to the sample repository
+func expectLines(result *SearchResult, want ...string) error {
+	var got []string
+	for _, line := range result.Lines {
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\n") {
+			continue
+		}
+		got = append(got, relativeResultLine(line))
+	}
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("expected lines %q, got %q", want, got)
+	}
+	return nil
+}
+
+// expectFiles checks that a search result matched exactly the files want,
+// by path relative to the sample repository
+func expectFiles(result *SearchResult, want ...string) error {
+	var got []string
+	for _, file := range result.files {
+		name, _ := splitChunkName(file.name)
+		got = append(got, filepath.ToSlash(name))
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("expected files %q, got %q", want, got)
+	}
+	return nil
+}
+
+// relativeResultLine strips the directory of the sample repository from a
+// result line, so it can be compared on every platform
+func relativeResultLine(line string) string {
+	path, rest, ok := strings.Cut(line, ":")
+	// Drive letters contain a colon
+	if ok && len(path) == 1 {
+		var more string
+		more, rest, ok = strings.Cut(rest, ":")
+		path += ":" + more
+	}
+	if !ok {
+		return line
+	}
+	for name := range selfTestRepo {
+		if strings.HasSuffix(filepath.ToSlash(path), "/"+name) {
+			return name + ":" + rest
+		}
+	}
+	return line
+}
@@ -0,0 +1,173 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// shardPrefix returns the name of the shards the index is stored in: its own
+// prefix, or the prefix of the index it shares shards with
+func (meta *indexMetadata) shardPrefix(prefix string) string {
+	if meta.SharedWith != "" {
+		return meta.SharedWith
+	}
+	return prefix
+}
+
+// shareIdenticalIndex records the index of absPath as sharing the shards of
+// another clone or worktree of the same repository at the same commit, if
+// the files of both are identical. It returns false if there is no such
+// index and absPath has to be built.
+func (m *IndexManager) shareIdenticalIndex(ctx context.Context, absPath string, walkRoot string, filter *sourceFilter, gitHead string, sizeMax int) (bool, error) {
+	if gitHead == "" {
+		return false, nil
+	}
+
+	prefix := m.getIndexPrefix(absPath)
+	metadata := m.loadAllMetadata()
+	var candidates []string
+	for _, other := range slices.Sorted(maps.Keys(metadata)) {
+		meta := metadata[other]
+		if other != prefix && meta.GitHead == gitHead && meta.Fingerprint != "" && meta.Stale == "" {
+			candidates = append(candidates, other)
+		}
+	}
+	if len(candidates) == 0 {
+		return false, nil
+	}
+
+	// The same commit can still differ in uncommitted changes, so compare
+	// the files before sharing
+	stats, err := m.walkSource(ctx, walkRoot, filter, sizeMax, func(index.Document) error { return nil })
+	if err != nil {
+		return false, fmt.Errorf("failed to index files: %w", err)
+	}
+
+	for _, other := range candidates {
+		target := metadata[other]
+		if target.Fingerprint != stats.fingerprint {
+			continue
+		}
+		shardPrefix := target.shardPrefix(other)
+		if shards, err := m.shardFiles(shardPrefix); err != nil || len(shards) == 0 {
+			continue
+		}
+
+		meta := &indexMetadata{
+			IndexedAt:   time.Now().UTC(),
+			Files:       stats.files,
+			Bytes:       stats.bytes,
+			Languages:   stats.languages,
+			Skipped:     stats.skipped,
+			GitHead:     gitHead,
+			Fingerprint: stats.fingerprint,
+			Compressed:  target.Compressed,
+			Sparse:      filter.sparsePatterns(),
+			TrackedOnly: filter.tracked != nil,
+			Submodules:  filter.submodulePaths(),
+			Symbols:     target.Symbols,
+
+			IgnorePatterns:    filter.ignorePatterns,
+			MaxFileSize:       filter.maxFileSize,
+			FollowSymlinks:    filter.followSymlinks,
+			Branch:            gitBranch(absPath),
+			Commit:            gitCommit(gitHead),
+			NoDefaultExcludes: filter.noDefaultExcludes,
+		}
+		// The shards may have been built from this directory before
+		if shardPrefix != prefix {
+			meta.SharedWith = shardPrefix
+		}
+		if owner := ownerFromContext(ctx); owner != "" {
+			meta.Owners = []string{owner}
+		}
+		if err := m.saveIndexMetadata(absPath, meta); err != nil {
+			return false, fmt.Errorf("failed to save metadata: %w", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// reindexSharers re-indexes the directories that shared the shards named
+// prefix after they were rebuilt from different content
+func (m *IndexManager) reindexSharers(ctx context.Context, prefix string) error {
+	// Forget their fingerprints first so they cannot match each other's
+	// outdated content
+	var sharers []string
+	err := m.updateShared(prefix, func(meta *indexMetadata) {
+		if meta.SharedWith == prefix {
+			meta.Fingerprint = ""
+			sharers = append(sharers, meta.SourceDir)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(sharers)
+
+	for _, sourceDir := range sharers {
+		// Re-indexing on behalf of the caller must not make it an owner
+		if err := m.IndexDirectory(WithOwner(ctx, ""), sourceDir); err != nil {
+			return fmt.Errorf("failed to re-index %s, which shared the replaced index: %w", sourceDir, err)
+		}
+	}
+	return nil
+}
+
+// releaseShards deletes the shards named prefix unless an index in metadata
+// still uses them. The caller must hold metadataMu.
+func (m *IndexManager) releaseShards(metadata map[string]*indexMetadata, prefix string) error {
+	for other, meta := range metadata {
+		if meta.shardPrefix(other) == prefix {
+			return nil
+		}
+	}
+
+	shards, err := m.shardFiles(prefix)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if err := removeShard(shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardView maps the repository names stored in the shards to the metadata
+// of an index using them, preferring the index that built them, so results
+// from shared shards are reported once under one source directory
+func shardView(metadata map[string]*indexMetadata) map[string]*indexMetadata {
+	view := make(map[string]*indexMetadata, len(metadata))
+	for _, prefix := range slices.Sorted(maps.Keys(metadata)) {
+		meta := metadata[prefix]
+		shardPrefix := meta.shardPrefix(prefix)
+		if _, ok := view[shardPrefix]; !ok || shardPrefix == prefix {
+			view[shardPrefix] = meta
+		}
+	}
+	return view
+}
+
+// updateShared applies update to the stored metadata of every index using
+// the shards named prefix
+func (m *IndexManager) updateShared(prefix string, update func(*indexMetadata)) error {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	for other, meta := range metadata {
+		if meta.shardPrefix(other) == prefix {
+			update(meta)
+		}
+	}
+	return m.saveAllMetadata(metadata)
+}
@@ -0,0 +1,129 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sourcegraphSearchQuery asks the Sourcegraph GraphQL API for the file
+// matches of a search
+const sourcegraphSearchQuery = `query Search($query: String!) {
+  search(query: $query, version: V3) {
+    results {
+      results {
+        __typename
+        ... on FileMatch {
+          repository { name }
+          file { path }
+          lineMatches { preview lineNumber }
+        }
+      }
+    }
+  }
+}`
+
+// sourcegraphRemote searches a Sourcegraph instance through its GraphQL API
+type sourcegraphRemote struct {
+	name   string
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (r *sourcegraphRemote) Name() string {
+	return r.name
+}
+
+func (r *sourcegraphRemote) Search(ctx context.Context, query string, opts SearchOptions) ([]RemoteFile, error) {
+	// Queries are Zoekt regex syntax, which Sourcegraph only uses when asked
+	query = fmt.Sprintf("%s patterntype:regexp count:%d", query, opts.MaxFiles)
+	if opts.Language != "" {
+		query += " lang:" + opts.Language
+	}
+	if opts.IgnoreCase {
+		query += " case:no"
+	}
+	body, err := json.Marshal(map[string]any{
+		"query":     sourcegraphSearchQuery,
+		"variables": map[string]string{"query": query},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/.api/graphql", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "token "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach backend: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Data struct {
+			Search struct {
+				Results struct {
+					Results []struct {
+						Typename   string `json:"__typename"`
+						Repository struct {
+							Name string `json:"name"`
+						} `json:"repository"`
+						File struct {
+							Path string `json:"path"`
+						} `json:"file"`
+						LineMatches []struct {
+							Preview    string `json:"preview"`
+							LineNumber int    `json:"lineNumber"`
+						} `json:"lineMatches"`
+					} `json:"results"`
+				} `json:"results"`
+			} `json:"search"`
+		} `json:"data"`
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend returned %s", resp.Status)
+	}
+	if err := json.Unmarshal(content, &reply); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if len(reply.Errors) > 0 {
+		messages := make([]string, len(reply.Errors))
+		for i, e := range reply.Errors {
+			messages[i] = e.Message
+		}
+		return nil, errors.New(strings.Join(messages, "; "))
+	}
+
+	var files []RemoteFile
+	for _, match := range reply.Data.Search.Results.Results {
+		if match.Typename != "FileMatch" {
+			continue
+		}
+		file := RemoteFile{Repository: match.Repository.Name, Path: match.File.Path, Matches: len(match.LineMatches)}
+		for _, line := range match.LineMatches {
+			// Sourcegraph numbers lines from 0
+			file.Lines = append(file.Lines, RemoteLine{Number: line.LineNumber + 1, Text: line.Preview})
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
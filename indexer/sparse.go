@@ -0,0 +1,132 @@
+package indexer
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sparseCheckout holds the sparse-checkout definition of a git checkout.
+// Paths outside it are not indexed, even if they exist on disk.
+type sparseCheckout struct {
+	patterns []string // The definition as written in info/sparse-checkout
+
+	// Cone mode includes the files directly in parent directories and
+	// everything below recursive directories
+	cone      bool
+	parents   map[string]bool
+	recursive map[string]bool
+
+	// Otherwise the definition is a list of gitignore-style patterns
+	rules []gitPattern
+}
+
+// loadSparseCheckout returns the sparse-checkout definition of the checkout
+// using gitDir, or nil if sparse checkout is not enabled
+func loadSparseCheckout(gitDir string) *sparseCheckout {
+	if !gitConfigBool(gitDir, "core", "sparseCheckout") {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(gitDir, "info", "sparse-checkout"))
+	if err != nil {
+		return nil
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+
+	sparse := &sparseCheckout{patterns: patterns}
+	if !gitConfigBool(gitDir, "core", "sparseCheckoutCone") || !sparse.parseCone() {
+		// Git also falls back to full patterns if cone patterns are malformed
+		sparse.cone = false
+		sparse.rules = parseGitPatterns(patterns, "")
+	}
+	return sparse
+}
+
+// parseCone parses the definition as cone mode patterns, which only name
+// directories, and reports whether it is valid
+func (s *sparseCheckout) parseCone() bool {
+	s.cone = true
+	s.parents = make(map[string]bool)
+	s.recursive = make(map[string]bool)
+	for _, pattern := range s.patterns {
+		switch {
+		case pattern == "/*" || pattern == "!/*/":
+			// The files at the root are always included
+		case strings.HasPrefix(pattern, "!/") && strings.HasSuffix(pattern, "/*/"):
+			s.parents[unescapeCone(pattern[2:len(pattern)-3])] = true
+		case strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") && len(pattern) > 2:
+			s.recursive[unescapeCone(pattern[1:len(pattern)-1])] = true
+		default:
+			return false
+		}
+	}
+	for dir := range s.parents {
+		delete(s.recursive, dir)
+	}
+	return true
+}
+
+// unescapeCone removes the backslashes git adds before glob characters in
+// cone mode directory names
+func unescapeCone(dir string) string {
+	return strings.NewReplacer(`\*`, "*", `\?`, "?", `\[`, "[", `\\`, `\`).Replace(dir)
+}
+
+// includes reports whether a path, slash separated from the repository
+// root, is part of the sparse checkout. Directories are included if
+// anything below them can be.
+func (s *sparseCheckout) includes(name string, isDir bool) bool {
+	if s.cone {
+		return s.includesCone(name, isDir)
+	}
+
+	// Every directory may contain matching files
+	if isDir {
+		return true
+	}
+	// The closest matching pattern on the file or its parents decides
+	for p, dir := name, false; p != "."; p, dir = path.Dir(p), true {
+		if matched, positive := matchGitPatterns(s.rules, p, dir); matched {
+			return positive
+		}
+	}
+	return false
+}
+
+// includesCone implements includes for cone mode
+func (s *sparseCheckout) includesCone(name string, isDir bool) bool {
+	// Everything below a recursive directory is included
+	for p := name; p != "."; p = path.Dir(p) {
+		if s.recursive[p] {
+			return true
+		}
+	}
+
+	if isDir {
+		// Parents lead to the recursive directories below them
+		return s.parents[name]
+	}
+	dir := path.Dir(name)
+	return dir == "." || s.parents[dir]
+}
+
+// currentSparsePatterns returns the sparse-checkout definition currently in
+// effect for a source directory, if any
+func currentSparsePatterns(sourceDir string) []string {
+	_, gitDir := findGitDir(sourceDir)
+	if gitDir == "" {
+		return nil
+	}
+	if sparse := loadSparseCheckout(gitDir); sparse != nil {
+		return sparse.patterns
+	}
+	return nil
+}
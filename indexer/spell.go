@@ -0,0 +1,157 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Modes of SearchOptions.SpellFallback
+const (
+	SpellSuggest = "suggest" // Suggest near misses of a query that found nothing
+	SpellInclude = "include" // Also search for them
+)
+
+// maxSpellSuggestions limits the near misses suggested or searched for
+const maxSpellSuggestions = 3
+
+// spellWord matches a query term the spelling fallback looks for near
+// misses of. Shorter terms have too many.
+var spellWord = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{3,}$`)
+
+// misspelledTerm returns the index of the one identifier term among the
+// tokens of a query, if the other tokens are all field filters such as
+// lang:go or negations, or -1
+func misspelledTerm(tokens []string) int {
+	term := -1
+	for i, token := range tokens {
+		switch {
+		case spellWord.MatchString(token) && token != "or":
+			if term >= 0 {
+				return -1
+			}
+			term = i
+		case strings.HasPrefix(token, "-") || (strings.Contains(token, ":") && !strings.HasPrefix(token, "(")):
+		default:
+			return -1
+		}
+	}
+	return term
+}
+
+// nearMisses returns regexes matching the words at edit distance one from
+// term: a character substituted, deleted, inserted or two neighbors
+// swapped
+func nearMisses(term string) []string {
+	var variants []string
+	add := func(variant string) {
+		if variant != "" && !slices.Contains(variants, variant) {
+			variants = append(variants, variant)
+		}
+	}
+	for i := 0; i <= len(term); i++ {
+		add(term[:i] + `\w` + term[i:])
+		if i == len(term) {
+			break
+		}
+		add(term[:i] + `\w` + term[i+1:])
+		add(term[:i] + term[i+1:])
+		if i+1 < len(term) && term[i] != term[i+1] {
+			add(term[:i] + term[i+1:i+2] + term[i:i+1] + term[i+2:])
+		}
+	}
+	for i, variant := range variants {
+		variants[i] = `\b` + variant + `\b`
+	}
+	return variants
+}
+
+// spellFallback looks for near misses of the identifier in a query that
+// found nothing, by searching for the words at edit distance one from it
+// in either case. It returns empty with the near misses found as
+// suggestions, or with SpellInclude the result of searching for them
+// instead of the identifier. Queries other than one identifier with field
+// filters get empty back as it is.
+func (m *IndexManager) spellFallback(ctx context.Context, queryStr string, sourceDir string, opts SearchOptions, empty *SearchResult) (*SearchResult, error) {
+	tokens := queryTokens(queryStr)
+	term := misspelledTerm(tokens)
+	if term < 0 {
+		return empty, nil
+	}
+
+	// Find the near misses used most in the files they occur in
+	original := tokens[term]
+	variants := nearMisses(original)
+	probe := slices.Clone(tokens)
+	probe[term] = "( " + strings.Join(variants, " or ") + " )"
+	probeOpts := opts
+	probeOpts.MaxFiles, probeOpts.MaxLinesPerFile, probeOpts.MaxLineLength = 50, 5, 1000
+	probeOpts.FilesOnly, probeOpts.OnePerFile, probeOpts.Terse, probeOpts.IgnoreCase = false, false, true, true
+	probeOpts.HighlightStart, probeOpts.HighlightEnd, probeOpts.Color = "", "", false
+	probeOpts.SmartIdentifiers, probeOpts.ExpandAliases, probeOpts.SpellFallback = false, false, ""
+	probeOpts.OnProgress, probeOpts.OnQueued = nil, nil
+	probeResult, err := m.search(ctx, strings.Join(probe, " "), sourceDir, probeOpts, nil)
+	if err != nil || probeResult.TotalFiles == 0 {
+		return empty, nil
+	}
+	word := regexp.MustCompile(`(?i)(?:` + strings.Join(variants, "|") + `)`)
+	counts := make(map[string]int)
+	for _, line := range probeResult.Lines {
+		for _, match := range word.FindAllString(line, -1) {
+			if match != original {
+				counts[match]++
+			}
+		}
+	}
+	suggestions := make([]string, 0, len(counts))
+	for match := range counts {
+		suggestions = append(suggestions, match)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if counts[suggestions[i]] != counts[suggestions[j]] {
+			return counts[suggestions[i]] > counts[suggestions[j]]
+		}
+		return suggestions[i] < suggestions[j]
+	})
+	if len(suggestions) > maxSpellSuggestions {
+		suggestions = suggestions[:maxSpellSuggestions]
+	}
+	if len(suggestions) == 0 {
+		return empty, nil
+	}
+
+	quoted := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		quoted[i] = "`" + suggestion + "`"
+	}
+	if opts.SpellFallback != SpellInclude {
+		// The empty result may be cached, so it is copied before adding to it
+		sr := *empty
+		sr.Suggestions = suggestions
+		if !opts.Terse {
+			sr.Lines = []string{fmt.Sprintf("No results found. Did you mean %s?", strings.Join(quoted, " or "))}
+		}
+		return &sr, nil
+	}
+
+	// Search for the near misses instead, as whole words in their case
+	patterns := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		patterns[i] = `\b` + suggestion + `\b`
+	}
+	tokens[term] = "( " + strings.Join(patterns, " or ") + " )"
+	opts.SpellFallback = ""
+	sr, err := m.search(ctx, strings.Join(tokens, " "), sourceDir, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	corrected := *sr
+	corrected.Suggestions = suggestions
+	if !opts.Terse {
+		corrected.Lines = append([]string{fmt.Sprintf("[No matches for %s; showing matches for %s]", original, strings.Join(quoted, ", "))}, sr.Lines...)
+	}
+	return &corrected, nil
+}
@@ -0,0 +1,100 @@
+package indexer
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+)
+
+// shardVersion matches the index format version in a shard file name, e.g.
+// "name_v16.00000.zoekt"
+var shardVersion = regexp.MustCompile(`_v(\d+)\.\d+\.zoekt`)
+
+// shardStaleness returns why the Zoekt library linked in cannot use a shard
+// with the given metadata as it is, or "" if it can
+func shardStaleness(meta *zoekt.IndexMetadata) string {
+	switch {
+	case meta.IndexFormatVersion > index.NextIndexFormatVersion || meta.IndexMinReaderVersion > index.FeatureVersion:
+		return fmt.Sprintf("shards were built by a newer Zoekt version (format v%d, feature version %d) than this server's (v%d, %d)",
+			meta.IndexFormatVersion, meta.IndexFeatureVersion, index.IndexFormatVersion, index.FeatureVersion)
+	case meta.IndexFormatVersion < index.IndexFormatVersion || meta.IndexFeatureVersion < index.WriteMinFeatureVersion:
+		return fmt.Sprintf("shards were built by an older Zoekt version (format v%d, feature version %d) than this server's (v%d, %d)",
+			meta.IndexFormatVersion, meta.IndexFeatureVersion, index.IndexFormatVersion, index.FeatureVersion)
+	}
+	return ""
+}
+
+// shardFileStaleness returns why a shard file cannot be used as it is, or
+// "" if it can. Compressed and encrypted shards are only checked by the
+// format version in their name.
+func shardFileStaleness(shard string) string {
+	if strings.HasSuffix(shard, ".zoekt") {
+		_, meta, err := index.ReadMetadataPathAlive(shard)
+		if err != nil {
+			return fmt.Sprintf("shard %s cannot be read: %v", filepath.Base(shard), err)
+		}
+		return shardStaleness(meta)
+	}
+	match := shardVersion.FindStringSubmatch(filepath.Base(shard))
+	if match == nil {
+		return ""
+	}
+	version, _ := strconv.Atoi(match[1])
+	return shardStaleness(&zoekt.IndexMetadata{
+		IndexFormatVersion:  version,
+		IndexFeatureVersion: index.FeatureVersion,
+	})
+}
+
+// MarkStaleIndexes checks the shards of every index against the Zoekt
+// library linked in, e.g. after an upgrade, and records the indexes whose
+// shards it cannot use as they are as stale, which list_indexes shows until
+// they are rebuilt. It returns the directories to rebuild: those whose
+// shards are stale, not the directories sharing them, which are re-indexed
+// along with them. Attached indexes are marked but not rebuilt.
+func (m *IndexManager) MarkStaleIndexes() ([]string, error) {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	staleness := make(map[string]string) // By shard prefix
+	changed := false
+	var rebuild []string
+	for _, prefix := range slices.Sorted(maps.Keys(metadata)) {
+		meta := metadata[prefix]
+		shardPrefix := meta.shardPrefix(prefix)
+		reason, ok := staleness[shardPrefix]
+		if !ok {
+			shards, err := m.shardFiles(shardPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list shards: %w", err)
+			}
+			for _, shard := range shards {
+				if reason = shardFileStaleness(shard); reason != "" {
+					break
+				}
+			}
+			staleness[shardPrefix] = reason
+		}
+		if meta.Stale != reason {
+			meta.Stale = reason
+			changed = true
+		}
+		if reason != "" && shardPrefix == prefix && meta.Attached == "" {
+			rebuild = append(rebuild, meta.SourceDir)
+		}
+	}
+	if changed {
+		if err := m.saveAllMetadata(metadata); err != nil {
+			return nil, err
+		}
+	}
+	return rebuild, nil
+}
@@ -0,0 +1,48 @@
+package indexer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/index"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// SearchProgress reports files found so far while a search is streaming
+type SearchProgress struct {
+	FilesFound int      // Files with matches received so far
+	NewFiles   []string // Full paths of the files in this batch
+}
+
+// streamSearch runs a streaming search, reporting each batch of matching
+// files to onProgress as shards finish, and returns the aggregated result
+func streamSearch(ctx context.Context, searcher zoekt.Streamer, q query.Q, opts *zoekt.SearchOptions, metadata map[string]*indexMetadata, onProgress func(SearchProgress)) (*zoekt.SearchResult, error) {
+	var mu sync.Mutex
+	aggregate := &zoekt.SearchResult{}
+
+	sender := zoekt.SenderFunc(func(batch *zoekt.SearchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		aggregate.Files = append(aggregate.Files, batch.Files...)
+		aggregate.Stats.Add(batch.Stats)
+		if len(batch.Files) == 0 {
+			return
+		}
+
+		progress := SearchProgress{FilesFound: len(aggregate.Files)}
+		for _, fileMatch := range batch.Files {
+			progress.NewFiles = append(progress.NewFiles, resultPath(fileMatch, metadata))
+		}
+		onProgress(progress)
+	})
+
+	if err := searcher.StreamSearch(ctx, q, opts, sender); err != nil {
+		return nil, err
+	}
+
+	// Batches arrive in shard order; rank them like a regular search would
+	index.SortFiles(aggregate.Files)
+	return aggregate, nil
+}
@@ -0,0 +1,398 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// maxStructuralSteps bounds the backtracking spent matching a template
+// against one file, so pathological templates cannot stall a search
+const maxStructuralSteps = 1000000
+
+// defaultStructuralMatches is the number of matches returned by default
+const defaultStructuralMatches = 50
+
+// holeName matches the names allowed for template holes
+var holeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// StructuralOptions narrows down the files a template is matched against
+type StructuralOptions struct {
+	Language      string // Only match files of this language (name or alias)
+	File          string // Only match files whose path matches this regex
+	MaxMatches    int    // Maximum number of matches to return (default: 50)
+	MaxLineLength int    // Truncate matched code longer than this many runes (default: 200)
+}
+
+// StructuralMatch is a piece of code matching a template
+type StructuralMatch struct {
+	File  string           `json:"file"`
+	Line  int              `json:"line"`
+	Text  string           `json:"text"`
+	Holes []StructuralHole `json:"holes,omitempty"` // In template order
+}
+
+// StructuralHole is the code a named hole of a template matched
+type StructuralHole struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// StructuralResult holds the matches of a structural search
+type StructuralResult struct {
+	Matches      []StructuralMatch
+	FilesMatched int  // Number of files with matches
+	More         bool // Matches were left out beyond MaxMatches
+	// Lines is the compact output: "file:line: code" per match, with the
+	// code on one line, followed by "  name = code" per hole
+	Lines []string
+}
+
+// templateToken is a piece of a parsed template
+type templateToken struct {
+	kind string // literal, space or hole
+	text string // Text of a literal, name of a hole
+	word bool   // The hole only matches identifier characters
+}
+
+// StructuralSearch matches a comby-style template against the files of the
+// index of sourceDir, or of all indexes, that contain its literal text. In
+// a template, :[name] matches any code with balanced (), [] and {} and
+// quotes, :[[name]] matches an identifier, and whitespace matches any
+// whitespace. A hole used twice must match the same code both times, and
+// :[_] matches without being reported.
+func (m *IndexManager) StructuralSearch(ctx context.Context, sourceDir string, template string, opts StructuralOptions) (*StructuralResult, error) {
+	if opts.MaxMatches <= 0 {
+		opts.MaxMatches = defaultStructuralMatches
+	}
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = 200
+	}
+	tokens, err := parseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only files containing all the literal text of the template can match
+	var q query.Q
+	for _, token := range tokens {
+		if token.kind != "literal" {
+			continue
+		}
+		for _, fragment := range strings.Fields(token.text) {
+			if len(fragment) < 2 {
+				continue
+			}
+			substring := &query.Substring{Pattern: fragment, Content: true, CaseSensitive: true}
+			if q == nil {
+				q = substring
+			} else {
+				q = query.NewAnd(q, substring)
+			}
+		}
+	}
+	if q == nil {
+		return nil, errors.New("the template needs literal text of at least two characters, e.g. a keyword or a function name")
+	}
+
+	if opts.File != "" {
+		re, err := syntax.Parse(opts.File, syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file pattern: %w", err)
+		}
+		q = query.NewAnd(q, &query.Regexp{Regexp: re, FileName: true, CaseSensitive: true})
+	}
+	if opts.Language != "" {
+		prefixes, err := m.indexPrefixes(ctx, sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		lang, err := resolveLanguage(opts.Language, m.visibleMetadata(ctx), prefixes)
+		if err != nil {
+			return nil, err
+		}
+		q = query.NewAnd(q, &query.Language{Language: lang})
+	}
+
+	result := &StructuralResult{}
+	err = m.wholeFiles(ctx, sourceDir, q, func(path string, content []byte) {
+		matches := matchTemplate(tokens, string(content))
+		if len(matches) == 0 {
+			return
+		}
+		result.FilesMatched++
+		for _, match := range matches {
+			if len(result.Matches) >= opts.MaxMatches {
+				result.More = true
+				return
+			}
+			match.File = path
+			result.Matches = append(result.Matches, match)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, match := range result.Matches {
+		result.Lines = append(result.Lines, fmt.Sprintf("%s:%d: %s", match.File, match.Line, oneLine(match.Text, opts.MaxLineLength)))
+		for _, hole := range match.Holes {
+			result.Lines = append(result.Lines, fmt.Sprintf("  %s = %s", hole.Name, oneLine(hole.Value, opts.MaxLineLength)))
+		}
+	}
+	return result, nil
+}
+
+// oneLine collapses the whitespace of code, including line breaks, and
+// truncates it to maxLen runes
+func oneLine(code string, maxLen int) string {
+	return truncateLine(strings.Join(strings.Fields(code), " "), maxLen)
+}
+
+// parseTemplate splits a template into literals, whitespace and holes
+func parseTemplate(template string) ([]templateToken, error) {
+	var tokens []templateToken
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			tokens = append(tokens, templateToken{kind: "literal", text: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	template = strings.TrimSpace(template)
+	for i := 0; i < len(template); {
+		c := template[i]
+		switch {
+		case isSpace(c):
+			flush()
+			for i < len(template) && isSpace(template[i]) {
+				i++
+			}
+			tokens = append(tokens, templateToken{kind: "space"})
+		case strings.HasPrefix(template[i:], ":[["):
+			end := strings.Index(template[i:], "]]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed hole at %q", template[i:])
+			}
+			name := template[i+3 : i+end]
+			if !holeName.MatchString(name) {
+				return nil, fmt.Errorf("invalid hole name %q", name)
+			}
+			flush()
+			tokens = append(tokens, templateToken{kind: "hole", text: name, word: true})
+			i += end + 2
+		case strings.HasPrefix(template[i:], ":["):
+			end := strings.IndexByte(template[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed hole at %q", template[i:])
+			}
+			name := template[i+2 : i+end]
+			if !holeName.MatchString(name) {
+				return nil, fmt.Errorf("invalid hole name %q", name)
+			}
+			flush()
+			tokens = append(tokens, templateToken{kind: "hole", text: name})
+			i += end + 1
+		default:
+			literal.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	if len(tokens) == 0 {
+		return nil, errors.New("the template is empty")
+	}
+	return tokens, nil
+}
+
+// templateMatcher matches the tokens of a template against a file
+type templateMatcher struct {
+	tokens   []templateToken
+	src      string
+	bindings map[string]string
+	steps    int
+}
+
+// matchTemplate returns the non-overlapping matches of a template in src,
+// without their file
+func matchTemplate(tokens []templateToken, src string) []StructuralMatch {
+	tm := &templateMatcher{tokens: tokens, src: src, bindings: map[string]string{}}
+	var matches []StructuralMatch
+	line := 1
+	counted := 0 // Offset up to which newlines are counted into line
+	for pos := 0; pos < len(src) && tm.steps < maxStructuralSteps; pos++ {
+		// Matches start at a token, not inside an identifier or whitespace
+		if isSpace(src[pos]) || (pos > 0 && isWordChar(src[pos]) && isWordChar(src[pos-1])) {
+			continue
+		}
+		clear(tm.bindings)
+		end, ok := tm.match(0, pos)
+		if !ok || end == pos {
+			continue
+		}
+
+		line += strings.Count(src[counted:pos], "\n")
+		counted = pos
+		match := StructuralMatch{Line: line, Text: src[pos:end]}
+		for _, token := range tokens {
+			if token.kind != "hole" || token.text == "_" || holeReported(match.Holes, token.text) {
+				continue
+			}
+			match.Holes = append(match.Holes, StructuralHole{Name: token.text, Value: tm.bindings[token.text]})
+		}
+		matches = append(matches, match)
+		pos = end - 1
+	}
+	return matches
+}
+
+// holeReported reports whether the hole name is already in holes
+func holeReported(holes []StructuralHole, name string) bool {
+	for _, hole := range holes {
+		if hole.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches the tokens from i on at pos, returning where the match ends
+func (tm *templateMatcher) match(i int, pos int) (int, bool) {
+	tm.steps++
+	if tm.steps >= maxStructuralSteps {
+		return 0, false
+	}
+	if i == len(tm.tokens) {
+		return pos, true
+	}
+	src := tm.src
+	token := tm.tokens[i]
+
+	switch token.kind {
+	case "space":
+		start := pos
+		for pos < len(src) && isSpace(src[pos]) {
+			pos++
+		}
+		// Whitespace may be left out, but not between two identifiers
+		if pos == start && pos > 0 && pos < len(src) && isWordChar(src[pos-1]) && isWordChar(src[pos]) {
+			return 0, false
+		}
+		return tm.match(i+1, pos)
+
+	case "literal":
+		if !strings.HasPrefix(src[pos:], token.text) {
+			return 0, false
+		}
+		end := pos + len(token.text)
+		// A template ending in a word doesn't match a longer identifier
+		if i == len(tm.tokens)-1 && isWordChar(token.text[len(token.text)-1]) && end < len(src) && isWordChar(src[end]) {
+			return 0, false
+		}
+		return tm.match(i+1, end)
+	}
+
+	// A hole matched before must match the same code again
+	if bound, ok := tm.bindings[token.text]; ok && token.text != "_" {
+		if !strings.HasPrefix(src[pos:], bound) {
+			return 0, false
+		}
+		return tm.match(i+1, pos+len(bound))
+	}
+
+	if token.word {
+		end := pos
+		for end < len(src) && isWordChar(src[end]) {
+			end++
+		}
+		if end == pos {
+			return 0, false
+		}
+		return tm.bind(token.text, pos, end, i)
+	}
+
+	// A hole at the end of the template runs to the end of the line
+	last := i == len(tm.tokens)-1
+
+	// Try the shortest balanced code first
+	depth := 0
+	for end := pos; ; {
+		if depth == 0 && (!last || end == len(src) || src[end] == '\n') {
+			if matchEnd, ok := tm.bind(token.text, pos, end, i); ok {
+				return matchEnd, true
+			}
+			if last || tm.steps >= maxStructuralSteps {
+				return 0, false
+			}
+		}
+		if end == len(src) {
+			return 0, false
+		}
+		switch c := src[end]; c {
+		case '(', '[', '{':
+			depth++
+			end++
+		case ')', ']', '}':
+			if depth == 0 {
+				return 0, false
+			}
+			depth--
+			end++
+		case '"', '\'', '`':
+			end = skipQuoted(src, end)
+		default:
+			end++
+		}
+	}
+}
+
+// bind matches the rest of the template with the hole of token i bound to
+// src[start:end]
+func (tm *templateMatcher) bind(name string, start int, end int, i int) (int, bool) {
+	if name != "_" {
+		tm.bindings[name] = tm.src[start:end]
+	}
+	matchEnd, ok := tm.match(i+1, end)
+	if !ok {
+		delete(tm.bindings, name)
+	}
+	return matchEnd, ok
+}
+
+// skipQuoted returns the offset after the string literal starting at pos.
+// A quote that isn't closed, e.g. an apostrophe in a comment, is skipped on
+// its own. Only backquoted strings may span lines.
+func skipQuoted(src string, pos int) int {
+	quote := src[pos]
+	for i := pos + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case '\n':
+			if quote != '`' {
+				return pos + 1
+			}
+		case quote:
+			return i + 1
+		}
+	}
+	return pos + 1
+}
+
+// isSpace reports whether c is ASCII whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// isWordChar reports whether c can be part of an identifier
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
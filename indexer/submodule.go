@@ -0,0 +1,122 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// gitSubmodules returns the paths of the submodules declared in the
+// .gitmodules file at the repository root, slash separated from the root
+func gitSubmodules(root string) map[string]bool {
+	paths := readGitConfigAll(filepath.Join(root, ".gitmodules"), "submodule", "path")
+	if len(paths) == 0 {
+		return nil
+	}
+	submodules := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		submodules[path.Clean(strings.Trim(filepath.ToSlash(p), "/"))] = true
+	}
+	return submodules
+}
+
+// submodulePaths returns the submodules within the source directory,
+// relative to it and sorted
+func (f *sourceFilter) submodulePaths() []string {
+	var paths []string
+	for _, name := range slices.Sorted(maps.Keys(f.submodules)) {
+		if f.repoPath == "" {
+			paths = append(paths, name)
+		} else if rel, ok := strings.CutPrefix(name, f.repoPath+"/"); ok {
+			paths = append(paths, rel)
+		}
+	}
+	return paths
+}
+
+// indexSubmodules indexes the checked out submodules within absPath as
+// separate indexes linked to it, with the same options, unless submodules
+// are skipped. Linked indexes of submodules that are gone or skipped now
+// are deleted.
+func (m *IndexManager) indexSubmodules(ctx context.Context, absPath string, filter *sourceFilter) error {
+	prefix := m.getIndexPrefix(absPath)
+	linked := make(map[string]bool)
+	if !m.buildOptions.SkipSubmodules {
+		opts := IndexOptions{TrackedOnly: filter.tracked != nil, NoDefaultExcludes: filter.noDefaultExcludes}
+		for _, sub := range filter.submodulePaths() {
+			dir := filepath.Join(absPath, filepath.FromSlash(sub))
+			// Submodules that are not initialized have no .git file
+			if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+				continue
+			}
+			if err := m.indexDirectory(ctx, dir, &opts); err != nil {
+				return fmt.Errorf("failed to index submodule %s: %w", sub, err)
+			}
+			subPrefix := m.getIndexPrefix(dir)
+			if err := m.updateMetadata(subPrefix, func(meta *indexMetadata) { meta.Parent = prefix }); err != nil {
+				return err
+			}
+			linked[subPrefix] = true
+		}
+	}
+
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	metadata := m.loadAllMetadata()
+	var stale []string
+	for other, meta := range metadata {
+		if meta.Parent == prefix && !linked[other] {
+			stale = append(stale, other)
+			stale = append(stale, linkedIndexes(metadata, other)...)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	for _, other := range stale {
+		if err := m.removeIndex(metadata, other); err != nil {
+			return err
+		}
+	}
+	return m.saveAllMetadata(metadata)
+}
+
+// linkedIndexes returns the indexes of the submodules of the index named
+// prefix, including nested submodules, sorted
+func linkedIndexes(metadata map[string]*indexMetadata, prefix string) []string {
+	var linked []string
+	for _, other := range slices.Sorted(maps.Keys(metadata)) {
+		if metadata[other].Parent == prefix && other != prefix {
+			linked = append(linked, other)
+			linked = append(linked, linkedIndexes(metadata, other)...)
+		}
+	}
+	return linked
+}
+
+// removeIndex deletes the metadata of the index named prefix, and its shards
+// unless another clone or worktree still shares them. The caller must hold
+// metadataMu and save the metadata.
+func (m *IndexManager) removeIndex(metadata map[string]*indexMetadata, prefix string) error {
+	shardPrefix := prefix
+	if meta, ok := metadata[prefix]; ok {
+		shardPrefix = meta.shardPrefix(prefix)
+	}
+	delete(metadata, prefix)
+	if err := os.Remove(m.bazelTargetsPath(prefix)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove Bazel targets: %w", err)
+	}
+	if err := os.Remove(m.codeOwnersPath(prefix)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove code owners: %w", err)
+	}
+	if err := m.removeBuildJournal(prefix); err != nil {
+		return err
+	}
+	return m.releaseShards(metadata, shardPrefix)
+}
@@ -0,0 +1,95 @@
+package indexer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// walkTree walks the tree at root like filepath.WalkDir, in lexical order.
+// With follow set, symbolic links are resolved: links to directories are
+// walked as directories under the path of the link, and links to files are
+// reported with the entry of their target. Links into the tree itself are
+// skipped, as their targets are walked under their own paths, and so are
+// links to a directory or file outside the tree that was walked before, so
+// cycles of links end and every file is walked once. Dangling links are
+// reported as they are.
+func walkTree(root string, follow bool, fn fs.WalkDirFunc) error {
+	if !follow {
+		return filepath.WalkDir(root, fn)
+	}
+	info, err := os.Stat(root)
+	var real string
+	if err == nil {
+		real, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		w := &treeWalk{fn: fn, root: real, seen: make(map[string]bool)}
+		err = w.walk(root, real, fs.FileInfoToDirEntry(info), false)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// treeWalk is the state of a walkTree that follows links
+type treeWalk struct {
+	fn   fs.WalkDirFunc
+	root string // Real path of the root
+	// seen holds the real paths reached through links walked so far
+	seen map[string]bool
+}
+
+// walk walks path, whose real path is real; linked tells whether a link was
+// followed to reach it. It returns filepath.SkipDir if fn skips the rest of
+// the directory containing path.
+func (w *treeWalk) walk(path string, real string, d fs.DirEntry, linked bool) error {
+	if d.Type()&fs.ModeSymlink != 0 {
+		target, err := os.Stat(path)
+		if err != nil {
+			// Dangling, or a cycle the system refuses to resolve
+			return w.fn(path, d, nil)
+		}
+		if real, err = filepath.EvalSymlinks(path); err != nil {
+			return w.fn(path, d, err)
+		}
+		d, linked = fs.FileInfoToDirEntry(target), true
+	}
+	if linked {
+		if w.seen[real] || containsPath(w.root, real) {
+			return nil
+		}
+		w.seen[real] = true
+	}
+
+	if !d.IsDir() {
+		return w.fn(path, d, nil)
+	}
+	if err := w.fn(path, d, nil); err != nil {
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if err := w.fn(path, d, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+			return err
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		err := w.walk(filepath.Join(path, entry.Name()), filepath.Join(real, entry.Name()), entry, linked)
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
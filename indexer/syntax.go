@@ -0,0 +1,77 @@
+package indexer
+
+import (
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// QueryAtom describes one query construct accepted by search_code
+type QueryAtom struct {
+	Atom        string   `json:"atom"`
+	Aliases     []string `json:"aliases,omitempty"`
+	Description string   `json:"description"`
+	Example     string   `json:"example"`
+}
+
+// QuerySyntaxReference is a machine-readable summary of the query language
+type QuerySyntaxReference struct {
+	Atoms    []QueryAtom `json:"atoms"`
+	Examples []QueryAtom `json:"examples"`
+	Notes    []string    `json:"notes"`
+}
+
+// queryAtoms lists the constructs of the Zoekt query language that are
+// meaningful for local indexes. Entries whose example does not parse with the
+// linked Zoekt version are dropped by QuerySyntax.
+var queryAtoms = []QueryAtom{
+	{Atom: "text", Description: "Substring match against file content (and file names). Space separated terms must all match (AND)", Example: "func main"},
+	{Atom: "\"quoted text\"", Description: "Match a phrase including spaces literally", Example: "\"func main()\""},
+	{Atom: "regex", Description: "Terms are RE2 regular expressions when they contain regex metacharacters; escape with \\ to match literally", Example: "func.*Handler\\("},
+	{Atom: "content:", Aliases: []string{"c:"}, Description: "Match only file content, not file names", Example: "content:TODO"},
+	{Atom: "file:", Aliases: []string{"f:"}, Description: "Restrict to files whose path matches the regex", Example: "file:\\.go$ Handler"},
+	{Atom: "lang:", Description: "Restrict to files of a language (name or alias, e.g. go, python, typescript)", Example: "lang:python class"},
+	{Atom: "sym:", Description: "Match symbol definitions (requires symbol data in the index)", Example: "sym:ParseQuery"},
+	{Atom: "kind:", Description: "Match only definitions of these symbol kinds, separated by |: function, method, class, const or a ctags kind (requires symbol data in the index)", Example: "kind:function|method Parse"},
+	{Atom: "target:", Description: "Match only the source files (srcs and hdrs) of Bazel targets matching this label: //pkg:name, //pkg:all or //pkg/... (requires indexing a Bazel workspace root)", Example: "target://server/http:handlers ServeHTTP"},
+	{Atom: "case:", Description: "Case sensitivity: yes, no, or auto (default auto: sensitive only if the query has upper case)", Example: "case:yes MyFunc"},
+	{Atom: "repo:", Aliases: []string{"r:"}, Description: "Restrict to indexes whose name matches the regex. Prefer the directory parameter", Example: "repo:myapp main"},
+	{Atom: "type:", Aliases: []string{"t:"}, Description: "Result type: filematch (default), file (file names only) or repo", Example: "type:file config"},
+	{Atom: "regex:", Description: "Force the following term to be treated as a regex", Example: "regex:a.b"},
+	{Atom: "-", Description: "Negate the following atom or group", Example: "-file:_test\\.go$ Handler"},
+	{Atom: "or", Description: "Either side matches. AND binds tighter than or", Example: "foo or bar"},
+	{Atom: "( )", Description: "Group atoms", Example: "(foo or bar) file:\\.go$"},
+}
+
+// queryExamples are complete queries for common tasks
+var queryExamples = []QueryAtom{
+	{Atom: "definition", Description: "Find a Go function definition", Example: "func\\s+ParseConfig\\( lang:go"},
+	{Atom: "exclude tests", Description: "Usages outside test files", Example: "NewClient -file:_test\\.go$"},
+	{Atom: "file name", Description: "Find files by name only", Example: "type:file file:docker-compose"},
+	{Atom: "either term", Description: "Files mentioning either name", Example: "(getUser or fetchUser) lang:typescript"},
+}
+
+// QuerySyntax returns the query language reference, keeping only constructs
+// whose examples are accepted by the Zoekt parser this binary is built with
+func QuerySyntax() QuerySyntaxReference {
+	return QuerySyntaxReference{
+		Atoms:    parseableAtoms(queryAtoms),
+		Examples: parseableAtoms(queryExamples),
+		Notes: []string{
+			"Regular expressions use RE2 syntax: no backreferences or lookaround. Queries using them fail with an error suggesting a rewrite",
+			"Use the directory parameter of search_code instead of repo: to limit a search to one index",
+			"Matching is case-insensitive unless the query contains upper case letters or case:yes is given",
+			"'.' does not match newlines and '^' and '$' match at every line; the ignore_case, dotall and multiline parameters of search_code change this without inline flags",
+		},
+	}
+}
+
+// parseableAtoms filters out entries whose example the query parser rejects
+func parseableAtoms(atoms []QueryAtom) []QueryAtom {
+	var result []QueryAtom
+	for _, atom := range atoms {
+		if _, err := query.Parse(atom.Example); err != nil {
+			continue
+		}
+		result = append(result, atom)
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// QueryTemplate is a reusable search query with {placeholder} parameters,
+// e.g. `func.*{name}.*http.ResponseWriter`
+type QueryTemplate struct {
+	Query       string `json:"query"`
+	Description string `json:"description,omitempty"`
+	// Literal controls whether parameter values are regex-escaped before
+	// substitution (default true). Set to false to pass regex fragments.
+	Literal *bool `json:"literal,omitempty"`
+}
+
+// templatePlaceholder matches {name} but not regex repetition like {2,3}
+var templatePlaceholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Placeholders returns the distinct parameter names used by the template
+func (t QueryTemplate) Placeholders() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(t.Query, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// Expand substitutes params into the template and returns the query string.
+// All placeholders must be provided.
+func (t QueryTemplate) Expand(params map[string]string) (string, error) {
+	var missing []string
+	for _, name := range t.Placeholders() {
+		if _, ok := params[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("missing template parameters: %s", strings.Join(missing, ", "))
+	}
+
+	literal := t.Literal == nil || *t.Literal
+	return templatePlaceholder.ReplaceAllStringFunc(t.Query, func(placeholder string) string {
+		value := params[placeholder[1:len(placeholder)-1]]
+		if literal {
+			return regexp.QuoteMeta(value)
+		}
+		return value
+	}), nil
+}
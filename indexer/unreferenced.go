@@ -0,0 +1,217 @@
+package indexer
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
+)
+
+// defaultUnreferencedCandidates is how many files PossiblyUnreferenced
+// checks unless asked otherwise
+const defaultUnreferencedCandidates = 2000
+
+// maxReferenceTerms bounds the names looked up per file, so a file defining
+// many symbols does not make a huge query
+const maxReferenceTerms = 50
+
+// unreferencedLanguages are the languages whose files are checked. Their
+// files are used through imports or the symbols they define.
+var unreferencedLanguages = []string{"Go", "Python", "JavaScript", "TypeScript", "TSX", "Java", "Kotlin", "Ruby", "Rust", "C", "C++", "C#", "PHP", "Swift", "Scala"}
+
+// entryPointNames are file stems that are run or loaded by convention rather
+// than referenced, such as main modules and package markers
+var entryPointNames = []string{"main", "index", "__init__", "__main__", "setup", "conftest", "manage", "mod", "lib", "build", "app", "server"}
+
+// goDefinition matches the top-level declarations of a Go file
+var goDefinition = regexp.MustCompile(`(?m)^(?:func(?:\s*\([^)]*\))?|type|var|const)\s+([A-Za-z_]\w*)`)
+
+// goMainPackage matches the package clause of a Go command
+var goMainPackage = regexp.MustCompile(`(?m)^package main\b`)
+
+// UnreferencedOptions controls PossiblyUnreferenced
+type UnreferencedOptions struct {
+	Language      string // Only check files of this language
+	MaxCandidates int    // Files checked (default: 2000)
+}
+
+// UnreferencedResult lists files nothing else seems to use
+type UnreferencedResult struct {
+	Files     []UnreferencedFile `json:"files"`
+	Checked   int                `json:"checked"`             // Files checked
+	Truncated bool               `json:"truncated,omitempty"` // More files could have been checked
+	Symbols   bool               `json:"symbols"`             // Symbol data was used for the names files define
+}
+
+// UnreferencedFile is a file whose names no other file mentions
+type UnreferencedFile struct {
+	Path  string   `json:"path"`
+	Names []string `json:"names"` // The names looked for, e.g. the file stem and its symbols
+}
+
+// PossiblyUnreferenced lists code files of the index of sourceDir, or of all
+// indexes, that nothing else in the index seems to import or use: no other
+// file mentions the file's name (its stem, as in an import path) or any of
+// the symbols it defines. This is a heuristic: files loaded by reflection,
+// configuration outside the index or generated code show up too, and a file
+// whose names are common words is never listed. Tests and entry points such
+// as main and index files are not checked.
+func (m *IndexManager) PossiblyUnreferenced(ctx context.Context, sourceDir string, opts UnreferencedOptions) (*UnreferencedResult, error) {
+	if opts.MaxCandidates <= 0 {
+		opts.MaxCandidates = defaultUnreferencedCandidates
+	}
+	languages := unreferencedLanguages
+	if opts.Language != "" {
+		prefixes, err := m.indexPrefixes(ctx, sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		lang, err := resolveLanguage(opts.Language, m.visibleMetadata(ctx), prefixes)
+		if err != nil {
+			return nil, err
+		}
+		languages = []string{lang}
+	}
+	var languageQueries []query.Q
+	for _, lang := range languages {
+		languageQueries = append(languageQueries, &query.Language{Language: lang})
+	}
+	candidatesQuery := query.NewOr(languageQueries...)
+
+	result := &UnreferencedResult{}
+	err := m.withSearcher(ctx, sourceDir, func(searcher zoekt.Searcher, scope query.Q, repos map[string]*indexMetadata) error {
+		// Read the candidates, one more than needed to tell if there are more
+		found, err := searcher.Search(ctx, query.NewAnd(candidatesQuery, scope), &zoekt.SearchOptions{Whole: true, MaxDocDisplayCount: opts.MaxCandidates + 1})
+		if err != nil {
+			return err
+		}
+		files := found.Files
+		if len(files) > opts.MaxCandidates {
+			files, result.Truncated = files[:opts.MaxCandidates], true
+		}
+
+		// Symbols defined by the candidates, where ctags ran
+		symbols := make(map[string][]string)
+		for _, meta := range repos {
+			if meta.Symbols {
+				result.Symbols = true
+				break
+			}
+		}
+		if result.Symbols {
+			defined, err := searcher.Search(ctx, query.NewAnd(candidatesQuery, scope, &query.Symbol{Expr: mustRegexpQuery(`\w`, false)}), &zoekt.SearchOptions{})
+			if err != nil {
+				return err
+			}
+			for _, fileMatch := range defined.Files {
+				key := fileMatch.Repository + "\x00" + fileMatch.FileName
+				for _, lineMatch := range fileMatch.LineMatches {
+					for _, fragment := range lineMatch.LineFragments {
+						if fragment.SymbolInfo != nil && fragment.SymbolInfo.Sym != "" {
+							symbols[key] = append(symbols[key], fragment.SymbolInfo.Sym)
+						}
+					}
+				}
+			}
+		}
+
+		for _, fileMatch := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Parts of chunked large files are not checked on their own
+			if name, _ := splitChunkName(fileMatch.FileName); name != fileMatch.FileName {
+				continue
+			}
+			name := filepath.ToSlash(fileMatch.FileName)
+			if isTestPath(name) || isEntryPoint(name, fileMatch) {
+				continue
+			}
+			result.Checked++
+
+			names := referenceNames(name, fileMatch, symbols[fileMatch.Repository+"\x00"+fileMatch.FileName])
+			if len(names) == 0 {
+				continue
+			}
+			referenced, err := isReferenced(ctx, searcher, scope, fileMatch, names)
+			if err != nil {
+				return err
+			}
+			if !referenced {
+				result.Files = append(result.Files, UnreferencedFile{Path: resultPath(fileMatch, repos), Names: names})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(result.Files, func(a, b UnreferencedFile) int { return strings.Compare(a.Path, b.Path) })
+	return result, nil
+}
+
+// isEntryPoint reports whether a file is run or loaded by convention, such
+// as a main module or a Go command
+func isEntryPoint(name string, fileMatch zoekt.FileMatch) bool {
+	if slices.Contains(entryPointNames, strings.ToLower(fileStem(name))) {
+		return true
+	}
+	return fileMatch.Language == "Go" && goMainPackage.Match(fileMatch.Content)
+}
+
+// fileStem returns the base name of a file without its extensions
+func fileStem(name string) string {
+	stem, _, _ := strings.Cut(path.Base(name), ".")
+	return stem
+}
+
+// referenceNames returns the names another file would mention to use a
+// file: its stem, except for Go, which imports packages rather than files,
+// and the symbols it defines. Names shorter than three characters are left
+// out, as they are too common to tell anything.
+func referenceNames(name string, fileMatch zoekt.FileMatch, symbols []string) []string {
+	var names []string
+	add := func(n string) {
+		if len(n) >= 3 && !slices.Contains(names, n) && len(names) < maxReferenceTerms {
+			names = append(names, n)
+		}
+	}
+	if fileMatch.Language != "Go" {
+		add(fileStem(name))
+	}
+	if fileMatch.Language == "Go" && symbols == nil {
+		for _, match := range goDefinition.FindAllSubmatch(fileMatch.Content, -1) {
+			add(string(match[1]))
+		}
+	}
+	for _, symbol := range symbols {
+		add(symbol)
+	}
+	return names
+}
+
+// isReferenced reports whether a file other than fileMatch mentions one of
+// names as a whole word
+func isReferenced(ctx context.Context, searcher zoekt.Searcher, scope query.Q, fileMatch zoekt.FileMatch, names []string) (bool, error) {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = regexp.QuoteMeta(n)
+	}
+	re, err := syntax.Parse(`\b(?:`+strings.Join(quoted, "|")+`)\b`, syntax.Perl)
+	if err != nil {
+		return false, err
+	}
+	self := query.NewAnd(query.NewRepoSet(fileMatch.Repository), query.NewFileNameSet(fileMatch.FileName))
+	q := query.NewAnd(scope, &query.Regexp{Regexp: re, Content: true, CaseSensitive: true}, &query.Not{Child: self})
+	result, err := searcher.Search(ctx, q, &zoekt.SearchOptions{ShardMaxMatchCount: 1, TotalMaxMatchCount: 1, MaxDocDisplayCount: 1})
+	if err != nil {
+		return false, err
+	}
+	return len(result.Files) > 0, nil
+}
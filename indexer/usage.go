@@ -0,0 +1,165 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/zoekt"
+)
+
+// defaultUsageDirectories is how many directories UsageStats lists unless
+// asked otherwise
+const defaultUsageDirectories = 30
+
+// UsageOptions controls how UsageStats groups the matches
+type UsageOptions struct {
+	Symbol         string // Count whole-word, case-sensitive uses of this identifier instead of a query
+	Language       string // Only count files of this language
+	Depth          int    // Group by this many directory levels below the indexed directory; 0 groups by the file's directory
+	MaxDirectories int    // Directories listed, most matches first (default: 30)
+}
+
+// UsageStats counts the matches of a query across the indexes, to show how
+// widely an API is used
+type UsageStats struct {
+	Query       string           `json:"query"`
+	Files       int              `json:"files"`
+	Matches     int              `json:"matches"`
+	TestFiles   int              `json:"test_files"`
+	TestMatches int              `json:"test_matches"`
+	Directories []DirectoryUsage `json:"directories,omitempty"`
+	// OtherDirectories counts the directories with matches left out of
+	// Directories
+	OtherDirectories int `json:"other_directories,omitempty"`
+}
+
+// DirectoryUsage counts the matches in a directory or package
+type DirectoryUsage struct {
+	Directory   string `json:"directory"`
+	Files       int    `json:"files"`
+	Matches     int    `json:"matches"`
+	TestMatches int    `json:"test_matches,omitempty"`
+}
+
+// testDirectories are directory names holding tests
+var testDirectories = []string{"test", "tests", "__tests__", "spec", "specs", "testdata", "testing"}
+
+// testFileName matches the file names of tests in common languages
+var testFileName = regexp.MustCompile(`(_test\.go|_test\.py|^test_.*\.py|\.(test|spec)\.[cm]?[jt]sx?|_spec\.rb|_test\.rb|Tests?\.(java|kt|cs|scala|swift)|_test\.(c|cc|cpp|rs|exs?|dart))$`)
+
+// isTestPath reports whether a slash separated path is test code, by its
+// file name or a directory holding tests
+func isTestPath(name string) bool {
+	if testFileName.MatchString(path.Base(name)) {
+		return true
+	}
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		if slices.Contains(testDirectories, strings.ToLower(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsageStats counts the matches of queryStr, or of the uses of
+// opts.Symbol, in the index of sourceDir or in all indexes, grouped by
+// directory and by test and non-test code
+func (m *IndexManager) UsageStats(ctx context.Context, sourceDir string, queryStr string, opts UsageOptions) (*UsageStats, error) {
+	switch {
+	case queryStr == "" && opts.Symbol == "":
+		return nil, errors.New("either a query or a symbol is needed")
+	case queryStr != "" && opts.Symbol != "":
+		return nil, errors.New("query and symbol cannot be combined")
+	case opts.Symbol != "":
+		queryStr = fmt.Sprintf(`case:yes \b%s\b`, regexp.QuoteMeta(opts.Symbol))
+	}
+	if opts.MaxDirectories <= 0 {
+		opts.MaxDirectories = defaultUsageDirectories
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := m.parseSearchQuery(queryStr, SearchOptions{Language: opts.Language}, m.visibleMetadata(ctx), prefixes, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every file is counted, not only those a search would show
+	result, repos, err := m.searchIndexes(ctx, sourceDir, parsed.q, &zoekt.SearchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	files := result.Files
+	if parsed.kinds != nil {
+		files = filterSymbolKinds(files, parsed.kinds)
+	}
+
+	stats := &UsageStats{Query: queryStr}
+	directories := make(map[string]*DirectoryUsage)
+	counted := make(map[string]bool) // Files of chunked large files are counted once
+	for _, fileMatch := range files {
+		name, _ := splitChunkName(fileMatch.FileName)
+		name = filepath.ToSlash(name)
+		matches := fileMatchCount(fileMatch)
+		fileKey := fileMatch.Repository + "\x00" + name
+		newFile := !counted[fileKey]
+		counted[fileKey] = true
+		test := isTestPath(name)
+
+		stats.Matches += matches
+		if newFile {
+			stats.Files++
+		}
+		if test {
+			stats.TestMatches += matches
+			if newFile {
+				stats.TestFiles++
+			}
+		}
+
+		dir := path.Dir(name)
+		if opts.Depth > 0 {
+			if parts := strings.Split(dir, "/"); len(parts) > opts.Depth {
+				dir = strings.Join(parts[:opts.Depth], "/")
+			}
+		}
+		if meta, ok := repos[fileMatch.Repository]; ok && meta.SourceDir != "" {
+			dir = filepath.Join(meta.dir(), filepath.FromSlash(dir))
+		}
+		usage, ok := directories[dir]
+		if !ok {
+			usage = &DirectoryUsage{Directory: dir}
+			directories[dir] = usage
+		}
+		usage.Matches += matches
+		if newFile {
+			usage.Files++
+		}
+		if test {
+			usage.TestMatches += matches
+		}
+	}
+
+	for _, usage := range directories {
+		stats.Directories = append(stats.Directories, *usage)
+	}
+	slices.SortFunc(stats.Directories, func(a, b DirectoryUsage) int {
+		if a.Matches != b.Matches {
+			return b.Matches - a.Matches
+		}
+		return strings.Compare(a.Directory, b.Directory)
+	})
+	if len(stats.Directories) > opts.MaxDirectories {
+		stats.OtherDirectories = len(stats.Directories) - opts.MaxDirectories
+		stats.Directories = stats.Directories[:opts.MaxDirectories]
+	}
+	return stats, nil
+}
@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WarmResult summarizes a warm-up run
+type WarmResult struct {
+	Indexes  int    `json:"indexes"`
+	Shards   int    `json:"shards"`
+	Bytes    int64  `json:"bytes"`
+	Duration string `json:"duration"`
+}
+
+// WarmIndex reads every shard of the index for sourceDir (or of all indexes
+// if sourceDir is empty) so the files are in the page cache before the first
+// search. This mostly helps on network filesystems and after a reboot. With
+// encryption, the decrypted copies searches read are warmed.
+func (m *IndexManager) WarmIndex(ctx context.Context, sourceDir string) (*WarmResult, error) {
+	start := time.Now()
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compressed shards cannot be paged in until they are restored. Warming
+	// counts as use, so they are not compressed again by the next check.
+	metadata := m.loadAllMetadata()
+	m.markSearched(prefixes, metadata)
+	if err := m.decompressIndexes(prefixes, metadata); err != nil {
+		return nil, err
+	}
+
+	// Searches read the decrypted copies of encrypted shards, so those are
+	// the ones to warm, decrypting any that are not cached yet
+	plainDir := ""
+	if m.Encrypted() {
+		if plainDir, err = m.searchDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &WarmResult{Indexes: len(prefixes)}
+	warmed := make(map[string]bool)
+	for _, prefix := range prefixes {
+		// Identical checkouts share their shards
+		shardPrefix := metadata[prefix].shardPrefix(prefix)
+		if warmed[shardPrefix] {
+			continue
+		}
+		warmed[shardPrefix] = true
+
+		shards, err := m.shardFiles(shardPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards: %w", err)
+		}
+		for _, shard := range shards {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if plainDir != "" && strings.HasSuffix(shard, encryptedShardSuffix) {
+				shard = filepath.Join(plainDir, strings.TrimSuffix(filepath.Base(shard), encryptedShardSuffix))
+			}
+			n, err := touchFile(shard)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read shard %s: %w", shard, err)
+			}
+			result.Shards++
+			result.Bytes += n
+		}
+	}
+
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+	return result, nil
+}
+
+// touchFile reads a file to the end and returns the number of bytes read
+func touchFile(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(io.Discard, f)
+}
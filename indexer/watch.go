@@ -0,0 +1,211 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a watched directory must be quiet after a
+// change before it is re-indexed, so a checkout or a save of many files
+// causes one build
+const watchDebounce = 2 * time.Second
+
+// SetWatched sets whether sourceDir is re-indexed automatically when its
+// files change while a Scheduler is running. The directory must be indexed
+// already. Watching is kept when the directory is re-indexed.
+func (m *IndexManager) SetWatched(ctx context.Context, sourceDir string, watched bool) error {
+	if sourceDir == "" {
+		return fmt.Errorf("a directory is required")
+	}
+
+	prefixes, err := m.indexPrefixes(ctx, sourceDir)
+	if err != nil {
+		return err
+	}
+
+	return m.updateMetadata(prefixes[0], func(meta *indexMetadata) {
+		meta.Watched = watched
+	})
+}
+
+// SyncWatches makes the scheduler pick up directories whose watching was
+// turned on or off, rather than at the next minute
+func (s *Scheduler) SyncWatches() {
+	select {
+	case s.watchSync <- struct{}{}:
+	default:
+	}
+}
+
+// dirWatcher maps the file system watches of a scheduler to the watched
+// directories. It is only used by the watch goroutine.
+type dirWatcher struct {
+	*fsnotify.Watcher
+	dirs    map[string]string      // Watched directory to the local root containing it
+	pending map[string]*time.Timer // Debounced re-index by local root
+	full    bool                   // Adding watches failed, e.g. at the inotify limit
+}
+
+// watch re-indexes watched directories in the background as their files
+// change, until ctx is cancelled. Re-indexes are queued like scheduled
+// ones, so they wait while the scheduler is paused or on battery power.
+func (s *Scheduler) watch(ctx context.Context) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: watching directories is unavailable: %v\n", err)
+		return
+	}
+	defer fsw.Close()
+	w := &dirWatcher{Watcher: fsw, dirs: make(map[string]string), pending: make(map[string]*time.Timer)}
+	defer func() {
+		for _, timer := range w.pending {
+			timer.Stop()
+		}
+	}()
+
+	s.syncWatches(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.watchSync:
+			s.syncWatches(w)
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			s.handleWatchEvent(w, event)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Warning: watching directories: %v\n", err)
+		}
+	}
+}
+
+// syncWatches adds watches for the directories watching was turned on for
+// and removes those of the directories it was turned off for
+func (s *Scheduler) syncWatches(w *dirWatcher) {
+	roots := make(map[string]string) // Local root to source directory
+	for _, meta := range s.manager.loadAllMetadata() {
+		if meta.Watched && meta.Attached == "" {
+			roots[meta.dir()] = meta.SourceDir
+		}
+	}
+
+	s.mu.Lock()
+	old := s.watched
+	s.watched = roots
+	s.mu.Unlock()
+
+	for dir, root := range w.dirs {
+		if _, ok := roots[root]; !ok {
+			_ = w.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+	for root := range old {
+		if _, ok := roots[root]; !ok {
+			if timer, ok := w.pending[root]; ok {
+				timer.Stop()
+				delete(w.pending, root)
+			}
+		}
+	}
+	for root := range roots {
+		if _, ok := old[root]; !ok {
+			s.addWatches(w, root, root)
+		}
+	}
+}
+
+// addWatches watches dir and the directories below it that builds index,
+// as part of the watched directory root
+func (s *Scheduler) addWatches(w *dirWatcher, root string, dir string) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if path != root && (strings.HasPrefix(d.Name(), ".") || isSkippedDir(d.Name())) {
+			return filepath.SkipDir
+		}
+		if path == s.manager.indexDir {
+			return filepath.SkipDir
+		}
+		if err := w.Add(path); err != nil {
+			if !w.full {
+				fmt.Fprintf(os.Stderr, "Warning: cannot watch all of %s, changes in some directories will not be noticed: %v\n", root, err)
+				w.full = true
+			}
+			return filepath.SkipAll
+		}
+		w.dirs[path] = root
+		return nil
+	})
+}
+
+// handleWatchEvent schedules a re-index of the watched directory a change
+// was made in, once it is quiet, and watches directories created in it
+func (s *Scheduler) handleWatchEvent(w *dirWatcher, event fsnotify.Event) {
+	// Hidden files and the index's own files are not indexed
+	if event.Op == fsnotify.Chmod || strings.HasPrefix(filepath.Base(event.Name), ".") {
+		return
+	}
+	if containsPath(s.manager.indexDir, event.Name) {
+		return
+	}
+
+	root, ok := w.dirs[filepath.Dir(event.Name)]
+	if !ok {
+		return
+	}
+	switch {
+	case event.Has(fsnotify.Create):
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() && !isSkippedDir(info.Name()) {
+			s.addWatches(w, root, event.Name)
+		}
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		// Watches of removed directories are dropped by the system
+		for dir := range w.dirs {
+			if containsPath(event.Name, dir) {
+				delete(w.dirs, dir)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	sourceDir, ok := s.watched[root]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if timer, ok := w.pending[root]; ok {
+		timer.Reset(watchDebounce)
+		return
+	}
+	w.pending[root] = time.AfterFunc(watchDebounce, func() { s.enqueueChanged(sourceDir) })
+}
+
+// enqueueChanged queues a re-index of a watched directory whose files
+// changed. If the directory is being indexed already, it is indexed again
+// afterwards, since the running build may have missed the change.
+func (s *Scheduler) enqueueChanged(sourceDir string) {
+	s.mu.Lock()
+	if s.queued[sourceDir] {
+		if s.running == sourceDir {
+			s.rerun[sourceDir] = true
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.enqueue(sourceDir)
+}
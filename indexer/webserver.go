@@ -2,12 +2,17 @@ package indexer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/sourcegraph/zoekt"
+	"github.com/sourcegraph/zoekt/query"
 	"github.com/sourcegraph/zoekt/search"
 	"github.com/sourcegraph/zoekt/web"
 )
@@ -16,10 +21,27 @@ import (
 type WebServerManager struct {
 	mu        sync.Mutex
 	server    *http.Server
+	searcher  zoekt.Streamer
+	done      chan struct{} // Closed once the server stopped serving
 	indexDir  string
 	port      int
-	running   bool
 	startedAt time.Time
+	workspace string
+	editor    string // URL template result links open files with
+	// releaseIndexes lets the served indexes be compressed again
+	releaseIndexes func()
+}
+
+// webServerInstanceFile records the web server a process started in the
+// index directory, so an instance left running by an earlier process can be
+// recognized when it holds the port
+const webServerInstanceFile = "webserver.json"
+
+// webServerInstance is the content of the instance file
+type webServerInstance struct {
+	PID       int       `json:"pid"`
+	Port      int       `json:"port"`
+	StartedAt time.Time `json:"started_at"`
 }
 
 // WebServerStatus contains information about the web server state
@@ -28,6 +50,8 @@ type WebServerStatus struct {
 	Port      int       `json:"port,omitempty"`
 	URL       string    `json:"url,omitempty"`
 	StartedAt time.Time `json:"started_at,omitempty"`
+	Workspace string    `json:"workspace,omitempty"`
+	Editor    string    `json:"editor,omitempty"` // URL template result links open files with
 }
 
 // NewWebServerManager creates a new web server manager
@@ -37,13 +61,50 @@ func NewWebServerManager(indexDir string) *WebServerManager {
 	}
 }
 
+// SetEditor makes the result links of the web UI open files at their line
+// in a local editor rather than showing them in the browser, from the next
+// start on. editor is the name of a known editor such as vscode or a URL
+// template, as accepted by EditorURL; "" shows files in the browser. It
+// cannot be changed while the server is running.
+func (m *WebServerManager) SetEditor(editor string) error {
+	template, err := EditorURL(editor)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.alive() {
+		return fmt.Errorf("web server is already running on port %d", m.port)
+	}
+	m.editor = template
+	return nil
+}
+
 // Start starts the Zoekt web server on the specified port
 // If port is 0, a random available port will be used
 func (m *WebServerManager) Start(port int) (*WebServerStatus, error) {
+	return m.StartScoped(port, "", nil, nil)
+}
+
+// StartScoped starts the Zoekt web server like Start, serving only the
+// repositories repos of the workspace name, e.g. as returned by
+// IndexManager.WorkspaceRepositories. A nil repos serves every index. The
+// web server reads the shards directly, so the caller holds the served
+// indexes with IndexManager.HoldIndexes and passes the release function,
+// which is called once the server stops, or right away if it fails to
+// start.
+func (m *WebServerManager) StartScoped(port int, workspace string, repos []string, releaseIndexes func()) (*WebServerStatus, error) {
+	started := false
+	defer func() {
+		if !started && releaseIndexes != nil {
+			releaseIndexes()
+		}
+	}()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.running {
+	if m.alive() {
 		return nil, fmt.Errorf("web server is already running on port %d", m.port)
 	}
 
@@ -53,12 +114,23 @@ func (m *WebServerManager) Start(port int) (*WebServerStatus, error) {
 		return nil, fmt.Errorf("failed to create searcher: %w", err)
 	}
 
+	// Limit the searches of the web UI to the workspace
+	var streamer zoekt.Streamer = searcher
+	if repos != nil {
+		streamer = &scopedStreamer{Streamer: searcher, repos: query.NewRepoSet(repos...)}
+	}
+	served := streamer
+	// Link results to the open endpoint, which redirects to the editor
+	if m.editor != "" {
+		streamer = &editorStreamer{Streamer: streamer}
+	}
+
 	// Create the web server
 	webServer := &web.Server{
-		Searcher: searcher,
+		Searcher: streamer,
 		HTML:     true,
 		RPC:      true,
-		Print:    true,
+		Print:    m.editor == "",
 		Version:  "code-index-mcp",
 		Top:      web.Top,
 	}
@@ -72,17 +144,22 @@ func (m *WebServerManager) Start(port int) (*WebServerStatus, error) {
 	}
 
 	// Create the HTTP mux
-	mux, err := web.NewMux(webServer)
+	webMux, err := web.NewMux(webServer)
 	if err != nil {
 		searcher.Close()
 		return nil, fmt.Errorf("failed to create mux: %w", err)
 	}
+	mux := http.NewServeMux()
+	mux.Handle("/", webMux)
+	if m.editor != "" {
+		mux.Handle(editorOpenPath, editorHandler(served, m.editor))
+	}
 
 	// Find an available port if port is 0
 	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
 		searcher.Close()
-		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+		return nil, m.listenError(port, err)
 	}
 
 	// Get the actual port (useful when port was 0)
@@ -92,50 +169,134 @@ func (m *WebServerManager) Start(port int) (*WebServerStatus, error) {
 	m.server = &http.Server{
 		Handler: mux,
 	}
+	m.searcher = searcher
+	m.done = make(chan struct{})
 
 	m.port = actualPort
-	m.running = true
 	m.startedAt = time.Now()
+	m.workspace = workspace
+	m.releaseIndexes = releaseIndexes
+	m.writeInstance()
+	started = true
 
-	// Start serving in a goroutine
-	go func() {
-		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			// Server stopped unexpectedly
-			m.mu.Lock()
-			m.running = false
-			m.mu.Unlock()
-		}
-	}()
+	// Start serving in a goroutine. It does not take the lock, which Stop
+	// holds while it waits for serving to end; a server that stops
+	// unexpectedly is cleaned up by the next call that finds it stopped.
+	go func(server *http.Server, done chan struct{}) {
+		defer close(done)
+		server.Serve(listener)
+	}(m.server, m.done)
 
 	return &WebServerStatus{
 		Running:   true,
 		Port:      actualPort,
 		URL:       fmt.Sprintf("http://127.0.0.1:%d", actualPort),
 		StartedAt: m.startedAt,
+		Workspace: workspace,
+		Editor:    m.editor,
 	}, nil
 }
 
-// Stop stops the Zoekt web server
+// Stop stops the Zoekt web server. It returns once the port is released,
+// so the server can be started again on the same port right away.
 func (m *WebServerManager) Stop() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if !m.running {
+	if !m.alive() {
 		return fmt.Errorf("web server is not running")
 	}
 
+	// Let running requests finish, then close what is left
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-
 	if err := m.server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("failed to shutdown server: %w", err)
+		m.server.Close()
 	}
+	<-m.done
+	m.release()
+
+	return nil
+}
 
-	m.running = false
+// alive reports whether the server is serving, releasing what a server
+// that stopped unexpectedly left behind. The caller holds m.mu.
+func (m *WebServerManager) alive() bool {
+	if m.server == nil {
+		return false
+	}
+	select {
+	case <-m.done:
+		m.release()
+		return false
+	default:
+		return true
+	}
+}
+
+// release closes the searcher of a server that stopped serving and resets
+// the state. The caller holds m.mu.
+func (m *WebServerManager) release() {
+	m.searcher.Close()
+	if m.releaseIndexes != nil {
+		m.releaseIndexes()
+	}
+	os.Remove(filepath.Join(m.indexDir, webServerInstanceFile))
 	m.server = nil
+	m.searcher = nil
+	m.done = nil
+	m.releaseIndexes = nil
 	m.port = 0
+	m.workspace = ""
+}
 
-	return nil
+// writeInstance records the running server in the instance file. It is
+// informational, so failures are ignored.
+func (m *WebServerManager) writeInstance() {
+	content, err := json.Marshal(webServerInstance{PID: os.Getpid(), Port: m.port, StartedAt: m.startedAt})
+	if err == nil {
+		os.WriteFile(filepath.Join(m.indexDir, webServerInstanceFile), content, 0644)
+	}
+}
+
+// listenError explains why port cannot be listened on, naming the process
+// holding it if it can be found, and whether that is a web server an
+// earlier process started and left running
+func (m *WebServerManager) listenError(port int, err error) error {
+	if port == 0 {
+		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	var previous webServerInstance
+	content, readErr := os.ReadFile(filepath.Join(m.indexDir, webServerInstanceFile))
+	if readErr != nil || json.Unmarshal(content, &previous) != nil || previous.Port != port || previous.PID == os.Getpid() {
+		previous = webServerInstance{}
+	}
+
+	owner := listeningProcess(port)
+	switch {
+	case owner.pid != 0 && owner.pid == previous.PID:
+		return fmt.Errorf("port %d is held by a web server an earlier code-index process (pid %d) started at %s and did not stop; end that process or use another port",
+			port, owner.pid, previous.StartedAt.Local().Format(time.DateTime))
+	case owner.pid != 0:
+		return fmt.Errorf("port %d is in use by %s: %w", port, owner, err)
+	case previous.PID != 0:
+		return fmt.Errorf("port %d is in use, possibly by a web server an earlier code-index process (pid %d) started at %s and did not stop: %w",
+			port, previous.PID, previous.StartedAt.Local().Format(time.DateTime), err)
+	}
+	return fmt.Errorf("failed to listen on port %d: %w", port, err)
+}
+
+// portProcess is the process listening on a port
+type portProcess struct {
+	pid  int
+	name string // Command name, if known
+}
+
+func (p portProcess) String() string {
+	if p.name == "" {
+		return fmt.Sprintf("process %d", p.pid)
+	}
+	return fmt.Sprintf("process %d (%s)", p.pid, p.name)
 }
 
 // Status returns the current status of the web server
@@ -143,7 +304,7 @@ func (m *WebServerManager) Status() *WebServerStatus {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if !m.running {
+	if !m.alive() {
 		return &WebServerStatus{Running: false}
 	}
 
@@ -152,5 +313,26 @@ func (m *WebServerManager) Status() *WebServerStatus {
 		Port:      m.port,
 		URL:       fmt.Sprintf("http://127.0.0.1:%d", m.port),
 		StartedAt: m.startedAt,
+		Workspace: m.workspace,
+		Editor:    m.editor,
 	}
 }
+
+// scopedStreamer limits searches and repository listings to some
+// repositories
+type scopedStreamer struct {
+	zoekt.Streamer
+	repos query.Q
+}
+
+func (s *scopedStreamer) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return s.Streamer.Search(ctx, query.NewAnd(q, s.repos), opts)
+}
+
+func (s *scopedStreamer) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) error {
+	return s.Streamer.StreamSearch(ctx, query.NewAnd(q, s.repos), opts, sender)
+}
+
+func (s *scopedStreamer) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	return s.Streamer.List(ctx, query.NewAnd(q, s.repos), opts)
+}
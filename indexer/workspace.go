@@ -0,0 +1,190 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrUnknownWorkspace is returned for a workspace name that was not created
+// or is not visible to the owner
+var ErrUnknownWorkspace = errors.New("unknown workspace")
+
+// Workspace groups indexed directories under one name, like a multi-root
+// editor workspace, so they can be searched and inspected as a unit
+type Workspace struct {
+	Name        string   `json:"name"`
+	Directories []string `json:"directories"`
+	Owner       string   `json:"owner,omitempty"`
+}
+
+func (m *IndexManager) getWorkspacesPath() string {
+	return filepath.Join(m.indexDir, "workspaces.json")
+}
+
+// loadWorkspaces returns the stored workspaces, or none if they cannot be
+// read
+func (m *IndexManager) loadWorkspaces() []*Workspace {
+	content, err := m.readIndexFile(m.getWorkspacesPath())
+	if err != nil {
+		return nil
+	}
+	var workspaces []*Workspace
+	if err := json.Unmarshal(content, &workspaces); err != nil {
+		return nil
+	}
+	return workspaces
+}
+
+func (m *IndexManager) saveWorkspaces(workspaces []*Workspace) error {
+	content, err := json.MarshalIndent(workspaces, "", "  ")
+	if err != nil {
+		return err
+	}
+	return m.writeIndexFile(m.getWorkspacesPath(), content)
+}
+
+// CreateWorkspace groups the indexed directories dirs under name, replacing
+// the directories of an existing workspace of that name. Workspaces are
+// scoped to the owner in ctx like indexes.
+func (m *IndexManager) CreateWorkspace(ctx context.Context, name string, dirs []string) (*Workspace, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("workspace name cannot be empty")
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("a workspace needs at least one directory")
+	}
+
+	// Only indexed directories can be added
+	metadata := m.visibleMetadata(ctx)
+	workspace := &Workspace{Name: name, Owner: ownerFromContext(ctx)}
+	for _, dir := range dirs {
+		absPath, err := m.resolveIndexPath(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		if _, ok := metadata[m.getIndexPrefix(absPath)]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+		}
+		if !slices.Contains(workspace.Directories, absPath) {
+			workspace.Directories = append(workspace.Directories, absPath)
+		}
+	}
+	slices.Sort(workspace.Directories)
+
+	m.workspacesMu.Lock()
+	defer m.workspacesMu.Unlock()
+
+	workspaces := slices.DeleteFunc(m.loadWorkspaces(), func(w *Workspace) bool {
+		return w.Name == name && w.Owner == workspace.Owner
+	})
+	workspaces = append(workspaces, workspace)
+	slices.SortFunc(workspaces, func(a, b *Workspace) int { return strings.Compare(a.Name, b.Name) })
+	if err := m.saveWorkspaces(workspaces); err != nil {
+		return nil, fmt.Errorf("failed to save workspace: %w", err)
+	}
+	return workspace, nil
+}
+
+// DeleteWorkspace removes the workspace name. The indexes of its
+// directories are kept.
+func (m *IndexManager) DeleteWorkspace(ctx context.Context, name string) error {
+	m.workspacesMu.Lock()
+	defer m.workspacesMu.Unlock()
+
+	owner := ownerFromContext(ctx)
+	workspaces := m.loadWorkspaces()
+	kept := slices.DeleteFunc(slices.Clone(workspaces), func(w *Workspace) bool {
+		return w.Name == name && w.Owner == owner
+	})
+	if len(kept) == len(workspaces) {
+		return fmt.Errorf("%w: %s", ErrUnknownWorkspace, name)
+	}
+	if len(kept) == 0 {
+		if err := os.Remove(m.getWorkspacesPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete workspace: %w", err)
+		}
+		return nil
+	}
+	if err := m.saveWorkspaces(kept); err != nil {
+		return fmt.Errorf("failed to delete workspace: %w", err)
+	}
+	return nil
+}
+
+// ListWorkspaces returns the workspaces of the owner in ctx, sorted by name
+func (m *IndexManager) ListWorkspaces(ctx context.Context) ([]Workspace, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owner := ownerFromContext(ctx)
+	var workspaces []Workspace
+	for _, w := range m.loadWorkspaces() {
+		if w.Owner == owner {
+			workspaces = append(workspaces, *w)
+		}
+	}
+	return workspaces, nil
+}
+
+// WorkspaceDirectories returns the directories of the workspace name
+func (m *IndexManager) WorkspaceDirectories(ctx context.Context, name string) ([]string, error) {
+	owner := ownerFromContext(ctx)
+	for _, w := range m.loadWorkspaces() {
+		if w.Name == name && w.Owner == owner {
+			return w.Directories, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownWorkspace, name)
+}
+
+// WorkspaceRepositories returns the names the indexes of the workspace name,
+// including those of submodules, have in the shards, e.g. to limit a web
+// server to them
+func (m *IndexManager) WorkspaceRepositories(ctx context.Context, name string) ([]string, error) {
+	dirs, err := m.WorkspaceDirectories(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := m.visibleMetadata(ctx)
+	prefixes, err := m.scopePrefixes(ctx, metadata, dirs)
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, prefix := range prefixes {
+		if meta, ok := metadata[prefix]; ok {
+			prefix = meta.shardPrefix(prefix)
+		}
+		if !slices.Contains(repos, prefix) {
+			repos = append(repos, prefix)
+		}
+	}
+	return repos, nil
+}
+
+// scopePrefixes returns the indexes of dirs and of their submodules. With
+// an owner in ctx, every directory must be indexed for it.
+func (m *IndexManager) scopePrefixes(ctx context.Context, metadata map[string]*indexMetadata, dirs []string) ([]string, error) {
+	owner := ownerFromContext(ctx)
+	var prefixes []string
+	for _, dir := range dirs {
+		absPath, err := m.resolveIndexPath(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path: %w", err)
+		}
+		prefix := m.getIndexPrefix(absPath)
+		if _, ok := metadata[prefix]; owner != "" && !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotIndexed, absPath)
+		}
+		prefixes = append(prefixes, prefix)
+		prefixes = append(prefixes, linkedIndexes(metadata, prefix)...)
+	}
+	return prefixes, nil
+}
@@ -1,26 +1,143 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mark3labs/mcp-go/server"
 	"github.com/trondhindenes/code-index-mcp/handlers"
 )
 
+// defaultListenAddr is used by the HTTP transports if CODE_INDEX_LISTEN_ADDR is not set
+const defaultListenAddr = "localhost:8080"
+
+// shutdownTimeout bounds how long the HTTP transports wait for requests in
+// flight when stopped
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	container := flag.Bool("container", os.Getenv("CODE_INDEX_CONTAINER") == "true",
+		"Run as a container entrypoint: serve HTTP on "+containerListenAddr+" with indexes in "+containerIndexDir+" unless configured otherwise")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-container] [healthcheck | selftest | migrate_store DIR]\n\nWithout a command, runs the MCP server. healthcheck probes the health endpoint of a running HTTP server. selftest indexes a built-in sample repository and checks that searches return the expected results. migrate_store moves the index store to DIR, leaving a redirect in its old location; stop servers using the store first.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *container {
+		prepareContainer()
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "healthcheck":
+		os.Exit(healthcheck())
+	case "selftest":
+		report, passed := handlers.SelfTest(context.Background())
+		fmt.Println(report)
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	case "migrate_store":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		report, err := handlers.MigrateStore(flag.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(report)
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	s := server.NewMCPServer(
 		"code-index",
 		"1.0.0",
-		server.WithToolCapabilities(false),
+		// Tools with requirements are listed once they are met
+		server.WithToolCapabilities(true),
+		server.WithResourceCapabilities(false, false),
 	)
 
 	// Register all tools
-	handlers.RegisterTools(s)
+	h, err := handlers.NewDefault()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Startup error: %v\n", err)
+		os.Exit(1)
+	}
+	h.Register(s)
 
-	// Start the server
-	if err := server.ServeStdio(s); err != nil {
+	// Start the server on the configured transport
+	err = serve(s, h)
+	h.Close()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// listenAddr returns the address the HTTP transports listen on
+func listenAddr() string {
+	if addr := os.Getenv("CODE_INDEX_LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultListenAddr
+}
+
+// serve runs the server on the transport selected by CODE_INDEX_TRANSPORT:
+// stdio (default), http (streamable HTTP) or sse. The HTTP transports also
+// serve a health endpoint, and stop gracefully on SIGINT and SIGTERM.
+func serve(s *server.MCPServer, h *handlers.Handlers) error {
+	addr := listenAddr()
+	httpServer := &http.Server{Addr: addr}
+	mux := http.NewServeMux()
+	mux.Handle(healthPath, h.HealthHandler())
+	httpServer.Handler = mux
+
+	var shutdown func(context.Context) error
+	switch transport := os.Getenv("CODE_INDEX_TRANSPORT"); transport {
+	case "", "stdio":
+		return server.ServeStdio(s)
+	case "http":
+		streamable := server.NewStreamableHTTPServer(s, server.WithStreamableHTTPServer(httpServer))
+		mux.Handle("/mcp", streamable)
+		shutdown = streamable.Shutdown
+		fmt.Fprintf(os.Stderr, "Serving MCP over HTTP on %s/mcp\n", addr)
+	case "sse":
+		sse := server.NewSSEServer(s, server.WithHTTPServer(httpServer))
+		mux.Handle("/", sse)
+		shutdown = sse.Shutdown
+		fmt.Fprintf(os.Stderr, "Serving MCP over SSE on %s/sse\n", addr)
+	default:
+		return fmt.Errorf("unknown transport %q (expected stdio, http or sse)", transport)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- httpServer.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	fmt.Fprintln(os.Stderr, "Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}